@@ -0,0 +1,270 @@
+package certmanager
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mredolatti/tf/codigo/common/log"
+)
+
+// changes to watched files are coalesced for this long before reloading, since a rotation usually
+// involves writing the certificate, key & CA files one after the other
+const reloadDelay = 500 * time.Millisecond
+
+// Public errors
+var (
+	ErrNoCACertificates = errors.New("no CA certificates found")
+	ErrNoPeerCertficate = errors.New("peer did not present a certificate")
+	ErrNoServerName     = errors.New("no server name to verify the peer certificate against")
+)
+
+// ReloadListener is called after a new certificate has been loaded
+type ReloadListener func()
+
+// Interface defines the set of methods to build tls configurations that always use the latest certificates
+type Interface interface {
+	ServerConfig(base *tls.Config) *tls.Config
+	ClientConfig(base *tls.Config) *tls.Config
+	RootCAs() *x509.CertPool
+
+	// Thumbprint returns the base64url-encoded SHA-256 hash of the current certificate, as used in
+	// certificate-bound tokens (RFC 8705)
+	Thumbprint() string
+
+	// AddListener registers a function to be called whenever the certificate is replaced
+	AddListener(l ReloadListener)
+}
+
+// Config contains parameters to set up a certificate manager
+type Config struct {
+	Logger       log.Interface
+	CertChainFN  string
+	PrivateKeyFN string
+	RootCAFN     string
+}
+
+type bundle struct {
+	certificate *tls.Certificate
+	roots       *x509.CertPool
+	thumbprint  string
+}
+
+// Impl keeps a certificate, its private key & a CA bundle loaded from disk, and swaps them whenever the files change.
+// Connections established before a swap keep using the previous ones
+type Impl struct {
+	logger       log.Interface
+	certChainFN  string
+	privateKeyFN string
+	rootCAFN     string
+	current      atomic.Value // *bundle
+	watcher      *fsnotify.Watcher
+	listeners    []ReloadListener
+	lMutex       sync.Mutex
+}
+
+// New constructs a new certificate manager, and loads the certificate, key & CA bundle
+func New(cfg *Config) (*Impl, error) {
+	m := &Impl{
+		logger:       cfg.Logger,
+		certChainFN:  cfg.CertChainFN,
+		privateKeyFN: cfg.PrivateKeyFN,
+		rootCAFN:     cfg.RootCAFN,
+	}
+
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Reload reads the certificate, key & CA bundle from disk. If any of them can't be loaded, the previous ones are kept
+func (m *Impl) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(m.certChainFN, m.privateKeyFN)
+	if err != nil {
+		return fmt.Errorf("error loading certificate chain / private key: %w", err)
+	}
+
+	caBytes, err := os.ReadFile(m.rootCAFN)
+	if err != nil {
+		return fmt.Errorf("error reading root CA file: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caBytes) {
+		return fmt.Errorf("%w in '%s'", ErrNoCACertificates, m.rootCAFN)
+	}
+
+	if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err == nil {
+		certificate.Leaf = leaf
+		m.logger.Info("certmanager: loaded certificate for '%s', valid until %s", leaf.Subject.CommonName, leaf.NotAfter)
+	}
+
+	sum := sha256.Sum256(certificate.Certificate[0])
+	updated := &bundle{certificate: &certificate, roots: roots, thumbprint: base64.RawURLEncoding.EncodeToString(sum[:])}
+	previous, _ := m.current.Swap(updated).(*bundle)
+	if previous != nil && previous.thumbprint != updated.thumbprint {
+		m.notify()
+	}
+	return nil
+}
+
+// Watch reloads the certificate, key & CA bundle whenever any of them changes, until Close is called.
+// Parent directories are watched instead of the files themselves, so that atomic replacements (ie: renames
+// or kubernetes secret updates) are picked up as well
+func (m *Impl) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error setting up file watcher: %w", err)
+	}
+
+	dirs := map[string]struct{}{}
+	for _, fn := range []string{m.certChainFN, m.privateKeyFN, m.rootCAFN} {
+		dirs[filepath.Dir(fn)] = struct{}{}
+	}
+
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("error watching directory '%s': %w", dir, err)
+		}
+	}
+
+	m.watcher = watcher
+	go m.watch(watcher)
+	return nil
+}
+
+// Close stops watching for changes, if Watch was called
+func (m *Impl) Close() error {
+	if m.watcher == nil {
+		return nil
+	}
+	return m.watcher.Close()
+}
+
+// ServerConfig returns a copy of `base` that presents the current certificate and verifies clients against the
+// current CA bundle on every new connection
+func (m *Impl) ServerConfig(base *tls.Config) *tls.Config {
+	config := base.Clone()
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return m.load().certificate, nil
+	}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		current := m.load()
+		forClient := base.Clone()
+		forClient.Certificates = []tls.Certificate{*current.certificate}
+		forClient.ClientCAs = current.roots
+		return forClient, nil
+	}
+	return config
+}
+
+// ClientConfig returns a copy of `base` that presents the current certificate when requested by the server, and
+// verifies servers against the current CA bundle
+func (m *Impl) ClientConfig(base *tls.Config) *tls.Config {
+	config := base.Clone()
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return m.load().certificate, nil
+	}
+
+	// RootCAs is read once per config, so the default verification is replaced by one that uses the current bundle
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return ErrNoPeerCertficate
+		}
+
+		// with InsecureSkipVerify set, nothing else checks the hostname, so an empty one can't be let through
+		if state.ServerName == "" {
+			return ErrNoServerName
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         m.load().roots,
+			DNSName:       state.ServerName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		_, err := state.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	return config
+}
+
+// RootCAs returns the current CA bundle
+func (m *Impl) RootCAs() *x509.CertPool {
+	return m.load().roots
+}
+
+// Thumbprint implements Interface
+func (m *Impl) Thumbprint() string {
+	return m.load().thumbprint
+}
+
+// AddListener implements Interface
+func (m *Impl) AddListener(l ReloadListener) {
+	m.lMutex.Lock()
+	m.listeners = append(m.listeners, l)
+	m.lMutex.Unlock()
+}
+
+func (m *Impl) notify() {
+	m.lMutex.Lock()
+	listeners := append([]ReloadListener(nil), m.listeners...)
+	m.lMutex.Unlock()
+	for _, l := range listeners {
+		l()
+	}
+}
+
+func (m *Impl) load() *bundle {
+	return m.current.Load().(*bundle)
+}
+
+func (m *Impl) watch(watcher *fsnotify.Watcher) {
+	watched := map[string]struct{}{}
+	for _, fn := range []string{m.certChainFN, m.privateKeyFN, m.rootCAFN} {
+		watched[filepath.Clean(fn)] = struct{}{}
+	}
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			// kubernetes swaps a `..data` symlink in the same directory, so those events are relevant too
+			if _, isWatched := watched[filepath.Clean(event.Name)]; isWatched || filepath.Base(event.Name) == "..data" {
+				pending = time.After(reloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			m.logger.Error("certmanager: error watching certificate files: %s", err)
+		case <-pending:
+			pending = nil
+			if err := m.Reload(); err != nil {
+				m.logger.Error("certmanager: error reloading certificates, keeping the previous ones: %s", err)
+			}
+		}
+	}
+}
+
+var _ Interface = (*Impl)(nil)
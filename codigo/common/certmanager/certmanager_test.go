@@ -0,0 +1,242 @@
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func TestRotation(t *testing.T) {
+	ca := newCA(t)
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	ca.writeFiles(t, serverDir, "server-1")
+	ca.writeFiles(t, clientDir, "client-1")
+
+	server := setupManager(t, serverDir)
+	client := setupManager(t, clientDir)
+
+	serverCN, clientCN := handshake(t, server, client)
+	assert.Equal(t, "server-1", serverCN)
+	assert.Equal(t, "client-1", clientCN)
+
+	// explicit reload
+	ca.writeFiles(t, serverDir, "server-2")
+	assert.Nil(t, server.Reload())
+	serverCN, _ = handshake(t, server, client)
+	assert.Equal(t, "server-2", serverCN)
+
+	// reload triggered by the file watcher
+	assert.Nil(t, client.Watch())
+	defer client.Close()
+	ca.writeFiles(t, clientDir, "client-2")
+	assert.Eventually(t, func() bool {
+		_, clientCN := handshake(t, server, client)
+		return clientCN == "client-2"
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// broken files don't replace working ones
+	assert.Nil(t, os.WriteFile(filepath.Join(serverDir, "key.pem"), []byte("garbage"), 0600))
+	assert.NotNil(t, server.Reload())
+	serverCN, _ = handshake(t, server, client)
+	assert.Equal(t, "server-2", serverCN)
+}
+
+func TestRootRotation(t *testing.T) {
+	oldCA, newCA := newCA(t), newCA(t)
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	oldCA.writeFiles(t, serverDir, "server-1")
+	oldCA.writeFiles(t, clientDir, "client-1")
+	server := setupManager(t, serverDir)
+	client := setupManager(t, clientDir)
+
+	// the client trusts the new CA before the server rotates, and the server keeps trusting the old one
+	newCA.writeFiles(t, clientDir, "client-2")
+	writePEM(t, filepath.Join(clientDir, "ca.pem"), oldCA.cert.Raw, newCA.cert.Raw)
+	writePEM(t, filepath.Join(serverDir, "ca.pem"), oldCA.cert.Raw, newCA.cert.Raw)
+	assert.Nil(t, client.Reload())
+	assert.Nil(t, server.Reload())
+
+	serverCN, clientCN := handshake(t, server, client)
+	assert.Equal(t, "server-1", serverCN)
+	assert.Equal(t, "client-2", clientCN)
+
+	// once the old CA is dropped, its certificates are rejected
+	writePEM(t, filepath.Join(clientDir, "ca.pem"), newCA.cert.Raw)
+	assert.Nil(t, client.Reload())
+	_, err := dial(server, client)
+	assert.NotNil(t, err)
+}
+
+func TestReloadListeners(t *testing.T) {
+	ca := newCA(t)
+	dir := t.TempDir()
+	ca.writeFiles(t, dir, "client-1")
+	manager := setupManager(t, dir)
+
+	calls := 0
+	manager.AddListener(func() { calls++ })
+	before := manager.Thumbprint()
+	assert.NotEmpty(t, before)
+
+	// reloading the same certificate doesn't notify anyone
+	assert.Nil(t, manager.Reload())
+	assert.Equal(t, 0, calls)
+	assert.Equal(t, before, manager.Thumbprint())
+
+	ca.writeFiles(t, dir, "client-2")
+	assert.Nil(t, manager.Reload())
+	assert.Equal(t, 1, calls)
+	assert.NotEqual(t, before, manager.Thumbprint())
+}
+
+func TestClientRequiresServerName(t *testing.T) {
+	ca := newCA(t)
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	ca.writeFiles(t, serverDir, "server-1")
+	ca.writeFiles(t, clientDir, "client-1")
+	server := setupManager(t, serverDir)
+	client := setupManager(t, clientDir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			tls.Server(conn, server.ServerConfig(&tls.Config{})).Handshake()
+			conn.Close()
+		}
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer clientConn.Close()
+	err = tls.Client(clientConn, client.ClientConfig(&tls.Config{})).Handshake()
+	assert.ErrorIs(t, err, ErrNoServerName)
+}
+
+func setupManager(t *testing.T, dir string) *Impl {
+	t.Helper()
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+	manager, err := New(&Config{
+		Logger:       logger,
+		CertChainFN:  filepath.Join(dir, "cert.pem"),
+		PrivateKeyFN: filepath.Join(dir, "key.pem"),
+		RootCAFN:     filepath.Join(dir, "ca.pem"),
+	})
+	assert.Nil(t, err)
+	return manager
+}
+
+// handshake connects `client` to `server` and returns the common names each of them presented
+func handshake(t *testing.T, server *Impl, client *Impl) (string, string) {
+	t.Helper()
+	state, err := dial(server, client)
+	assert.Nil(t, err)
+	if err != nil {
+		return "", ""
+	}
+	return state[0].PeerCertificates[0].Subject.CommonName, state[1].PeerCertificates[0].Subject.CommonName
+}
+
+func dial(server *Impl, client *Impl) ([2]tls.ConnectionState, error) {
+	var states [2]tls.ConnectionState
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	serverTLS := tls.Server(serverConn, server.ServerConfig(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serverTLS.Handshake()
+		serverConn.Close()
+	}()
+
+	clientTLS := tls.Client(clientConn, client.ClientConfig(&tls.Config{ServerName: "localhost"}))
+	if err := clientTLS.Handshake(); err != nil {
+		return states, err
+	}
+
+	if err := <-errs; err != nil {
+		return states, err
+	}
+
+	states[0], states[1] = clientTLS.ConnectionState(), serverTLS.ConnectionState()
+	return states, nil
+}
+
+func newCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(raw)
+	assert.Nil(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// writeFiles issues a certificate for `cn` and writes it, along with its key & the CA, to `dir`
+func (c *testCA) writeFiles(t *testing.T, dir string, cn string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	assert.Nil(t, err)
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600))
+	writePEM(t, filepath.Join(dir, "cert.pem"), raw)
+	writePEM(t, filepath.Join(dir, "ca.pem"), c.cert.Raw)
+}
+
+func writePEM(t *testing.T, fn string, certs ...[]byte) {
+	t.Helper()
+	var out []byte
+	for _, raw := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})...)
+	}
+	assert.Nil(t, os.WriteFile(fn, out, 0600))
+}
@@ -13,9 +13,24 @@ func IntOr(num string, fallback int) int {
 	return parsed
 }
 
+func FloatOr(num string, fallback float64) float64 {
+	parsed, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
 func StringListOr(list string, fallback []string) []string {
 	if len(list) == 0 {
 		return fallback
 	}
 	return strings.Split(list, ",")
 }
+
+func StringOr(str string, fallback string) string {
+	if len(str) == 0 {
+		return fallback
+	}
+	return str
+}
@@ -1,11 +1,12 @@
 package config
 
 type Server struct {
-	Host         string
-	Port         int
-	RootCAFn     string
-	CertChainFn  string
-	PrivateKeyFn string
+	Host           string
+	Port           int
+	RootCAFn       string
+	CertChainFn    string
+	PrivateKeyFn   string
+	TrustedProxies []string // addresses or CIDRs whose X-Forwarded-For headers are honored. none if empty
 }
 
 type Mongo struct {
@@ -28,3 +29,22 @@ type Redis struct {
 	Port int
 	DB int
 }
+
+// Tracing holds the OTLP collector spans are exported to. spans are written to stdout if no endpoint is set
+type Tracing struct {
+	OTLPEndpoint string
+	Insecure     bool
+}
+
+// RateLimit determines how many requests per second a single user or client can perform, and how many at once
+type RateLimit struct {
+	RequestsPerSecond float64
+	Burst             int
+}
+
+type Revocation struct {
+	CRLSources     []string
+	RefreshMinutes int
+	OCSPEnabled    bool
+	OCSPResponder  string
+}
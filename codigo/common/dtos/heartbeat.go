@@ -0,0 +1,18 @@
+package dtos
+
+// HeartbeatDTO is periodically posted by a file server to report that it's alive
+type HeartbeatDTO struct {
+	OrgName         string        `json:"orgName"`
+	Version         string        `json:"version"`
+	UptimeSeconds   int64         `json:"uptimeSeconds"`
+	IntervalSeconds int64         `json:"intervalSeconds"`
+	Healthy         bool          `json:"healthy"`
+	Message         string        `json:"message,omitempty"`
+	Load            ServerLoadDTO `json:"load"`
+}
+
+// ServerLoadDTO contains load indicators reported by a file server
+type ServerLoadDTO struct {
+	Goroutines int    `json:"goroutines"`
+	HeapBytes  uint64 `json:"heapBytes"`
+}
@@ -1,19 +1,34 @@
 package dtos
 
+import "fmt"
+
 type ServerInfoStatus int
 
 const (
 	StatusServerReady         ServerInfoStatus = 0
 	StatusServerNotRegistered ServerInfoStatus = 1
-	StatusServerDisabled      ServerInfoStatus = 2
+	StatusServerDisabled      ServerInfoStatus = 2 // paused for maintenance
 )
 
+func (s ServerInfoStatus) String() string {
+	switch s {
+	case StatusServerReady:
+		return "ready"
+	case StatusServerNotRegistered:
+		return "not registered"
+	case StatusServerDisabled:
+		return "paused"
+	}
+	return fmt.Sprintf("unknown (%d)", int(s))
+}
+
 type RegistrationResult int
 
 const (
 	ResultOK                RegistrationResult = 0
 	ResultAlreadyRegistered RegistrationResult = 1
 	ResultFail              RegistrationResult = 2
+	ResultUpdated           RegistrationResult = 3 // already registered, endpoints have been updated
 )
 
 type ServerStatusDTO struct {
@@ -22,6 +37,11 @@ type ServerStatusDTO struct {
 	Status int    `json:"status"`
 }
 
+// ServerStatusRequestDTO is posted by a server when pausing or resuming itself
+type ServerStatusRequestDTO struct {
+	OrgName string `json:"orgName"`
+}
+
 type RegistrationResultDTO struct {
 	ServerInfo ServerStatusDTO    `json:"serverInfo"`
 	Result     RegistrationResult `json:"result"`
@@ -0,0 +1,32 @@
+package log
+
+import "context"
+
+// Well-known request-scoped field names
+const (
+	KeyRequestID = "requestId"
+	KeyUser      = "user"
+	KeyOrg       = "org"
+	KeyServer    = "server"
+)
+
+type fieldsKey struct{}
+
+// WithFields returns a copy of `ctx` carrying the supplied key-value pairs in addition to those already present.
+// Loggers obtained with Ctx add them to every entry
+func WithFields(ctx context.Context, keyvals ...interface{}) context.Context {
+	current := FieldsFrom(ctx)
+	fields := make([]interface{}, 0, len(current)+len(keyvals))
+	fields = append(fields, current...)
+	fields = append(fields, keyvals...)
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+// FieldsFrom returns the key-value pairs carried by `ctx`
+func FieldsFrom(ctx context.Context) []interface{} {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(fieldsKey{}).([]interface{})
+	return fields
+}
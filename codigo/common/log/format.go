@@ -0,0 +1,97 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const missingValue = "!MISSING"
+
+func formatText(now time.Time, level int, caller string, msg string, fieldSets ...[]interface{}) string {
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(LevelName(level)))
+	b.WriteString(" - ")
+	b.WriteString(now.Format(time.RFC3339))
+	b.WriteByte(' ')
+	b.WriteString(caller)
+	b.WriteString(": ")
+	b.WriteString(msg)
+	forEachField(fieldSets, func(key string, value interface{}) {
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(textValue(value))
+	})
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func formatJSON(now time.Time, level int, caller string, msg string, fieldSets ...[]interface{}) string {
+	var b strings.Builder
+	b.WriteString(`{"time":`)
+	b.WriteString(jsonValue(now.Format(time.RFC3339Nano)))
+	b.WriteString(`,"level":`)
+	b.WriteString(jsonValue(LevelName(level)))
+	b.WriteString(`,"caller":`)
+	b.WriteString(jsonValue(caller))
+	b.WriteString(`,"msg":`)
+	b.WriteString(jsonValue(msg))
+	forEachField(fieldSets, func(key string, value interface{}) {
+		b.WriteByte(',')
+		b.WriteString(jsonValue(key))
+		b.WriteByte(':')
+		b.WriteString(jsonValue(value))
+	})
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// forEachField walks key-value pairs. A trailing key without a value is reported as missing
+func forEachField(fieldSets [][]interface{}, fn func(key string, value interface{})) {
+	for _, fields := range fieldSets {
+		for idx := 0; idx < len(fields); idx += 2 {
+			key := fmt.Sprint(fields[idx])
+			if idx+1 >= len(fields) {
+				fn(key, missingValue)
+				continue
+			}
+			fn(key, fields[idx+1])
+		}
+	}
+}
+
+func textValue(value interface{}) string {
+	str := stringify(value)
+	if str == "" || strings.ContainsAny(str, " =\"\t\n") {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+func jsonValue(value interface{}) string {
+	switch value.(type) {
+	case error, fmt.Stringer:
+		value = stringify(value)
+	}
+
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		serialized, _ = json.Marshal(stringify(value))
+	}
+	return string(serialized)
+}
+
+func stringify(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
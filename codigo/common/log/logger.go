@@ -1,9 +1,16 @@
 package log
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -15,66 +22,174 @@ const (
 	Verbose
 )
 
+// Format determines how log entries are written
+type Format string
+
+// Supported formats
+const (
+	FormatText Format = "text" // INFO - 2006-01-02T15:04:05Z file.go:10: message key=value
+	FormatJSON Format = "json" // one json object per line
+)
+
+// Public errors
+var (
+	ErrUnknownLevel  = errors.New("unknown level")
+	ErrUnknownFormat = errors.New("unknown log format")
+)
+
+var levelNames = []string{"none", "error", "warning", "info", "debug", "verbose"}
+
+// Interface is implemented by loggers. The printf-style methods are kept for existing callers;
+// new code should prefer Log with a constant message & key-value pairs, which are easier to search & parse
 type Interface interface {
 	Error(tpl string, params ...interface{})
 	Warning(tpl string, params ...interface{})
 	Info(tpl string, params ...interface{})
 	Debug(tpl string, params ...interface{})
 	Verbose(tpl string, params ...interface{})
+
+	// Log writes `msg` along with the supplied key-value pairs at `level`
+	Log(level int, msg string, keyvals ...interface{})
+
+	// With returns a logger that adds `keyvals` to every entry
+	With(keyvals ...interface{}) Interface
+
+	// Ctx returns a logger that adds the fields carried by `ctx` (see WithFields) to every entry
+	Ctx(ctx context.Context) Interface
+
+	// Level & SetLevel allow changing verbosity at runtime. Changes affect every logger derived from the same root
+	Level() int
+	SetLevel(level int) error
 }
 
+// Impl is a leveled logger writing text or json lines
 type Impl struct {
-	errLogger   log.Logger
-	warnLogger  log.Logger
-	infoLogger  log.Logger
-	debugLogger log.Logger
-	verLogger   log.Logger
-	level       int
+	out    *output
+	fields []interface{}
+}
+
+// output is shared by a logger and every logger derived from it with With/Ctx
+type output struct {
+	w      io.Writer
+	format Format
+	level  int32
+	mutex  sync.Mutex
+	now    func() time.Time
 }
 
+// New constructs a logger writing text lines to `w`
 func New(w io.Writer, level int) (*Impl, error) {
+	return NewWithFormat(w, level, FormatText)
+}
+
+// NewWithFormat constructs a logger writing entries to `w` in the supplied format
+func NewWithFormat(w io.Writer, level int, format Format) (*Impl, error) {
 	if level < None || level > Verbose {
-		return nil, fmt.Errorf("unknown level: %d", level)
+		return nil, fmt.Errorf("%w: %d", ErrUnknownLevel, level)
 	}
 
-	flags := log.Ldate | log.LUTC | log.Lshortfile
-	return &Impl{
-		level:       level,
-		errLogger:   *log.New(w, "ERROR - ", flags),
-		warnLogger:  *log.New(w, "WARNING - ", flags),
-		infoLogger:  *log.New(w, "INFO - ", flags),
-		debugLogger: *log.New(w, "DEBUG - ", flags),
-		verLogger:   *log.New(w, "VERBOSE - ", flags),
-	}, nil
+	if format != FormatText && format != FormatJSON {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownFormat, format)
+	}
 
+	return &Impl{out: &output{w: w, format: format, level: int32(level), now: time.Now}}, nil
 }
 
-func (i *Impl) Error(tpl string, params ...interface{}) {
-	if i.level >= Error {
-		i.errLogger.Output(2, fmt.Sprintf(tpl, params...))
+// ParseLevel returns the level matching a name such as "info" or "debug"
+func ParseLevel(name string) (int, error) {
+	for level, candidate := range levelNames {
+		if strings.EqualFold(name, candidate) {
+			return level, nil
+		}
 	}
+	return None, fmt.Errorf("%w: '%s'", ErrUnknownLevel, name)
 }
 
-func (i *Impl) Warning(tpl string, params ...interface{}) {
-	if i.level >= Warning {
-		i.warnLogger.Output(2, fmt.Sprintf(tpl, params...))
+// LevelName returns the name of a level
+func LevelName(level int) string {
+	if level < None || level > Verbose {
+		return fmt.Sprintf("level(%d)", level)
 	}
+	return levelNames[level]
+}
+
+func (i *Impl) Error(tpl string, params ...interface{}) {
+	i.write(Error, fmt.Sprintf(tpl, params...), nil)
+}
+
+func (i *Impl) Warning(tpl string, params ...interface{}) {
+	i.write(Warning, fmt.Sprintf(tpl, params...), nil)
 }
 
 func (i *Impl) Info(tpl string, params ...interface{}) {
-	if i.level >= Info {
-		i.infoLogger.Output(2, fmt.Sprintf(tpl, params...))
-	}
+	i.write(Info, fmt.Sprintf(tpl, params...), nil)
 }
 
 func (i *Impl) Debug(tpl string, params ...interface{}) {
-	if i.level >= Debug {
-		i.debugLogger.Output(2, fmt.Sprintf(tpl, params...))
-	}
+	i.write(Debug, fmt.Sprintf(tpl, params...), nil)
 }
 
 func (i *Impl) Verbose(tpl string, params ...interface{}) {
-	if i.level >= Verbose {
-		i.verLogger.Output(2, fmt.Sprintf(tpl, params...))
+	i.write(Verbose, fmt.Sprintf(tpl, params...), nil)
+}
+
+// Log implements Interface
+func (i *Impl) Log(level int, msg string, keyvals ...interface{}) {
+	i.write(level, msg, keyvals)
+}
+
+// With implements Interface
+func (i *Impl) With(keyvals ...interface{}) Interface {
+	if len(keyvals) == 0 {
+		return i
+	}
+
+	fields := make([]interface{}, 0, len(i.fields)+len(keyvals))
+	fields = append(fields, i.fields...)
+	fields = append(fields, keyvals...)
+	return &Impl{out: i.out, fields: fields}
+}
+
+// Ctx implements Interface
+func (i *Impl) Ctx(ctx context.Context) Interface {
+	return i.With(FieldsFrom(ctx)...)
+}
+
+// Level implements Interface
+func (i *Impl) Level() int {
+	return int(atomic.LoadInt32(&i.out.level))
+}
+
+// SetLevel implements Interface
+func (i *Impl) SetLevel(level int) error {
+	if level < None || level > Verbose {
+		return fmt.Errorf("%w: %d", ErrUnknownLevel, level)
+	}
+	atomic.StoreInt32(&i.out.level, int32(level))
+	return nil
+}
+
+func (i *Impl) write(level int, msg string, keyvals []interface{}) {
+	if level == None || i.Level() < level {
+		return
 	}
+
+	caller := "???"
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	var line string
+	now := i.out.now().UTC()
+	if i.out.format == FormatJSON {
+		line = formatJSON(now, level, caller, msg, i.fields, keyvals)
+	} else {
+		line = formatText(now, level, caller, msg, i.fields, keyvals)
+	}
+
+	i.out.mutex.Lock()
+	defer i.out.mutex.Unlock()
+	io.WriteString(i.out.w, line)
 }
+
+var _ Interface = (*Impl)(nil)
@@ -0,0 +1,76 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Info)
+	assert.Nil(t, err)
+	logger.out.now = func() time.Time { return time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	logger.Info("hello %s", "world")
+	logger.Debug("not written")
+	logger.With("user", "some user", "count", 3).Log(Warning, "structured", "err", errors.New("failed"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "INFO - 2023-01-02T03:04:05Z logger_test.go:21: hello world", lines[0])
+	assert.Equal(t, `WARNING - 2023-01-02T03:04:05Z logger_test.go:23: structured user="some user" count=3 err=failed`, lines[1])
+}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewWithFormat(&buf, Debug, FormatJSON)
+	assert.Nil(t, err)
+
+	ctx := WithFields(context.Background(), KeyRequestID, "abc")
+	ctx = WithFields(ctx, KeyUser, "user1")
+	logger.Ctx(ctx).Log(Error, "something \"quoted\"", "status", 500, "dangling")
+
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "error", entry["level"])
+	assert.Equal(t, `something "quoted"`, entry["msg"])
+	assert.Equal(t, "abc", entry[KeyRequestID])
+	assert.Equal(t, "user1", entry[KeyUser])
+	assert.Equal(t, 500.0, entry["status"])
+	assert.Equal(t, missingValue, entry["dangling"])
+	assert.Contains(t, entry["caller"], "logger_test.go:")
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Error)
+	assert.Nil(t, err)
+	derived := logger.With("some", "field")
+
+	derived.Info("not written")
+	assert.Empty(t, buf.String())
+
+	assert.Nil(t, logger.SetLevel(Info)) // affects derived loggers as well
+	assert.Equal(t, Info, derived.Level())
+	derived.Info("written")
+	assert.Contains(t, buf.String(), "written some=field")
+
+	assert.ErrorIs(t, logger.SetLevel(42), ErrUnknownLevel)
+
+	level, err := ParseLevel("DEBUG")
+	assert.Nil(t, err)
+	assert.Equal(t, Debug, level)
+	_, err = ParseLevel("loud")
+	assert.ErrorIs(t, err, ErrUnknownLevel)
+	assert.Equal(t, "warning", LevelName(Warning))
+
+	_, err = NewWithFormat(&buf, Info, "xml")
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
@@ -0,0 +1,97 @@
+package loghttp
+
+import (
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/dtos/jsend"
+	"github.com/mredolatti/tf/codigo/common/log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader is read from incoming requests (or generated if missing) and echoed back in responses
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+// RequestLogger assigns an id to every request, stores it in the request context so that loggers obtained
+// with Ctx include it, and writes an access-log entry once the request has been served
+func RequestLogger(logger log.Interface) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+
+		requestID := ctx.GetHeader(RequestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = uuid.New().String()
+		}
+		ctx.Header(RequestIDHeader, requestID)
+		ctx.Request = ctx.Request.WithContext(log.WithFields(ctx.Request.Context(), log.KeyRequestID, requestID))
+
+		ctx.Next()
+
+		level := log.Info
+		if ctx.Writer.Status() >= 500 {
+			level = log.Error
+		}
+
+		// handlers further down the chain may have added fields (ie: the authenticated user)
+		logger.Ctx(ctx.Request.Context()).Log(level, "request served",
+			"method", ctx.Request.Method,
+			"path", ctx.Request.URL.Path,
+			"route", ctx.FullPath(),
+			"status", ctx.Writer.Status(),
+			"bytes", ctx.Writer.Size(),
+			"durationMs", time.Since(start).Milliseconds(),
+			"clientIP", ctx.ClientIP(),
+		)
+	}
+}
+
+// LevelController exposes endpoints to inspect & change the log level at runtime
+type LevelController struct {
+	logger log.Interface
+}
+
+// NewLevelController constructs a new controller
+func NewLevelController(logger log.Interface) *LevelController {
+	return &LevelController{logger: logger}
+}
+
+// Register mounts the endpoints on the supplied router. `handlers` (ie: authorization checks) are run first
+func (c *LevelController) Register(router gin.IRouter, handlers ...gin.HandlerFunc) {
+	router.GET("/log/level", append(handlers, c.get)...)
+	router.PUT("/log/level", append(handlers, c.set)...)
+}
+
+// LevelDTO is the json representation of a log level
+type LevelDTO struct {
+	Level string `json:"level"`
+}
+
+func (c *LevelController) get(ctx *gin.Context) {
+	ctx.JSON(200, jsend.NewSuccessResponse("log", LevelDTO{Level: log.LevelName(c.logger.Level())}, ""))
+}
+
+func (c *LevelController) set(ctx *gin.Context) {
+	var dto LevelDTO
+	if err := ctx.ShouldBindJSON(&dto); err != nil {
+		ctx.AbortWithStatusJSON(400, jsend.NewReadBodyFailResponse(err))
+		return
+	}
+
+	level, err := log.ParseLevel(dto.Level)
+	if err != nil {
+		ctx.AbortWithStatusJSON(400, jsend.NewCustomFailResponse("", "level", err.Error()))
+		return
+	}
+
+	previous := c.logger.Level()
+	c.logger.SetLevel(level) // already validated
+	c.logger.Ctx(ctx.Request.Context()).Log(log.Warning, "log level changed",
+		"from", log.LevelName(previous),
+		"to", log.LevelName(level),
+	)
+
+	ctx.JSON(200, jsend.NewSuccessResponse("log", LevelDTO{Level: log.LevelName(level)}, ""))
+}
@@ -0,0 +1,78 @@
+package loghttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func setup(t *testing.T) (*gin.Engine, *log.Impl, *bytes.Buffer) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	var buf bytes.Buffer
+	logger, err := log.NewWithFormat(&buf, log.Info, log.FormatJSON)
+	assert.Nil(t, err)
+
+	router := gin.New()
+	router.Use(RequestLogger(logger))
+	NewLevelController(logger).Register(router.Group("/admin"))
+	router.GET("/files/:id", func(ctx *gin.Context) {
+		ctx.Request = ctx.Request.WithContext(log.WithFields(ctx.Request.Context(), log.KeyUser, "user1"))
+		ctx.Status(204)
+	})
+	return router, logger, &buf
+}
+
+func TestRequestLogger(t *testing.T) {
+	router, _, buf := setup(t)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/files/123", nil))
+	generated := recorder.Header().Get(RequestIDHeader)
+	assert.NotEmpty(t, generated)
+
+	req := httptest.NewRequest("GET", "/files/456", nil)
+	req.Header.Set(RequestIDHeader, "provided-id")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, "provided-id", recorder.Header().Get(RequestIDHeader))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, generated, entry[log.KeyRequestID])
+	assert.Equal(t, "user1", entry[log.KeyUser])
+	assert.Equal(t, "/files/:id", entry["route"])
+	assert.Equal(t, 204.0, entry["status"])
+
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "provided-id", entry[log.KeyRequestID])
+}
+
+func TestLevelController(t *testing.T) {
+	router, logger, _ := setup(t)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/log/level", nil))
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"level":"info"`)
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("PUT", "/admin/log/level", strings.NewReader(`{"level":"debug"}`)))
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, log.Debug, logger.Level())
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("PUT", "/admin/log/level", strings.NewReader(`{"level":"loud"}`)))
+	assert.Equal(t, 400, recorder.Code)
+	assert.Equal(t, log.Debug, logger.Level())
+}
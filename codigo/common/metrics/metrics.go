@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Path is where both servers expose their metrics
+const Path = "/metrics"
+
+const unmatchedRoute = "unmatched" // used for requests not matching any route, to keep label cardinality bounded
+
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time taken to serve http requests, by route & status code",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	grpcStreamsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_streams_started_total",
+		Help: "Number of streaming rpcs started",
+	}, []string{"method"})
+
+	grpcStreamsHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_streams_handled_total",
+		Help: "Number of streaming rpcs completed, by status code",
+	}, []string{"method", "code"})
+
+	grpcStreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_stream_duration_seconds",
+		Help:    "Time streaming rpcs were open for",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+)
+
+// Handler returns an http handler exposing every registered metric in prometheus' text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// HTTPMiddleware records latency & status code of requests served by a gin router.
+// Requests are labeled with the route template (ie: /files/:id) rather than the actual path
+func HTTPMiddleware(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+
+	route := ctx.FullPath()
+	if route == "" {
+		route = unmatchedRoute
+	}
+
+	httpRequestDuration.
+		WithLabelValues(ctx.Request.Method, route, strconv.Itoa(ctx.Writer.Status())).
+		Observe(time.Since(start).Seconds())
+}
+
+// StreamServerInterceptor counts streaming rpcs & records how long they were open for
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		grpcStreamsStarted.WithLabelValues(info.FullMethod).Inc()
+		err := handler(srv, ss)
+		grpcStreamsHandled.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+		grpcStreamDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHTTPMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(HTTPMiddleware)
+	router.GET("/files/:id", func(ctx *gin.Context) { ctx.Status(204) })
+	router.GET(Path, gin.WrapH(Handler()))
+
+	for _, path := range []string{"/files/1", "/files/2", "/nonexistent"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	assert.Equal(t, 2, testutil.CollectAndCount(httpRequestDuration))
+	assert.Contains(t, scrape(t, router), `http_request_duration_seconds_count{method="GET",route="/files/:id",status="204"} 2`)
+	assert.Contains(t, scrape(t, router), `http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`)
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	interceptor := StreamServerInterceptor()
+	info := &grpc.StreamServerInfo{FullMethod: "/FileRefSync/SyncUser", IsServerStream: true}
+
+	assert.Nil(t, interceptor(nil, nil, info, func(interface{}, grpc.ServerStream) error { return nil }))
+	err := interceptor(nil, nil, info, func(interface{}, grpc.ServerStream) error { return status.Error(codes.Unauthenticated, "") })
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	interceptor(nil, nil, info, func(interface{}, grpc.ServerStream) error { return errors.New("some") })
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(grpcStreamsStarted.WithLabelValues(info.FullMethod)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(grpcStreamsHandled.WithLabelValues(info.FullMethod, "OK")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(grpcStreamsHandled.WithLabelValues(info.FullMethod, "Unauthenticated")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(grpcStreamsHandled.WithLabelValues(info.FullMethod, "Unknown")))
+}
+
+func scrape(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	req := httptest.NewRequest("GET", Path, nil).WithContext(context.Background())
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+	return strings.TrimSpace(recorder.Body.String())
+}
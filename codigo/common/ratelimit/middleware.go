@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/dtos/jsend"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RetryAfterHeader tells rejected clients how many seconds to wait before trying again.
+// The same name (lowercase) is used in grpc response metadata
+const RetryAfterHeader = "Retry-After"
+
+// KeyFunc returns the key a request is accounted to. Requests with an empty key are not limited
+type KeyFunc func(ctx *gin.Context) string
+
+// ByClientIP accounts requests to the address they originate from. Used for endpoints reachable without authentication
+func ByClientIP(ctx *gin.Context) string {
+	return ctx.ClientIP()
+}
+
+// Middleware returns a gin handler rejecting requests with 429 once the key returned by `key` has run out of tokens
+func Middleware(limiter Interface, key KeyFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		k := key(ctx)
+		if k == "" {
+			ctx.Next()
+			return
+		}
+
+		if ok, retryAfter := limiter.Allow(k); !ok {
+			ctx.Header(RetryAfterHeader, retryAfterSeconds(retryAfter))
+			ctx.AbortWithStatusJSON(429, jsend.NewCustomFailResponse("too many requests", "retryAfter", retryAfterSeconds(retryAfter)))
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+// StreamServerInterceptor returns a grpc interceptor rejecting streams with ResourceExhausted once
+// the key returned by `key` has run out of tokens. It must be chained after the one authenticating the caller
+func StreamServerInterceptor(limiter Interface, key func(ctx context.Context) string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		k := key(ss.Context())
+		if k == "" {
+			return handler(srv, ss)
+		}
+
+		if ok, retryAfter := limiter.Allow(k); !ok {
+			ss.SetHeader(metadata.Pairs("retry-after", retryAfterSeconds(retryAfter)))
+			return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %s", retryAfter.Round(time.Millisecond))
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// retryAfterSeconds rounds up to whole seconds, as required by the http header
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Public errors
+var (
+	ErrInvalidConfig = errors.New("invalid rate limit configuration")
+)
+
+const sweepInterval = time.Minute
+
+// Config determines how many requests a single key (user, client, ip) can perform
+type Config struct {
+	RequestsPerSecond float64 // sustained rate
+	Burst             int     // requests allowed at once after being idle
+}
+
+// Interface is implemented by rate limiters
+type Interface interface {
+	// Allow consumes a token from `key`'s bucket. If none is available, it returns false along with
+	// the time after which the request could be retried
+	Allow(key string) (bool, time.Duration)
+}
+
+// Impl is a token-bucket limiter keeping one bucket per key
+type Impl struct {
+	limit     rate.Limit
+	burst     int
+	idle      time.Duration
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	mutex     sync.Mutex
+	now       func() time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// New constructs a new limiter
+func New(cfg Config) (*Impl, error) {
+	if cfg.RequestsPerSecond <= 0 || cfg.Burst <= 0 {
+		return nil, fmt.Errorf("%w: requests per second & burst must be positive", ErrInvalidConfig)
+	}
+
+	// a bucket left untouched for this long is full again, and therefore equivalent to a new one
+	idle := time.Duration(float64(cfg.Burst) / cfg.RequestsPerSecond * float64(time.Second))
+
+	return &Impl{
+		limit:   rate.Limit(cfg.RequestsPerSecond),
+		burst:   cfg.Burst,
+		idle:    idle,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}, nil
+}
+
+// Allow implements Interface
+func (i *Impl) Allow(key string) (bool, time.Duration) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	now := i.now()
+	i.sweep(now)
+
+	b, ok := i.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(i.limit, i.burst)}
+		i.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now) // the request is rejected, so the token must not be consumed
+		return false, delay
+	}
+	return true, 0
+}
+
+// sweep drops buckets that have been idle long enough to be full, so that memory usage is bounded
+// by the number of active keys. Must be called with the lock held
+func (i *Impl) sweep(now time.Time) {
+	if now.Sub(i.lastSweep) < sweepInterval {
+		return
+	}
+	i.lastSweep = now
+
+	for key, b := range i.buckets {
+		if now.Sub(b.lastSeen) > i.idle {
+			delete(i.buckets, key)
+		}
+	}
+}
+
+var _ Interface = (*Impl)(nil)
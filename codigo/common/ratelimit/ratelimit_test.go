@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLimiter(t *testing.T) {
+	_, err := New(Config{RequestsPerSecond: 0, Burst: 1})
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+
+	now := time.Now()
+	limiter, err := New(Config{RequestsPerSecond: 1, Burst: 2})
+	assert.Nil(t, err)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		ok, _ := limiter.Allow("user1")
+		assert.True(t, ok)
+	}
+	ok, retryAfter := limiter.Allow("user1")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// rejected requests don't consume tokens, and other keys are not affected
+	ok, retryAfter = limiter.Allow("user1")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+	ok, _ = limiter.Allow("user2")
+	assert.True(t, ok)
+
+	now = now.Add(time.Second)
+	ok, _ = limiter.Allow("user1")
+	assert.True(t, ok)
+
+	// idle buckets are eventually dropped
+	now = now.Add(sweepInterval)
+	limiter.Allow("user3")
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestMiddleware(t *testing.T) {
+	limiter, err := New(Config{RequestsPerSecond: 0.5, Burst: 1})
+	assert.Nil(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware(limiter, func(ctx *gin.Context) string { return ctx.GetHeader("X-User") }))
+	router.GET("/mappings", func(ctx *gin.Context) { ctx.Status(200) })
+
+	call := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/mappings", nil)
+		req.Header.Set("X-User", user)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(t, 200, call("user1").Code)
+	rejected := call("user1")
+	assert.Equal(t, 429, rejected.Code)
+	assert.Equal(t, "2", rejected.Header().Get(RetryAfterHeader))
+	assert.Equal(t, 200, call("user2").Code)
+
+	// requests without a key are not limited
+	assert.Equal(t, 200, call("").Code)
+	assert.Equal(t, 200, call("").Code)
+}
+
+func TestByClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setup := func(trusted []string) *gin.Engine {
+		limiter, err := New(Config{RequestsPerSecond: 0.5, Burst: 1})
+		assert.Nil(t, err)
+		router := gin.New()
+		assert.Nil(t, router.SetTrustedProxies(trusted))
+		router.Use(Middleware(limiter, ByClientIP))
+		router.POST("/login", func(ctx *gin.Context) { ctx.Status(200) })
+		return router
+	}
+
+	call := func(router *gin.Engine, remote string, forwardedFor string) int {
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.RemoteAddr = remote + ":40000"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// without trusted proxies, forged headers don't get clients a fresh bucket
+	router := setup(nil)
+	assert.Equal(t, 200, call(router, "203.0.113.7", "198.51.100.1"))
+	assert.Equal(t, 429, call(router, "203.0.113.7", "198.51.100.2"))
+
+	// headers set by a trusted proxy are honored
+	router = setup([]string{"10.0.0.0/8"})
+	assert.Equal(t, 200, call(router, "10.0.0.1", "198.51.100.1"))
+	assert.Equal(t, 200, call(router, "10.0.0.1", "198.51.100.2"))
+	assert.Equal(t, 429, call(router, "10.0.0.1", "198.51.100.2"))
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	limiter, err := New(Config{RequestsPerSecond: 1, Burst: 1})
+	assert.Nil(t, err)
+
+	interceptor := StreamServerInterceptor(limiter, func(ctx context.Context) string { return "user1" })
+	info := &grpc.StreamServerInfo{FullMethod: "/FileRefSync/SyncUser", IsServerStream: true}
+	handler := func(interface{}, grpc.ServerStream) error { return nil }
+
+	stream := &fakeStream{ctx: context.Background()}
+	assert.Nil(t, interceptor(nil, stream, info, handler))
+	err = interceptor(nil, stream, info, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"1"}, stream.header.Get("retry-after"))
+}
+
+type fakeStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	header metadata.MD
+}
+
+func (f *fakeStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeStream) SetHeader(md metadata.MD) error {
+	f.header = metadata.Join(f.header, md)
+	return nil
+}
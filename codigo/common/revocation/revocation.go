@@ -0,0 +1,408 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	defaultRefreshPeriod = time.Hour
+	defaultOCSPCacheTTL  = 10 * time.Minute
+	defaultHTTPTimeout   = 10 * time.Second
+)
+
+// Public errors
+var (
+	ErrRevoked          = errors.New("certificate has been revoked")
+	ErrNoIssuers        = errors.New("at least one issuer certificate is required")
+	ErrUnknownCRLIssuer = errors.New("crl is not signed by any of the configured issuers")
+)
+
+// crlStatus publishes, for every crl source, how long ago the currently loaded crl was issued
+var crlStatus = expvar.NewMap("revocation.crl")
+
+// Interface defines the set of methods to check whether a client certificate has been revoked
+type Interface interface {
+	Check(cert *x509.Certificate) error
+}
+
+// Config contains parameters to set up a revocation checker
+type Config struct {
+	Logger        log.Interface
+	IssuerFNs     []string      // pem files with the CA certificates that issue client certificates and sign CRLs
+	CRLSources    []string      // CRL files or http(s) urls, either in DER or PEM format
+	RefreshPeriod time.Duration // how often CRLs are reloaded
+	OCSPEnabled   bool
+	OCSPResponder string        // overrides the responder advertised in certificates
+	OCSPCacheTTL  time.Duration // how long responses without a `nextUpdate` are cached
+	HTTPClient    *http.Client
+}
+
+type crlState struct {
+	issuer     string              // raw subject of the issuer
+	revoked    map[string]struct{} // serial numbers in base 10
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+type ocspEntry struct {
+	revoked bool
+	expires time.Time
+}
+
+// Impl is a revocation checker backed by periodically reloaded CRLs and, optionally, OCSP queries.
+// OCSP is checked on a best-effort basis: responders that can't be reached or answer `unknown` are logged and ignored
+type Impl struct {
+	logger        log.Interface
+	issuers       map[string]*x509.Certificate // by raw subject
+	sources       []string
+	refreshPeriod time.Duration
+	ocspEnabled   bool
+	ocspResponder string
+	ocspCacheTTL  time.Duration
+	httpClient    *http.Client
+	crls          map[string]*crlState // by source
+	ocspCache     map[string]ocspEntry // by issuer & serial
+	mtx           sync.RWMutex
+	stop          chan struct{}
+}
+
+// New constructs a new revocation checker, and loads every CRL source. An error is returned if any of them can't be loaded
+func New(cfg *Config) (*Impl, error) {
+	issuers, err := loadIssuers(cfg.IssuerFNs)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshPeriod := cfg.RefreshPeriod
+	if refreshPeriod <= 0 {
+		refreshPeriod = defaultRefreshPeriod
+	}
+
+	ocspCacheTTL := cfg.OCSPCacheTTL
+	if ocspCacheTTL <= 0 {
+		ocspCacheTTL = defaultOCSPCacheTTL
+	}
+
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+
+	checker := &Impl{
+		logger:        cfg.Logger,
+		issuers:       issuers,
+		sources:       cfg.CRLSources,
+		refreshPeriod: refreshPeriod,
+		ocspEnabled:   cfg.OCSPEnabled,
+		ocspResponder: cfg.OCSPResponder,
+		ocspCacheTTL:  ocspCacheTTL,
+		httpClient:    httpClient,
+		crls:          make(map[string]*crlState, len(cfg.CRLSources)),
+		ocspCache:     make(map[string]ocspEntry),
+	}
+
+	if err := checker.Refresh(); err != nil {
+		return nil, err
+	}
+
+	for _, source := range cfg.CRLSources {
+		source := source
+		crlStatus.Set(source, expvar.Func(func() interface{} { return checker.crlStatus(source) }))
+	}
+
+	return checker, nil
+}
+
+// Check returns ErrRevoked if the certificate is listed in a CRL or reported as revoked by an OCSP responder
+func (c *Impl) Check(cert *x509.Certificate) error {
+	issuer := string(cert.RawIssuer)
+	serial := cert.SerialNumber.String()
+
+	c.mtx.RLock()
+	for _, crl := range c.crls {
+		if _, revoked := crl.revoked[serial]; revoked && crl.issuer == issuer {
+			c.mtx.RUnlock()
+			return ErrRevoked
+		}
+	}
+	c.mtx.RUnlock()
+
+	if !c.ocspEnabled {
+		return nil
+	}
+
+	return c.checkOCSP(cert)
+}
+
+// Refresh reloads every CRL source. Sources that fail to load keep their previous contents, and the first error is returned
+func (c *Impl) Refresh() error {
+	var first error
+	for _, source := range c.sources {
+		state, err := c.loadCRL(source)
+		if err != nil {
+			c.logger.Error("revocation.refresh: error loading crl from '%s': %s", source, err)
+			if first == nil {
+				first = fmt.Errorf("error loading crl from '%s': %w", source, err)
+			}
+			continue
+		}
+
+		if !state.nextUpdate.IsZero() && time.Now().After(state.nextUpdate) {
+			c.logger.Warning("revocation.refresh: crl from '%s' is past its next update (%s)", source, state.nextUpdate)
+		}
+
+		c.mtx.Lock()
+		c.crls[source] = state
+		c.mtx.Unlock()
+	}
+
+	return first
+}
+
+// Start periodically reloads CRLs & evicts expired OCSP responses, until Close is called
+func (c *Impl) Start() {
+	c.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(c.refreshPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Refresh() // errors are logged, and retried on the next tick
+				c.evictOCSP()
+			case <-stop:
+				return
+			}
+		}
+	}(c.stop)
+}
+
+// Close stops the refresh goroutine, if any
+func (c *Impl) Close() {
+	if c.stop != nil {
+		close(c.stop)
+	}
+}
+
+// VerifyPeerCertificate returns a function to be used as tls.Config.VerifyPeerCertificate, which rejects
+// handshakes where the verified client certificate has been revoked
+func VerifyPeerCertificate(checker Interface) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			return nil // no client certificate. ClientAuth decides whether that's acceptable
+		}
+		return checker.Check(verifiedChains[0][0])
+	}
+}
+
+func (c *Impl) checkOCSP(cert *x509.Certificate) error {
+	issuer, ok := c.issuers[string(cert.RawIssuer)]
+	if !ok {
+		c.logger.Warning("revocation.ocsp: unknown issuer for certificate '%s'. skipping", cert.Subject.CommonName)
+		return nil
+	}
+
+	responder := c.ocspResponder
+	if responder == "" && len(cert.OCSPServer) > 0 {
+		responder = cert.OCSPServer[0]
+	}
+
+	if responder == "" {
+		return nil
+	}
+
+	key := string(cert.RawIssuer) + cert.SerialNumber.String()
+	c.mtx.RLock()
+	entry, cached := c.ocspCache[key]
+	c.mtx.RUnlock()
+	if cached && time.Now().Before(entry.expires) {
+		if entry.revoked {
+			return ErrRevoked
+		}
+		return nil
+	}
+
+	response, err := c.queryOCSP(responder, cert, issuer)
+	if err != nil {
+		c.logger.Warning("revocation.ocsp: error checking certificate '%s' against '%s': %s", cert.Subject.CommonName, responder, err)
+		return nil
+	}
+
+	if response.Status == ocsp.Unknown {
+		c.logger.Warning("revocation.ocsp: responder '%s' doesn't know certificate '%s'", responder, cert.Subject.CommonName)
+		return nil
+	}
+
+	entry = ocspEntry{revoked: response.Status == ocsp.Revoked, expires: response.NextUpdate}
+	if entry.expires.IsZero() {
+		entry.expires = time.Now().Add(c.ocspCacheTTL)
+	}
+
+	c.mtx.Lock()
+	c.ocspCache[key] = entry
+	c.mtx.Unlock()
+
+	if entry.revoked {
+		return ErrRevoked
+	}
+	return nil
+}
+
+func (c *Impl) queryOCSP(responder string, cert *x509.Certificate, issuer *x509.Certificate) (*ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %w", err)
+	}
+
+	resp, err := c.httpClient.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("error querying responder: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder returned status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	return ocsp.ParseResponseForCert(body, cert, issuer)
+}
+
+func (c *Impl) evictOCSP() {
+	now := time.Now()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key, entry := range c.ocspCache {
+		if now.After(entry.expires) {
+			delete(c.ocspCache, key)
+		}
+	}
+}
+
+func (c *Impl) crlStatus(source string) map[string]interface{} {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	state, ok := c.crls[source]
+	if !ok {
+		return map[string]interface{}{"loaded": false}
+	}
+
+	return map[string]interface{}{
+		"loaded":     true,
+		"ageSeconds": int64(time.Since(state.thisUpdate).Seconds()),
+		"nextUpdate": state.nextUpdate.Unix(),
+		"entries":    len(state.revoked),
+	}
+}
+
+func (c *Impl) loadCRL(source string) (*crlState, error) {
+	raw, err := c.fetch(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(raw); block != nil {
+		raw = block.Bytes
+	}
+
+	crl, err := x509.ParseCRL(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing crl: %w", err)
+	}
+
+	issuer, err := c.findCRLIssuer(crl)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &crlState{
+		issuer:     string(issuer.RawSubject),
+		revoked:    make(map[string]struct{}, len(crl.TBSCertList.RevokedCertificates)),
+		thisUpdate: crl.TBSCertList.ThisUpdate,
+		nextUpdate: crl.TBSCertList.NextUpdate,
+	}
+	for _, entry := range crl.TBSCertList.RevokedCertificates {
+		state.revoked[entry.SerialNumber.String()] = struct{}{}
+	}
+
+	return state, nil
+}
+
+func (c *Impl) findCRLIssuer(crl *pkix.CertificateList) (*x509.Certificate, error) {
+	for _, issuer := range c.issuers {
+		if issuer.CheckCRLSignature(crl) == nil {
+			return issuer, nil
+		}
+	}
+	return nil, ErrUnknownCRLIssuer
+}
+
+func (c *Impl) fetch(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+
+	resp, err := c.httpClient.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching crl: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("crl server returned status %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func loadIssuers(fns []string) (map[string]*x509.Certificate, error) {
+	issuers := make(map[string]*x509.Certificate)
+	for _, fn := range fns {
+		raw, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("error reading issuers file '%s': %w", fn, err)
+		}
+
+		for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing certificate in '%s': %w", fn, err)
+			}
+
+			if cert.IsCA {
+				issuers[string(cert.RawSubject)] = cert
+			}
+		}
+	}
+
+	if len(issuers) == 0 {
+		return nil, ErrNoIssuers
+	}
+
+	return issuers, nil
+}
+
+var _ Interface = (*Impl)(nil)
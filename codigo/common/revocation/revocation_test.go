@@ -0,0 +1,166 @@
+package revocation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func TestCRL(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+	revoked, valid := ca.issue(t, 1), ca.issue(t, 2)
+	issuersFN := writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.cert.Raw)
+	crlFN := writePEM(t, filepath.Join(dir, "ca.crl"), "X509 CRL", ca.crl(t, revoked))
+
+	checker, err := New(&Config{Logger: testLogger(t), IssuerFNs: []string{issuersFN}, CRLSources: []string{crlFN}})
+	assert.Nil(t, err)
+	assert.ErrorIs(t, checker.Check(revoked), ErrRevoked)
+	assert.Nil(t, checker.Check(valid))
+
+	// same serial number, different issuer
+	other := newCA(t, "other")
+	assert.Nil(t, checker.Check(other.issue(t, 1)))
+
+	status := checker.crlStatus(crlFN)
+	assert.Equal(t, true, status["loaded"])
+	assert.Equal(t, 1, status["entries"])
+
+	// reloading picks up newly revoked certificates
+	writePEM(t, crlFN, "X509 CRL", ca.crl(t, revoked, valid))
+	assert.Nil(t, checker.Refresh())
+	assert.ErrorIs(t, checker.Check(valid), ErrRevoked)
+
+	// crls signed by unknown issuers are rejected
+	otherFN := writePEM(t, filepath.Join(dir, "other.crl"), "X509 CRL", other.crl(t, valid))
+	_, err = New(&Config{Logger: testLogger(t), IssuerFNs: []string{issuersFN}, CRLSources: []string{otherFN}})
+	assert.ErrorIs(t, err, ErrUnknownCRLIssuer)
+}
+
+func TestOCSP(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+	revoked, valid := ca.issue(t, 1), ca.issue(t, 2)
+	issuersFN := writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.cert.Raw)
+
+	var calls int32
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		assert.Nil(t, err)
+
+		template := ocsp.Response{Status: ocsp.Good, SerialNumber: request.SerialNumber, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+		if request.SerialNumber.Cmp(revoked.SerialNumber) == 0 {
+			template.Status, template.RevokedAt = ocsp.Revoked, time.Now()
+		}
+
+		response, err := ocsp.CreateResponse(ca.cert, ca.cert, template, ca.key)
+		assert.Nil(t, err)
+		w.Write(response)
+	}))
+	defer responder.Close()
+
+	checker, err := New(&Config{Logger: testLogger(t), IssuerFNs: []string{issuersFN}, OCSPEnabled: true, OCSPResponder: responder.URL})
+	assert.Nil(t, err)
+	assert.ErrorIs(t, checker.Check(revoked), ErrRevoked)
+	assert.Nil(t, checker.Check(valid))
+
+	// responses are cached
+	assert.ErrorIs(t, checker.Check(revoked), ErrRevoked)
+	assert.Nil(t, checker.Check(valid))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// unreachable responders don't block clients
+	responder.Close()
+	assert.Nil(t, checker.Check(ca.issue(t, 3)))
+}
+
+func newCA(t *testing.T, cn string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1000),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(raw)
+	assert.Nil(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+func (c *testCA) issue(t *testing.T, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(raw)
+	assert.Nil(t, err)
+	return cert
+}
+
+func (c *testCA) crl(t *testing.T, revoked ...*x509.Certificate) []byte {
+	t.Helper()
+	entries := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for _, cert := range revoked {
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+
+	raw, err := c.cert.CreateCRL(rand.Reader, c.key, entries, time.Now(), time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	return raw
+}
+
+func writePEM(t *testing.T, fn string, blockType string, raw []byte) string {
+	t.Helper()
+	assert.Nil(t, os.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: raw}), 0600))
+	return fn
+}
+
+func testLogger(t *testing.T) log.Interface {
+	t.Helper()
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+	return logger
+}
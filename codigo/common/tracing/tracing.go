@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Public errors
+var (
+	ErrNoServiceName = errors.New("service name cannot be empty")
+)
+
+// Config contains tracing configuration parameters
+type Config struct {
+	ServiceName  string
+	Version      string
+	OTLPEndpoint string    // host:port of an OTLP/gRPC collector. spans are written to `Output` if empty
+	Insecure     bool      // connect to the collector without TLS
+	Output       io.Writer // defaults to stdout
+}
+
+// Setup installs a global tracer provider & W3C trace-context propagator.
+// The returned function flushes pending spans and must be called before exiting
+func Setup(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	if cfg.ServiceName == "" {
+		return nil, ErrNoServiceName
+	}
+
+	exporter, err := newExporter(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up span exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(cfg.ServiceName),
+		semconv.ServiceVersionKey.String(cfg.Version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("error building tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// End records `err` (if any) in the span, ends it, and returns `err` unchanged
+func End(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+func newExporter(ctx context.Context, cfg *Config) (sdktrace.SpanExporter, error) {
+	if cfg.OTLPEndpoint == "" {
+		output := cfg.Output
+		if output == nil {
+			output = os.Stdout
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(output))
+	}
+
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.OTLPEndpoint)}
+	if cfg.Insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, options...)
+}
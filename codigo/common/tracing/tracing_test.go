@@ -0,0 +1,49 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSetupStdout(t *testing.T) {
+	_, err := Setup(context.Background(), &Config{})
+	assert.ErrorIs(t, err, ErrNoServiceName)
+
+	var output bytes.Buffer
+	shutdown, err := Setup(context.Background(), &Config{ServiceName: "test-service", Version: "v1", Output: &output})
+	assert.Nil(t, err)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "some-operation")
+	span.End()
+	assert.Nil(t, shutdown(context.Background()))
+
+	assert.Contains(t, output.String(), "some-operation")
+	assert.Contains(t, output.String(), "test-service")
+}
+
+func TestEnd(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	_, span := tracer.Start(context.Background(), "ok")
+	assert.Nil(t, End(span, nil))
+
+	someErr := errors.New("something failed")
+	_, span = tracer.Start(context.Background(), "failed")
+	assert.Equal(t, someErr, End(span, someErr))
+
+	ended := recorder.Ended()
+	assert.Len(t, ended, 2)
+	assert.Equal(t, codes.Unset, ended[0].Status().Code)
+	assert.Equal(t, codes.Error, ended[1].Status().Code)
+	assert.Equal(t, "something failed", ended[1].Status().Description)
+	assert.Len(t, ended[1].Events(), 1) // the recorded error
+}
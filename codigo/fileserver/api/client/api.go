@@ -2,49 +2,69 @@ package client
 
 import (
 	"crypto/tls"
-	"crypto/x509"
+	"expvar"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
+	"github.com/mredolatti/tf/codigo/fileserver/api/client/audit"
 	"github.com/mredolatti/tf/codigo/fileserver/api/client/files"
 	"github.com/mredolatti/tf/codigo/fileserver/api/client/login"
 	"github.com/mredolatti/tf/codigo/fileserver/api/client/middleware"
+	webhookctl "github.com/mredolatti/tf/codigo/fileserver/api/client/webhooks"
 	"github.com/mredolatti/tf/codigo/fileserver/api/oauth2"
 	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+	"github.com/mredolatti/tf/codigo/fileserver/webhooks"
 
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/common/log/loghttp"
+	"github.com/mredolatti/tf/codigo/common/metrics"
+	"github.com/mredolatti/tf/codigo/common/ratelimit"
+	"github.com/mredolatti/tf/codigo/common/revocation"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 // Options contains user-api configuration parameters
 type Options struct {
-	Host                     string
-	Port                     int
-	ServerCertificateChainFN string
-	ServerPrivateKeyFN       string
-	RootCAFn                 string
-	OAuht2Wrapper            oauth2.Interface
-	FileManager              filemanager.Interface
-	Logger                   log.Interface
+	Host           string
+	Port           int
+	TrustedProxies []string // addresses or CIDRs whose X-Forwarded-For headers are honored. none if empty
+	Certificates   certmanager.Interface
+	OAuht2Wrapper  oauth2.Interface
+	FileManager    filemanager.Interface
+	Revocation     revocation.Interface // optional
+	RateLimiter    ratelimit.Interface
+	Webhooks       webhooks.Interface // optional
+	Logger         log.Interface
 }
 
 // API is the user-facing API serving the frontend assets and incoming client api calls
 type API struct {
-	server                   http.Server
-	logger                   log.Interface
-	serverCertificateChainFN string
-	serverPrivateKeyFN       string
+	server http.Server
+	logger log.Interface
 }
 
 // New instantiates a new user-api
 func New(options *Options) (*API, error) {
 
 	router := gin.New()
+
+	// gin trusts every proxy by default, which would let clients pick the address they're rate limited by
+	if err := router.SetTrustedProxies(options.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("error setting trusted proxies: %w", err)
+	}
+
 	router.Use(gin.Recovery())
-	router.Use(gin.Logger())
-	router.Use(middleware.NewPkAuth(options.Logger).Handle)
+	router.Use(loghttp.RequestLogger(options.Logger))
+	router.Use(otelgin.Middleware(options.Host))
+	router.Use(metrics.HTTPMiddleware)
+	router.Use(middleware.NewBearerAuth(options.Logger, options.OAuht2Wrapper, options.Revocation).Handle)
+	router.Use(middleware.NewPkAuth(options.Logger, options.Revocation, func(ctx *gin.Context) bool {
+		return files.IsSignedRequest(ctx) || login.IsPublicRequest(ctx)
+	}).Handle)
+	router.Use(ratelimit.Middleware(options.RateLimiter, middleware.ClientKey))
 
 	login := login.New(options.Logger, options.OAuht2Wrapper)
 	login.Register(router)
@@ -52,31 +72,37 @@ func New(options *Options) (*API, error) {
 	files := files.New(options.Logger, options.FileManager)
 	files.Register(router)
 
-	certBytes, err := ioutil.ReadFile(options.RootCAFn)
-	if err != nil {
-		panic(err.Error())
+	audit := audit.New(options.Logger, options.FileManager)
+	audit.Register(router)
+
+	admin := router.Group("/admin", middleware.RequireScope(oauth2.ScopeFilesAdmin), middleware.RequireAdmin(options.Logger, options.FileManager.IsAdmin))
+	levels := loghttp.NewLevelController(options.Logger)
+	levels.Register(admin)
+
+	if options.Webhooks != nil {
+		hooks := webhookctl.New(options.Logger, options.Webhooks)
+		hooks.Register(admin)
 	}
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(certBytes)
+
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+	router.GET(metrics.Path, gin.WrapH(metrics.Handler())) // scrapers authenticate with a client certificate
 
 	return &API{
-		logger:                   options.Logger,
-		serverCertificateChainFN: options.ServerCertificateChainFN,
-		serverPrivateKeyFN:       options.ServerPrivateKeyFN,
+		logger: options.Logger,
 		server: http.Server{
 			Addr:    fmt.Sprintf("%s:%d", options.Host, options.Port),
 			Handler: router,
-			TLSConfig: &tls.Config{
+			TLSConfig: options.Certificates.ServerConfig(&tls.Config{
 				ServerName: options.Host,
 				MinVersion: tls.VersionTLS13,
-				ClientCAs:  certPool,
-				ClientAuth: tls.RequireAndVerifyClientCert,
-			},
+				NextProtos: []string{"h2", "http/1.1"},
+				ClientAuth: tls.VerifyClientCertIfGiven, // PKAuth middleware rejects requests without a certificate
+			}),
 		},
 	}, nil
 }
 
 // Start blocks while accepting incoming connections. returns an error when done
 func (a *API) Start() error {
-	return a.server.ListenAndServeTLS(a.serverCertificateChainFN, a.serverPrivateKeyFN)
+	return a.server.ListenAndServeTLS("", "") // certificates are provided by the tls config
 }
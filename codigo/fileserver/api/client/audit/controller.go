@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/mredolatti/tf/codigo/common/dtos/jsend"
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/api/client/middleware"
+	"github.com/mredolatti/tf/codigo/fileserver/api/oauth2"
+	"github.com/mredolatti/tf/codigo/fileserver/audit"
+	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Controller implements audit-log review endpoints
+type Controller struct {
+	logger log.Interface
+	fm     filemanager.Interface
+}
+
+// New constructs a new controller
+func New(logger log.Interface, manager filemanager.Interface) *Controller {
+	return &Controller{
+		logger: logger,
+		fm:     manager,
+	}
+}
+
+// Register mounts the audit endpoints onto the supplied router
+func (c *Controller) Register(router gin.IRouter) {
+	admin := middleware.RequireScope(oauth2.ScopeFilesAdmin)
+	router.GET("/audit", admin, c.query)
+	router.GET("/audit/export", admin, c.export)
+}
+
+func (c *Controller) query(ctx *gin.Context) {
+	user := ctx.GetString("user")
+	if user == "" {
+		c.logger.Error("audit.query: received request with no user")
+		ctx.AbortWithStatusJSON(500, responseNoUser)
+		return
+	}
+
+	query, err := parseQuery(ctx)
+	if err != nil {
+		c.logger.Error("audit.query: invalid query parameters: %s", err)
+		ctx.AbortWithStatusJSON(400, jsend.NewCustomFailResponse("", "query", err.Error()))
+		return
+	}
+
+	entries, err := c.fm.QueryAuditLog(ctx.Request.Context(), user, query)
+	if err != nil {
+		c.logger.Error("audit.query: error querying audit log: %s", err)
+		c.abortWithError(ctx, err)
+		return
+	}
+
+	ctx.JSON(200, jsend.NewSuccessResponse("entries", entries, ""))
+}
+
+func (c *Controller) export(ctx *gin.Context) {
+	user := ctx.GetString("user")
+	if user == "" {
+		c.logger.Error("audit.export: received request with no user")
+		ctx.AbortWithStatusJSON(500, responseNoUser)
+		return
+	}
+
+	ctx.Header("Content-Type", "application/x-ndjson")
+	ctx.Header("Content-Disposition", `attachment; filename="audit.log"`)
+	if err := c.fm.ExportAuditLog(ctx.Request.Context(), user, ctx.Writer); err != nil {
+		c.logger.Error("audit.export: error exporting audit log: %s", err)
+		if ctx.Writer.Written() { // too late to change the status code
+			ctx.Abort()
+			return
+		}
+		c.abortWithError(ctx, err)
+	}
+}
+
+func (c *Controller) abortWithError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, filemanager.ErrUnauthorized):
+		ctx.AbortWithStatusJSON(401, responseUnauthorized)
+	case errors.Is(err, filemanager.ErrAuditDisabled):
+		ctx.AbortWithStatusJSON(404, responseAuditDisabled)
+	default:
+		ctx.AbortWithStatusJSON(500, responseErrorFetchingAudit)
+	}
+}
+
+func parseQuery(ctx *gin.Context) (*audit.Query, error) {
+	query := &audit.Query{
+		User:      optionalString(ctx, "user"),
+		FileID:    optionalString(ctx, "file"),
+		PatientID: optionalString(ctx, "patient"),
+		Operation: optionalString(ctx, "operation"),
+	}
+
+	var err error
+	if query.From, err = optionalInt64(ctx, "from"); err != nil {
+		return nil, err
+	}
+
+	if query.To, err = optionalInt64(ctx, "to"); err != nil {
+		return nil, err
+	}
+
+	if limit, ok := ctx.GetQuery("limit"); ok {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return nil, errors.New("limit must be a non-negative integer")
+		}
+	}
+
+	return query, nil
+}
+
+func optionalString(ctx *gin.Context, name string) *string {
+	if value, ok := ctx.GetQuery(name); ok && value != "" {
+		return &value
+	}
+	return nil
+}
+
+func optionalInt64(ctx *gin.Context, name string) (*int64, error) {
+	value, ok := ctx.GetQuery(name)
+	if !ok || value == "" {
+		return nil, nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, errors.New(name + " must be a timestamp in nanoseconds")
+	}
+	return &parsed, nil
+}
+
+var (
+	responseNoUser             = jsend.NewErrorResponse("internal error processing client authentication")
+	responseUnauthorized       = jsend.NewCustomFailResponse("", "reason", "insufficient permissions")
+	responseAuditDisabled      = jsend.NewCustomFailResponse("", "reason", "audit log is not enabled in this server")
+	responseErrorFetchingAudit = jsend.NewErrorResponse("internal error fetching audit log")
+)
@@ -0,0 +1,147 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mredolatti/tf/codigo/common/dtos/jsend"
+	"github.com/mredolatti/tf/codigo/fileserver/api/client/middleware"
+	"github.com/mredolatti/tf/codigo/fileserver/api/oauth2"
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
+	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+	"github.com/mredolatti/tf/codigo/fileserver/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxBatchOperations = 10000
+
+func (c *Controller) customMethod(ctx *gin.Context) {
+	switch ctx.Param("method") {
+	case ":batch":
+		c.batch(ctx)
+	default:
+		ctx.AbortWithStatus(404)
+	}
+}
+
+func (c *Controller) batch(ctx *gin.Context) {
+	user := ctx.GetString("user")
+	if user == "" {
+		c.logger.Error("files.batch: received request with no user")
+		ctx.AbortWithStatusJSON(500, responseNoUser)
+		return
+	}
+
+	var dto BatchRequestDTO
+	if err := ctx.ShouldBindJSON(&dto); err != nil {
+		c.logger.Error("files.batch: failed to parse json in request body : %s", err)
+		ctx.AbortWithStatusJSON(400, jsend.NewReadBodyFailResponse(err))
+		return
+	}
+
+	if len(dto.Operations) == 0 || len(dto.Operations) > maxBatchOperations {
+		ctx.AbortWithStatusJSON(400, responseFailBatchSize)
+		return
+	}
+
+	ops := make([]filemanager.BatchOperation, 0, len(dto.Operations))
+	for idx := range dto.Operations {
+		op, err := toBatchOperation(&dto.Operations[idx])
+		if err != nil {
+			ctx.AbortWithStatusJSON(400, jsend.NewCustomFailResponse("", fmt.Sprintf("operations[%d]", idx), err.Error()))
+			return
+		}
+
+		// granting permissions requires the same scope as reviewing them
+		if op.Type == filemanager.BatchGrant && !middleware.HasScope(ctx, oauth2.ScopeFilesAdmin) {
+			middleware.AbortInsufficientScope(ctx, oauth2.ScopeFilesAdmin)
+			return
+		}
+		ops = append(ops, op)
+	}
+
+	results, err := c.fm.BatchFileMetadata(ctx.Request.Context(), user, ops, dto.Atomic)
+	if err != nil {
+		c.logger.Error("files.batch: error applying batch of %d operations: %s", len(ops), err)
+		if errors.Is(err, filemanager.ErrAtomicUnsupported) {
+			ctx.AbortWithStatusJSON(400, responseFailAtomicUnsupported)
+		} else {
+			ctx.AbortWithStatusJSON(500, responseErrorWritingMetadata)
+		}
+		return
+	}
+
+	ctx.JSON(200, jsend.NewSuccessResponse("results", c.toBatchResultDTOs(results), ""))
+}
+
+func toBatchOperation(dto *BatchOperationDTO) (filemanager.BatchOperation, error) {
+	op := filemanager.BatchOperation{
+		Type:    dto.Op,
+		FileID:  dto.ID,
+		Subject: dto.Subject,
+	}
+
+	if dto.File != nil {
+		op.Data = dto.File
+	}
+
+	if dto.Op == filemanager.BatchGrant {
+		operation, ok := parseOperation(dto.Operation)
+		if !ok {
+			return op, fmt.Errorf("unknown operation '%s'", dto.Operation)
+		}
+		op.Operation = operation
+	}
+
+	return op, nil
+}
+
+func parseOperation(name string) (authz.Operation, bool) {
+	for _, candidate := range operationNames {
+		if candidate.name == name {
+			return candidate.op, true
+		}
+	}
+	return 0, false
+}
+
+func (c *Controller) toBatchResultDTOs(results []filemanager.BatchResult) []BatchResultDTO {
+	dtos := make([]BatchResultDTO, 0, len(results))
+	for _, result := range results {
+		dto := BatchResultDTO{Status: 200}
+		if result.Meta != nil {
+			meta := toFileMetaDTO(result.Meta)
+			dto.File = &meta
+		}
+
+		if result.Err != nil {
+			dto.Status, dto.Error = batchErrorStatus(result.Err)
+			if dto.Status == 500 {
+				c.logger.Error("files.batch: error applying operation: %s", result.Err)
+			}
+		}
+		dtos = append(dtos, dto)
+	}
+	return dtos
+}
+
+func batchErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, filemanager.ErrUnauthorized):
+		return 401, "insufficient permissions"
+	case errors.Is(err, filemanager.ErrInvalidBatchOperation):
+		return 400, err.Error()
+	case errors.Is(err, storage.ErrNoSuchFile):
+		return 404, "file not found"
+	case errors.Is(err, filemanager.ErrBatchAborted):
+		return 409, err.Error()
+	default:
+		return 500, "internal error writing file information"
+	}
+}
+
+var (
+	responseFailBatchSize         = jsend.NewCustomFailResponse("", "operations", fmt.Sprintf("between 1 and %d operations are required", maxBatchOperations))
+	responseFailAtomicUnsupported = jsend.NewCustomFailResponse("", "atomic", "the storage backend of this server cannot apply batches atomically")
+)
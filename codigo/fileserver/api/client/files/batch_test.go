@@ -0,0 +1,143 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mredolatti/tf/codigo/common/dtos/jsend"
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/api/oauth2"
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
+	authzBasic "github.com/mredolatti/tf/codigo/fileserver/authz/basic"
+	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+	"github.com/mredolatti/tf/codigo/fileserver/storage/basic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupBatchRouter(t *testing.T) (*gin.Engine, *authzBasic.InMemoryAuthz) {
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+
+	authorization := authzBasic.NewInMemoryAuthz()
+	authorization.Grant("martin", authz.OperationCreate, authz.AnyObject)
+	fm := filemanager.New(basic.NewInMemoryFileStore(), basic.NewInMemoryFileMetadataStore(), authorization)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(ctx *gin.Context) { ctx.Set("user", "martin") })
+	New(logger, fm).Register(router)
+	return router, authorization
+}
+
+func postBatch(router *gin.Engine, path string, body string) (int, *jsend.ResponseDTO[json.RawMessage]) {
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	var response jsend.ResponseDTO[json.RawMessage]
+	if json.Unmarshal(recorder.Body.Bytes(), &response) != nil {
+		return recorder.Code, nil
+	}
+	return recorder.Code, &response
+}
+
+func TestBatchEndpoint(t *testing.T) {
+	router, authorization := setupBatchRouter(t)
+	authorization.Grant("martin", authz.OperationWrite, "99")
+
+	status, response := postBatch(router, "/files:batch", `{"operations": [
+		{"op": "create", "file": {"name": "f1", "patientId": "p1"}},
+		{"op": "grant", "id": "1", "subject": "pedro", "operation": "read"},
+		{"op": "update", "id": "99", "file": {"name": "nope"}},
+		{"op": "delete", "id": "2"},
+		{"op": "rename", "id": "1"}
+	]}`)
+	assert.Equal(t, 200, status)
+	var results []BatchResultDTO
+	assert.Nil(t, json.Unmarshal(response.Data["results"], &results))
+	assert.Len(t, results, 5)
+	assert.Equal(t, 200, results[0].Status)
+	assert.Equal(t, "f1", results[0].File.Name())
+	assert.Equal(t, "p1", results[0].File.PatientID())
+	assert.Equal(t, 200, results[1].Status)
+	assert.Equal(t, 404, results[2].Status)
+	assert.Equal(t, 401, results[3].Status)
+	assert.Equal(t, 400, results[4].Status)
+
+	allowed, _ := authorization.Can("pedro", authz.OperationRead, "1")
+	assert.True(t, allowed)
+
+	// a single failure aborts atomic batches
+	status, response = postBatch(router, "/files:batch", `{"atomic": true, "operations": [
+		{"op": "create", "file": {"name": "f2"}},
+		{"op": "update", "id": "99", "file": {"name": "nope"}}
+	]}`)
+	assert.Equal(t, 200, status)
+	var aborted []BatchResultDTO
+	assert.Nil(t, json.Unmarshal(response.Data["results"], &aborted))
+	assert.Equal(t, 409, aborted[0].Status)
+	assert.Nil(t, aborted[0].File)
+	assert.Equal(t, 404, aborted[1].Status)
+}
+
+func TestBatchEndpointValidation(t *testing.T) {
+	router, _ := setupBatchRouter(t)
+
+	status, response := postBatch(router, "/files:batch", `{"operations": []}`)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, jsend.StatusFailed, response.Status)
+	assert.Contains(t, response.Data, "operations")
+
+	status, response = postBatch(router, "/files:batch", `{"operations": [{"op": "grant", "id": "1", "subject": "pedro", "operation": "own"}]}`)
+	assert.Equal(t, 400, status)
+	assert.Contains(t, response.Data, "operations[0]")
+
+	status, _ = postBatch(router, "/files:batch", `not json`)
+	assert.Equal(t, 400, status)
+
+	// unknown custom methods & paths that only share the prefix are not dispatched
+	status, _ = postBatch(router, "/files:purge", `{}`)
+	assert.Equal(t, 404, status)
+	status, _ = postBatch(router, "/filesbatch", `{}`)
+	assert.Equal(t, 404, status)
+}
+
+func TestBatchEndpointGrantScope(t *testing.T) {
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+
+	authorization := authzBasic.NewInMemoryAuthz()
+	authorization.Grant("martin", authz.OperationCreate, authz.AnyObject)
+	fm := filemanager.New(basic.NewInMemoryFileStore(), basic.NewInMemoryFileMetadataStore(), authorization)
+
+	// a token granted files:write only
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(ctx *gin.Context) {
+		ctx.Set("user", "martin")
+		ctx.Set("tokenClaims", &oauth2.Claims{Scope: oauth2.ScopeFilesWrite})
+	})
+	New(logger, fm).Register(router)
+
+	status, _ := postBatch(router, "/files:batch", `{"operations": [{"op": "create", "file": {"name": "f1"}}]}`)
+	assert.Equal(t, 200, status)
+
+	status, _ = postBatch(router, "/files:batch", `{"operations": [
+		{"op": "create", "file": {"name": "f2"}},
+		{"op": "grant", "id": "1", "subject": "pedro", "operation": "read"}
+	]}`)
+	assert.Equal(t, 403, status)
+	allowed, _ := authorization.Can("pedro", authz.OperationRead, "1")
+	assert.False(t, allowed)
+	listed, err := fm.ListFileMetadata(context.Background(), "martin", nil)
+	assert.Nil(t, err)
+	assert.Len(t, listed, 1) // nothing in the rejected batch was applied
+}
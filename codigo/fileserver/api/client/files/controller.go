@@ -3,11 +3,18 @@ package files
 import (
 	"errors"
 	"io/ioutil"
+	"strconv"
+	"time"
 
 	"github.com/mredolatti/tf/codigo/common/dtos"
 	"github.com/mredolatti/tf/codigo/common/dtos/jsend"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/api/client/middleware"
+	"github.com/mredolatti/tf/codigo/fileserver/api/oauth2"
+	"github.com/mredolatti/tf/codigo/fileserver/breakglass"
 	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+	"github.com/mredolatti/tf/codigo/fileserver/sharelinks"
 
 	"github.com/gin-gonic/gin"
 )
@@ -29,17 +36,36 @@ func New(logger log.Interface, manager filemanager.Interface) *Controller {
 // Register mounts the login endpoints onto the supplied router
 func (c *Controller) Register(router gin.IRouter) {
 
+	read := middleware.RequireScope(oauth2.ScopeFilesRead)
+	write := middleware.RequireScope(oauth2.ScopeFilesWrite)
+	admin := middleware.RequireScope(oauth2.ScopeFilesAdmin)
+
 	// File record metadata
-	router.GET("/files", c.list)
-	router.GET("/files/:id", c.get)
-	router.POST("/files", c.create)
-	router.PUT("/files/:id", c.update)
-	router.DELETE("/files/:id", c.remove)
+	router.GET("/files", read, c.list)
+	router.GET("/files/:id", read, c.get)
+	router.POST("/files", write, c.create)
+	router.PUT("/files/:id", write, c.update)
+	router.DELETE("/files/:id", write, c.remove)
+
+	// gin has no way of escaping ':', so custom methods (ie: /files:batch) are matched with a wildcard
+	// whose value includes the colon, and dispatched by name
+	router.POST("/files:method", write, c.customMethod)
 
 	// File contents
-	router.GET("/files/:id/contents", c.getContents)
-	router.PUT("/files/:id/contents", c.updateContents)
-	router.DELETE("/files/:id/contents", c.removeContents)
+	router.GET("/files/:id/contents", read, c.getContents)
+	router.PUT("/files/:id/contents", write, c.updateContents)
+	router.DELETE("/files/:id/contents", write, c.removeContents)
+
+	// Permissions
+	router.GET("/files/:id/permissions", admin, c.listPermissions)
+
+	// Emergency (break-glass) access
+	router.POST("/files/:id/emergency", admin, c.requestEmergencyAccess)
+	router.GET("/emergency", admin, c.listEmergencyAccesses)
+
+	// Share links
+	router.POST("/files/:id/links", write, c.createShareLink)
+	router.DELETE("/links/:id", write, c.revokeShareLink)
 }
 
 func (c *Controller) list(ctx *gin.Context) {
@@ -50,7 +76,7 @@ func (c *Controller) list(ctx *gin.Context) {
 		return
 	}
 
-	metas, err := c.fm.ListFileMetadata(user, nil)
+	metas, err := c.fm.ListFileMetadata(ctx.Request.Context(), user, nil)
 	if err != nil {
 		c.logger.Error("files.list: failed to fetch file list for user %s: %s", user, err)
 		ctx.AbortWithStatusJSON(500, responseErrorFetchingMetadata)
@@ -75,7 +101,7 @@ func (c *Controller) get(ctx *gin.Context) {
 		return
 	}
 
-	meta, err := c.fm.GetFileMetadata(user, id)
+	meta, err := c.fm.GetFileMetadata(ctx.Request.Context(), user, id)
 	if err != nil {
 		c.logger.Error("files.get: unable to fetch file metadata: %s", err)
 		if errors.Is(err, filemanager.ErrUnauthorized) {
@@ -104,7 +130,7 @@ func (c *Controller) create(ctx *gin.Context) {
 		return
 	}
 
-	meta, err := c.fm.CreateFileMetadata(user, &dto)
+	meta, err := c.fm.CreateFileMetadata(ctx.Request.Context(), user, &dto)
 	if err != nil {
 		c.logger.Error("files.create: unable to create file metadata: %s", err)
 		if errors.Is(err, filemanager.ErrUnauthorized) {
@@ -140,7 +166,7 @@ func (c *Controller) update(ctx *gin.Context) {
 		return
 	}
 
-	meta, err := c.fm.UpdateFileMetadata(user, id, &dto)
+	meta, err := c.fm.UpdateFileMetadata(ctx.Request.Context(), user, id, &dto)
 	if err != nil {
 		c.logger.Error("files.update: unable to update file metadata: %s", err)
 		if errors.Is(err, filemanager.ErrUnauthorized) {
@@ -170,7 +196,7 @@ func (c *Controller) remove(ctx *gin.Context) {
 		return
 	}
 
-	if err := c.fm.DeleteFileMetadata(user, id); err != nil {
+	if err := c.fm.DeleteFileMetadata(ctx.Request.Context(), user, id); err != nil {
 		c.logger.Error("files.remove: error removing file: %w", err)
 		if errors.Is(err, filemanager.ErrUnauthorized) {
 			ctx.AbortWithStatusJSON(401, responseUnauthorized)
@@ -186,6 +212,11 @@ func (c *Controller) remove(ctx *gin.Context) {
 // Contents mangement endpoints
 
 func (c *Controller) getContents(ctx *gin.Context) {
+	if IsSignedRequest(ctx) {
+		c.getSharedContents(ctx)
+		return
+	}
+
 	user := ctx.GetString("user")
 	if user == "" {
 		c.logger.Error("files.contents.get: received request with no user")
@@ -200,7 +231,7 @@ func (c *Controller) getContents(ctx *gin.Context) {
 		return
 	}
 
-	file, err := c.fm.GetFileContents(user, id)
+	file, err := c.fm.GetFileContents(ctx.Request.Context(), user, id)
 	if err != nil {
 		c.logger.Error("files.contents.get: error fetching file contents for %s::%s: : %s", user, id, err)
 		if errors.Is(err, filemanager.ErrUnauthorized) {
@@ -236,7 +267,7 @@ func (c *Controller) updateContents(ctx *gin.Context) {
 		return
 	}
 
-	if err := c.fm.UpdateFileContents(user, id, body); err != nil {
+	if err := c.fm.UpdateFileContents(ctx.Request.Context(), user, id, body); err != nil {
 		c.logger.Error("files.contents.update: error updating file contents for [%s::%s] : %s", user, id, err)
 		if errors.Is(err, filemanager.ErrUnauthorized) {
 			ctx.AbortWithStatusJSON(401, responseUnauthorized)
@@ -265,7 +296,7 @@ func (c *Controller) removeContents(ctx *gin.Context) {
 		return
 	}
 
-	if err := c.fm.DeleteFileContents(user, id); err != nil {
+	if err := c.fm.DeleteFileContents(ctx.Request.Context(), user, id); err != nil {
 		c.logger.Error("files.contents.delete: error deleting file contents for %s::%s: : %s", user, id, err)
 		if errors.Is(err, filemanager.ErrUnauthorized) {
 			ctx.AbortWithStatusJSON(401, responseUnauthorized)
@@ -278,6 +309,211 @@ func (c *Controller) removeContents(ctx *gin.Context) {
     ctx.JSON(200, jsend.ResponseEmptySuccess)
 }
 
+// Emergency access endpoints
+
+func (c *Controller) listPermissions(ctx *gin.Context) {
+	user := ctx.GetString("user")
+	if user == "" {
+		c.logger.Error("files.permissions.list: received request with no user")
+		ctx.AbortWithStatusJSON(500, responseNoUser)
+		return
+	}
+
+	id := ctx.Param("id")
+	if id == "" {
+		c.logger.Error("files.permissions.list: no id supplied")
+		ctx.AbortWithStatusJSON(400, responseFailNoID)
+		return
+	}
+
+	perms, err := c.fm.ListPermissions(ctx.Request.Context(), user, id)
+	if err != nil {
+		c.logger.Error("files.permissions.list: error fetching permissions for %s::%s: %s", user, id, err)
+		if errors.Is(err, filemanager.ErrUnauthorized) {
+			ctx.AbortWithStatusJSON(401, responseUnauthorized)
+		} else {
+			ctx.AbortWithStatusJSON(500, responseErrorFetchingPermissions)
+		}
+		return
+	}
+
+	ctx.JSON(200, jsend.NewSuccessResponse("permissions", toPermissionDTOs(perms), ""))
+}
+
+func (c *Controller) requestEmergencyAccess(ctx *gin.Context) {
+	user := ctx.GetString("user")
+	if user == "" {
+		c.logger.Error("files.emergency.request: received request with no user")
+		ctx.AbortWithStatusJSON(500, responseNoUser)
+		return
+	}
+
+	id := ctx.Param("id")
+	if id == "" {
+		c.logger.Error("files.emergency.request: no id supplied")
+		ctx.AbortWithStatusJSON(400, responseFailNoID)
+		return
+	}
+
+	var dto EmergencyAccessRequestDTO
+	if err := ctx.ShouldBindJSON(&dto); err != nil {
+		c.logger.Error("files.emergency.request: failed to parse json in request body : %s", err)
+		ctx.AbortWithStatusJSON(400, jsend.NewReadBodyFailResponse(err))
+		return
+	}
+
+	grant, err := c.fm.RequestEmergencyAccess(ctx.Request.Context(), user, id, dto.Justification)
+	if err != nil {
+		c.logger.Error("files.emergency.request: error granting emergency access for %s::%s: %s", user, id, err)
+		switch {
+		case errors.Is(err, breakglass.ErrJustificationRequired):
+			ctx.AbortWithStatusJSON(400, responseFailNoJustification)
+		case errors.Is(err, filemanager.ErrBreakGlassDisabled):
+			ctx.AbortWithStatusJSON(404, responseBreakGlassDisabled)
+		default:
+			ctx.AbortWithStatusJSON(500, responseErrorGrantingEmergency)
+		}
+		return
+	}
+
+	ctx.JSON(200, jsend.NewSuccessResponse("grant", grant, ""))
+}
+
+func (c *Controller) listEmergencyAccesses(ctx *gin.Context) {
+	user := ctx.GetString("user")
+	if user == "" {
+		c.logger.Error("files.emergency.list: received request with no user")
+		ctx.AbortWithStatusJSON(500, responseNoUser)
+		return
+	}
+
+	events, err := c.fm.ListEmergencyAccesses(ctx.Request.Context(), user)
+	if err != nil {
+		c.logger.Error("files.emergency.list: error fetching emergency access trail: %s", err)
+		switch {
+		case errors.Is(err, filemanager.ErrUnauthorized):
+			ctx.AbortWithStatusJSON(401, responseUnauthorized)
+		case errors.Is(err, filemanager.ErrBreakGlassDisabled):
+			ctx.AbortWithStatusJSON(404, responseBreakGlassDisabled)
+		default:
+			ctx.AbortWithStatusJSON(500, responseErrorFetchingEmergency)
+		}
+		return
+	}
+
+	ctx.JSON(200, jsend.NewSuccessResponse("events", events, ""))
+}
+
+func (c *Controller) getSharedContents(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if id == "" {
+		c.logger.Error("files.contents.shared: no id supplied")
+		ctx.AbortWithStatusJSON(400, responseFailNoID)
+		return
+	}
+
+	linkID := ctx.Query(sharelinks.ParamLink)
+	expires, err := strconv.ParseInt(ctx.Query(sharelinks.ParamExpires), 10, 64)
+	if linkID == "" || err != nil {
+		c.logger.Error("files.contents.shared: malformed share link for file %s", id)
+		ctx.AbortWithStatusJSON(400, responseFailMalformedLink)
+		return
+	}
+
+	file, err := c.fm.GetSharedFileContents(ctx.Request.Context(), id, linkID, expires, ctx.Query(sharelinks.ParamSignature))
+	if err != nil {
+		c.logger.Error("files.contents.shared: error fetching file contents for %s via link %s: %s", id, linkID, err)
+		switch {
+		case errors.Is(err, sharelinks.ErrInvalidSignature), errors.Is(err, filemanager.ErrUnauthorized):
+			ctx.AbortWithStatusJSON(403, responseFailInvalidLink)
+		case errors.Is(err, sharelinks.ErrExpired), errors.Is(err, sharelinks.ErrUnavailable):
+			ctx.AbortWithStatusJSON(410, responseFailLinkUnavailable)
+		case errors.Is(err, filemanager.ErrShareLinksDisabled):
+			ctx.AbortWithStatusJSON(404, responseShareLinksDisabled)
+		default:
+			ctx.AbortWithStatusJSON(500, responseErrorFetchingContents)
+		}
+		return
+	}
+
+	ctx.Data(200, "application/octet-stream", file)
+}
+
+func (c *Controller) createShareLink(ctx *gin.Context) {
+	user := ctx.GetString("user")
+	if user == "" {
+		c.logger.Error("files.links.create: received request with no user")
+		ctx.AbortWithStatusJSON(500, responseNoUser)
+		return
+	}
+
+	id := ctx.Param("id")
+	if id == "" {
+		c.logger.Error("files.links.create: no id supplied")
+		ctx.AbortWithStatusJSON(400, responseFailNoID)
+		return
+	}
+
+	var dto ShareLinkRequestDTO
+	if err := ctx.ShouldBindJSON(&dto); err != nil {
+		c.logger.Error("files.links.create: failed to parse json in request body : %s", err)
+		ctx.AbortWithStatusJSON(400, jsend.NewReadBodyFailResponse(err))
+		return
+	}
+
+	ttl := time.Duration(dto.TTLSeconds) * time.Second
+	signed, err := c.fm.CreateShareLink(ctx.Request.Context(), user, id, ttl, dto.MaxDownloads)
+	if err != nil {
+		c.logger.Error("files.links.create: error creating share link for %s::%s: %s", user, id, err)
+		switch {
+		case errors.Is(err, filemanager.ErrUnauthorized):
+			ctx.AbortWithStatusJSON(401, responseUnauthorized)
+		case errors.Is(err, sharelinks.ErrInvalidTTL):
+			ctx.AbortWithStatusJSON(400, responseFailInvalidLinkParams)
+		case errors.Is(err, filemanager.ErrShareLinksDisabled):
+			ctx.AbortWithStatusJSON(404, responseShareLinksDisabled)
+		default:
+			ctx.AbortWithStatusJSON(500, responseErrorWritingLink)
+		}
+		return
+	}
+
+	ctx.JSON(200, jsend.NewSuccessResponse("link", toShareLinkDTO(ctx.Request, signed), ""))
+}
+
+func (c *Controller) revokeShareLink(ctx *gin.Context) {
+	user := ctx.GetString("user")
+	if user == "" {
+		c.logger.Error("files.links.revoke: received request with no user")
+		ctx.AbortWithStatusJSON(500, responseNoUser)
+		return
+	}
+
+	linkID := ctx.Param("id")
+	if linkID == "" {
+		c.logger.Error("files.links.revoke: no id supplied")
+		ctx.AbortWithStatusJSON(400, responseFailNoID)
+		return
+	}
+
+	if err := c.fm.RevokeShareLink(ctx.Request.Context(), user, linkID); err != nil {
+		c.logger.Error("files.links.revoke: error revoking share link %s: %s", linkID, err)
+		switch {
+		case errors.Is(err, filemanager.ErrUnauthorized):
+			ctx.AbortWithStatusJSON(401, responseUnauthorized)
+		case errors.Is(err, repository.ErrNotFound):
+			ctx.AbortWithStatusJSON(404, responseFailLinkNotFound)
+		case errors.Is(err, filemanager.ErrShareLinksDisabled):
+			ctx.AbortWithStatusJSON(404, responseShareLinksDisabled)
+		default:
+			ctx.AbortWithStatusJSON(500, responseErrorWritingLink)
+		}
+		return
+	}
+
+	ctx.JSON(200, jsend.ResponseEmptySuccess)
+}
+
 var (
 	responseNoUser                = jsend.NewErrorResponse("internal error processing client authentication")
 	responseErrorFetchingMetadata = jsend.NewErrorResponse("internal error fetching files information")
@@ -286,4 +522,19 @@ var (
 	responseErrorWritingContents  = jsend.NewErrorResponse("internal error writing file contents")
 	responseFailNoID              = jsend.NewCustomFailResponse("", "id", "parameter is mandatory and missing")
 	responseUnauthorized          = jsend.NewCustomFailResponse("", "reason", "insufficient permissions")
+
+	responseErrorFetchingPermissions = jsend.NewErrorResponse("internal error fetching file permissions")
+
+	responseFailNoJustification    = jsend.NewCustomFailResponse("", "justification", "a meaningful justification is mandatory")
+	responseBreakGlassDisabled     = jsend.NewCustomFailResponse("", "reason", "emergency access is not enabled in this server")
+	responseErrorGrantingEmergency = jsend.NewErrorResponse("internal error granting emergency access")
+	responseErrorFetchingEmergency = jsend.NewErrorResponse("internal error fetching emergency access trail")
+
+	responseFailMalformedLink     = jsend.NewCustomFailResponse("", "link", "malformed share link")
+	responseFailInvalidLink       = jsend.NewCustomFailResponse("", "link", "invalid share link")
+	responseFailLinkUnavailable   = jsend.NewCustomFailResponse("", "link", "share link has expired, been revoked or has no downloads left")
+	responseFailLinkNotFound      = jsend.NewCustomFailResponse("", "link", "share link not found")
+	responseFailInvalidLinkParams = jsend.NewCustomFailResponse("", "ttlSeconds", "invalid link duration or download limit")
+	responseShareLinksDisabled    = jsend.NewCustomFailResponse("", "reason", "share links are not enabled in this server")
+	responseErrorWritingLink      = jsend.NewErrorResponse("internal error writing share link")
 )
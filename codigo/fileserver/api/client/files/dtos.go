@@ -0,0 +1,52 @@
+package files
+
+import "github.com/mredolatti/tf/codigo/common/dtos"
+
+// EmergencyAccessRequestDTO is the body expected when requesting emergency access to a file
+type EmergencyAccessRequestDTO struct {
+	Justification string `json:"justification"`
+}
+
+// ShareLinkRequestDTO is the body expected when creating a share link for a file
+type ShareLinkRequestDTO struct {
+	TTLSeconds   int `json:"ttlSeconds"`
+	MaxDownloads int `json:"maxDownloads"`
+}
+
+// ShareLinkDTO is the representation of a newly created share link
+type ShareLinkDTO struct {
+	ID           string `json:"id"`
+	FileID       string `json:"fileId"`
+	ExpiresAt    int64  `json:"expiresAt"`
+	MaxDownloads int    `json:"maxDownloads"`
+	URL          string `json:"url"`
+}
+
+// PermissionDTO lists the operations a subject can perform on a file
+type PermissionDTO struct {
+	Subject    string   `json:"subject"`
+	Operations []string `json:"operations"`
+}
+
+// BatchRequestDTO is the body expected by the batch endpoint
+type BatchRequestDTO struct {
+	Atomic     bool                `json:"atomic"`
+	Operations []BatchOperationDTO `json:"operations"`
+}
+
+// BatchOperationDTO is a single item in a batch request
+type BatchOperationDTO struct {
+	Op        string             `json:"op"`                  // create | update | delete | grant
+	ID        string             `json:"id,omitempty"`        // update, delete & grant
+	File      *dtos.FileMetadata `json:"file,omitempty"`      // create & update
+	Subject   string             `json:"subject,omitempty"`   // grant
+	Operation string             `json:"operation,omitempty"` // grant: read | write | create | admin
+}
+
+// BatchResultDTO is the outcome of a batch item, reported in the same position as in the request.
+// Status is the code the equivalent single-item request would have returned
+type BatchResultDTO struct {
+	Status int                `json:"status"`
+	File   *dtos.FileMetadata `json:"file,omitempty"`
+	Error  string             `json:"error,omitempty"`
+}
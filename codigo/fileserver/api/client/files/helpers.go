@@ -1,8 +1,15 @@
 package files
 
 import (
+	"fmt"
+	"net/http"
+
 	"github.com/mredolatti/tf/codigo/common/dtos"
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
 	"github.com/mredolatti/tf/codigo/fileserver/models"
+	"github.com/mredolatti/tf/codigo/fileserver/sharelinks"
+
+	"github.com/gin-gonic/gin"
 )
 
 func toFileMetaDTO(meta models.FileMetadata) dtos.FileMetadata {
@@ -20,7 +27,52 @@ func toFileMetaDTO(meta models.FileMetadata) dtos.FileMetadata {
 func toFileMetaDTOs(metas []models.FileMetadata) []dtos.FileMetadata {
 	result := make([]dtos.FileMetadata, 0, len(metas))
 	for _, meta := range metas {
+		if meta.Deleted() { // tombstones are only relevant to index servers
+			continue
+		}
 		result = append(result, toFileMetaDTO(meta))
 	}
 	return result
 }
+
+var operationNames = []struct {
+	op   authz.Operation
+	name string
+}{
+	{authz.OperationRead, "read"},
+	{authz.OperationWrite, "write"},
+	{authz.OperationCreate, "create"},
+	{authz.OperationAdmin, "admin"},
+}
+
+func toPermissionDTOs(perms map[string]authz.Permission) []PermissionDTO {
+	result := make([]PermissionDTO, 0, len(perms))
+	for subject, perm := range perms {
+		dto := PermissionDTO{Subject: subject, Operations: []string{}}
+		for _, candidate := range operationNames {
+			if ok, _ := perm.Can(candidate.op); ok {
+				dto.Operations = append(dto.Operations, candidate.name)
+			}
+		}
+		result = append(result, dto)
+	}
+	return result
+}
+
+func toShareLinkDTO(request *http.Request, signed *sharelinks.SignedLink) ShareLinkDTO {
+	return ShareLinkDTO{
+		ID:           signed.Link.ID(),
+		FileID:       signed.Link.FileID(),
+		ExpiresAt:    signed.Expires,
+		MaxDownloads: signed.Link.MaxDownloads(),
+		URL:          fmt.Sprintf("https://%s/files/%s/contents?%s", request.Host, signed.Link.FileID(), signed.Query().Encode()),
+	}
+}
+
+// IsSignedRequest returns true if the request carries a share-link signature, and can therefore be
+// served without a client certificate
+func IsSignedRequest(ctx *gin.Context) bool {
+	return ctx.Request.Method == http.MethodGet &&
+		ctx.FullPath() == "/files/:id/contents" &&
+		ctx.Query(sharelinks.ParamSignature) != ""
+}
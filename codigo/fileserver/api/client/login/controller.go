@@ -1,6 +1,8 @@
 package login
 
 import (
+	"net/http"
+
 	"github.com/mredolatti/tf/codigo/fileserver/api/oauth2"
 
 	"github.com/mredolatti/tf/codigo/common/log"
@@ -27,13 +29,25 @@ func (c *Controller) Register(router gin.IRouter) {
 	router.GET("/authorize", c.authorize)
 	router.GET("/token", c.token)
 	router.POST("/token", c.token)
+	router.POST("/revoke", c.revoke)
+	router.POST("/introspect", c.introspect)
+	router.GET(jwksPath, c.jwks)
+}
+
+const jwksPath = "/.well-known/jwks.json"
+
+// IsPublicRequest returns true for endpoints that can be served without a client certificate
+func IsPublicRequest(ctx *gin.Context) bool {
+	return ctx.Request.Method == http.MethodGet && ctx.FullPath() == jwksPath
 }
 
 func (c *Controller) authorize(ctx *gin.Context) {
 	err := c.oauth2Wrapper.HandleAuthCodeRequest(ctx)
 	if err != nil {
 		c.logger.Error("error handling oauth2 authorization request: %s", err)
-		ctx.AbortWithStatus(500)
+		if !ctx.Writer.Written() {
+			ctx.AbortWithStatus(500)
+		}
 	}
 }
 
@@ -49,3 +63,28 @@ func (c *Controller) token(ctx *gin.Context) {
 		ctx.AbortWithStatus(401)
 	}
 }
+
+func (c *Controller) jwks(ctx *gin.Context) {
+	if err := c.oauth2Wrapper.HandleJWKSRequest(ctx); err != nil {
+		c.logger.Error("error serving jwks: %s", err)
+		ctx.AbortWithStatus(500)
+	}
+}
+
+func (c *Controller) revoke(ctx *gin.Context) {
+	if err := c.oauth2Wrapper.HandleRevocationRequest(ctx); err != nil {
+		c.logger.Error("error handling oauth2 token revocation request: %s", err)
+		if !ctx.Writer.Written() {
+			ctx.AbortWithStatus(500)
+		}
+	}
+}
+
+func (c *Controller) introspect(ctx *gin.Context) {
+	if err := c.oauth2Wrapper.HandleIntrospectionRequest(ctx); err != nil {
+		c.logger.Error("error handling oauth2 token introspection request: %s", err)
+		if !ctx.Writer.Written() {
+			ctx.AbortWithStatus(500)
+		}
+	}
+}
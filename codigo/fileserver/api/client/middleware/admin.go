@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mredolatti/tf/codigo/common/log"
+)
+
+// AdminChecker returns true if a user is allowed to perform server-wide administrative tasks
+type AdminChecker func(ctx context.Context, user string) (bool, error)
+
+// RequireAdmin returns a handler that rejects requests not made by an administrator
+func RequireAdmin(logger log.Interface, isAdmin AdminChecker) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		user := ctx.GetString("user")
+		if user == "" {
+			ctx.AbortWithStatus(401)
+			return
+		}
+
+		allowed, err := isAdmin(ctx.Request.Context(), user)
+		if err != nil {
+			logger.Ctx(ctx.Request.Context()).Log(log.Error, "error checking admin permissions", "err", err)
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		if !allowed {
+			logger.Ctx(ctx.Request.Context()).Log(log.Warning, "rejecting administrative request from non-admin user")
+			ctx.AbortWithStatus(403)
+			return
+		}
+
+		ctx.Next()
+	}
+}
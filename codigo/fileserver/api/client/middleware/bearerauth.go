@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/common/revocation"
+	"github.com/mredolatti/tf/codigo/fileserver/api/oauth2"
+	"github.com/mredolatti/tf/codigo/fileserver/audit"
+)
+
+const (
+	bearerPrefix = "Bearer "
+	claimsKey    = "tokenClaims"
+)
+
+// BearerAuth is an access-token authentication middleware, for clients calling the api on behalf of a user.
+// Tokens are bound to the client certificate they were issued to, which must be presented along with them
+type BearerAuth struct {
+	logger        log.Interface
+	oauth2Wrapper oauth2.Interface
+	revocation    revocation.Interface
+}
+
+// NewBearerAuth returns a new instance of a BearerAuth middleware. Requests without a bearer token are let through,
+// to be authenticated by other means. Certificates are checked against `checker` if it's not nil
+func NewBearerAuth(logger log.Interface, oauth2Wrapper oauth2.Interface, checker revocation.Interface) *BearerAuth {
+	return &BearerAuth{logger: logger, oauth2Wrapper: oauth2Wrapper, revocation: checker}
+}
+
+// Handle is the function to be called by gin to validate the provided token
+func (a *BearerAuth) Handle(ctx *gin.Context) {
+	header := ctx.GetHeader("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		ctx.Next()
+		return
+	}
+
+	claims, err := a.oauth2Wrapper.ValidateToken(strings.TrimPrefix(header, bearerPrefix))
+	if err != nil {
+		a.logger.Error("invalid access token provided by the client: %s", err.Error())
+		ctx.AbortWithStatus(401)
+		return
+	}
+
+	var cert *x509.Certificate
+	if ctx.Request.TLS != nil && len(ctx.Request.TLS.PeerCertificates) > 0 {
+		cert = ctx.Request.TLS.PeerCertificates[0]
+	}
+
+	if !claims.BoundTo(cert) {
+		a.logger.Error("access token for %s presented without the certificate it was issued to", claims.Subject)
+		ctx.AbortWithStatus(401)
+		return
+	}
+
+	if a.revocation != nil {
+		if err := a.revocation.Check(cert); err != nil {
+			a.logger.Error("rejecting certificate for %s: %s", cert.Subject.CommonName, err)
+			ctx.AbortWithStatus(401)
+			return
+		}
+	}
+
+	a.logger.Debug("found valid access token for: %s (client %s)", claims.Subject, claims.Audience)
+	ctx.Set("user", claims.Subject)
+	ctx.Set(claimsKey, claims)
+	reqCtx := audit.WithClientCN(ctx.Request.Context(), claims.Audience)
+	ctx.Request = ctx.Request.WithContext(log.WithFields(reqCtx, log.KeyUser, claims.Subject, "client", claims.Audience))
+
+	ctx.Next()
+}
+
+// IsTokenAuthenticated returns true if the request was authenticated with a bearer token
+func IsTokenAuthenticated(ctx *gin.Context) bool {
+	_, ok := ctx.Get(claimsKey)
+	return ok
+}
+
+// RequireScope returns a handler that rejects requests authenticated with a token that wasn't granted `scope`.
+// Users authenticated with their own certificate, and share-link requests, are not restricted by scopes
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !HasScope(ctx, scope) {
+			AbortInsufficientScope(ctx, scope)
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+// HasScope returns false if the request was authenticated with a token that wasn't granted `scope`. It's meant
+// for handlers whose required scope depends on the contents of the request
+func HasScope(ctx *gin.Context, scope string) bool {
+	raw, ok := ctx.Get(claimsKey)
+	if !ok {
+		return true
+	}
+
+	claims, ok := raw.(*oauth2.Claims)
+	return ok && claims.HasScope(scope)
+}
+
+// AbortInsufficientScope rejects a request whose token lacks `scope`
+func AbortInsufficientScope(ctx *gin.Context, scope string) {
+	ctx.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+	ctx.AbortWithStatus(403)
+}
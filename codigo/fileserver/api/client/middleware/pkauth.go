@@ -5,21 +5,32 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/common/revocation"
+	"github.com/mredolatti/tf/codigo/fileserver/audit"
 )
 
 // PKAuth is a public-key authentication middleware
 type PKAuth struct {
-	logger log.Interface
+	logger     log.Interface
+	revocation revocation.Interface
+	bypass     func(ctx *gin.Context) bool
 }
 
-// NewPkAuth returns a new instance of a PKAuth middleware
-func NewPkAuth(logger log.Interface) *PKAuth {
-	return &PKAuth{logger: logger}
+// NewPkAuth returns a new instance of a PKAuth middleware. Requests for which `bypass` returns true
+// are let through when no client certificate is presented, and are expected to be authenticated by the handler.
+// Certificates are checked against `checker` if it's not nil
+func NewPkAuth(logger log.Interface, checker revocation.Interface, bypass func(ctx *gin.Context) bool) *PKAuth {
+	return &PKAuth{logger: logger, revocation: checker, bypass: bypass}
 }
 
 // Handle is the function to be called by gin to validate provided PK
 func (a *PKAuth) Handle(ctx *gin.Context) {
 
+	if IsTokenAuthenticated(ctx) { // the certificate belongs to the client acting on behalf of the user
+		ctx.Next()
+		return
+	}
+
 	var clientCertficate *x509.Certificate
 	for _, cert := range ctx.Request.TLS.PeerCertificates {
 		if cert != nil || !cert.IsCA {
@@ -28,13 +39,29 @@ func (a *PKAuth) Handle(ctx *gin.Context) {
 		}
 	}
 
+	if clientCertficate == nil && a.bypass != nil && a.bypass(ctx) {
+		ctx.Next()
+		return
+	}
+
 	if clientCertficate == nil {
 		a.logger.Error("no valid certificate provided by the client")
 		ctx.AbortWithStatus(401)
+		return
+	}
+
+	if a.revocation != nil {
+		if err := a.revocation.Check(clientCertficate); err != nil {
+			a.logger.Error("rejecting certificate for %s: %s", clientCertficate.Subject.CommonName, err)
+			ctx.AbortWithStatus(401)
+			return
+		}
 	}
 
 	a.logger.Debug("found valid certificate for: %s", clientCertficate.Subject.CommonName)
 	ctx.Set("user", clientCertficate.Subject.CommonName)
+	reqCtx := audit.WithClientCN(ctx.Request.Context(), clientCertficate.Subject.CommonName)
+	ctx.Request = ctx.Request.WithContext(log.WithFields(reqCtx, log.KeyUser, clientCertficate.Subject.CommonName))
 
 	ctx.Next()
 }
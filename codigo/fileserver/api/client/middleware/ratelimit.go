@@ -0,0 +1,17 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mredolatti/tf/codigo/common/ratelimit"
+)
+
+// ClientKey accounts requests to the client certificate they were made with, or to the address
+// they originate from for those not presenting one (ie: login & signed urls). Requests made with
+// a bearer token are accounted to the certificate as well, not to the oauth2 client the token was
+// issued to, so that every instance of a client gets its own budget
+func ClientKey(ctx *gin.Context) string {
+	if tls := ctx.Request.TLS; tls != nil && len(tls.PeerCertificates) > 0 {
+		return "cn:" + tls.PeerCertificates[0].Subject.CommonName
+	}
+	return "ip:" + ratelimit.ByClientIP(ctx)
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mredolatti/tf/codigo/fileserver/audit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest("GET", "/", nil)
+	ctx.Request.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "ip:10.0.0.1", ClientKey(ctx))
+
+	// bearer requests carry the oauth2 client id as audit cn, but are accounted to the certificate
+	ctx.Request = ctx.Request.WithContext(audit.WithClientCN(context.Background(), "oauth2-client"))
+	ctx.Request.RemoteAddr = "10.0.0.1:1234"
+	ctx.Request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "index-server-1"}}}}
+	assert.Equal(t, "cn:index-server-1", ClientKey(ctx))
+}
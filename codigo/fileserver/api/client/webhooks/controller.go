@@ -0,0 +1,139 @@
+package webhooks
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/mredolatti/tf/codigo/common/dtos/jsend"
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/webhooks"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+)
+
+// Controller implements webhook management endpoints. Callers are expected to be authorized as admins beforehand
+type Controller struct {
+	logger log.Interface
+	hooks  webhooks.Interface
+}
+
+// New constructs a new controller
+func New(logger log.Interface, hooks webhooks.Interface) *Controller {
+	return &Controller{
+		logger: logger,
+		hooks:  hooks,
+	}
+}
+
+// Register mounts the webhook endpoints onto the supplied router
+func (c *Controller) Register(router gin.IRouter) {
+	router.POST("/webhooks", c.create)
+	router.GET("/webhooks", c.list)
+	router.DELETE("/webhooks/:id", c.remove)
+	router.GET("/webhooks/:id/deliveries", c.deliveries)
+	router.POST("/webhooks/:id/deliveries/:deliveryId/replay", c.replay)
+}
+
+func (c *Controller) create(ctx *gin.Context) {
+	user := ctx.GetString("user")
+	if user == "" {
+		c.logger.Error("webhooks.create: received request with no user")
+		ctx.AbortWithStatusJSON(500, responseNoUser)
+		return
+	}
+
+	var dto WebhookRequestDTO
+	if err := ctx.ShouldBindJSON(&dto); err != nil {
+		c.logger.Error("webhooks.create: failed to parse json in request body : %s", err)
+		ctx.AbortWithStatusJSON(400, jsend.NewReadBodyFailResponse(err))
+		return
+	}
+
+	hook, err := c.hooks.Register(ctx.Request.Context(), user, dto.URL)
+	if err != nil {
+		c.logger.Error("webhooks.create: error registering webhook for %s: %s", dto.URL, err)
+		if errors.Is(err, webhooks.ErrInvalidURL) {
+			ctx.AbortWithStatusJSON(400, responseFailInvalidURL)
+			return
+		}
+		ctx.AbortWithStatusJSON(500, responseErrorWritingWebhook)
+		return
+	}
+
+	ctx.JSON(201, jsend.NewSuccessResponse("webhook", toWebhookDTO(hook, true), ""))
+}
+
+func (c *Controller) list(ctx *gin.Context) {
+	hooks, err := c.hooks.List(ctx.Request.Context())
+	if err != nil {
+		c.logger.Error("webhooks.list: error fetching webhooks: %s", err)
+		ctx.AbortWithStatusJSON(500, responseErrorFetchingWebhooks)
+		return
+	}
+
+	ctx.JSON(200, jsend.NewSuccessResponse("webhooks", toWebhookDTOs(hooks), ""))
+}
+
+func (c *Controller) remove(ctx *gin.Context) {
+	if err := c.hooks.Remove(ctx.Request.Context(), ctx.Param("id")); err != nil {
+		c.logger.Error("webhooks.remove: error removing webhook %s: %s", ctx.Param("id"), err)
+		c.abortWithError(ctx, err, responseErrorWritingWebhook)
+		return
+	}
+
+	ctx.Status(204)
+}
+
+func (c *Controller) deliveries(ctx *gin.Context) {
+	limit := defaultDeliveryLimit
+	if value, ok := ctx.GetQuery("limit"); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxDeliveryLimit {
+			ctx.AbortWithStatusJSON(400, responseFailInvalidLimit)
+			return
+		}
+		limit = parsed
+	}
+
+	deliveries, err := c.hooks.Deliveries(ctx.Request.Context(), ctx.Param("id"), limit)
+	if err != nil {
+		c.logger.Error("webhooks.deliveries: error fetching deliveries for webhook %s: %s", ctx.Param("id"), err)
+		c.abortWithError(ctx, err, responseErrorFetchingWebhooks)
+		return
+	}
+
+	ctx.JSON(200, jsend.NewSuccessResponse("deliveries", toDeliveryDTOs(deliveries), ""))
+}
+
+func (c *Controller) replay(ctx *gin.Context) {
+	delivery, err := c.hooks.Replay(ctx.Request.Context(), ctx.Param("id"), ctx.Param("deliveryId"))
+	if err != nil {
+		c.logger.Error("webhooks.replay: error replaying delivery %s: %s", ctx.Param("deliveryId"), err)
+		c.abortWithError(ctx, err, responseErrorWritingWebhook)
+		return
+	}
+
+	ctx.JSON(202, jsend.NewSuccessResponse("delivery", toDeliveryDTO(delivery), ""))
+}
+
+func (c *Controller) abortWithError(ctx *gin.Context, err error, fallback interface{}) {
+	if errors.Is(err, webhooks.ErrNotFound) {
+		ctx.AbortWithStatusJSON(404, responseNotFound)
+		return
+	}
+	ctx.AbortWithStatusJSON(500, fallback)
+}
+
+var (
+	responseNoUser                = jsend.NewErrorResponse("internal error processing client authentication")
+	responseFailInvalidURL        = jsend.NewCustomFailResponse("", "url", webhooks.ErrInvalidURL.Error())
+	responseFailInvalidLimit      = jsend.NewCustomFailResponse("", "limit", "must be an integer between 1 and 500")
+	responseNotFound              = jsend.NewCustomFailResponse("", "reason", "webhook or delivery not found")
+	responseErrorWritingWebhook   = jsend.NewErrorResponse("internal error updating webhooks")
+	responseErrorFetchingWebhooks = jsend.NewErrorResponse("internal error fetching webhooks")
+)
@@ -0,0 +1,80 @@
+package webhooks
+
+import (
+	"encoding/json"
+
+	"github.com/mredolatti/tf/codigo/fileserver/models"
+)
+
+// WebhookRequestDTO is the body expected when registering a webhook
+type WebhookRequestDTO struct {
+	URL string `json:"url"`
+}
+
+// WebhookDTO is the representation of a registered webhook. The secret is only included right after registration
+type WebhookDTO struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	CreatedBy string `json:"createdBy"`
+	CreatedAt int64  `json:"createdAt"`
+	Secret    string `json:"secret,omitempty"`
+}
+
+// DeliveryDTO is the representation of an entry in a webhook's delivery log
+type DeliveryDTO struct {
+	ID            string          `json:"id"`
+	EventID       string          `json:"eventId"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"lastError,omitempty"`
+	ResponseCode  int             `json:"responseCode,omitempty"`
+	CreatedAt     int64           `json:"createdAt"`
+	NextAttemptAt int64           `json:"nextAttemptAt,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+func toWebhookDTO(hook models.Webhook, withSecret bool) WebhookDTO {
+	dto := WebhookDTO{
+		ID:        hook.ID(),
+		URL:       hook.URL(),
+		CreatedBy: hook.CreatedBy(),
+		CreatedAt: hook.CreatedAt().Unix(),
+	}
+	if withSecret {
+		dto.Secret = hook.Secret()
+	}
+	return dto
+}
+
+func toWebhookDTOs(hooks []models.Webhook) []WebhookDTO {
+	dtos := make([]WebhookDTO, 0, len(hooks))
+	for _, hook := range hooks {
+		dtos = append(dtos, toWebhookDTO(hook, false))
+	}
+	return dtos
+}
+
+func toDeliveryDTO(delivery models.WebhookDelivery) DeliveryDTO {
+	dto := DeliveryDTO{
+		ID:           delivery.ID(),
+		EventID:      delivery.EventID(),
+		Status:       delivery.Status(),
+		Attempts:     delivery.Attempts(),
+		LastError:    delivery.LastError(),
+		ResponseCode: delivery.ResponseCode(),
+		CreatedAt:    delivery.CreatedAt().Unix(),
+		Payload:      json.RawMessage(delivery.Payload()),
+	}
+	if delivery.Status() == models.DeliveryPending {
+		dto.NextAttemptAt = delivery.NextAttemptAt().Unix()
+	}
+	return dto
+}
+
+func toDeliveryDTOs(deliveries []models.WebhookDelivery) []DeliveryDTO {
+	dtos := make([]DeliveryDTO, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		dtos = append(dtos, toDeliveryDTO(delivery))
+	}
+	return dtos
+}
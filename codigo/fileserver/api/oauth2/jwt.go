@@ -0,0 +1,117 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mredolatti/tf/codigo/fileserver/signingkeys"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// Public errors
+var (
+	ErrNoClientCertificate = errors.New("tokens can only be issued to clients presenting a certificate")
+)
+
+// Claims are the claims carried by access tokens issued by this server
+type Claims struct {
+	jwt.StandardClaims
+	Scope        string        `json:"scope,omitempty"`
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+}
+
+// Confirmation binds a token to the certificate of the client it was issued to, as described in RFC 8705
+type Confirmation struct {
+	X5tS256 string `json:"x5t#S256"`
+}
+
+// BoundTo returns true if the token was issued to a client presenting `cert`
+func (c *Claims) BoundTo(cert *x509.Certificate) bool {
+	if cert == nil || c.Confirmation == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Confirmation.X5tS256), []byte(CertificateThumbprint(cert))) == 1
+}
+
+// CertificateThumbprint returns the base64url-encoded SHA-256 hash of a DER-encoded certificate
+func CertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// accessGenerate signs access tokens with the currently active key, and tags them with its id so that they
+// can still be verified after the key is rotated
+type accessGenerate struct {
+	keys signingkeys.Interface
+}
+
+// Token implements oauth2.AccessGenerate
+func (a *accessGenerate) Token(ctx context.Context, data *oauth2.GenerateBasic, isGenRefresh bool) (string, string, error) {
+	cert := clientCertificate(data.Request)
+	if cert == nil {
+		return "", "", ErrNoClientCertificate
+	}
+
+	claims := &Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  data.Client.GetID(),
+			Subject:   data.UserID,
+			IssuedAt:  data.TokenInfo.GetAccessCreateAt().Unix(),
+			ExpiresAt: data.TokenInfo.GetAccessCreateAt().Add(data.TokenInfo.GetAccessExpiresIn()).Unix(),
+		},
+		Scope:        data.TokenInfo.GetScope(),
+		Confirmation: &Confirmation{X5tS256: CertificateThumbprint(cert)},
+	}
+
+	key := a.keys.Active()
+	token := jwt.NewWithClaims(key.Method(), claims)
+	token.Header["kid"] = key.ID
+	access, err := token.SignedString(key.PrivateKey())
+	if err != nil {
+		return "", "", fmt.Errorf("error signing access token: %w", err)
+	}
+
+	var refresh string
+	if isGenRefresh {
+		refresh = base64.URLEncoding.EncodeToString([]byte(uuid.NewSHA1(uuid.Must(uuid.NewRandom()), []byte(access)).String()))
+		refresh = strings.ToUpper(strings.TrimRight(refresh, "="))
+	}
+
+	tokensIssued.WithLabelValues(data.Request.FormValue("grant_type")).Inc()
+	return access, refresh, nil
+}
+
+// verificationKey returns the public key a token was signed with, as long as it hasn't been retired
+func (a *accessGenerate) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, err := a.keys.Lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("invalid signature method")
+	}
+
+	return key.PublicKey(), nil
+}
+
+// clientCertificate returns the leaf certificate presented by the client, if any
+func clientCertificate(request *http.Request) *x509.Certificate {
+	if request == nil || request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return request.TLS.PeerCertificates[0]
+}
+
+var _ oauth2.AccessGenerate = (*accessGenerate)(nil)
@@ -0,0 +1,12 @@
+package oauth2
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var tokensIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "fileserver",
+	Name:      "oauth2_tokens_issued_total",
+	Help:      "Number of access tokens issued, by grant type",
+}, []string{"grant_type"})
@@ -0,0 +1,71 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+
+	"github.com/go-oauth2/oauth2/v4"
+	oauth2errors "github.com/go-oauth2/oauth2/v4/errors"
+)
+
+// pkceClient is implemented by clients that can opt out of mandatory PKCE. Clients not implementing it
+// are always required to send a code challenge
+type pkceClient interface {
+	RequiresPKCE() bool
+}
+
+// checkCodeChallenge rejects authorization requests with a non-S256 code challenge, or lacking one when the
+// client requires it
+func (o *Impl) checkCodeChallenge(request *http.Request) error {
+	if request.FormValue("code_challenge") != "" {
+		if oauth2.CodeChallengeMethod(request.FormValue("code_challenge_method")) != oauth2.CodeChallengeS256 {
+			return oauth2errors.ErrUnsupportedCodeChallengeMethod
+		}
+		return nil
+	}
+
+	required, err := o.requiresPKCE(request.Context(), request.FormValue("client_id"))
+	if err != nil {
+		return err
+	}
+
+	if required {
+		return oauth2errors.ErrCodeChallengeRquired
+	}
+	return nil
+}
+
+// checkCodeVerifier rejects code exchanges without a verifier for clients that require PKCE. Verifiers
+// themselves are validated against the stored challenge by the oauth2 manager
+func (o *Impl) checkCodeVerifier(request *http.Request) error {
+	if oauth2.GrantType(request.FormValue("grant_type")) != oauth2.AuthorizationCode || request.FormValue("code_verifier") != "" {
+		return nil
+	}
+
+	required, err := o.requiresPKCE(request.Context(), request.FormValue("client_id"))
+	if err != nil {
+		return err
+	}
+
+	if required {
+		return oauth2errors.ErrInvalidRequest
+	}
+	return nil
+}
+
+func (o *Impl) requiresPKCE(ctx context.Context, clientID string) (bool, error) {
+	client, err := o.manager.GetClient(ctx, clientID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return false, oauth2errors.ErrInvalidClient
+		}
+		return false, fmt.Errorf("error fetching client '%s': %w", clientID, err)
+	}
+
+	withPolicy, ok := client.(pkceClient)
+	return !ok || withPolicy.RequiresPKCE(), nil
+}
@@ -0,0 +1,95 @@
+package oauth2
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type optionalPKCEClient struct {
+	models.Client
+}
+
+func (c *optionalPKCEClient) RequiresPKCE() bool { return false }
+
+func TestPKCE(t *testing.T) {
+	wrapper, _ := setupWrapper(t)
+	router := setupRouter(wrapper)
+	router.GET("/authorize", func(ctx *gin.Context) {
+		ctx.Set("user", "user1")
+		wrapper.HandleAuthCodeRequest(ctx)
+	})
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// code challenge is mandatory, and only S256 is accepted
+	status, _ := authorize(router, url.Values{})
+	assert.Equal(t, 400, status)
+	status, _ = authorize(router, url.Values{"code_challenge": {verifier}, "code_challenge_method": {"plain"}})
+	assert.Equal(t, 400, status)
+	status, _ = authorize(router, url.Values{"code_challenge": {verifier}})
+	assert.Equal(t, 400, status)
+
+	status, code := authorize(router, url.Values{"code_challenge": {challenge}, "code_challenge_method": {"S256"}})
+	assert.Equal(t, http.StatusFound, status)
+	assert.NotEmpty(t, code)
+
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://localhost/callback"}}
+	exchange.Set("code_verifier", "wrong-verifier-wrong-verifier-wrong-verifier")
+	status, _ = post(router, "/token", exchange)
+	assert.Equal(t, 401, status)
+
+	// the verifier is mandatory
+	_, code = authorize(router, url.Values{"code_challenge": {challenge}, "code_challenge_method": {"S256"}})
+	status, _ = post(router, "/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://localhost/callback"}})
+	assert.Equal(t, 400, status)
+
+	_, code = authorize(router, url.Values{"code_challenge": {challenge}, "code_challenge_method": {"S256"}})
+	status, body := post(router, "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"https://localhost/callback"},
+		"code_verifier": {verifier},
+	})
+	assert.Equal(t, 200, status)
+	assert.NotEmpty(t, body["access_token"])
+}
+
+func TestPKCEOptionalPerClient(t *testing.T) {
+	wrapper, _ := setupWrapper(t, &optionalPKCEClient{models.Client{ID: "client2", Secret: "secret2", Domain: "https://localhost"}})
+	router := gin.New()
+	router.GET("/authorize", func(ctx *gin.Context) {
+		ctx.Set("user", "user1")
+		wrapper.HandleAuthCodeRequest(ctx)
+	})
+
+	query := url.Values{"client_id": {"client2"}, "response_type": {"code"}, "redirect_uri": {"https://localhost/callback"}}
+	request := httptest.NewRequest(http.MethodGet, "/authorize?"+query.Encode(), nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusFound, recorder.Code)
+}
+
+func authorize(router *gin.Engine, query url.Values) (int, string) {
+	query.Set("client_id", "client1")
+	query.Set("response_type", "code")
+	query.Set("redirect_uri", "https://localhost/callback")
+	request := httptest.NewRequest(http.MethodGet, "/authorize?"+query.Encode(), nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		return recorder.Code, ""
+	}
+	return recorder.Code, location.Query().Get("code")
+}
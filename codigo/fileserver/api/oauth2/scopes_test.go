@@ -0,0 +1,81 @@
+package oauth2
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopes(t *testing.T) {
+	wrapper, _ := setupWrapper(t)
+	router := setupRouter(wrapper)
+	router.GET("/authorize", func(ctx *gin.Context) {
+		ctx.Set("user", "user1")
+		wrapper.HandleAuthCodeRequest(ctx)
+	})
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	pkce := url.Values{"code_challenge": {base64.RawURLEncoding.EncodeToString(sum[:])}, "code_challenge_method": {"S256"}}
+	issue := func(scope string) (int, map[string]interface{}) {
+		query := url.Values{"scope": {scope}}
+		for k, v := range pkce {
+			query[k] = v
+		}
+		status, code := authorize(router, query)
+		if status != http.StatusFound {
+			return status, nil
+		}
+		return post(router, "/token", url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {"https://localhost/callback"},
+			"code_verifier": {verifier},
+		})
+	}
+
+	// unknown scopes are rejected
+	status, _ := issue("read")
+	assert.Equal(t, 400, status)
+
+	// scopes are recorded in the token
+	status, body := issue("sync files:read sync")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "files:read sync", body["scope"])
+	claims, err := wrapper.ValidateToken(body["access_token"].(string))
+	assert.Nil(t, err)
+	assert.Equal(t, "files:read sync", claims.Scope)
+	assert.True(t, claims.HasScope(ScopeSync))
+	assert.True(t, claims.HasScope(ScopeFilesRead))
+	assert.False(t, claims.HasScope(ScopeFilesWrite))
+
+	// broader scopes include narrower ones
+	status, body = issue("files:admin")
+	assert.Equal(t, 200, status)
+	claims, err = wrapper.ValidateToken(body["access_token"].(string))
+	assert.Nil(t, err)
+	assert.True(t, claims.HasScope(ScopeFilesWrite))
+	assert.True(t, claims.HasScope(ScopeFilesRead))
+	assert.False(t, claims.HasScope(ScopeSync))
+
+	// no scope means the default one
+	status, body = issue("")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, DefaultScope, body["scope"])
+
+	// refreshing can narrow the scope, but not widen it
+	_, body = issue("files:write")
+	refresh := body["refresh_token"].(string)
+	status, _ = post(router, "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}, "scope": {"files:admin"}})
+	assert.Equal(t, 400, status)
+	status, body = post(router, "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}, "scope": {"files:read"}})
+	assert.Equal(t, 200, status)
+	claims, err = wrapper.ValidateToken(body["access_token"].(string))
+	assert.Nil(t, err)
+	assert.Equal(t, "files:read", claims.Scope)
+}
@@ -0,0 +1,261 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-oauth2/oauth2/v4"
+	oauth2errors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/go-oauth2/oauth2/v4/server"
+)
+
+const (
+	tokenTypeHintAccess  = "access_token"
+	tokenTypeHintRefresh = "refresh_token"
+)
+
+// IntrospectionResponse is the body returned by the introspection endpoint, as defined in RFC 7662
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// HandleTokenRefreshRequest exchanges a refresh token for a new access/refresh token pair. Refresh tokens are
+// rotated on every use, and presenting an already rotated one revokes every token issued to that client & user,
+// since either the legitimate client or an attacker is holding a stolen copy
+func (o *Impl) HandleTokenRefreshRequest(ctx *gin.Context) error {
+	client, err := o.authenticateClient(ctx.Request)
+	if err != nil {
+		o.writeError(ctx, oauth2errors.ErrInvalidClient)
+		return fmt.Errorf("error authenticating client: %w", err)
+	}
+
+	// the token is claimed before being exchanged, so that out of many concurrent requests presenting it only one
+	// can succeed. The rest are treated as reuse
+	refresh := ctx.Request.FormValue("refresh_token")
+	if scope := ctx.Request.FormValue("scope"); scope != "" && refresh != "" {
+		// attempts to widen the scope are turned down before claiming, so that they don't consume the token
+		current, err := o.tokenStore.GetByRefresh(ctx.Request.Context(), refresh)
+		if err != nil {
+			return fmt.Errorf("error fetching refresh token: %w", err)
+		}
+
+		if current != nil {
+			if allowed, _ := refreshingScope(&oauth2.TokenGenerateRequest{Scope: scope}, current.GetScope()); !allowed {
+				o.writeError(ctx, oauth2errors.ErrInvalidScope)
+				return nil
+			}
+		}
+	}
+
+	claim := &refreshClaim{}
+	if refresh != "" {
+		if claim.token, err = o.tokenStore.Rotate(ctx.Request.Context(), refresh, client.GetID(), time.Now()); err != nil {
+			return fmt.Errorf("error rotating refresh token: %w", err)
+		}
+	}
+
+	if claim.token == nil && refresh != "" {
+		clientID, userID, err := o.tokenStore.GetRotated(ctx.Request.Context(), refresh)
+		switch {
+		case err == nil:
+			o.logger.Warning("oauth2.refresh: rotated refresh token reused by client '%s' for user '%s'. revoking all their tokens", clientID, userID)
+			if err := o.tokenStore.RemoveByClientAndUser(ctx.Request.Context(), clientID, userID); err != nil {
+				return fmt.Errorf("error revoking tokens after refresh token reuse: %w", err)
+			}
+		case !errors.Is(err, repository.ErrNotFound):
+			return fmt.Errorf("error checking for refresh token reuse: %w", err)
+		}
+		// let the oauth2 server respond with an invalid_grant error
+	}
+
+	request := ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), ctxRefreshClaim, claim))
+	if err := o.server.HandleTokenRequest(ctx.Writer, request); err != nil {
+		return fmt.Errorf("error refreshing token: %w", err)
+	}
+
+	return nil
+}
+
+// refreshClaim holds the token claimed by a refresh request, if any
+type refreshClaim struct {
+	token oauth2.TokenInfo
+}
+
+// claimingTokenStore is handed to the oauth2 manager. When refreshing, it only serves the token claimed by the
+// current request, which has already been removed from the underlying repository
+type claimingTokenStore struct {
+	repository.OAuth2TokenRepository
+}
+
+func (s *claimingTokenStore) GetByRefresh(ctx context.Context, refresh string) (oauth2.TokenInfo, error) {
+	claim, ok := ctx.Value(ctxRefreshClaim).(*refreshClaim)
+	if !ok {
+		return s.OAuth2TokenRepository.GetByRefresh(ctx, refresh)
+	}
+
+	if claim.token == nil || claim.token.GetRefresh() != refresh {
+		return nil, nil // the oauth2 manager expects a nil token for unknown ones
+	}
+	return claim.token, nil
+}
+
+// HandleRevocationRequest revokes an access or refresh token as described in RFC 7009. Since access & refresh
+// tokens are issued & stored together, revoking either of them invalidates both
+func (o *Impl) HandleRevocationRequest(ctx *gin.Context) error {
+	client, err := o.authenticateClient(ctx.Request)
+	if err != nil {
+		o.writeError(ctx, oauth2errors.ErrInvalidClient)
+		return fmt.Errorf("error authenticating client: %w", err)
+	}
+
+	token := ctx.Request.FormValue("token")
+	if token == "" {
+		o.writeError(ctx, oauth2errors.ErrInvalidRequest)
+		return nil
+	}
+
+	info, isRefresh, err := o.lookupToken(ctx.Request.Context(), token, ctx.Request.FormValue("token_type_hint"))
+	if err != nil {
+		return fmt.Errorf("error fetching token: %w", err)
+	}
+
+	// unknown tokens and tokens issued to other clients are reported as successfully revoked,
+	// so that callers can't probe for valid ones
+	if info != nil && info.GetClientID() == client.GetID() {
+		remove := o.tokenStore.RemoveByAccess
+		if isRefresh {
+			remove = o.tokenStore.RemoveByRefresh
+		}
+
+		if err := remove(ctx.Request.Context(), token); err != nil {
+			return fmt.Errorf("error revoking token: %w", err)
+		}
+	}
+
+	ctx.Status(http.StatusOK)
+	return nil
+}
+
+// HandleIntrospectionRequest reports whether a token is active, and the information it carries (RFC 7662).
+// Clients can only introspect tokens that were issued to them
+func (o *Impl) HandleIntrospectionRequest(ctx *gin.Context) error {
+	client, err := o.authenticateClient(ctx.Request)
+	if err != nil {
+		o.writeError(ctx, oauth2errors.ErrInvalidClient)
+		return fmt.Errorf("error authenticating client: %w", err)
+	}
+
+	token := ctx.Request.FormValue("token")
+	if token == "" {
+		o.writeError(ctx, oauth2errors.ErrInvalidRequest)
+		return nil
+	}
+
+	info, isRefresh, err := o.lookupToken(ctx.Request.Context(), token, ctx.Request.FormValue("token_type_hint"))
+	if err != nil {
+		return fmt.Errorf("error fetching token: %w", err)
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	if info == nil || info.GetClientID() != client.GetID() {
+		ctx.JSON(http.StatusOK, IntrospectionResponse{Active: false})
+		return nil
+	}
+
+	response := IntrospectionResponse{
+		Scope:     info.GetScope(),
+		ClientID:  info.GetClientID(),
+		Subject:   info.GetUserID(),
+		TokenType: tokenTypeHintAccess,
+		IssuedAt:  info.GetAccessCreateAt().Unix(),
+		ExpiresAt: info.GetAccessCreateAt().Add(info.GetAccessExpiresIn()).Unix(),
+	}
+	if isRefresh {
+		response.TokenType = tokenTypeHintRefresh
+		response.IssuedAt = info.GetRefreshCreateAt().Unix()
+		response.ExpiresAt = 0
+		if exp := info.GetRefreshExpiresIn(); exp > 0 {
+			response.ExpiresAt = info.GetRefreshCreateAt().Add(exp).Unix()
+		}
+	}
+
+	response.Active = response.ExpiresAt == 0 || time.Now().Unix() < response.ExpiresAt
+	if !response.Active {
+		response = IntrospectionResponse{Active: false}
+	}
+
+	ctx.JSON(http.StatusOK, response)
+	return nil
+}
+
+// authenticateClient validates the credentials supplied either in the request body or in a basic-auth header
+func (o *Impl) authenticateClient(request *http.Request) (oauth2.ClientInfo, error) {
+	if err := request.ParseForm(); err != nil {
+		return nil, fmt.Errorf("error parsing form: %w", err)
+	}
+
+	clientID, secret, err := server.ClientFormHandler(request)
+	if err != nil {
+		if clientID, secret, err = server.ClientBasicHandler(request); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := o.manager.GetClient(request.Context(), clientID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching client '%s': %w", clientID, err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(client.GetSecret()), []byte(secret)) != 1 {
+		return nil, oauth2errors.ErrInvalidClient
+	}
+
+	return client, nil
+}
+
+// lookupToken searches for a token among access tokens and refresh tokens, in the order suggested by the client
+func (o *Impl) lookupToken(ctx context.Context, token string, hint string) (oauth2.TokenInfo, bool, error) {
+	lookups := []bool{false, true}
+	if hint == tokenTypeHintRefresh {
+		lookups = []bool{true, false}
+	}
+
+	for _, isRefresh := range lookups {
+		get := o.tokenStore.GetByAccess
+		if isRefresh {
+			get = o.tokenStore.GetByRefresh
+		}
+
+		info, err := get(ctx, token)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if info != nil {
+			return info, isRefresh, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+func (o *Impl) writeError(ctx *gin.Context, err error) {
+	data, status, header := o.server.GetErrorData(err)
+	for key := range header {
+		ctx.Header(key, header.Get(key))
+	}
+	ctx.JSON(status, data)
+}
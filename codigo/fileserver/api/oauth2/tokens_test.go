@@ -0,0 +1,319 @@
+package oauth2
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+	"github.com/mredolatti/tf/codigo/fileserver/signingkeys"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshRotationAndReuse(t *testing.T) {
+	wrapper, tokens := setupWrapper(t)
+	router := setupRouter(wrapper)
+	tokens.seed(t, "access1", "refresh1")
+
+	status, body := post(router, "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"refresh1"}})
+	assert.Equal(t, 200, status)
+	refresh2, _ := body["refresh_token"].(string)
+	assert.NotEmpty(t, refresh2)
+	assert.NotEqual(t, "refresh1", refresh2)
+	access2, _ := body["access_token"].(string)
+	claims, err := wrapper.ValidateToken(access2)
+	assert.Nil(t, err)
+	assert.Equal(t, "user1", claims.Subject)
+	assert.True(t, claims.BoundTo(clientCert))
+	assert.False(t, claims.BoundTo(newCertificate("client1")))
+	assert.False(t, claims.BoundTo(nil))
+
+	// the new refresh token works once
+	status, body = post(router, "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh2}})
+	assert.Equal(t, 200, status)
+	refresh3, _ := body["refresh_token"].(string)
+	assert.NotEmpty(t, refresh3)
+
+	// reusing a rotated token revokes the whole family
+	status, _ = post(router, "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"refresh1"}})
+	assert.Equal(t, 401, status)
+	info, err := tokens.GetByRefresh(context.Background(), refresh3)
+	assert.Nil(t, err)
+	assert.Nil(t, info)
+
+	status, _ = post(router, "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh3}})
+	assert.Equal(t, 401, status)
+}
+
+func TestConcurrentRefreshes(t *testing.T) {
+	wrapper, tokens := setupWrapper(t, &models.Client{ID: "client2", Secret: "secret2", Domain: "https://localhost"})
+	router := setupRouter(wrapper)
+	tokens.seed(t, "access1", "refresh1")
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 10)
+	for idx := range statuses {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			statuses[idx], _ = post(router, "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"refresh1"}})
+		}(idx)
+	}
+	wg.Wait()
+
+	// only one of the requests gets to exchange the token, the rest are seen as reuse
+	var succeeded int
+	for _, status := range statuses {
+		if status == 200 {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+
+	// tokens issued to other clients can't be claimed
+	tokens.seed(t, "access2", "refresh2")
+	status, _ := postAs(router, "/token", "client2", "secret2", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"refresh2"}})
+	assert.Equal(t, 401, status)
+	status, _ = post(router, "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"refresh2"}})
+	assert.Equal(t, 200, status)
+}
+
+func TestTokensRequireClientCertificate(t *testing.T) {
+	wrapper, tokens := setupWrapper(t)
+	router := setupRouter(wrapper)
+	tokens.seed(t, "access1", "refresh1")
+
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"refresh1"}, "client_id": {"client1"}, "client_secret": {"secret1"}}
+	request := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, 401, recorder.Code)
+
+	// the refresh token is still usable by the legitimate client
+	status, _ := post(router, "/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"refresh1"}})
+	assert.Equal(t, 200, status)
+}
+
+func TestRevocationAndIntrospection(t *testing.T) {
+	wrapper, tokens := setupWrapper(t)
+	router := setupRouter(wrapper)
+	tokens.seed(t, "access1", "refresh1")
+
+	status, body := post(router, "/introspect", url.Values{"token": {"refresh1"}, "token_type_hint": {"refresh_token"}})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, true, body["active"])
+	assert.Equal(t, "user1", body["sub"])
+	assert.Equal(t, "client1", body["client_id"])
+	assert.Equal(t, "refresh_token", body["token_type"])
+
+	status, body = post(router, "/introspect", url.Values{"token": {"access1"}})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, true, body["active"])
+	assert.Equal(t, "access_token", body["token_type"])
+
+	// bad client credentials
+	status, _ = postAs(router, "/revoke", "client1", "wrong", url.Values{"token": {"refresh1"}})
+	assert.Equal(t, 401, status)
+
+	// unknown tokens are reported as revoked
+	status, _ = post(router, "/revoke", url.Values{"token": {"nonexistant"}})
+	assert.Equal(t, 200, status)
+
+	// revoking the refresh token also invalidates the access token issued with it
+	status, _ = post(router, "/revoke", url.Values{"token": {"refresh1"}})
+	assert.Equal(t, 200, status)
+	status, body = post(router, "/introspect", url.Values{"token": {"access1"}})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, map[string]interface{}{"active": false}, body)
+}
+
+func setupWrapper(t *testing.T, extraClients ...oauth2.ClientInfo) (*Impl, *tokenRepoMock) {
+	t.Helper()
+	clients := store.NewClientStore()
+	clients.Set("client1", &models.Client{ID: "client1", Secret: "secret1", Domain: "https://localhost"})
+	for _, client := range extraClients {
+		clients.Set(client.GetID(), client)
+	}
+
+	memStore, err := store.NewMemoryTokenStore()
+	assert.Nil(t, err)
+	tokens := &tokenRepoMock{TokenStore: memStore, rotated: map[string][2]string{}}
+
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+	keys, err := signingkeys.New(&signingkeys.Config{Directory: t.TempDir(), Algorithm: signingkeys.AlgorithmEdDSA})
+	assert.Nil(t, err)
+	wrapper, err := New(logger, "user", clients, tokens, keys)
+	assert.Nil(t, err)
+	return wrapper, tokens
+}
+
+func setupRouter(wrapper *Impl) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/token", func(ctx *gin.Context) { wrapper.HandleAuthCodeExchangeRequest(ctx) })
+	router.POST("/revoke", func(ctx *gin.Context) { wrapper.HandleRevocationRequest(ctx) })
+	router.POST("/introspect", func(ctx *gin.Context) { wrapper.HandleIntrospectionRequest(ctx) })
+	return router
+}
+
+// clientCert is presented by test clients when requesting tokens
+var clientCert = newCertificate("client1")
+
+func newCertificate(cn string) *x509.Certificate {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, public, private)
+	if err != nil {
+		panic(err)
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+func post(router *gin.Engine, path string, form url.Values) (int, map[string]interface{}) {
+	return postAs(router, path, "client1", "secret1", form)
+}
+
+func postAs(router *gin.Engine, path string, clientID string, secret string, form url.Values) (int, map[string]interface{}) {
+	form.Set("client_id", clientID)
+	form.Set("client_secret", secret)
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{clientCert}}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	var body map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return recorder.Code, body
+}
+
+type tokenRepoMock struct {
+	oauth2.TokenStore
+	mtx     sync.Mutex
+	issued  []oauth2.TokenInfo
+	rotated map[string][2]string
+}
+
+func (m *tokenRepoMock) seed(t *testing.T, access string, refresh string) {
+	t.Helper()
+	info := models.NewToken()
+	info.SetClientID("client1")
+	info.SetUserID("user1")
+	info.SetAccess(access)
+	info.SetAccessCreateAt(time.Now())
+	info.SetAccessExpiresIn(time.Hour)
+	info.SetRefresh(refresh)
+	info.SetRefreshCreateAt(time.Now())
+	info.SetRefreshExpiresIn(24 * time.Hour)
+	assert.Nil(t, m.Create(context.Background(), info))
+}
+
+func (m *tokenRepoMock) Create(ctx context.Context, info oauth2.TokenInfo) error {
+	m.mtx.Lock()
+	m.issued = append(m.issued, &models.Token{ // copied, since the oauth2 manager modifies tokens in-place when refreshing
+		ClientID: info.GetClientID(),
+		UserID:   info.GetUserID(),
+		Access:   info.GetAccess(),
+		Refresh:  info.GetRefresh(),
+	})
+	m.mtx.Unlock()
+	return m.TokenStore.Create(ctx, info)
+}
+
+func (m *tokenRepoMock) Rotate(ctx context.Context, refresh string, clientID string, when time.Time) (oauth2.TokenInfo, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	info, err := m.TokenStore.GetByRefresh(ctx, refresh)
+	if err != nil || info == nil || info.GetClientID() != clientID {
+		return nil, err
+	}
+
+	m.rotated[refresh] = [2]string{info.GetClientID(), info.GetUserID()}
+	return info, m.removeRow(ctx, info)
+}
+
+func (m *tokenRepoMock) GetRotated(ctx context.Context, refresh string) (string, string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	entry, ok := m.rotated[refresh]
+	if !ok {
+		return "", "", repository.ErrNotFound
+	}
+	return entry[0], entry[1], nil
+}
+
+// RemoveByAccess & RemoveByRefresh drop both tokens, since they're stored as a single row in postgres
+func (m *tokenRepoMock) RemoveByAccess(ctx context.Context, access string) error {
+	info, err := m.TokenStore.GetByAccess(ctx, access)
+	if err != nil || info == nil {
+		return err
+	}
+	return m.removeRow(ctx, info)
+}
+
+func (m *tokenRepoMock) RemoveByRefresh(ctx context.Context, refresh string) error {
+	info, err := m.TokenStore.GetByRefresh(ctx, refresh)
+	if err != nil || info == nil {
+		return err
+	}
+	return m.removeRow(ctx, info)
+}
+
+func (m *tokenRepoMock) RemoveByClientAndUser(ctx context.Context, clientID string, userID string) error {
+	m.mtx.Lock()
+	issued := append([]oauth2.TokenInfo(nil), m.issued...)
+	m.mtx.Unlock()
+	for _, info := range issued {
+		if info.GetClientID() == clientID && info.GetUserID() == userID {
+			if err := m.removeRow(ctx, info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *tokenRepoMock) removeRow(ctx context.Context, info oauth2.TokenInfo) error {
+	if err := m.TokenStore.RemoveByAccess(ctx, info.GetAccess()); err != nil {
+		return err
+	}
+	return m.TokenStore.RemoveByRefresh(ctx, info.GetRefresh())
+}
+
+var _ repository.OAuth2TokenRepository = (*tokenRepoMock)(nil)
@@ -8,11 +8,12 @@ import (
 
 	"github.com/golang-jwt/jwt"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+	"github.com/mredolatti/tf/codigo/fileserver/signingkeys"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-oauth2/oauth2/v4"
 	"github.com/go-oauth2/oauth2/v4/errors"
-	"github.com/go-oauth2/oauth2/v4/generates"
 	"github.com/go-oauth2/oauth2/v4/manage"
 	"github.com/go-oauth2/oauth2/v4/server"
 )
@@ -26,6 +27,7 @@ var (
 
 const (
 	ctxUser ctxKey = iota + 100
+	ctxRefreshClaim
 
     accessTokenDuration = 24 * time.Hour // 1 day
     refreshTokenDUration = 30 * 24 * time.Hour // 1 month
@@ -35,11 +37,14 @@ const (
 type Interface interface {
 	HandleAuthCodeRequest(ctx *gin.Context) error
 	HandleAuthCodeExchangeRequest(ctx *gin.Context) error
-	HandleTokenRefreshRequest(ctx *gin.Context)
+	HandleTokenRefreshRequest(ctx *gin.Context) error
+	HandleRevocationRequest(ctx *gin.Context) error
+	HandleIntrospectionRequest(ctx *gin.Context) error
 
 	// TODO(mredolatti): mover esto a un compoenente que encapsule todo lo de jwt
 	ValidateAccess(ctx *gin.Context) (string, error)
-	ValidateToken(token string) (*generates.JWTAccessClaims, error)
+	ValidateToken(token string) (*Claims, error)
+	HandleJWKSRequest(ctx *gin.Context) error
 }
 
 // Impl is a wrapper around a set of helpers that handle oauth2 auth code & token requests
@@ -48,9 +53,9 @@ type Impl struct {
 	server      *server.Server
 	userCtxKey  string
 	manager     *manage.Manager
-	tokenStore  oauth2.TokenStore
+	tokenStore  repository.OAuth2TokenRepository
 	clientStore oauth2.ClientStore
-	jwtSecret   []byte
+	access      *accessGenerate
 }
 
 // New constructs a new OAuth2 wrapper
@@ -58,14 +63,15 @@ func New(
 	logger log.Interface,
 	userContextKey string,
 	clientStore oauth2.ClientStore,
-	tokenStore oauth2.TokenStore,
-	jwtSecret []byte,
+	tokenStore repository.OAuth2TokenRepository,
+	signingKeys signingkeys.Interface,
 ) (*Impl, error) {
 
 	manager := manage.NewDefaultManager()
 	manager.MapClientStorage(clientStore)
-	manager.MapTokenStorage(tokenStore)
-	manager.MapAccessGenerate(generates.NewJWTAccessGenerate("", jwtSecret, jwt.SigningMethodHS512))
+	manager.MapTokenStorage(&claimingTokenStore{tokenStore})
+	access := &accessGenerate{keys: signingKeys}
+	manager.MapAccessGenerate(access)
 	manager.SetClientTokenCfg(&manage.Config{
 		AccessTokenExp:    accessTokenDuration,
 		RefreshTokenExp:   refreshTokenDUration,
@@ -76,10 +82,20 @@ func New(
 		RefreshTokenExp:   refreshTokenDUration,
 		IsGenerateRefresh: true,
 	})
+	manager.SetRefreshTokenCfg(&manage.RefreshingConfig{ // every refresh token can only be used once
+		AccessTokenExp:     accessTokenDuration,
+		RefreshTokenExp:    refreshTokenDUration,
+		IsGenerateRefresh:  true,
+		IsResetRefreshTime: true,
+		IsRemoveAccess:     true,
+		IsRemoveRefreshing: true,
+	})
 
 	srv := server.NewDefaultServer(manager)
 	srv.SetAllowGetAccessRequest(true)
 	srv.SetClientInfoHandler(server.ClientFormHandler)
+	srv.SetAuthorizeScopeHandler(authorizeScope)
+	srv.SetRefreshingScopeHandler(refreshingScope)
 	srv.SetInternalErrorHandler(func(err error) (re *errors.Response) {
 		logger.Error("oauth2 internal error: %s", err.Error())
 		return
@@ -101,9 +117,10 @@ func New(
 		logger:      logger,
 		userCtxKey:  userContextKey,
 		manager:     manager,
+		tokenStore:  tokenStore,
 		clientStore: clientStore,
 		server:      srv,
-		jwtSecret:   jwtSecret,
+		access:      access,
 	}, nil
 }
 
@@ -114,6 +131,16 @@ func (o *Impl) HandleAuthCodeRequest(ctx *gin.Context) error {
 		return ErrNoUserInContext
 	}
 
+	if err := o.checkCodeChallenge(ctx.Request); err != nil {
+		o.writeError(ctx, err)
+		return fmt.Errorf("error validating pkce parameters: %w", err)
+	}
+
+	if _, err := normalizeScope(ctx.Request.FormValue("scope")); err != nil {
+		o.writeError(ctx, err)
+		return fmt.Errorf("error validating requested scope: %w", err)
+	}
+
 	ctxWithUser := context.WithValue(ctx.Request.Context(), ctxUser, user)
 	if err := o.server.HandleAuthorizeRequest(ctx.Writer, ctx.Request.WithContext(ctxWithUser)); err != nil {
 		return fmt.Errorf("error handling auth code request: %w", err)
@@ -124,6 +151,20 @@ func (o *Impl) HandleAuthCodeRequest(ctx *gin.Context) error {
 
 // HandleAuthCodeExchangeRequest handles exchanging an authorization code for a token
 func (o *Impl) HandleAuthCodeExchangeRequest(ctx *gin.Context) error {
+	if clientCertificate(ctx.Request) == nil { // issued tokens are bound to it
+		o.writeError(ctx, errors.ErrInvalidClient)
+		return ErrNoClientCertificate
+	}
+
+	if oauth2.GrantType(ctx.Request.FormValue("grant_type")) == oauth2.Refreshing {
+		return o.HandleTokenRefreshRequest(ctx)
+	}
+
+	if err := o.checkCodeVerifier(ctx.Request); err != nil {
+		o.writeError(ctx, err)
+		return fmt.Errorf("error validating pkce parameters: %w", err)
+	}
+
 	err := o.server.HandleTokenRequest(ctx.Writer, ctx.Request)
 	if err != nil {
 		return fmt.Errorf("error exchanging auth code for token: %w", err)
@@ -131,10 +172,6 @@ func (o *Impl) HandleAuthCodeExchangeRequest(ctx *gin.Context) error {
 	return nil
 }
 
-// HandleTokenRefreshRequest TODO
-func (o *Impl) HandleTokenRefreshRequest(ctx *gin.Context) {
-}
-
 // ValidateAccess verifies the token supplied in the requests and either accepts it or rejects it
 func (o *Impl) ValidateAccess(ctx *gin.Context) (string, error) {
 	info, err := o.server.ValidationBearerToken(ctx.Request)
@@ -146,21 +183,14 @@ func (o *Impl) ValidateAccess(ctx *gin.Context) (string, error) {
 }
 
 // ValidateToken parses and verifies a token in string form
-func (o *Impl) ValidateToken(token string) (*generates.JWTAccessClaims, error) {
-	parsed, err := jwt.ParseWithClaims(token, &generates.JWTAccessClaims{}, func(token *jwt.Token) (interface{}, error) {
-		_, ok := token.Method.(*jwt.SigningMethodHMAC)
-		if !ok {
-			return nil, fmt.Errorf("invalid signature method")
-		}
-
-		return o.jwtSecret, nil
-	})
+func (o *Impl) ValidateToken(token string) (*Claims, error) {
+	parsed, err := jwt.ParseWithClaims(token, &Claims{}, o.access.verificationKey)
 
 	if err != nil {
 		return nil, fmt.Errorf("invalid token: %w", err)
 	}
 
-	claims, ok := parsed.Claims.(*generates.JWTAccessClaims)
+	claims, ok := parsed.Claims.(*Claims)
 	if !ok {
 		return nil, fmt.Errorf("invalid claims")
 	}
@@ -168,4 +198,11 @@ func (o *Impl) ValidateToken(token string) (*generates.JWTAccessClaims, error) {
 	return claims, nil
 }
 
+// HandleJWKSRequest publishes the public keys that can be used to verify access tokens
+func (o *Impl) HandleJWKSRequest(ctx *gin.Context) error {
+	ctx.Header("Cache-Control", "max-age=300")
+	ctx.JSON(http.StatusOK, o.access.keys.JWKS())
+	return nil
+}
+
 var _ Interface = (*Impl)(nil)
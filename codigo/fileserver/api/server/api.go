@@ -5,24 +5,29 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	"github.com/mredolatti/tf/codigo/common/is2fs"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/common/metrics"
+	"github.com/mredolatti/tf/codigo/common/ratelimit"
+	"github.com/mredolatti/tf/codigo/common/revocation"
 	"github.com/mredolatti/tf/codigo/fileserver/api/oauth2"
 	"github.com/mredolatti/tf/codigo/fileserver/api/server/control"
 	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
 
 // Options to configure server-side gRPC API
 type Options struct {
-	Logger                   log.Interface
-	Port                     int
-	FileManager              filemanager.Interface
-	ServerCertificateChainFN string
-	ServerPrivateKeyFN       string
-	RootCAFn                 string
-	OAuth2Wrapper            oauth2.Interface
+	Logger        log.Interface
+	Port          int
+	FileManager   filemanager.Interface
+	Certificates  certmanager.Interface
+	OAuth2Wrapper oauth2.Interface
+	Revocation    revocation.Interface // optional
+	RateLimiter   ratelimit.Interface  // applied to SyncUser calls, by user
 }
 
 // ServerAPI is the gRPC server
@@ -35,11 +40,6 @@ type ServerAPI struct {
 // New constructs a new server-side API
 func New(options *Options) (*ServerAPI, error) {
 
-	credentials, err := parseTLSCredentials(options)
-	if err != nil {
-		return nil, fmt.Errorf("failed to build TLS credentials: %w", err)
-	}
-
 	controlServer, err := control.New(options.Logger, options.FileManager)
 	if err != nil {
 		return nil, fmt.Errorf("error instantiating control server: %w", err)
@@ -48,9 +48,10 @@ func New(options *Options) (*ServerAPI, error) {
 	auth := newAuthInterceptor(options.Logger, options.OAuth2Wrapper)
 
 	server := grpc.NewServer(
-		grpc.Creds(credentials),
-		grpc.UnaryInterceptor(auth.Unary()),
-		grpc.StreamInterceptor(auth.Stream()),
+		grpc.Creds(tlsCredentials(options)),
+		grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), auth.Unary()),
+		grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(), metrics.StreamServerInterceptor(), auth.Stream(),
+			ratelimit.StreamServerInterceptor(options.RateLimiter, userFromContext)),
 	)
 	is2fs.RegisterFileRefSyncServer(server, controlServer)
 
@@ -71,14 +72,16 @@ func (s *ServerAPI) Start() error {
 	return s.server.Serve(lis)
 }
 
-func parseTLSCredentials(options *Options) (credentials.TransportCredentials, error) {
-	serverCert, err := tls.LoadX509KeyPair(options.ServerCertificateChainFN, options.ServerPrivateKeyFN)
-	if err != nil {
-		return nil, err
+func tlsCredentials(options *Options) credentials.TransportCredentials {
+	// clients must present a certificate, which access tokens are bound to
+	tlsConfig := &tls.Config{
+		NextProtos: []string{"h2"},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+
+	if options.Revocation != nil {
+		tlsConfig.VerifyPeerCertificate = revocation.VerifyPeerCertificate(options.Revocation)
 	}
 
-	return credentials.NewTLS(&tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		ClientAuth:   tls.NoClientCert,
-	}), nil
+	return credentials.NewTLS(options.Certificates.ServerConfig(tlsConfig))
 }
@@ -0,0 +1,43 @@
+package control
+
+import (
+	"sync"
+
+	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queues = &queueSet{}
+
+	// the depth is read when scraped, so that it reflects changes drained from the queues as well
+	queueDepth = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "fileserver",
+		Name:      "listener_queue_depth",
+		Help:      "Number of file changes waiting to be forwarded to subscribers",
+	}, queues.depth)
+)
+
+// queueSet keeps track of the incoming-changes queue of every control server constructed
+type queueSet struct {
+	queues []chan filemanager.Change
+	mtx    sync.Mutex
+}
+
+func (s *queueSet) add(queue chan filemanager.Change) {
+	s.mtx.Lock()
+	s.queues = append(s.queues, queue)
+	s.mtx.Unlock()
+}
+
+func (s *queueSet) depth() float64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var depth int
+	for _, queue := range s.queues {
+		depth += len(queue)
+	}
+	return float64(depth)
+}
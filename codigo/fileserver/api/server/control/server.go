@@ -34,6 +34,7 @@ func New(logger log.Interface, manager filemanager.Interface) (*Server, error) {
 		incomingChanges: make(chan filemanager.Change, defaultQueueSize),
 	}
 
+	queues.add(server.incomingChanges)
 	manager.AddListener(func(c filemanager.Change) {
 		server.incomingChanges <- c
 	})
@@ -49,20 +50,33 @@ func (c *Server) SyncUser(request *is2fs.SyncUserRequest, stream is2fs.FileRefSy
 		return ErrNoUser
 	}
 
-	forUser, err := c.manager.ListFileMetadata(user, &filemanager.ListQuery{UpdatedAfter: refutil.Ref(request.GetCheckpoint())})
+	logger := c.logger.Ctx(stream.Context())
+	forUser, err := c.manager.ListFileMetadata(stream.Context(), user, &filemanager.ListQuery{UpdatedAfter: refutil.Ref(request.GetCheckpoint())})
 	if err != nil {
+		logger.Log(log.Error, "error listing files to sync", "checkpoint", request.GetCheckpoint(), "err", err)
 		return fmt.Errorf("error getting files for user %s: %w", request.GetUserID(), err)
 	}
 
 	for idx := range forUser {
-		stream.Send(&is2fs.Update{
+		changeType := is2fs.ChangeType_FileChangeUpdate
+		if forUser[idx].Deleted() {
+			changeType = is2fs.ChangeType_FileChangeDelete
+		}
+
+		err := stream.Send(&is2fs.Update{
 			FileReference: forUser[idx].ID(),
-			ChangeType:    is2fs.ChangeType_FileChangeUpdate,
+			ChangeType:    changeType,
 			Checkpoint:    forUser[idx].LastUpdated(),
 			SizeBytes:     forUser[idx].SizeBytes(),
 		})
+		if err != nil {
+			logger.Log(log.Error, "error sending update", "file", forUser[idx].ID(), "err", err)
+			return fmt.Errorf("error sending update for file %s: %w", forUser[idx].ID(), err)
+		}
 	}
 
+	logger.Log(log.Debug, "sent updates", "checkpoint", request.GetCheckpoint(), "updates", len(forUser))
+
 	// TODO(mredolatti): Implement subscription mechanism
 	// - We need a MUX that parses incoming changes, checks if theres a subscription for the affected user,
 	//   and queues the messages
@@ -0,0 +1,54 @@
+package control
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mredolatti/tf/codigo/common/dtos"
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
+	authzBasic "github.com/mredolatti/tf/codigo/fileserver/authz/basic"
+	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+	"github.com/mredolatti/tf/codigo/fileserver/storage/basic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueDepth(t *testing.T) {
+	logger, _ := log.New(io.Discard, log.None)
+	authorization := authzBasic.NewInMemoryAuthz()
+	authorization.Grant("martin", authz.OperationCreate, authz.AnyObject)
+	fm := filemanager.New(basic.NewInMemoryFileStore(), basic.NewInMemoryFileMetadataStore(), authorization)
+
+	server, err := New(logger, fm)
+	assert.Nil(t, err)
+
+	depth := func(expected string) error {
+		return testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(`
+# HELP fileserver_listener_queue_depth Number of file changes waiting to be forwarded to subscribers
+# TYPE fileserver_listener_queue_depth gauge
+fileserver_listener_queue_depth `+expected+"\n"), "fileserver_listener_queue_depth")
+	}
+
+	for _, name := range []string{"f1", "f2"} {
+		_, err := fm.CreateFileMetadata(context.Background(), "martin", &dtos.FileMetadata{PName: name})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, depth("2"))
+
+	// draining the queue is reflected without further changes
+	<-server.incomingChanges
+	assert.Nil(t, depth("1"))
+
+	// constructing another server doesn't register the gauge again, the depth covers both queues
+	other := filemanager.New(basic.NewInMemoryFileStore(), basic.NewInMemoryFileMetadataStore(), authorization)
+	_, err = New(logger, other)
+	assert.Nil(t, err)
+	_, err = other.CreateFileMetadata(context.Background(), "martin", &dtos.FileMetadata{PName: "f3"})
+	assert.Nil(t, err)
+	assert.Nil(t, depth("2"))
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
 
@@ -10,7 +11,9 @@ import (
 	"github.com/mredolatti/tf/codigo/fileserver/api/oauth2"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
@@ -22,8 +25,14 @@ type authInterceptor struct {
 var (
 	errNoMetadata      = errors.New("no metadata in context")
 	errNoAuthorization = errors.New("no authorization in metadata")
+	errNoCertificate   = errors.New("no client certificate in connection")
 )
 
+// methodScopes maps each rpc method to the scope a token must carry to invoke it. methods not listed are rejected
+var methodScopes = map[string]string{
+	"/FileRefSync/SyncUser": oauth2.ScopeSync,
+}
+
 func newAuthInterceptor(logger log.Interface, oauth2Wrapper oauth2.Interface) *authInterceptor {
 	return &authInterceptor{
 		oauth2Wrapper: oauth2Wrapper,
@@ -33,7 +42,7 @@ func newAuthInterceptor(logger log.Interface, oauth2Wrapper oauth2.Interface) *a
 
 func (a *authInterceptor) Unary() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
-		if _, err := a.validate(ctx); err != nil { // TODO(user validation)
+		if _, _, err := a.validate(ctx, info.FullMethod); err != nil { // TODO(user validation)
 			return nil, fmt.Errorf("error validating token in incoming rpc: %w", err)
 		}
 		return handler(ctx, req)
@@ -42,44 +51,74 @@ func (a *authInterceptor) Unary() grpc.UnaryServerInterceptor {
 
 func (a *authInterceptor) Stream() grpc.StreamServerInterceptor {
 	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		user, err := a.validate(ss.Context())
+		user, caller, err := a.validate(ss.Context(), info.FullMethod)
 		if err != nil {
 			return fmt.Errorf("error validating token in incoming rpc: %w", err)
 		}
 
 		// TODO(mredolatti): mover esto a un package separado y usar una key para guardar el user
-		return handler(srv, wrapServerStream(ss, context.WithValue(ss.Context(), "user", user)))
+		ctx := log.WithFields(ss.Context(), log.KeyUser, user, log.KeyServer, caller)
+		return handler(srv, wrapServerStream(ss, context.WithValue(ctx, "user", user)))
 	}
 }
 
-func (a *authInterceptor) validate(ctx context.Context) (string, error) {
+// validate checks the token & certificate presented in an incoming rpc, returning the user the token was issued
+// for & the common name of the calling server
+func (a *authInterceptor) validate(ctx context.Context, method string) (string, string, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return "", errNoMetadata
+		return "", "", errNoMetadata
 	}
 
 	values := md["authorization"]
 	if len(values) == 0 {
-		return "", status.Errorf(codes.Unauthenticated, "missing metadata")
+		return "", "", status.Errorf(codes.Unauthenticated, "missing metadata")
 	}
 
-	user, err := a.verifyJWT(values[0])
+	claims, err := a.oauth2Wrapper.ValidateToken(values[0])
 	if err != nil {
-		return "", fmt.Errorf("error getting user: %w", err)
+		return "", "", fmt.Errorf("error validating incoming jwt: %w", err)
+	}
+
+	cert, err := clientCertificate(ctx)
+	if err != nil {
+		return "", "", status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	logger := a.logger.Ctx(log.WithFields(ctx, log.KeyUser, claims.Subject, log.KeyServer, cert.Subject.CommonName))
+	if !claims.BoundTo(cert) {
+		logger.Log(log.Warning, "rejecting token presented with a certificate it was not issued to")
+		return "", "", status.Errorf(codes.Unauthenticated, "token not bound to client certificate")
 	}
 
-	// TODO(mredolatti): validar que el subject del token este en los SAN del client cert
+	required, ok := methodScopes[method]
+	if !ok || !claims.HasScope(required) {
+		logger.Log(log.Warning, "rejecting call with insufficient scope", "method", method, "scope", claims.Scope)
+		return "", "", status.Errorf(codes.PermissionDenied, "insufficient scope")
+	}
 
-	return user, nil
+	return claims.Subject, cert.Subject.CommonName, nil
 }
 
-func (a *authInterceptor) verifyJWT(token string) (user string, err error) {
-	claims, err := a.oauth2Wrapper.ValidateToken(token)
-	if err != nil {
-		return "", fmt.Errorf("error validating incoming jwt: %w", err)
+// userFromContext returns the subject of the token validated by the auth interceptor
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value("user").(string)
+	return user
+}
+
+// clientCertificate returns the leaf certificate presented by the peer when establishing the connection
+func clientCertificate(ctx context.Context) (*x509.Certificate, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, errNoCertificate
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil, errNoCertificate
 	}
 
-	return claims.Subject, nil
+	return tlsInfo.State.PeerCertificates[0], nil
 }
 
 type tokenTag struct{}
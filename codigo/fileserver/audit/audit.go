@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/mredolatti/tf/codigo/fileserver/hashchain"
+)
+
+// Operations
+const (
+	OperationList            = "list"
+	OperationGet             = "get"
+	OperationCreate          = "create"
+	OperationUpdate          = "update"
+	OperationDelete          = "delete"
+	OperationReadContents    = "read_contents"
+	OperationWriteContents   = "write_contents"
+	OperationDeleteContents  = "delete_contents"
+	OperationGrant           = "grant"
+	OperationRevoke          = "revoke"
+	OperationEmergencyAccess = "emergency_access"
+	OperationCreateShareLink = "create_share_link"
+	OperationRevokeShareLink = "revoke_share_link"
+)
+
+// Outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeError   = "error"
+)
+
+// Record contains the information of a single operation performed on the file server
+type Record struct {
+	Timestamp int64  `json:"timestamp"`
+	Operation string `json:"operation"`
+	User      string `json:"user"`
+	FileID    string `json:"fileId,omitempty"`
+	PatientID string `json:"patientId,omitempty"`
+	ClientCN  string `json:"clientCN,omitempty"`
+	Outcome   string `json:"outcome"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// Entry is a record as stored in the log, along with the values that chain it to the previous one
+type Entry struct {
+	Seq      uint64 `json:"seq"`
+	Hash     string `json:"hash"`
+	PrevHash string `json:"prevHash"`
+	Record   Record `json:"record"`
+}
+
+// Query has optional fields used to narrow down the records returned
+type Query struct {
+	User      *string
+	FileID    *string
+	PatientID *string
+	Operation *string
+	From      *int64
+	To        *int64
+	Limit     int
+}
+
+func (q *Query) matches(r *Record) bool {
+	switch {
+	case q.User != nil && *q.User != r.User,
+		q.FileID != nil && *q.FileID != r.FileID,
+		q.PatientID != nil && *q.PatientID != r.PatientID,
+		q.Operation != nil && *q.Operation != r.Operation,
+		q.From != nil && r.Timestamp < *q.From,
+		q.To != nil && r.Timestamp > *q.To:
+		return false
+	}
+	return true
+}
+
+// Interface defines the set of methods to record & review audit records
+type Interface interface {
+	Record(record *Record) error
+	Query(query *Query) ([]Entry, error)
+	Export(w io.Writer) error
+}
+
+// Impl is an audit log backed by an append-only hash-chained file
+type Impl struct {
+	log *hashchain.Log
+}
+
+// New constructs a new audit log
+func New(log *hashchain.Log) *Impl {
+	return &Impl{log: log}
+}
+
+// Record appends a new record to the log
+func (i *Impl) Record(record *Record) error {
+	if _, err := i.log.Append(record); err != nil {
+		return fmt.Errorf("error appending audit record: %w", err)
+	}
+	return nil
+}
+
+// Query verifies the log and returns the entries matching the query in chronological order
+func (i *Impl) Query(query *Query) ([]Entry, error) {
+	if query == nil {
+		query = &Query{}
+	}
+
+	var result []Entry
+	err := i.log.ForEach(func(e *hashchain.Entry) error {
+		var record Record
+		if err := e.Decode(&record); err != nil {
+			return fmt.Errorf("error parsing audit entry %d: %w", e.Seq, err)
+		}
+
+		if query.matches(&record) {
+			result = append(result, Entry{Seq: e.Seq, Hash: e.Hash, PrevHash: e.PrevHash, Record: record})
+		}
+
+		if query.Limit > 0 && len(result) > query.Limit {
+			result = result[1:] // keep the latest `limit` entries
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading audit log: %w", err)
+	}
+
+	return result, nil
+}
+
+// Export writes the full log in its raw, verifiable form
+func (i *Impl) Export(w io.Writer) error {
+	return i.log.Export(w)
+}
+
+type ctxKeyClientCN struct{}
+
+// WithClientCN returns a context carrying the common name of the client certificate used in a request
+func WithClientCN(ctx context.Context, cn string) context.Context {
+	return context.WithValue(ctx, ctxKeyClientCN{}, cn)
+}
+
+// ClientCNFromContext returns the client certificate common name stored in the context, if any
+func ClientCNFromContext(ctx context.Context) string {
+	cn, _ := ctx.Value(ctxKeyClientCN{}).(string)
+	return cn
+}
+
+var _ Interface = (*Impl)(nil)
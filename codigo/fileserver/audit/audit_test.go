@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mredolatti/tf/codigo/common/refutil"
+	"github.com/mredolatti/tf/codigo/fileserver/hashchain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditQuery(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "audit_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := hashchain.Open(path.Join(dir, "audit.log"))
+	assert.Nil(t, err)
+	defer l.Close()
+
+	a := New(l)
+	assert.Nil(t, a.Record(&Record{Timestamp: 1, Operation: OperationGet, User: "martin", FileID: "f1", PatientID: "p1", Outcome: OutcomeSuccess}))
+	assert.Nil(t, a.Record(&Record{Timestamp: 2, Operation: OperationReadContents, User: "pedro", FileID: "f1", PatientID: "p1", Outcome: OutcomeDenied}))
+	assert.Nil(t, a.Record(&Record{Timestamp: 3, Operation: OperationGet, User: "martin", FileID: "f2", PatientID: "p2", Outcome: OutcomeSuccess}))
+	assert.Nil(t, a.Record(&Record{Timestamp: 4, Operation: OperationDelete, User: "martin", FileID: "f1", PatientID: "p1", Outcome: OutcomeSuccess}))
+
+	all, err := a.Query(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(all))
+	assert.Equal(t, all[0].Hash, all[1].PrevHash)
+
+	byUser, err := a.Query(&Query{User: refutil.Ref("martin")})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(byUser))
+
+	byPatient, err := a.Query(&Query{PatientID: refutil.Ref("p1"), From: refutil.Ref(int64(2))})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(byPatient))
+	assert.Equal(t, OperationReadContents, byPatient[0].Record.Operation)
+	assert.Equal(t, OutcomeDenied, byPatient[0].Record.Outcome)
+
+	latest, err := a.Query(&Query{FileID: refutil.Ref("f1"), Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(latest))
+	assert.Equal(t, OperationDelete, latest[0].Record.Operation)
+
+	var exported bytes.Buffer
+	assert.Nil(t, a.Export(&exported))
+	assert.Nil(t, hashchain.Verify(&exported, nil))
+}
@@ -0,0 +1,241 @@
+package breakglass
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/hashchain"
+)
+
+const (
+	defaultWindow = 1 * time.Hour
+
+	minJustificationLength = 10
+)
+
+// Event types recorded in the trail
+const (
+	EventGranted  = "granted"
+	EventAccessed = "accessed"
+)
+
+// Public errors
+var (
+	ErrJustificationRequired = errors.New("a justification is required for emergency access")
+	ErrNoTrail               = errors.New("an audit trail is required for emergency access")
+)
+
+// Grant represents an emergency access to a file for a user, valid within a limited window
+type Grant struct {
+	ID            string `json:"id"`
+	User          string `json:"user"`
+	FileID        string `json:"fileId"`
+	Justification string `json:"justification"`
+	GrantedAt     int64  `json:"grantedAt"`
+	ExpiresAt     int64  `json:"expiresAt"`
+}
+
+// Expired returns true if the grant is no longer valid at the specified point in time
+func (g *Grant) Expired(now time.Time) bool {
+	return now.UnixNano() >= g.ExpiresAt
+}
+
+// Event is the record written to the audit trail, either when a grant is issued or used
+type Event struct {
+	Type      string `json:"type"`
+	Grant     Grant  `json:"grant"`
+	Operation string `json:"operation,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Notifier is implemented by components that report break-glass events to designated admins
+type Notifier interface {
+	Notify(event *Event, admins []string) error
+}
+
+// Interface defines the set of operations to issue, check & review emergency accesses
+type Interface interface {
+	Open(user string, fileID string, justification string) (*Grant, error)
+	Active(user string, fileID string) (*Grant, bool)
+	RecordAccess(grant *Grant, operation string) error
+	Events() ([]Event, error)
+	IsAdmin(user string) bool
+}
+
+// Config contains parameters to set up the break-glass component
+type Config struct {
+	Logger    log.Interface
+	Trail     *hashchain.Log
+	Window    time.Duration
+	Admins    []string
+	Notifiers []Notifier
+}
+
+// Impl is an implementation of the break-glass component, backed by a hash-chained trail
+type Impl struct {
+	logger    log.Interface
+	trail     *hashchain.Log
+	window    time.Duration
+	admins    []string
+	notifiers []Notifier
+	active    map[string]Grant
+	mtx       sync.Mutex
+}
+
+// New constructs a new break-glass component, restoring still-valid grants from the trail
+func New(cfg *Config) (*Impl, error) {
+	if cfg.Trail == nil {
+		return nil, ErrNoTrail
+	}
+
+	window := cfg.Window
+	if window <= 0 {
+		window = defaultWindow
+	}
+
+	i := &Impl{
+		logger:    cfg.Logger,
+		trail:     cfg.Trail,
+		window:    window,
+		admins:    cfg.Admins,
+		notifiers: cfg.Notifiers,
+		active:    make(map[string]Grant),
+	}
+
+	now := time.Now()
+	err := i.trail.ForEach(func(e *hashchain.Entry) error {
+		var event Event
+		if err := e.Decode(&event); err != nil {
+			return fmt.Errorf("error parsing trail entry %d: %w", e.Seq, err)
+		}
+		if event.Type == EventGranted && !event.Grant.Expired(now) {
+			i.active[makeKey(event.Grant.User, event.Grant.FileID)] = event.Grant
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error restoring grants from trail: %w", err)
+	}
+
+	return i, nil
+}
+
+// Open issues a new emergency grant for a user on a file
+func (i *Impl) Open(user string, fileID string, justification string) (*Grant, error) {
+	justification = strings.TrimSpace(justification)
+	if len(justification) < minJustificationLength {
+		return nil, ErrJustificationRequired
+	}
+
+	id, err := newGrantID()
+	if err != nil {
+		return nil, fmt.Errorf("error generating grant id: %w", err)
+	}
+
+	now := time.Now()
+	grant := Grant{
+		ID:            id,
+		User:          user,
+		FileID:        fileID,
+		Justification: justification,
+		GrantedAt:     now.UnixNano(),
+		ExpiresAt:     now.Add(i.window).UnixNano(),
+	}
+
+	event := &Event{Type: EventGranted, Grant: grant, Timestamp: grant.GrantedAt}
+	if _, err := i.trail.Append(event); err != nil {
+		return nil, fmt.Errorf("error recording grant in trail: %w", err)
+	}
+
+	i.mtx.Lock()
+	i.active[makeKey(user, fileID)] = grant
+	i.mtx.Unlock()
+
+	i.notify(event)
+	return &grant, nil
+}
+
+// Active returns the currently valid grant for a user on a file, if any
+func (i *Impl) Active(user string, fileID string) (*Grant, bool) {
+	key := makeKey(user, fileID)
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	grant, ok := i.active[key]
+	if !ok {
+		return nil, false
+	}
+
+	if grant.Expired(time.Now()) {
+		delete(i.active, key)
+		return nil, false
+	}
+
+	return &grant, true
+}
+
+// RecordAccess adds an entry to the trail for an operation performed under an emergency grant
+func (i *Impl) RecordAccess(grant *Grant, operation string) error {
+	event := &Event{Type: EventAccessed, Grant: *grant, Operation: operation, Timestamp: time.Now().UnixNano()}
+	if _, err := i.trail.Append(event); err != nil {
+		return fmt.Errorf("error recording access in trail: %w", err)
+	}
+
+	i.notify(event)
+	return nil
+}
+
+// Events returns every event in the trail after verifying its integrity
+func (i *Impl) Events() ([]Event, error) {
+	var events []Event
+	err := i.trail.ForEach(func(e *hashchain.Entry) error {
+		var event Event
+		if err := e.Decode(&event); err != nil {
+			return fmt.Errorf("error parsing trail entry %d: %w", e.Seq, err)
+		}
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// IsAdmin returns true if the user is one of the designated admins that review emergency accesses
+func (i *Impl) IsAdmin(user string) bool {
+	for _, admin := range i.admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Impl) notify(event *Event) {
+	for _, notifier := range i.notifiers {
+		if err := notifier.Notify(event, i.admins); err != nil {
+			i.logger.Error("error notifying break-glass event for grant %s: %s", event.Grant.ID, err)
+		}
+	}
+}
+
+func makeKey(user string, fileID string) string {
+	return user + "::" + fileID
+}
+
+func newGrantID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+var _ Interface = (*Impl)(nil)
@@ -0,0 +1,140 @@
+package breakglass
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/hashchain"
+	"github.com/stretchr/testify/assert"
+)
+
+type notifierMock struct {
+	mtx    sync.Mutex
+	events []Event
+	admins [][]string
+}
+
+func (n *notifierMock) Notify(event *Event, admins []string) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.events = append(n.events, *event)
+	n.admins = append(n.admins, admins)
+	return nil
+}
+
+func setupBreakGlass(t *testing.T, fn string, window time.Duration) (*Impl, *notifierMock) {
+	t.Helper()
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+	trail, err := hashchain.Open(fn)
+	assert.Nil(t, err)
+	t.Cleanup(func() { trail.Close() })
+
+	notifier := &notifierMock{}
+	bg, err := New(&Config{Logger: logger, Trail: trail, Window: window, Admins: []string{"admin"}, Notifiers: []Notifier{notifier}})
+	assert.Nil(t, err)
+	return bg, notifier
+}
+
+func TestOpen(t *testing.T) {
+	bg, notifier := setupBreakGlass(t, filepath.Join(t.TempDir(), "trail"), time.Hour)
+
+	_, err := bg.Open("martin", "f1", "  short   ")
+	assert.ErrorIs(t, err, ErrJustificationRequired)
+	_, ok := bg.Active("martin", "f1")
+	assert.False(t, ok)
+
+	grant, err := bg.Open("martin", "f1", "patient arrived unconscious")
+	assert.Nil(t, err)
+	assert.Equal(t, "martin", grant.User)
+	assert.Equal(t, "f1", grant.FileID)
+	assert.InDelta(t, time.Hour, time.Duration(grant.ExpiresAt-grant.GrantedAt), float64(time.Millisecond))
+
+	active, ok := bg.Active("martin", "f1")
+	assert.True(t, ok)
+	assert.Equal(t, grant.ID, active.ID)
+
+	// grants are scoped to a single user & file
+	_, ok = bg.Active("martin", "f2")
+	assert.False(t, ok)
+	_, ok = bg.Active("someone", "f1")
+	assert.False(t, ok)
+
+	// admins are told about every grant
+	assert.Len(t, notifier.events, 1)
+	assert.Equal(t, EventGranted, notifier.events[0].Type)
+	assert.Equal(t, grant.ID, notifier.events[0].Grant.ID)
+	assert.Equal(t, []string{"admin"}, notifier.admins[0])
+}
+
+func TestActiveExpires(t *testing.T) {
+	bg, _ := setupBreakGlass(t, filepath.Join(t.TempDir(), "trail"), 20*time.Millisecond)
+
+	_, err := bg.Open("martin", "f1", "patient arrived unconscious")
+	assert.Nil(t, err)
+	_, ok := bg.Active("martin", "f1")
+	assert.True(t, ok)
+
+	time.Sleep(40 * time.Millisecond)
+	_, ok = bg.Active("martin", "f1")
+	assert.False(t, ok)
+}
+
+func TestRestoreFromTrail(t *testing.T) {
+	_, err := New(&Config{})
+	assert.ErrorIs(t, err, ErrNoTrail)
+
+	fn := filepath.Join(t.TempDir(), "trail")
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+	trail, err := hashchain.Open(fn)
+	assert.Nil(t, err)
+	bg, err := New(&Config{Logger: logger, Trail: trail})
+	assert.Nil(t, err)
+
+	grant, err := bg.Open("martin", "f1", "patient arrived unconscious")
+	assert.Nil(t, err)
+
+	expired := Grant{ID: "g0", User: "martin", FileID: "f2", GrantedAt: time.Now().Add(-2 * time.Hour).UnixNano(), ExpiresAt: time.Now().Add(-time.Hour).UnixNano()}
+	_, err = trail.Append(&Event{Type: EventGranted, Grant: expired, Timestamp: expired.GrantedAt})
+	assert.Nil(t, err)
+	assert.Nil(t, trail.Close())
+
+	// still-valid grants survive a restart, expired ones don't
+	restored, _ := setupBreakGlass(t, fn, time.Hour)
+	active, ok := restored.Active("martin", "f1")
+	assert.True(t, ok)
+	assert.Equal(t, grant.ID, active.ID)
+	_, ok = restored.Active("martin", "f2")
+	assert.False(t, ok)
+}
+
+func TestRecordAccess(t *testing.T) {
+	bg, notifier := setupBreakGlass(t, filepath.Join(t.TempDir(), "trail"), time.Hour)
+
+	grant, err := bg.Open("martin", "f1", "patient arrived unconscious")
+	assert.Nil(t, err)
+	assert.Nil(t, bg.RecordAccess(grant, "get"))
+
+	events, err := bg.Events()
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, EventGranted, events[0].Type)
+	assert.Equal(t, EventAccessed, events[1].Type)
+	assert.Equal(t, grant.ID, events[1].Grant.ID)
+	assert.Equal(t, "get", events[1].Operation)
+
+	assert.Len(t, notifier.events, 2)
+	assert.Equal(t, EventAccessed, notifier.events[1].Type)
+}
+
+func TestIsAdmin(t *testing.T) {
+	bg, _ := setupBreakGlass(t, filepath.Join(t.TempDir(), "trail"), time.Hour)
+	assert.True(t, bg.IsAdmin("admin"))
+	assert.False(t, bg.IsAdmin("martin"))
+	assert.False(t, bg.IsAdmin(""))
+}
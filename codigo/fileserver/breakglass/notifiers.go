@@ -0,0 +1,112 @@
+package breakglass
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+)
+
+const (
+	defaultNotificationTimeout = 10 * time.Second
+	defaultNotificationQueue   = 100
+)
+
+// ErrNotificationQueueFull is returned when a notification is dropped because too many are pending delivery
+var ErrNotificationQueueFull = errors.New("notification queue full")
+
+// LogNotifier reports break-glass events as warnings in the server log
+type LogNotifier struct {
+	logger log.Interface
+}
+
+// NewLogNotifier constructs a new log-based notifier
+func NewLogNotifier(logger log.Interface) *LogNotifier {
+	return &LogNotifier{logger: logger}
+}
+
+// Notify implements Notifier
+func (n *LogNotifier) Notify(event *Event, admins []string) error {
+	n.logger.Warning(
+		"break-glass %s: user=%s file=%s grant=%s operation=%s justification=%q (admins: %s)",
+		event.Type, event.Grant.User, event.Grant.FileID, event.Grant.ID, event.Operation,
+		event.Grant.Justification, strings.Join(admins, ","),
+	)
+	return nil
+}
+
+// HTTPNotifier posts break-glass events as JSON to a URL (ie: a mail or paging relay).
+// Notifications are queued & delivered in the background, so that a slow relay doesn't hold up the
+// request that opened or used the grant
+type HTTPNotifier struct {
+	url    string
+	client http.Client
+	logger log.Interface
+	queue  chan []byte
+}
+
+// NewHTTPNotifier constructs a new http-based notifier and starts delivering queued notifications
+func NewHTTPNotifier(url string, logger log.Interface) *HTTPNotifier {
+	n := &HTTPNotifier{
+		url:    url,
+		client: http.Client{Timeout: defaultNotificationTimeout},
+		logger: logger,
+		queue:  make(chan []byte, defaultNotificationQueue),
+	}
+	go n.deliver()
+	return n
+}
+
+// Notify implements Notifier
+func (n *HTTPNotifier) Notify(event *Event, admins []string) error {
+	body, err := json.Marshal(notificationDTO{Event: event, Admins: admins})
+	if err != nil {
+		return fmt.Errorf("error serializing notification: %w", err)
+	}
+
+	select {
+	case n.queue <- body:
+		return nil
+	default:
+		return ErrNotificationQueueFull
+	}
+}
+
+// Close stops delivering notifications once the ones already queued have been posted
+func (n *HTTPNotifier) Close() {
+	close(n.queue)
+}
+
+func (n *HTTPNotifier) deliver() {
+	for body := range n.queue {
+		if err := n.post(body); err != nil {
+			n.logger.Error("error posting break-glass notification to %s: %s", n.url, err)
+		}
+	}
+}
+
+func (n *HTTPNotifier) post(body []byte) error {
+	response, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error posting notification: %w", err)
+	}
+	defer response.Body.Close()
+
+	if c := response.StatusCode; c < 200 || c >= 300 {
+		return fmt.Errorf("non-2xx (%d) status code returned", c)
+	}
+	return nil
+}
+
+type notificationDTO struct {
+	Event  *Event   `json:"event"`
+	Admins []string `json:"admins"`
+}
+
+var _ Notifier = (*LogNotifier)(nil)
+var _ Notifier = (*HTTPNotifier)(nil)
@@ -0,0 +1,55 @@
+package breakglass
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPNotifierDoesNotBlock(t *testing.T) {
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+
+	release := make(chan struct{})
+	received := make(chan notificationDTO, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // a slow relay
+		var dto notificationDTO
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&dto))
+		received <- dto
+	}))
+	defer server.Close()
+
+	notifier := NewHTTPNotifier(server.URL, logger)
+	defer notifier.Close()
+
+	event := &Event{Type: EventGranted, Grant: Grant{ID: "g1", User: "martin", FileID: "f1"}}
+	start := time.Now()
+	assert.Nil(t, notifier.Notify(event, []string{"admin"}))
+	assert.Less(t, time.Since(start), time.Second)
+
+	close(release)
+	select {
+	case dto := <-received:
+		assert.Equal(t, "g1", dto.Event.Grant.ID)
+		assert.Equal(t, []string{"admin"}, dto.Admins)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for notification")
+	}
+}
+
+func TestHTTPNotifierQueueFull(t *testing.T) {
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+
+	notifier := &HTTPNotifier{url: "http://localhost", logger: logger, queue: make(chan []byte, 1)} // no worker
+	event := &Event{Type: EventGranted, Grant: Grant{ID: "g1"}}
+	assert.Nil(t, notifier.Notify(event, nil))
+	assert.ErrorIs(t, notifier.Notify(event, nil), ErrNotificationQueueFull)
+}
@@ -2,55 +2,139 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/common/ratelimit"
+	"github.com/mredolatti/tf/codigo/common/revocation"
 	"github.com/mredolatti/tf/codigo/common/runtime"
+	"github.com/mredolatti/tf/codigo/common/tracing"
 	"github.com/mredolatti/tf/codigo/fileserver/api/client"
 	"github.com/mredolatti/tf/codigo/fileserver/api/oauth2"
 	"github.com/mredolatti/tf/codigo/fileserver/api/server"
+	"github.com/mredolatti/tf/codigo/fileserver/audit"
+	"github.com/mredolatti/tf/codigo/fileserver/breakglass"
+	"github.com/mredolatti/tf/codigo/fileserver/config"
 	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+	"github.com/mredolatti/tf/codigo/fileserver/hashchain"
 	"github.com/mredolatti/tf/codigo/fileserver/registrar"
 	"github.com/mredolatti/tf/codigo/fileserver/repository/psql"
+	"github.com/mredolatti/tf/codigo/fileserver/sharelinks"
+	"github.com/mredolatti/tf/codigo/fileserver/signingkeys"
+	"github.com/mredolatti/tf/codigo/fileserver/webhooks"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
+// set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 
-	cfg := parseEnvVars()
+	configFN := flag.String("config", os.Getenv("FS_CONFIG"), "yaml configuration file. environment variables override its values")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration and exit")
+	serverCommand := flag.String("server", "", "ask the index server to 'pause', 'resume' or report the 'status' of this server, and exit")
+	flag.Parse()
+
+	cfg, err := config.Load(*configFN)
+	if err == nil {
+		err = cfg.Validate()
+	}
+
+	if *checkConfig {
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("configuration ok for server '%s' of organization '%s'\n", cfg.Identity.Name, cfg.Identity.Org)
+		os.Exit(0)
+	}
+	mustBeNil(err)
 
 	logLevel := log.Info
-	if cfg.debug {
+	if cfg.Debug {
 		logLevel = log.Debug
 	}
 
-	logger, err := log.New(os.Stdout, logLevel)
+	logger, err := log.NewWithFormat(os.Stdout, logLevel, log.Format(cfg.LogFormat))
 	mustBeNil(err)
 
-	err = registerServer(cfg, logger)
+	certificates, err := setupCertificates(cfg, logger)
+	mustBeNil(err)
+
+	if *serverCommand != "" {
+		os.Exit(runServerCommand(cfg, logger, certificates, *serverCommand))
+	}
+
+	shutdownTracing, err := setupTracing(cfg, logger)
+	mustBeNil(err)
+	defer shutdownTracing()
+
+	reg, err := setupRegistrar(cfg, logger, certificates)
 	mustBeNil(err)
 
 	rtm, err := runtime.New(logger)
 	mustBeNil(err)
 
-	fm, err := filemanager.Setup(cfg.storagePlugin, cfg.storagePluginConf)
+	emergency, err := setupBreakGlass(cfg, logger)
+	mustBeNil(err)
+
+	auditor, err := setupAudit(cfg, logger)
+	mustBeNil(err)
+
+	db, err := sqlx.Connect("pgx", cfg.Database.PsqlURI)
+	mustBeNil(err)
+
+	reg.Start(db.PingContext) // registration is retried in the background until the index server is reachable
+
+	shares, err := setupShareLinks(cfg, db, logger)
+	mustBeNil(err)
+
+	fm, err := filemanager.Setup(&filemanager.Config{
+		Logger:       logger,
+		PluginPath:   cfg.Storage.Plugin,
+		PluginParams: cfg.Storage.Params,
+		Admins:       cfg.Admins,
+		BreakGlass:   emergency,
+		Audit:        auditor,
+		ShareLinks:   shares,
+	})
+	mustBeNil(err)
+
+	hooks, err := setupWebhooks(cfg, db, logger)
+	mustBeNil(err)
+	fm.AddChangesListener(hooks.NotifyAll)
+	hooks.Start()
+
+	signingKeys, err := setupSigningKeys(cfg)
+	mustBeNil(err)
+
+	revocationChecker, err := setupRevocation(cfg, logger)
+	mustBeNil(err)
+
+	clientLimiter, err := ratelimit.New(ratelimit.Config(cfg.RateLimits.Clients))
+	mustBeNil(err)
+
+	syncLimiter, err := ratelimit.New(ratelimit.Config(cfg.RateLimits.Sync))
 	mustBeNil(err)
 
-	oauth2W := setupOAuth2Wrapper(cfg.psqlURI, logger, cfg.jwtSecret)
+	oauth2W := setupOAuth2Wrapper(db, logger, signingKeys)
 	clientAPI, err := client.New(&client.Options{ // Client API -- consumed by end-users to interact with files
-		Logger:                   logger,
-		OAuht2Wrapper:            oauth2W,
-		FileManager:              fm,
-		Host:                     cfg.host,
-		Port:                     cfg.clientAPIPort,
-		ServerCertificateChainFN: cfg.serverCertChain,
-		ServerPrivateKeyFN:       cfg.serverPrivateKey,
-		RootCAFn:                 cfg.rootCA,
+		Logger:         logger,
+		OAuht2Wrapper:  oauth2W,
+		FileManager:    fm,
+		Revocation:     revocationChecker,
+		RateLimiter:    clientLimiter,
+		Webhooks:       hooks,
+		Host:           cfg.Listeners.Host,
+		Port:           cfg.Listeners.ClientPort,
+		TrustedProxies: cfg.Listeners.TrustedProxies,
+		Certificates:   certificates,
 	})
 	mustBeNil(err)
 
@@ -61,13 +145,13 @@ func main() {
 	}()
 
 	serverAPI, err := server.New(&server.Options{
-		Logger:                   logger,
-		Port:                     cfg.serverAPIPort,
-		FileManager:              fm,
-		ServerCertificateChainFN: cfg.serverCertChain,
-		ServerPrivateKeyFN:       cfg.serverPrivateKey,
-		RootCAFn:                 cfg.rootCA,
-		OAuth2Wrapper:            oauth2W,
+		Logger:        logger,
+		Port:          cfg.Listeners.ServerPort,
+		FileManager:   fm,
+		Certificates:  certificates,
+		OAuth2Wrapper: oauth2W,
+		Revocation:    revocationChecker,
+		RateLimiter:   syncLimiter,
 	})
 	mustBeNil(err)
 
@@ -79,86 +163,241 @@ func main() {
 	rtm.Block() // block the main thread
 }
 
-func setupOAuth2Wrapper(dbURI string, logger log.Interface, jwtSecret string) *oauth2.Impl {
-	db, err := sqlx.Connect("pgx", dbURI)
-	mustBeNil(err)
+func setupTracing(cfg *config.Main, logger log.Interface) (func(), error) {
+	shutdown, err := tracing.Setup(context.Background(), &tracing.Config{
+		ServiceName:  "file-server",
+		Version:      version,
+		OTLPEndpoint: cfg.Tracing.OTLPEndpoint,
+		Insecure:     cfg.Tracing.Insecure,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error setting up tracing: %w", err)
+	}
 
+	if cfg.Tracing.OTLPEndpoint == "" {
+		logger.Info("no OTLP collector configured. spans will be written to stdout")
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			logger.Error("error flushing pending spans: %s", err)
+		}
+	}, nil
+}
+
+func setupOAuth2Wrapper(db *sqlx.DB, logger log.Interface, signingKeys signingkeys.Interface) *oauth2.Impl {
 	clientRepo, _ := psql.NewClientRepository(db)
 	tokenRepo, _ := psql.NewTokenInfoRepository(db)
 
-	oauth2W, err := oauth2.New(logger, "user", clientRepo, tokenRepo, []byte(jwtSecret))
+	oauth2W, err := oauth2.New(logger, "user", clientRepo, tokenRepo, signingKeys)
 	mustBeNil(err)
 
 	return oauth2W
 }
 
-func registerServer(cfg *config, logger log.Interface) error {
-	reg, err := registrar.New(&registrar.Config{
-		ServerName:         cfg.serverName,
-		OrgName:            cfg.orgName,
-		ThisHost:           cfg.host,
-		ClientPort:         cfg.clientAPIPort,
-		ControlPort:        cfg.serverAPIPort,
-		IndexServerBaseURL: cfg.indexServerBaseURL,
-		RootCAFn:           cfg.rootCA,
-		CertChainFn:        cfg.serverCertChain,
-		PrivateKeyFn:       cfg.serverPrivateKey,
-	}, logger)
+func setupSigningKeys(cfg *config.Main) (signingkeys.Interface, error) {
+	keys, err := signingkeys.New(&signingkeys.Config{
+		Directory:      cfg.Tokens.KeysDir,
+		Algorithm:      cfg.Tokens.Algorithm,
+		RotationPeriod: time.Duration(cfg.Tokens.RotationHours) * time.Hour,
+		Overlap:        time.Duration(cfg.Tokens.OverlapHours) * time.Hour,
+	})
 	if err != nil {
-		return fmt.Errorf("error building registrar: %s", err)
+		return nil, fmt.Errorf("error setting up jwt signing keys: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	if err := reg.EnsureThisServerIsRegistered(ctx); err != nil {
-		return fmt.Errorf("error while trying to register server: %w", err)
+	keys.StartRotating(time.Hour)
+	return keys, nil
+}
+
+func setupRevocation(cfg *config.Main, logger log.Interface) (revocation.Interface, error) {
+	if len(cfg.Revocation.CRLSources) == 0 && !cfg.Revocation.OCSPEnabled {
+		logger.Info("no CRLs or OCSP configured. client certificates will not be checked for revocation")
+		return nil, nil
+	}
+
+	checker, err := revocation.New(&revocation.Config{
+		Logger:        logger,
+		IssuerFNs:     []string{cfg.TLS.RootCA, cfg.TLS.CertChain}, // the chain includes the intermediate CA
+		CRLSources:    cfg.Revocation.CRLSources,
+		RefreshPeriod: time.Duration(cfg.Revocation.RefreshMinutes) * time.Minute,
+		OCSPEnabled:   cfg.Revocation.OCSPEnabled,
+		OCSPResponder: cfg.Revocation.OCSPResponder,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error setting up certificate revocation checks: %w", err)
+	}
+
+	checker.Start()
+	return checker, nil
+}
+
+func setupShareLinks(cfg *config.Main, db *sqlx.DB, logger log.Interface) (sharelinks.Interface, error) {
+	if cfg.ShareLinks.Secret == "" {
+		logger.Info("no share-link secret configured. share links will be disabled")
+		return nil, nil
+	}
+
+	repo, err := psql.NewShareLinkRepository(db)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up share-link repository: %w", err)
 	}
 
-	return nil
+	links, err := sharelinks.New(&sharelinks.Config{
+		Secret:     []byte(cfg.ShareLinks.Secret),
+		Repository: repo,
+		MaxTTL:     time.Duration(cfg.ShareLinks.MaxTTLHours) * time.Hour,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error setting up share links: %w", err)
+	}
+
+	return links, nil
+}
+
+func setupWebhooks(cfg *config.Main, db *sqlx.DB, logger log.Interface) (webhooks.Interface, error) {
+	hooksRepo, err := psql.NewWebhookRepository(db)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up webhook repository: %w", err)
+	}
+
+	deliveriesRepo, err := psql.NewWebhookDeliveryRepository(db)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up webhook delivery repository: %w", err)
+	}
+
+	hooks, err := webhooks.New(&webhooks.Config{
+		Hooks:       hooksRepo,
+		Deliveries:  deliveriesRepo,
+		Logger:      logger,
+		Server:      cfg.Identity.Org + "/" + cfg.Identity.Name,
+		MaxAttempts: cfg.Webhooks.MaxAttempts,
+		Timeout:     time.Duration(cfg.Webhooks.TimeoutSeconds) * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error setting up webhooks: %w", err)
+	}
+
+	return hooks, nil
+}
+
+func setupAudit(cfg *config.Main, logger log.Interface) (audit.Interface, error) {
+	if cfg.Audit.LogFN == "" {
+		logger.Info("no audit log configured. file operations will not be audited")
+		return nil, nil
+	}
+
+	auditLog, err := hashchain.Open(cfg.Audit.LogFN)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %w", err)
+	}
+
+	return audit.New(auditLog), nil
+}
+
+func setupBreakGlass(cfg *config.Main, logger log.Interface) (breakglass.Interface, error) {
+	if cfg.BreakGlass.TrailFN == "" {
+		logger.Info("no break-glass trail configured. emergency access will be disabled")
+		return nil, nil
+	}
+
+	trail, err := hashchain.Open(cfg.BreakGlass.TrailFN)
+	if err != nil {
+		return nil, fmt.Errorf("error opening break-glass trail: %w", err)
+	}
+
+	notifiers := []breakglass.Notifier{breakglass.NewLogNotifier(logger)}
+	if cfg.BreakGlass.NotifyURL != "" {
+		notifiers = append(notifiers, breakglass.NewHTTPNotifier(cfg.BreakGlass.NotifyURL, logger))
+	}
+
+	bg, err := breakglass.New(&breakglass.Config{
+		Logger:    logger,
+		Trail:     trail,
+		Window:    time.Duration(cfg.BreakGlass.WindowMinutes) * time.Minute,
+		Admins:    cfg.BreakGlass.Admins,
+		Notifiers: notifiers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error setting up break-glass access: %w", err)
+	}
+
+	return bg, nil
 }
 
-type config struct {
-	serverName         string
-	orgName            string
-	debug              bool
-	host               string
-	clientAPIPort      int
-	serverAPIPort      int
-	serverCertChain    string
-	serverPrivateKey   string
-	rootCA             string
-	jwtSecret          string
-	psqlURI            string
-	storagePlugin      string
-	storagePluginConf  string
-	indexServerBaseURL string
+func setupCertificates(cfg *config.Main, logger log.Interface) (certmanager.Interface, error) {
+	certificates, err := certmanager.New(&certmanager.Config{
+		Logger:       logger,
+		CertChainFN:  cfg.TLS.CertChain,
+		PrivateKeyFN: cfg.TLS.PrivateKey,
+		RootCAFN:     cfg.TLS.RootCA,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificates: %w", err)
+	}
+
+	if err := certificates.Watch(); err != nil {
+		return nil, fmt.Errorf("error watching certificates for changes: %w", err)
+	}
+
+	return certificates, nil
 }
 
-func parseEnvVars() *config {
-	return &config{
-		serverName:         "filesrv1",
-		orgName:            "unicen",
-		indexServerBaseURL: "https://index-server:9876/api/fileservers/v1",
-		debug:              os.Getenv("FS_LOG_DEBUG") == "true",
-		host:               os.Getenv("FS_HOST"),
-		clientAPIPort:      intOr(os.Getenv("FS_CLIENT_PORT"), 9877),
-		serverAPIPort:      intOr(os.Getenv("FS_SERVER_PORT"), 9000),
-		serverCertChain:    os.Getenv("FS_SERVER_CERT_CHAIN"),
-		serverPrivateKey:   os.Getenv("FS_SERVER_PRIVATE_KEY"),
-		rootCA:             os.Getenv("FS_ROOT_CA"),
-		jwtSecret:          os.Getenv("FS_JWT_SECRET"),
-		psqlURI:            os.Getenv("FS_PSQL_URI"),
-		storagePlugin:      os.Getenv("FS_STORAGE_PLUGIN"),
-		storagePluginConf:  os.Getenv("FS_STORAGE_PLUGIN_CONF"),
+func runServerCommand(cfg *config.Main, logger log.Interface, certificates certmanager.Interface, command string) int {
+	reg, err := setupRegistrar(cfg, logger, certificates)
+	if err != nil {
+		fmt.Println(err)
+		return 1
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	switch command {
+	case "pause":
+		err = reg.Pause(ctx)
+	case "resume":
+		err = reg.Resume(ctx)
+	case "status":
+	default:
+		fmt.Printf("unknown server command '%s'. expected one of: pause, resume, status\n", command)
+		return 1
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	status, err := reg.Status(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	fmt.Printf("server '%s' of organization '%s' is %s\n", cfg.Identity.Name, cfg.Identity.Org, status)
+	return 0
 }
 
-func intOr(num string, fallback int) int {
-	parsed, err := strconv.Atoi(num)
+func setupRegistrar(cfg *config.Main, logger log.Interface, certificates certmanager.Interface) (registrar.Interface, error) {
+	reg, err := registrar.New(&registrar.Config{
+		ServerName:         cfg.Identity.Name,
+		OrgName:            cfg.Identity.Org,
+		ThisHost:           cfg.Listeners.Host,
+		ClientPort:         cfg.Listeners.ClientPort,
+		ControlPort:        cfg.Listeners.ServerPort,
+		IndexServerBaseURL: cfg.IndexServer.URL,
+		Certificates:       certificates,
+		Version:            version,
+		HeartbeatInterval:  time.Duration(cfg.IndexServer.HeartbeatSeconds) * time.Second,
+	}, logger)
 	if err != nil {
-		return fallback
+		return nil, fmt.Errorf("error building registrar: %s", err)
 	}
-	return parsed
+
+	return reg, nil
 }
 
 func mustBeNil(e error) {
@@ -0,0 +1,341 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	conf "github.com/mredolatti/tf/codigo/common/config"
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/signingkeys"
+	"gopkg.in/yaml.v3"
+)
+
+// Public errors
+var (
+	ErrInvalidConfig = errors.New("invalid configuration")
+)
+
+// Main is the full file-server configuration
+type Main struct {
+	Debug       bool        `yaml:"debug"`
+	LogFormat   string      `yaml:"logFormat"`
+	Identity    Identity    `yaml:"identity"`
+	Listeners   Listeners   `yaml:"listeners"`
+	TLS         TLS         `yaml:"tls"`
+	Database    Database    `yaml:"database"`
+	Storage     Storage     `yaml:"storage"`
+	IndexServer IndexServer `yaml:"indexServer"`
+	Admins      []string    `yaml:"admins"`
+	Tokens      Tokens      `yaml:"tokens"`
+	Revocation  Revocation  `yaml:"revocation"`
+	Audit       Audit       `yaml:"audit"`
+	ShareLinks  ShareLinks  `yaml:"shareLinks"`
+	BreakGlass  BreakGlass  `yaml:"breakGlass"`
+	Tracing     Tracing     `yaml:"tracing"`
+	RateLimits  RateLimits  `yaml:"rateLimits"`
+	Webhooks    Webhooks    `yaml:"webhooks"`
+}
+
+// Identity is how this server is known to the index server
+type Identity struct {
+	Name string `yaml:"name"`
+	Org  string `yaml:"org"`
+}
+
+// Listeners holds the public host name & ports for the client (REST) and control (gRPC) apis
+type Listeners struct {
+	Host           string   `yaml:"host"`
+	ClientPort     int      `yaml:"clientPort"`
+	ServerPort     int      `yaml:"serverPort"`
+	TrustedProxies []string `yaml:"trustedProxies"` // addresses or CIDRs whose X-Forwarded-For headers are honored
+}
+
+// TLS holds the certificate chain, private key & root CA file names
+type TLS struct {
+	CertChain  string `yaml:"certChain"`
+	PrivateKey string `yaml:"privateKey"`
+	RootCA     string `yaml:"rootCA"`
+}
+
+// Database holds the postgres connection string
+type Database struct {
+	PsqlURI string `yaml:"psqlURI"`
+}
+
+// Storage selects the storage plugin & the parameters passed to it. An empty plugin uses in-memory storage
+type Storage struct {
+	Plugin string                 `yaml:"plugin"`
+	Params map[string]interface{} `yaml:"params"`
+}
+
+// IndexServer holds the url of the index-server's file-server api, and how often heartbeats are sent to it
+type IndexServer struct {
+	URL              string `yaml:"url"`
+	HeartbeatSeconds int    `yaml:"heartbeatSeconds"`
+}
+
+// Tokens holds jwt signing key parameters
+type Tokens struct {
+	KeysDir       string `yaml:"keysDir"`
+	Algorithm     string `yaml:"algorithm"`
+	RotationHours int    `yaml:"rotationHours"`
+	OverlapHours  int    `yaml:"overlapHours"`
+}
+
+// Revocation holds CRL & OCSP parameters
+type Revocation struct {
+	CRLSources     []string `yaml:"crlSources"`
+	RefreshMinutes int      `yaml:"refreshMinutes"`
+	OCSPEnabled    bool     `yaml:"ocspEnabled"`
+	OCSPResponder  string   `yaml:"ocspResponder"`
+}
+
+// Audit holds the audit log file name. Auditing is disabled if empty
+type Audit struct {
+	LogFN string `yaml:"logFile"`
+}
+
+// ShareLinks holds share-link parameters. Share links are disabled if the secret is empty
+type ShareLinks struct {
+	Secret      string `yaml:"secret"`
+	MaxTTLHours int    `yaml:"maxTTLHours"`
+}
+
+// BreakGlass holds emergency access parameters. Emergency access is disabled if the trail is empty
+type BreakGlass struct {
+	TrailFN       string   `yaml:"trailFile"`
+	WindowMinutes int      `yaml:"windowMinutes"`
+	Admins        []string `yaml:"admins"`
+	NotifyURL     string   `yaml:"notifyURL"`
+}
+
+// Tracing holds the OTLP collector spans are exported to. Spans are written to stdout if the endpoint is empty
+type Tracing struct {
+	OTLPEndpoint string `yaml:"otlpEndpoint"`
+	Insecure     bool   `yaml:"insecure"`
+}
+
+// RateLimits holds the limits applied to each api
+type RateLimits struct {
+	Clients RateLimit `yaml:"clients"` // client api, by certificate CN (or ip address if none was presented)
+	Sync    RateLimit `yaml:"sync"`    // SyncUser rpc, by token subject
+}
+
+// RateLimit determines how many requests per second a single key can perform, and how many at once
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	Burst             int     `yaml:"burst"`
+}
+
+// Webhooks holds delivery parameters for webhooks registered by admins
+type Webhooks struct {
+	MaxAttempts    int `yaml:"maxAttempts"`
+	TimeoutSeconds int `yaml:"timeoutSeconds"`
+}
+
+// Defaults returns a configuration with every optional parameter set to its default value
+func Defaults() *Main {
+	return &Main{
+		LogFormat:   string(log.FormatText),
+		Listeners:   Listeners{ClientPort: 9877, ServerPort: 9000},
+		IndexServer: IndexServer{HeartbeatSeconds: 30},
+		Tokens:      Tokens{Algorithm: signingkeys.AlgorithmEdDSA, RotationHours: 30 * 24, OverlapHours: 48},
+		Revocation:  Revocation{RefreshMinutes: 60},
+		ShareLinks:  ShareLinks{MaxTTLHours: 7 * 24},
+		BreakGlass:  BreakGlass{WindowMinutes: 60},
+		RateLimits: RateLimits{
+			Clients: RateLimit{RequestsPerSecond: 10, Burst: 50},
+			Sync:    RateLimit{RequestsPerSecond: 0.2, Burst: 5},
+		},
+		Webhooks: Webhooks{MaxAttempts: 10, TimeoutSeconds: 10},
+	}
+}
+
+// Load builds a configuration from the defaults, the yaml file `fn` (if not empty) and the environment, in that order
+func Load(fn string) (*Main, error) {
+	cfg := Defaults()
+	if fn != "" {
+		raw, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+
+		// unknown keys are rejected so that typos don't silently fall back to defaults
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("error parsing config file '%s': %w", fn, err)
+		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that all required parameters are present & consistent, and that referenced files exist.
+// Every problem found is reported, not just the first one
+func (c *Main) Validate() error {
+	var problems []string
+	require := func(value string, name string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", name))
+		}
+	}
+	exists := func(fn string, name string) {
+		if fn == "" {
+			return
+		}
+		if _, err := os.Stat(fn); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if c.LogFormat != string(log.FormatText) && c.LogFormat != string(log.FormatJSON) {
+		problems = append(problems, fmt.Sprintf("logFormat must be one of %s, %s", log.FormatText, log.FormatJSON))
+	}
+
+	require(c.Identity.Name, "identity.name")
+	require(c.Identity.Org, "identity.org")
+	require(c.Listeners.Host, "listeners.host")
+	require(c.TLS.CertChain, "tls.certChain")
+	require(c.TLS.PrivateKey, "tls.privateKey")
+	require(c.TLS.RootCA, "tls.rootCA")
+	require(c.Database.PsqlURI, "database.psqlURI")
+	require(c.IndexServer.URL, "indexServer.url")
+	require(c.Tokens.KeysDir, "tokens.keysDir")
+
+	for name, port := range map[string]int{"listeners.clientPort": c.Listeners.ClientPort, "listeners.serverPort": c.Listeners.ServerPort} {
+		if port <= 0 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("%s must be between 1 and 65535", name))
+		}
+	}
+	if c.Listeners.ClientPort == c.Listeners.ServerPort {
+		problems = append(problems, "listeners.clientPort and listeners.serverPort must be different")
+	}
+
+	exists(c.TLS.CertChain, "tls.certChain")
+	exists(c.TLS.PrivateKey, "tls.privateKey")
+	exists(c.TLS.RootCA, "tls.rootCA")
+	exists(c.Storage.Plugin, "storage.plugin")
+
+	if c.IndexServer.URL != "" {
+		if parsed, err := url.Parse(c.IndexServer.URL); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			problems = append(problems, "indexServer.url must be an absolute https url")
+		}
+	}
+
+	if c.IndexServer.HeartbeatSeconds <= 0 {
+		problems = append(problems, "indexServer.heartbeatSeconds must be positive")
+	}
+
+	if c.Tokens.Algorithm != signingkeys.AlgorithmEdDSA && c.Tokens.Algorithm != signingkeys.AlgorithmRS256 {
+		problems = append(problems, fmt.Sprintf("tokens.algorithm must be one of %s, %s", signingkeys.AlgorithmEdDSA, signingkeys.AlgorithmRS256))
+	}
+
+	for name, limit := range map[string]RateLimit{"rateLimits.clients": c.RateLimits.Clients, "rateLimits.sync": c.RateLimits.Sync} {
+		if limit.RequestsPerSecond <= 0 || limit.Burst <= 0 {
+			problems = append(problems, fmt.Sprintf("%s requestsPerSecond & burst must be positive", name))
+		}
+	}
+
+	if c.Webhooks.MaxAttempts <= 0 || c.Webhooks.TimeoutSeconds <= 0 {
+		problems = append(problems, "webhooks.maxAttempts & webhooks.timeoutSeconds must be positive")
+	}
+
+	if c.BreakGlass.TrailFN != "" && len(c.BreakGlass.Admins) == 0 {
+		problems = append(problems, "breakGlass.admins is required when emergency access is enabled")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// applyEnv overrides parameters with those present in the environment
+func (c *Main) applyEnv(lookup func(string) (string, bool)) error {
+	str := func(name string, target *string) {
+		if value, ok := lookup(name); ok {
+			*target = value
+		}
+	}
+	num := func(name string, target *int) {
+		if value, ok := lookup(name); ok {
+			*target = conf.IntOr(value, *target)
+		}
+	}
+	flag := func(name string, target *bool) {
+		if value, ok := lookup(name); ok {
+			*target = value == "true"
+		}
+	}
+	real := func(name string, target *float64) {
+		if value, ok := lookup(name); ok {
+			*target = conf.FloatOr(value, *target)
+		}
+	}
+	list := func(name string, target *[]string) {
+		if value, ok := lookup(name); ok {
+			*target = conf.StringListOr(value, nil)
+		}
+	}
+
+	flag("FS_LOG_DEBUG", &c.Debug)
+	str("FS_LOG_FORMAT", &c.LogFormat)
+	str("FS_SERVER_NAME", &c.Identity.Name)
+	str("FS_ORG_NAME", &c.Identity.Org)
+	str("FS_HOST", &c.Listeners.Host)
+	num("FS_CLIENT_PORT", &c.Listeners.ClientPort)
+	num("FS_SERVER_PORT", &c.Listeners.ServerPort)
+	list("FS_TRUSTED_PROXIES", &c.Listeners.TrustedProxies)
+	str("FS_SERVER_CERT_CHAIN", &c.TLS.CertChain)
+	str("FS_SERVER_PRIVATE_KEY", &c.TLS.PrivateKey)
+	str("FS_ROOT_CA", &c.TLS.RootCA)
+	str("FS_PSQL_URI", &c.Database.PsqlURI)
+	str("FS_STORAGE_PLUGIN", &c.Storage.Plugin)
+	str("FS_INDEX_SERVER_URL", &c.IndexServer.URL)
+	num("FS_HEARTBEAT_SECONDS", &c.IndexServer.HeartbeatSeconds)
+	list("FS_ADMINS", &c.Admins)
+	str("FS_JWT_KEYS_DIR", &c.Tokens.KeysDir)
+	str("FS_JWT_ALGORITHM", &c.Tokens.Algorithm)
+	num("FS_JWT_ROTATION_HOURS", &c.Tokens.RotationHours)
+	num("FS_JWT_OVERLAP_HOURS", &c.Tokens.OverlapHours)
+	list("FS_CRL_SOURCES", &c.Revocation.CRLSources)
+	num("FS_CRL_REFRESH_MINUTES", &c.Revocation.RefreshMinutes)
+	flag("FS_OCSP_ENABLED", &c.Revocation.OCSPEnabled)
+	str("FS_OCSP_RESPONDER", &c.Revocation.OCSPResponder)
+	str("FS_AUDIT_LOG", &c.Audit.LogFN)
+	str("FS_SHARE_LINK_SECRET", &c.ShareLinks.Secret)
+	num("FS_SHARE_LINK_MAX_TTL_HOURS", &c.ShareLinks.MaxTTLHours)
+	str("FS_BREAKGLASS_TRAIL", &c.BreakGlass.TrailFN)
+	num("FS_BREAKGLASS_WINDOW_MINUTES", &c.BreakGlass.WindowMinutes)
+	list("FS_BREAKGLASS_ADMINS", &c.BreakGlass.Admins)
+	str("FS_BREAKGLASS_NOTIFY_URL", &c.BreakGlass.NotifyURL)
+	str("FS_OTLP_ENDPOINT", &c.Tracing.OTLPEndpoint)
+	flag("FS_OTLP_INSECURE", &c.Tracing.Insecure)
+	real("FS_RATELIMIT_CLIENTS_RPS", &c.RateLimits.Clients.RequestsPerSecond)
+	num("FS_RATELIMIT_CLIENTS_BURST", &c.RateLimits.Clients.Burst)
+	real("FS_RATELIMIT_SYNC_RPS", &c.RateLimits.Sync.RequestsPerSecond)
+	num("FS_RATELIMIT_SYNC_BURST", &c.RateLimits.Sync.Burst)
+	num("FS_WEBHOOK_MAX_ATTEMPTS", &c.Webhooks.MaxAttempts)
+	num("FS_WEBHOOK_TIMEOUT_SECONDS", &c.Webhooks.TimeoutSeconds)
+
+	if value, ok := lookup("FS_STORAGE_PLUGIN_CONF"); ok {
+		var params map[string]interface{}
+		if err := json.Unmarshal([]byte(value), &params); err != nil {
+			return fmt.Errorf("error parsing FS_STORAGE_PLUGIN_CONF json: %w", err)
+		}
+		c.Storage.Params = params
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExampleConfig(t *testing.T) {
+	raw, err := os.ReadFile("example.yaml")
+	assert.Nil(t, err)
+	cfg, err := loadFrom(t, string(raw), nil)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "file-server-1", cfg.Identity.Name)
+	assert.Equal(t, "unicen", cfg.Identity.Org)
+	assert.Equal(t, 9000, cfg.Listeners.ServerPort)
+	assert.Equal(t, []string{"martin.redolatti"}, cfg.Admins)
+	assert.Equal(t, "/var/mifs/files", cfg.Storage.Params["filePath"])
+	assert.Equal(t, "https://index-server:9876/api/fileservers/v1", cfg.IndexServer.URL)
+	assert.Equal(t, 30, cfg.IndexServer.HeartbeatSeconds)
+}
+
+func TestEnvOverrides(t *testing.T) {
+	cfg, err := loadFrom(t, "identity:\n  name: filesrv1\n  org: unicen\nlisteners:\n  clientPort: 1234\n", map[string]string{
+		"FS_SERVER_NAME":         "filesrv2",
+		"FS_SERVER_PORT":         "9001",
+		"FS_ADMINS":              "admin1,admin2",
+		"FS_STORAGE_PLUGIN_CONF": `{"filePath": "/tmp"}`,
+		"FS_RATELIMIT_SYNC_RPS":  "0.5",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "filesrv2", cfg.Identity.Name)
+	assert.Equal(t, "unicen", cfg.Identity.Org)
+	assert.Equal(t, 1234, cfg.Listeners.ClientPort)
+	assert.Equal(t, 9001, cfg.Listeners.ServerPort)
+	assert.Equal(t, []string{"admin1", "admin2"}, cfg.Admins)
+	assert.Equal(t, map[string]interface{}{"filePath": "/tmp"}, cfg.Storage.Params)
+	assert.Equal(t, 0.5, cfg.RateLimits.Sync.RequestsPerSecond)
+
+	// defaults are kept for anything not set
+	assert.Equal(t, 48, cfg.Tokens.OverlapHours)
+
+	_, err = loadFrom(t, "", map[string]string{"FS_STORAGE_PLUGIN_CONF": "{not json"})
+	assert.NotNil(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	cert := filepath.Join(dir, "cert.pem")
+	assert.Nil(t, os.WriteFile(cert, []byte("-"), 0600))
+
+	cfg := Defaults()
+	cfg.Identity = Identity{Name: "filesrv1", Org: "unicen"}
+	cfg.Listeners.Host = "file-server-1"
+	cfg.TLS = TLS{CertChain: cert, PrivateKey: cert, RootCA: cert}
+	cfg.Database.PsqlURI = "postgres://localhost/filesrv"
+	cfg.IndexServer.URL = "https://index-server:9876/api/fileservers/v1"
+	cfg.Tokens.KeysDir = dir
+	assert.Nil(t, cfg.Validate())
+
+	cfg.Identity.Org = ""
+	cfg.TLS.RootCA = filepath.Join(dir, "missing.pem")
+	cfg.Listeners.ServerPort = cfg.Listeners.ClientPort
+	cfg.IndexServer.URL = "index-server:9876"
+	cfg.Tokens.Algorithm = "HS256"
+	cfg.LogFormat = "xml"
+	cfg.RateLimits.Sync.Burst = 0
+	cfg.Tokens.KeysDir = ""
+	err := cfg.Validate()
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	for _, expected := range []string{"identity.org", "tls.rootCA", "listeners.clientPort", "indexServer.url", "tokens.algorithm", "logFormat", "rateLimits.sync", "tokens.keysDir"} {
+		assert.Contains(t, err.Error(), expected)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	_, err := loadFrom(t, "identity:\n  name: filesrv1\ntokens:\n  keysdir: /tmp/keys\n", nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "keysdir")
+
+	// an empty file is fine, everything comes from defaults & env
+	_, err = loadFrom(t, "", nil)
+	assert.Nil(t, err)
+}
+
+// loadFrom writes `contents` to a temporary file and loads it with `env` as the only environment variables
+func loadFrom(t *testing.T, contents string, env map[string]string) (*Main, error) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(fn, []byte(contents), 0600))
+
+	for _, name := range envVars {
+		value, ok := env[name]
+		if !ok {
+			// t.Setenv restores the original value once the test ends
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+			continue
+		}
+		t.Setenv(name, value)
+	}
+
+	return Load(fn)
+}
+
+var envVars = []string{
+	"FS_LOG_DEBUG", "FS_LOG_FORMAT", "FS_SERVER_NAME", "FS_ORG_NAME", "FS_HOST", "FS_CLIENT_PORT", "FS_SERVER_PORT",
+	"FS_SERVER_CERT_CHAIN", "FS_SERVER_PRIVATE_KEY", "FS_ROOT_CA", "FS_PSQL_URI", "FS_STORAGE_PLUGIN",
+	"FS_STORAGE_PLUGIN_CONF", "FS_INDEX_SERVER_URL", "FS_HEARTBEAT_SECONDS", "FS_ADMINS", "FS_JWT_KEYS_DIR", "FS_JWT_ALGORITHM",
+	"FS_JWT_ROTATION_HOURS", "FS_JWT_OVERLAP_HOURS", "FS_RATELIMIT_CLIENTS_RPS", "FS_RATELIMIT_CLIENTS_BURST",
+	"FS_RATELIMIT_SYNC_RPS", "FS_RATELIMIT_SYNC_BURST", "FS_WEBHOOK_MAX_ATTEMPTS", "FS_WEBHOOK_TIMEOUT_SECONDS",
+}
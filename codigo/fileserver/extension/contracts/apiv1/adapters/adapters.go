@@ -1,6 +1,9 @@
 package adapters
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/mredolatti/tf/codigo/fileserver/authz"
 	"github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1"
 	"github.com/mredolatti/tf/codigo/fileserver/models"
@@ -44,13 +47,19 @@ func NewFilesMetaWrapper(w apiv1.FilesMetadata) *FilesMetaWrapper {
 // Create implements storage.FilesMetadata
 func (fmw *FilesMetaWrapper) Create(name string, notes string, patient string, typ string, whenNs int64) (models.FileMetadata, error) {
 	n, err := fmw.w.Create(name, notes, patient, typ, whenNs)
-	return n.(models.FileMetadata), err
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
 }
 
 // Get implements storage.FilesMetadata
 func (fmw *FilesMetaWrapper) Get(id string) (models.FileMetadata, error) {
 	c, err := fmw.w.Get(id)
-	return c.(models.FileMetadata), err
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 // GetMany implements storage.FilesMetadata
@@ -76,7 +85,35 @@ func (fmw *FilesMetaWrapper) Remove(id string, whenNs int64) error {
 // Update implements storage.FilesMetadata
 func (fmw *FilesMetaWrapper) Update(id string, updated models.FileMetadata, whenNs int64) (models.FileMetadata, error) {
 	res, err := fmw.w.Update(id, updated.(apiv1.FileMetadata), whenNs)
-	return res.(apiv1.FileMetadata), err
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// TransactionalFilesMetaWrapper adapts storages that also implement apiv1.Transactional
+type TransactionalFilesMetaWrapper struct {
+	*FilesMetaWrapper
+	t apiv1.Transactional
+}
+
+// WrapFilesMetadata adapts a plugin's metadata storage, exposing storage.Transactional only if the plugin supports it
+func WrapFilesMetadata(w apiv1.FilesMetadata) storage.FilesMetadata {
+	if t, ok := w.(apiv1.Transactional); ok {
+		return &TransactionalFilesMetaWrapper{FilesMetaWrapper: NewFilesMetaWrapper(w), t: t}
+	}
+	return NewFilesMetaWrapper(w)
+}
+
+// Atomically implements storage.Transactional
+func (tw *TransactionalFilesMetaWrapper) Atomically(fn func(tx storage.FilesMetadata) error) error {
+	err := tw.t.Atomically(func(tx apiv1.FilesMetadata) error {
+		return fn(NewFilesMetaWrapper(tx))
+	})
+	if errors.Is(err, apiv1.ErrPartiallyCommitted) {
+		return fmt.Errorf("%w: %s", storage.ErrPartiallyCommitted, err)
+	}
+	return err
 }
 
 type AuthorizationWrapper struct {
@@ -98,8 +135,8 @@ func (aw *AuthorizationWrapper) AllForObject(object string) (map[string]authz.Pe
 	}
 
 	toRet := make(map[string]authz.Permission, len(res))
-	for k, v := range toRet {
-		toRet[k] = v.(authz.Permission)
+	for k, v := range res {
+		toRet[k] = &PermissionWrapper{p: v}
 	}
 	return toRet, nil
 }
@@ -157,5 +194,6 @@ func (p *PermissionWrapper) Revoke(operation authz.Operation) error {
 
 var _ storage.Files = (*FilesWrapper)(nil)
 var _ storage.FilesMetadata = (*FilesMetaWrapper)(nil)
+var _ storage.Transactional = (*TransactionalFilesMetaWrapper)(nil)
 var _ authz.Authorization = (*AuthorizationWrapper)(nil)
 var _ authz.Permission = (*PermissionWrapper)(nil)
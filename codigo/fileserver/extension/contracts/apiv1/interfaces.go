@@ -20,6 +20,10 @@ const CreateFuncName = "Create"
 var (
 	ErrFileDoesNotExist = errors.New("file does not exist")
 	ErrFileExists       = errors.New("file exists")
+
+	// ErrPartiallyCommitted is returned by Transactional.Atomically when changes were persisted, but some of
+	// the work that follows the commit failed
+	ErrPartiallyCommitted = errors.New("changes committed with errors")
 )
 
 // File methods
@@ -52,10 +56,39 @@ type FilesMetadata interface {
 	Get(id string) (FileMetadata, error)
 	GetMany(filter *Filter) (map[string]FileMetadata, error)
 	Create(name string, notes string, patient string, typ string, whenNs int64) (FileMetadata, error)
+	// Update changes the name, notes, patient id & type of a file. Fields left empty in `updated` keep their current value
 	Update(id string, updated FileMetadata, whenNs int64) (FileMetadata, error)
 	Remove(id string, whenNs int64) error
 }
 
+// ChangeType identifies the kind of change detected on a file
+type ChangeType int
+
+const (
+	ChangeAdded ChangeType = iota
+	ChangeUpdated
+	ChangeRemoved
+)
+
+// Change describes a modification to a file performed outside of the file server
+type Change struct {
+	Type   ChangeType
+	FileID string
+}
+
+// Watcher is optionally implemented by FilesMetadata storages that can detect changes performed outside
+// of the file server (ie: files copied directly into the storage). The listener is invoked for each change
+type Watcher interface {
+	Watch(listener func(Change))
+}
+
+// Transactional is optionally implemented by FilesMetadata storages that can apply several changes atomically.
+// Changes performed through tx are discarded if fn returns an error. Implementations return errors wrapping
+// ErrPartiallyCommitted if anything fails once the changes have been persisted
+type Transactional interface {
+	Atomically(fn func(tx FilesMetadata) error) error
+}
+
 // Files defines the set of operations that can be performed on file contents
 type Files interface {
 	Read(id string) ([]byte, error)
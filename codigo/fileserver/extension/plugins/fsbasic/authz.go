@@ -29,6 +29,16 @@ func (p *Permission) Revoke(operation apiv1.Operation) error {
 	return nil
 }
 
+// Permissions are stored as `subject::object` -> bitmask. A secondary index keyed by object
+// (`\x00o\x00object\x00subject` -> bitmask) is kept in sync in the same transaction, so that permissions
+// can be efficiently queried in both directions. Subjects never start with a NUL byte, so index keys
+// don't show up in by-subject prefix scans
+const (
+	objIndexPrefix   = "\x00o\x00"
+	objIndexSep      = "\x00"
+	objIndexBuiltKey = "\x00meta\x00object_index_built"
+)
+
 type Authorization struct {
 	db *badger.DB
 }
@@ -38,12 +48,68 @@ func NewAuthz(dbdir string) (*Authorization, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error opening db: %w", err)
 	}
-	return &Authorization{db: db}, nil
+
+	a := &Authorization{db: db}
+	if err := a.buildObjectIndex(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error building by-object index: %w", err)
+	}
+
+	return a, nil
 }
 
 // AllForObject implements apiv1.Authorization
 func (a *Authorization) AllForObject(object string) (map[string]apiv1.Permission, error) {
-	panic("unimplemented")
+	prefix := []byte(objIndexPrefix + object + objIndexSep)
+	m := make(map[string]apiv1.Permission)
+	err := a.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			subject := string(it.Item().Key()[len(prefix):])
+			err := it.Item().Value(func(v []byte) error {
+				m[subject] = ref(decodePermission(v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RemoveObject drops every permission granted on an object
+func (a *Authorization) RemoveObject(object string) error {
+	prefix := []byte(objIndexPrefix + object + objIndexSep)
+	err := a.db.Update(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		defer it.Close()
+
+		var keys [][]byte
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+
+		for _, key := range keys {
+			subject := string(key[len(prefix):])
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+			if err := txn.Delete([]byte(makeKey(subject, object))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error removing permissions for object '%s': %w", object, err)
+	}
+	return nil
 }
 
 // AllForSubject implements apiv1.Authorization
@@ -118,7 +184,7 @@ func (a *Authorization) Grant(subject string, operation apiv1.Operation, object
 		}
 
 		p.Grant(operation)
-		return t.Set(key, encodePermission(p))
+		return set(t, subject, object, p)
 	})
 	if err != nil {
 		return fmt.Errorf("error performing update on db: %w", err)
@@ -148,7 +214,7 @@ func (a *Authorization) Revoke(subject string, operation apiv1.Operation, object
 		}
 
 		p.Revoke(operation)
-		return t.Set(key, encodePermission(p))
+		return set(t, subject, object, p)
 	})
 	if err != nil {
 		return fmt.Errorf("error performing update on db: %w", err)
@@ -156,12 +222,144 @@ func (a *Authorization) Revoke(subject string, operation apiv1.Operation, object
 	return nil
 }
 
+// RestrictObject replaces every permission granted on an object with `operation`, so that all the subjects
+// who had any kind of access keep exactly that one
+func (a *Authorization) RestrictObject(object string, operation apiv1.Operation) error {
+	prefix := []byte(objIndexPrefix + object + objIndexSep)
+	err := a.db.Update(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		defer it.Close()
+
+		var subjects []string
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			subjects = append(subjects, string(it.Item().Key()[len(prefix):]))
+		}
+
+		for _, subject := range subjects {
+			if err := set(txn, subject, object, Permission(operation)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error restricting permissions for object '%s': %w", object, err)
+	}
+	return nil
+}
+
+// RenameObject moves every permission granted on `from` to `to`
+func (a *Authorization) RenameObject(from string, to string) error {
+	prefix := []byte(objIndexPrefix + from + objIndexSep)
+	err := a.db.Update(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		perms := make(map[string]Permission)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			subject := string(it.Item().Key()[len(prefix):])
+			if err := it.Item().Value(func(v []byte) error {
+				perms[subject] = decodePermission(v)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		for subject, p := range perms {
+			if err := set(txn, subject, from, 0); err != nil {
+				return err
+			}
+			if err := set(txn, subject, to, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error moving permissions from '%s' to '%s': %w", from, to, err)
+	}
+	return nil
+}
+
+// buildObjectIndex populates the by-object index from existing permissions. It only runs once, on
+// databases created before the index was introduced
+func (a *Authorization) buildObjectIndex() error {
+	built := false
+	err := a.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(objIndexBuiltKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		built = err == nil
+		return err
+	})
+	if err != nil || built {
+		return err
+	}
+
+	wb := a.db.NewWriteBatch()
+	defer wb.Cancel()
+	err = a.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := string(it.Item().Key())
+			if strings.HasPrefix(key, "\x00") {
+				continue
+			}
+
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			if err := wb.Set([]byte(makeIndexKey(subjFromKey(key), objFromKey(key))), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := wb.Set([]byte(objIndexBuiltKey), nil); err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// set stores a permission & its by-object index entry, or removes both if no operation is allowed
+func set(t *badger.Txn, subject string, object string, p Permission) error {
+	key, indexKey := []byte(makeKey(subject, object)), []byte(makeIndexKey(subject, object))
+	if p == 0 {
+		if err := t.Delete(key); err != nil {
+			return err
+		}
+		return t.Delete(indexKey)
+	}
+
+	if err := t.Set(key, encodePermission(p)); err != nil {
+		return err
+	}
+	return t.Set(indexKey, encodePermission(p))
+}
+
+func makeIndexKey(subject string, object string) string {
+	return objIndexPrefix + object + objIndexSep + subject
+}
+
 func makeKey(subject string, object string) string {
 	return subject + "::" + object
 }
 
 func objFromKey(key string) string {
-	return strings.Split(string(key), "::")[1]
+	return strings.SplitN(string(key), "::", 2)[1]
+}
+
+func subjFromKey(key string) string {
+	return strings.SplitN(string(key), "::", 2)[0]
 }
 
 func decodePermission(raw []byte) Permission {
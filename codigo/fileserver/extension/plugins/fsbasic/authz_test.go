@@ -5,6 +5,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/dgraph-io/badger/v3"
 	"github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1"
 	"github.com/stretchr/testify/assert"
 )
@@ -43,3 +44,61 @@ func TestFsBasicAuthz(t *testing.T) {
 	err = authz.Grant("martin", apiv1.OperationWrite, "file3.txt")
 	assert.Nil(t, err)
 }
+
+func TestFsBasicAuthzByObject(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "authz_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	authz, err := NewAuthz(dir)
+	assert.Nil(t, err)
+
+	assert.Nil(t, authz.Grant("martin", apiv1.OperationWrite, "file1.txt"))
+	assert.Nil(t, authz.Grant("martin", apiv1.OperationRead, "file1.txt"))
+	assert.Nil(t, authz.Grant("pedro", apiv1.OperationRead, "file1.txt"))
+	assert.Nil(t, authz.Grant("pedro", apiv1.OperationRead, "file2.txt"))
+
+	forObj, err := authz.AllForObject("file1.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(forObj))
+	can, _ := forObj["martin"].Can(apiv1.OperationWrite)
+	assert.True(t, can)
+	can, _ = forObj["pedro"].Can(apiv1.OperationWrite)
+	assert.False(t, can)
+
+	// index entries don't leak into by-subject queries
+	forSubj, err := authz.AllForSubject("pedro")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(forSubj))
+
+	// revoking every operation removes the subject
+	assert.Nil(t, authz.Revoke("pedro", apiv1.OperationRead, "file1.txt"))
+	forObj, err = authz.AllForObject("file1.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(forObj))
+
+	assert.Nil(t, authz.RemoveObject("file1.txt"))
+	forObj, err = authz.AllForObject("file1.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(forObj))
+	can, err = authz.Can("martin", apiv1.OperationWrite, "file1.txt")
+	assert.Nil(t, err)
+	assert.False(t, can)
+
+	// index is rebuilt for databases that predate it
+	assert.Nil(t, authz.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete([]byte(objIndexBuiltKey)); err != nil {
+			return err
+		}
+		return txn.Delete([]byte(makeIndexKey("pedro", "file2.txt")))
+	}))
+	assert.Nil(t, authz.db.Close())
+
+	authz, err = NewAuthz(dir)
+	assert.Nil(t, err)
+	defer authz.db.Close()
+	forObj, err = authz.AllForObject("file2.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(forObj))
+}
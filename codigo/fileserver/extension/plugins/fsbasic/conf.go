@@ -1,10 +1,18 @@
 package fsbasic
 
-import "fmt"
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+const defaultTombstoneRetention = 30 * 24 * time.Hour
 
 type Config struct {
-	FilePath string
-	AuthDBPath string
+	FilePath           string
+	AuthDBPath         string
+	MetaDBPath         string
+	TombstoneRetention time.Duration
 }
 
 func (c *Config) PopulateFromArgs(args map[string]interface{}) error {
@@ -17,5 +25,25 @@ func (c *Config) PopulateFromArgs(args map[string]interface{}) error {
 		return fmt.Errorf("argument 'authDBPath' missing or incorrect type")
 	}
 
+	switch metaDBPath := args["metaDBPath"].(type) {
+	case string:
+		c.MetaDBPath = metaDBPath
+	case nil:
+		c.MetaDBPath = filepath.Join(c.FilePath, ".meta")
+	default:
+		return fmt.Errorf("argument 'metaDBPath' has incorrect type")
+	}
+
+	switch hours := args["tombstoneRetentionHours"].(type) {
+	case float64: // numbers in json-decoded args
+		c.TombstoneRetention = time.Duration(hours * float64(time.Hour))
+	case int:
+		c.TombstoneRetention = time.Duration(hours) * time.Hour
+	case nil:
+		c.TombstoneRetention = defaultTombstoneRetention
+	default:
+		return fmt.Errorf("argument 'tombstoneRetentionHours' has incorrect type")
+	}
+
 	return nil
 }
@@ -1,6 +1,7 @@
 package fsbasic
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -9,7 +10,13 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/dgraph-io/badger/v3"
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/uuid"
 	"github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1"
 )
 
@@ -69,140 +76,963 @@ func (m *FileMetadata) Type() string {
 	return m.ftype
 }
 
+// Metadata records are kept in a badger db, keyed by an opaque id (a UUID) that is also used as the
+// on-disk filename. Display names are free-form and indexed separately, so that they can contain
+// slashes, `..` or any character that wouldn't make a valid filename
+const (
+	recordPrefix = "f\x00"
+	namePrefix   = "n\x00"
+)
+
+// Public errors
+var (
+	ErrInvalidID   = errors.New("invalid file id")
+	ErrInvalidName = errors.New("invalid file name")
+)
+
+// deletedFolder holds the contents & metadata of removed files until their tombstones are purged
+const deletedFolder = ".deleted"
+
+// recordVersion is bumped whenever records need to be upgraded when read
+const recordVersion = 1
+
+type record struct {
+	Version     int    `json:"v"`
+	Name        string `json:"name"`
+	Notes       string `json:"notes"`
+	PatientID   string `json:"patientId"`
+	Type        string `json:"type"`
+	LastUpdated int64  `json:"lastUpdated"`
+	Deleted     bool   `json:"deleted,omitempty"`
+}
+
 type FilesMetadata struct {
-	path string
+	path        string
+	db          *badger.DB
+	authz       *Authorization
+	index       map[string]indexEntry
+	indexMtx    sync.RWMutex
+	watcher     *fsnotify.Watcher
+	settleDelay time.Duration // how long a file must go without events before the watcher handles it
+	ownWrites   map[string]int
+	ownMtx      sync.Mutex
+	listener    func(apiv1.Change)
+	listenerMtx sync.RWMutex
+	stopPurging chan struct{}
 }
 
-func NewFilesMetadata(path string) (*FilesMetadata, error) {
+// indexEntry is an in-memory copy of a file's metadata, along with the on-disk modification time it was built from
+type indexEntry struct {
+	meta    *FileMetadata
+	modTime int64
+}
+
+// NewFilesMetadata constructs a metadata store for files in `path`, keeping records in a db at `metaDBPath`.
+// If an authorization db is supplied, permissions on a file are dropped when it's removed.
+// Files created before opaque ids were introduced are migrated on startup, and every record is
+// loaded into an in-memory index
+func NewFilesMetadata(path string, metaDBPath string, authz *Authorization) (*FilesMetadata, error) {
 	if stats, err := os.Stat(path); err != nil || !stats.IsDir() {
 		return nil, fmt.Errorf("cannot use '%s' as path: %w", path, err)
 	}
 
-	deletedFolder := filepath.Join(path, ".deleted")
-	if err := os.Mkdir(deletedFolder, 777); err != nil {
+	deletedPath := filepath.Join(path, deletedFolder)
+	if err := os.Mkdir(deletedPath, 0770); err != nil {
 		if !os.IsExist(err) {
 			return nil, fmt.Errorf("unexpected error when ensuring `.deleted` exists: %w", err)
 		}
 
-		if info, err := os.Stat(deletedFolder); err != nil || !info.IsDir() {
+		if info, err := os.Stat(deletedPath); err != nil || !info.IsDir() {
 			return nil, fmt.Errorf("unexpected error validating `.deleted` folder: %w", err)
 		}
 	}
-	return &FilesMetadata{path}, nil
+
+	db, err := badger.Open(badger.DefaultOptions(metaDBPath))
+	if err != nil {
+		return nil, fmt.Errorf("error opening metadata db: %w", err)
+	}
+
+	f := &FilesMetadata{
+		path:        path,
+		db:          db,
+		authz:       authz,
+		index:       make(map[string]indexEntry),
+		settleDelay: defaultSettleDelay,
+		ownWrites:   make(map[string]int),
+	}
+	if err := f.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating legacy files: %w", err)
+	}
+
+	if err := f.buildIndex(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error building in-memory index: %w", err)
+	}
+
+	return f, nil
 }
 
 // Create implements apiv1.FilesMetadata
 func (f *FilesMetadata) Create(name string, notes string, patient string, typ string, whenNs int64) (apiv1.FileMetadata, error) {
-	fname := path.Join(f.path, name)
-	_, err := os.Stat(fname)
+	if name == "" {
+		return nil, ErrInvalidName
+	}
+
+	id := uuid.New().String()
+	defer f.writing(id)()
+	err := f.db.Update(func(txn *badger.Txn) error {
+		return f.createRecord(txn, id, name, notes, patient, typ, whenNs)
+	})
 	if err != nil {
-		if os.IsExist(err) {
-			return nil, apiv1.ErrFileExists
-		}
-		if !os.IsNotExist(err) {
-			return nil, fmt.Errorf("error checking if file exists when creating: %w", err)
+		if !errors.Is(err, apiv1.ErrFileExists) {
+			os.Remove(path.Join(f.path, id))
 		}
+		return nil, err
 	}
 
-	file, err := os.Create(fname)
+	entry, _, err := f.refresh(id)
 	if err != nil {
 		return nil, err
 	}
-	file.Close()
+	return entry.meta, nil
+}
+
+// createRecord stores the record of a new file & creates it, empty, on disk
+func (f *FilesMetadata) createRecord(txn *badger.Txn, id string, name string, notes string, patient string, typ string, whenNs int64) error {
+	if _, err := txn.Get([]byte(namePrefix + name)); err == nil {
+		return apiv1.ErrFileExists
+	} else if !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
 
-	return getMetaFromStats(fname)
+	rec := &record{
+		Version:     recordVersion,
+		Name:        name,
+		Notes:       notes,
+		PatientID:   patient,
+		Type:        typ,
+		LastUpdated: whenNs,
+	}
+	if err := putRecord(txn, id, rec); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path.Join(f.path, id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	return file.Close()
 }
 
 // Get implements apiv1.FilesMetadata
 func (f *FilesMetadata) Get(id string) (apiv1.FileMetadata, error) {
+	if !isValidID(id) {
+		return nil, apiv1.ErrFileDoesNotExist
+	}
+
+	entry, err := f.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.meta.deleted {
+		return nil, apiv1.ErrFileDoesNotExist
+	}
+	return entry.meta, nil
+}
+
+// lookup returns the index entry for a file, including tombstones, loading it if necessary
+func (f *FilesMetadata) lookup(id string) (indexEntry, error) {
+	f.indexMtx.RLock()
+	entry, ok := f.index[id]
+	f.indexMtx.RUnlock()
+	if ok {
+		return entry, nil
+	}
+
+	entry, _, err := f.refresh(id)
+	return entry, err
+}
+
+// load builds a file's metadata from its record & on-disk stats
+func (f *FilesMetadata) load(id string) (indexEntry, error) {
+	rec, err := f.getRecord(id)
+	if err != nil {
+		return indexEntry{}, err
+	}
+
+	if rec.Deleted {
+		return indexEntry{meta: metaFromRecord(id, rec, 0)}, nil
+	}
+
 	fname := path.Join(f.path, id)
-	m, err := getMetaFromStats(fname)
+	if rec.Version < recordVersion {
+		if rec, err = f.upgrade(id, fname); err != nil {
+			return indexEntry{}, fmt.Errorf("error upgrading metadata record: %w", err)
+		}
+	}
+
+	stats, err := os.Stat(fname)
 	if err != nil {
-		return nil, fmt.Errorf("error getting file stats: %w", err)
+		if os.IsNotExist(err) {
+			return indexEntry{}, apiv1.ErrFileDoesNotExist
+		}
+		return indexEntry{}, fmt.Errorf("error getting file stats: %w", err)
+	}
+
+	m := metaFromRecord(id, rec, stats.Size())
+	if m.ftype == "" {
+		m.ftype, err = getFileType(fname)
+		if err != nil {
+			return indexEntry{}, fmt.Errorf("error getting file type: %w", err)
+		}
 	}
 
-	m.ftype, err = getFileType(fname)
+	return indexEntry{meta: m, modTime: stats.ModTime().UnixNano()}, nil
+}
+
+// refresh reloads a file's metadata into the index. It returns the previous entry, if any
+func (f *FilesMetadata) refresh(id string) (indexEntry, *indexEntry, error) {
+	entry, err := f.load(id)
 	if err != nil {
-		return nil, fmt.Errorf("error getting file type: %w", err)
+		return indexEntry{}, nil, err
 	}
 
-	return m, nil
+	f.indexMtx.Lock()
+	defer f.indexMtx.Unlock()
+	previous, existed := f.index[id]
+	f.index[id] = entry
+	if !existed {
+		return entry, nil, nil
+	}
+	return entry, &previous, nil
+}
+
+// evict drops a file from the index, returning true if it was there
+func (f *FilesMetadata) evict(id string) bool {
+	f.indexMtx.Lock()
+	defer f.indexMtx.Unlock()
+	_, existed := f.index[id]
+	delete(f.index, id)
+	return existed
+}
+
+func (f *FilesMetadata) buildIndex() error {
+	ids, err := f.allIDs()
+	if err != nil {
+		return fmt.Errorf("error listing file ids: %w", err)
+	}
+
+	for _, id := range ids {
+		if _, _, err := f.refresh(id); err != nil {
+			if errors.Is(err, apiv1.ErrFileDoesNotExist) { // removed out-of-band while the server was down
+				if err := f.Remove(id, time.Now().UnixNano()); err != nil {
+					return fmt.Errorf("error recording removal of '%s': %w", id, err)
+				}
+				continue
+			}
+			return fmt.Errorf("error loading '%s': %w", id, err)
+		}
+	}
+	return nil
 }
 
 // GetMany implements apiv1.FilesMetadata
 func (f *FilesMetadata) GetMany(filter *apiv1.Filter) (map[string]apiv1.FileMetadata, error) {
 	metas := make(map[string]apiv1.FileMetadata)
-	var names []string = filter.IDs
-	if names == nil {
-        indir, err := ioutil.ReadDir(f.path)
-        if err != nil {
-            return nil, fmt.Errorf("error fetching files in dir: %w", err)
-        }
-        
-        names = make([]string, 0, len(indir))
-        for _, fi := range indir {
-            if fi.Name() == ".deleted" {
-                continue
-            }
-            names = append(names, fi.Name())
-        }
-	}
-
-	for _, name := range names {
-		fm, err := f.Get(name)
+	var ids []string = filter.IDs
+	if ids == nil {
+		f.indexMtx.RLock()
+		for id, entry := range f.index {
+			if filter.UpdatedAfter == nil || *filter.UpdatedAfter < entry.meta.LastUpdated() {
+				metas[id] = entry.meta
+			}
+		}
+		f.indexMtx.RUnlock()
+		return metas, nil
+	}
+
+	for _, id := range ids {
+		if !isValidID(id) {
+			continue // ids can come from permissions on objects that aren't files
+		}
+
+		entry, err := f.lookup(id)
 		if err != nil {
-			return nil, fmt.Errorf("error fetching `%s`: %w", name, err) // consider returning partial list & error
+			if errors.Is(err, apiv1.ErrFileDoesNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("error fetching `%s`: %w", id, err) // consider returning partial list & error
 		}
 
-		if filter.UpdatedAfter == nil || *filter.UpdatedAfter < fm.LastUpdated() {
-			metas[name] = fm
+		if filter.UpdatedAfter == nil || *filter.UpdatedAfter < entry.meta.LastUpdated() {
+			metas[id] = entry.meta
 		}
 	}
 
 	return metas, nil
 }
 
-// Remove implements apiv1.FilesMetadata
+// Remove implements apiv1.FilesMetadata. The file's contents & metadata are moved into the `.deleted`
+// folder, and a tombstone is kept so that the removal is reported by GetMany. Permissions are saved along
+// with the metadata so that they can be brought back if the file is restored, and then narrowed down to
+// read-only until the tombstone is purged, so that every subject can still see it
 func (f *FilesMetadata) Remove(id string, whenNs int64) error {
-	fname := path.Join(f.path, id)
-	stats, err := os.Stat(fname)
+	if !isValidID(id) {
+		return apiv1.ErrFileDoesNotExist
+	}
+
+	var rec *record
+	err := f.db.Update(func(txn *badger.Txn) error {
+		var err error
+		rec, err = removeRecord(txn, id, whenNs)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("error fetching stats: %w", err)
+		return err
 	}
 
-	if stats.Size() != 0 {
-		return fmt.Errorf("cannot delete metadata with associated contents") // TODO(mredolatti): make this a std error
+	return f.completeRemoval(id, rec, whenNs)
+}
+
+// removeRecord replaces the record of a file with a tombstone, returning the last version of the record
+func removeRecord(txn *badger.Txn, id string, whenNs int64) (*record, error) {
+	rec, err := readRecord(txn, id)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := os.Remove(fname); err != nil {
-		return fmt.Errorf("error removing file: %w", err)
+	if rec.Deleted {
+		return nil, apiv1.ErrFileDoesNotExist
 	}
 
+	if err := txn.Delete([]byte(namePrefix + rec.Name)); err != nil {
+		return nil, err
+	}
+
+	tombstone := &record{Version: recordVersion, Name: rec.Name, LastUpdated: whenNs, Deleted: true}
+	serialized, err := json.Marshal(tombstone)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing tombstone: %w", err)
+	}
+	return rec, txn.Set([]byte(recordPrefix+id), serialized)
+}
+
+// completeRemoval moves a file's contents & last metadata into `.deleted` & drops its permissions, once its
+// tombstone has been stored. Permissions are dropped even if the trash record can't be written
+func (f *FilesMetadata) completeRemoval(id string, rec *record, whenNs int64) error {
+	var errs []string
+	if err := f.writeTrashRecord(id, rec, whenNs); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	// the index is updated before moving the file, so that the watcher doesn't report the removal
+	if _, _, err := f.refresh(id); err != nil {
+		errs = append(errs, fmt.Sprintf("error updating index: %s", err))
+	}
+
+	if err := os.Rename(path.Join(f.path, id), f.trashPath(id)); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, fmt.Sprintf("failed to move contents into `.deleted`: %s", err))
+	}
+
+	// subjects keep read access until the tombstone is purged, so that they (and the index servers syncing
+	// on their behalf) learn about the removal
+	if f.authz != nil {
+		if err := f.authz.RestrictObject(id, apiv1.OperationRead); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to restrict permissions: %s", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("metadata removed, but: %s", strings.Join(errs, "; "))
+	}
 	return nil
 }
 
-// Update implements apiv1.FilesMetadata
+// PurgeTombstones permanently removes files deleted before `beforeNs`
+func (f *FilesMetadata) PurgeTombstones(beforeNs int64) error {
+	ids, err := f.allIDs()
+	if err != nil {
+		return fmt.Errorf("error listing file ids: %w", err)
+	}
+
+	for _, id := range ids {
+		rec, err := f.getRecord(id)
+		if err != nil || !rec.Deleted || rec.LastUpdated >= beforeNs {
+			continue
+		}
+
+		if err := f.drop(id); err != nil {
+			return fmt.Errorf("error purging tombstone for '%s': %w", id, err)
+		}
+
+		f.evict(id)
+		for _, fn := range []string{f.trashPath(id), f.trashPath(id) + ".json"} {
+			if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error removing '%s': %w", fn, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// StartPurging periodically removes tombstones older than `retention`. It runs until Close is called
+func (f *FilesMetadata) StartPurging(retention time.Duration, every time.Duration) {
+	f.stopPurging = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			f.PurgeTombstones(time.Now().Add(-retention).UnixNano()) // errors are retried on the next tick
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}(f.stopPurging)
+}
+
+// trashRecord is the last version of a removed file's metadata & permissions
+type trashRecord struct {
+	ID          string            `json:"id"`
+	DeletedAt   int64             `json:"deletedAt"`
+	Permissions map[string]uint32 `json:"permissions,omitempty"` // subject -> operation bitmask
+	*record
+}
+
+// writeTrashRecord dumps the last version of a file's metadata & permissions next to its contents in `.deleted`,
+// so that removed files can be recovered by hand
+func (f *FilesMetadata) writeTrashRecord(id string, rec *record, whenNs int64) error {
+	trashed := trashRecord{ID: id, DeletedAt: whenNs, record: rec}
+	if f.authz != nil {
+		permissions, err := f.authz.AllForObject(id)
+		if err != nil {
+			return fmt.Errorf("error reading permissions: %w", err)
+		}
+
+		trashed.Permissions = make(map[string]uint32, len(permissions))
+		for subject, permission := range permissions {
+			trashed.Permissions[subject] = uint32(*permission.(*Permission))
+		}
+	}
+
+	serialized, err := json.Marshal(&trashed)
+	if err != nil {
+		return fmt.Errorf("error serializing metadata: %w", err)
+	}
+
+	if err := os.WriteFile(f.trashPath(id)+".json", serialized, 0660); err != nil {
+		return fmt.Errorf("error writing metadata into `.deleted`: %w", err)
+	}
+	return nil
+}
+
+func (f *FilesMetadata) trashPath(id string) string {
+	return path.Join(f.path, deletedFolder, id)
+}
+
+// drop removes the record of a file, along with its permissions
+func (f *FilesMetadata) drop(id string) error {
+	err := f.db.Update(func(txn *badger.Txn) error {
+		rec, err := readRecord(txn, id)
+		if err != nil {
+			return err
+		}
+
+		if err := txn.Delete([]byte(recordPrefix + id)); err != nil {
+			return err
+		}
+
+		if rec.Deleted {
+			return nil // the name has already been released, and might belong to another file by now
+		}
+		return txn.Delete([]byte(namePrefix + rec.Name))
+	})
+	if err != nil && !errors.Is(err, apiv1.ErrFileDoesNotExist) {
+		return fmt.Errorf("failed to drop metadata record: %w", err)
+	}
+
+	if f.authz != nil {
+		if err := f.authz.RemoveObject(id); err != nil {
+			return fmt.Errorf("failed to clean up permissions: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Update implements apiv1.FilesMetadata. Empty fields keep their current value
 func (f *FilesMetadata) Update(id string, updated apiv1.FileMetadata, whenNs int64) (apiv1.FileMetadata, error) {
-	return getMetaFromStats(path.Join(f.path, id)) // do nothing
+	if !isValidID(id) {
+		return nil, apiv1.ErrFileDoesNotExist
+	}
+
+	// make sure legacy records are upgraded before overwriting them
+	if _, err := f.Get(id); err != nil {
+		return nil, err
+	}
+
+	err := f.db.Update(func(txn *badger.Txn) error {
+		return updateRecord(txn, id, updated, whenNs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entry, _, err := f.refresh(id)
+	if err != nil {
+		return nil, err
+	}
+	return entry.meta, nil
+}
+
+// updateRecord applies changes to the record of an existing file
+func updateRecord(txn *badger.Txn, id string, updated apiv1.FileMetadata, whenNs int64) error {
+	current, err := readRecord(txn, id)
+	if err != nil {
+		return err
+	}
+
+	if current.Deleted {
+		return apiv1.ErrFileDoesNotExist
+	}
+
+	next := *current
+	next.Version = recordVersion // legacy records only lack the timestamp, which is overwritten here
+	next.Notes = valueOr(updated.Notes(), current.Notes)
+	next.PatientID = valueOr(updated.PatientID(), current.PatientID)
+	next.Type = valueOr(updated.Type(), current.Type)
+	next.LastUpdated = whenNs
+	if name := updated.Name(); name != "" && name != current.Name {
+		if _, err := txn.Get([]byte(namePrefix + name)); err == nil {
+			return apiv1.ErrFileExists
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		if err := txn.Delete([]byte(namePrefix + current.Name)); err != nil {
+			return err
+		}
+		next.Name = name
+	}
+
+	return putRecord(txn, id, &next)
+}
+
+// touch bumps the last-updated timestamp of a file after its contents change
+func (f *FilesMetadata) touch(id string, whenNs int64) error {
+	err := f.db.Update(func(txn *badger.Txn) error {
+		rec, err := readRecord(txn, id)
+		if err != nil {
+			return err
+		}
+
+		rec.LastUpdated = whenNs
+		return putRecord(txn, id, rec)
+	})
+	if err != nil {
+		return err
+	}
+
+	_, _, err = f.refresh(id)
+	return err
+}
+
+// upgrade fills in a record created before metadata was persisted, using the file's stats
+func (f *FilesMetadata) upgrade(id string, fname string) (*record, error) {
+	stats, err := os.Stat(fname)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching stats: %w", err)
+	}
+
+	var rec *record
+	err = f.db.Update(func(txn *badger.Txn) error {
+		if rec, err = readRecord(txn, id); err != nil {
+			return err
+		}
+
+		if rec.Version >= recordVersion { // upgraded concurrently
+			return nil
+		}
+
+		rec.Version = recordVersion
+		rec.LastUpdated = stats.ModTime().UnixNano()
+		return putRecord(txn, id, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Close stops the watcher, if running, and releases the metadata db
+func (f *FilesMetadata) Close() error {
+	if f.watcher != nil {
+		f.watcher.Close()
+	}
+	if f.stopPurging != nil {
+		close(f.stopPurging)
+	}
+	return f.db.Close()
+}
+
+func (f *FilesMetadata) getRecord(id string) (*record, error) {
+	var rec *record
+	err := f.db.View(func(txn *badger.Txn) error {
+		var err error
+		rec, err = readRecord(txn, id)
+		return err
+	})
+	return rec, err
+}
+
+func (f *FilesMetadata) allIDs() ([]string, error) {
+	var ids []string
+	prefix := []byte(recordPrefix)
+	err := f.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			ids = append(ids, string(it.Item().Key()[len(prefix):]))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// migrate assigns an opaque id to files stored by name, renaming them on disk & moving their permissions
+func (f *FilesMetadata) migrate() error {
+	indir, err := ioutil.ReadDir(f.path)
+	if err != nil {
+		return fmt.Errorf("error fetching files in dir: %w", err)
+	}
+
+	for _, fi := range indir {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+
+		if _, err := f.adopt(fi.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func getMetaFromStats(fn string) (*FileMetadata, error) {
-	stats, err := os.Stat(fn)
+// Atomically implements apiv1.Transactional. Every change performed through tx is applied in a single badger
+// transaction, which is discarded if fn returns an error
+func (f *FilesMetadata) Atomically(fn func(tx apiv1.FilesMetadata) error) error {
+	tx := &txFilesMetadata{f: f, removed: make(map[string]removal)}
+	defer func() {
+		for _, done := range tx.writes {
+			done()
+		}
+	}()
+
+	err := f.db.Update(func(txn *badger.Txn) error {
+		tx.txn = txn
+		return fn(tx)
+	})
+	tx.txn = nil
 	if err != nil {
-		return nil, fmt.Errorf("error fetching stats of newly created file: %w", err)
+		for _, id := range tx.created {
+			os.Remove(path.Join(f.path, id))
+		}
+		return err
+	}
+
+	var errs []string
+	for id := range tx.touched {
+		if _, removed := tx.removed[id]; removed {
+			continue
+		}
+		if _, _, err := f.refresh(id); err != nil {
+			f.evict(id)
+			errs = append(errs, fmt.Sprintf("%s: %s", id, err))
+		}
+	}
+
+	for id, r := range tx.removed {
+		if err := f.completeRemoval(id, r.rec, r.whenNs); err != nil {
+			f.evict(id)
+			errs = append(errs, fmt.Sprintf("%s: %s", id, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: failed to update the index: %s", apiv1.ErrPartiallyCommitted, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// txFilesMetadata reads & writes file records through an ongoing badger transaction
+type txFilesMetadata struct {
+	f       *FilesMetadata
+	txn     *badger.Txn
+	created []string
+	writes  []func()
+	removed map[string]removal
+	touched map[string]struct{}
+}
+
+// removal holds what's needed to move a file removed within a transaction into `.deleted` after committing
+type removal struct {
+	rec    *record
+	whenNs int64
+}
+
+// Get implements apiv1.FilesMetadata
+func (t *txFilesMetadata) Get(id string) (apiv1.FileMetadata, error) {
+	if !isValidID(id) {
+		return nil, apiv1.ErrFileDoesNotExist
 	}
 
+	m, err := t.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.deleted {
+		return nil, apiv1.ErrFileDoesNotExist
+	}
+	return m, nil
+}
+
+// load builds a file's metadata as seen by the transaction, including tombstones
+func (t *txFilesMetadata) load(id string) (*FileMetadata, error) {
+	rec, err := readRecord(t.txn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if rec.Deleted {
+		return metaFromRecord(id, rec, 0), nil
+	}
+
+	fname := path.Join(t.f.path, id)
+	stats, err := os.Stat(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, apiv1.ErrFileDoesNotExist
+		}
+		return nil, fmt.Errorf("error getting file stats: %w", err)
+	}
+
+	m := metaFromRecord(id, rec, stats.Size())
+	if rec.Version < recordVersion {
+		m.lastUpdated = stats.ModTime().UnixNano()
+	}
+	if m.ftype == "" {
+		if m.ftype, err = getFileType(fname); err != nil {
+			return nil, fmt.Errorf("error getting file type: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// GetMany implements apiv1.FilesMetadata. Files not touched by the transaction are read from the index
+func (t *txFilesMetadata) GetMany(filter *apiv1.Filter) (map[string]apiv1.FileMetadata, error) {
+	metas, err := t.f.GetMany(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	for id := range t.touched {
+		if filter.IDs != nil && !contains(filter.IDs, id) {
+			continue
+		}
+
+		delete(metas, id)
+		meta, err := t.load(id)
+		if err != nil {
+			if errors.Is(err, apiv1.ErrFileDoesNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("error fetching `%s`: %w", id, err)
+		}
+
+		if filter.UpdatedAfter == nil || *filter.UpdatedAfter < meta.LastUpdated() {
+			metas[id] = meta
+		}
+	}
+	return metas, nil
+}
+
+// Create implements apiv1.FilesMetadata
+func (t *txFilesMetadata) Create(name string, notes string, patient string, typ string, whenNs int64) (apiv1.FileMetadata, error) {
+	id := uuid.New().String()
+	t.writes = append(t.writes, t.f.writing(id))
+	if err := t.f.createRecord(t.txn, id, name, notes, patient, typ, whenNs); err != nil {
+		if !errors.Is(err, apiv1.ErrFileExists) {
+			os.Remove(path.Join(t.f.path, id))
+		}
+		return nil, err
+	}
+
+	t.created = append(t.created, id)
+	t.touch(id)
+	return t.Get(id)
+}
+
+// Update implements apiv1.FilesMetadata. Empty fields keep their current value
+func (t *txFilesMetadata) Update(id string, updated apiv1.FileMetadata, whenNs int64) (apiv1.FileMetadata, error) {
+	if !isValidID(id) {
+		return nil, apiv1.ErrFileDoesNotExist
+	}
+
+	if err := updateRecord(t.txn, id, updated, whenNs); err != nil {
+		return nil, err
+	}
+
+	t.touch(id)
+	return t.Get(id)
+}
+
+// Remove implements apiv1.FilesMetadata. Contents are moved into `.deleted` once the transaction is committed
+func (t *txFilesMetadata) Remove(id string, whenNs int64) error {
+	if !isValidID(id) {
+		return apiv1.ErrFileDoesNotExist
+	}
+
+	rec, err := removeRecord(t.txn, id, whenNs)
+	if err != nil {
+		return err
+	}
+
+	t.removed[id] = removal{rec: rec, whenNs: whenNs}
+	t.touch(id)
+	return nil
+}
+
+func (t *txFilesMetadata) touch(id string) {
+	if t.touched == nil {
+		t.touched = make(map[string]struct{})
+	}
+	t.touched[id] = struct{}{}
+}
+
+// valueOr returns `value`, or `fallback` if it's empty
+func valueOr(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func contains(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
+
+// adopt creates a record for a file placed in the storage path without one. Files not named after
+// a valid id are assigned one & renamed, after moving their permissions. If interrupted, the name index
+// is used to resume with the id already assigned. Returns the file's id
+func (f *FilesMetadata) adopt(name string) (string, error) {
+	if isValidID(name) {
+		err := f.db.Update(func(txn *badger.Txn) error {
+			if _, err := readRecord(txn, name); !errors.Is(err, apiv1.ErrFileDoesNotExist) {
+				return err // already has a record, or failed to read it
+			}
+			return putRecord(txn, name, &record{Name: name})
+		})
+		if err != nil {
+			return "", fmt.Errorf("error creating record for '%s': %w", name, err)
+		}
+		return name, nil
+	}
+
+	var id string
+	err := f.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(namePrefix + name))
+		if err == nil {
+			return item.Value(func(val []byte) error { id = string(val); return nil })
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		id = uuid.New().String()
+		return putRecord(txn, id, &record{Name: name})
+	})
+	if err != nil {
+		return "", fmt.Errorf("error assigning id to '%s': %w", name, err)
+	}
+
+	// permissions are moved before the file, so that an interrupted adoption finds the file under its old name
+	// and resumes: moving permissions again is a no-op, since none are left on the old name
+	if f.authz != nil {
+		if err := f.authz.RenameObject(name, id); err != nil {
+			return "", fmt.Errorf("error moving permissions from '%s' to '%s': %w", name, id, err)
+		}
+	}
+
+	if err := os.Rename(path.Join(f.path, name), path.Join(f.path, id)); err != nil {
+		if f.authz != nil {
+			if rbErr := f.authz.RenameObject(id, name); rbErr != nil {
+				return "", fmt.Errorf("error renaming '%s' to '%s': %w (permissions could not be moved back: %s)", name, id, err, rbErr)
+			}
+		}
+		return "", fmt.Errorf("error renaming '%s' to '%s': %w", name, id, err)
+	}
+
+	return id, nil
+}
+
+func readRecord(txn *badger.Txn, id string) (*record, error) {
+	item, err := txn.Get([]byte(recordPrefix + id))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, apiv1.ErrFileDoesNotExist
+		}
+		return nil, fmt.Errorf("error reading metadata record: %w", err)
+	}
+
+	var rec record
+	if err := item.Value(func(val []byte) error { return json.Unmarshal(val, &rec) }); err != nil {
+		return nil, fmt.Errorf("error parsing metadata record: %w", err)
+	}
+	return &rec, nil
+}
+
+func putRecord(txn *badger.Txn, id string, rec *record) error {
+	serialized, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("error serializing metadata record: %w", err)
+	}
+
+	if err := txn.Set([]byte(recordPrefix+id), serialized); err != nil {
+		return err
+	}
+	return txn.Set([]byte(namePrefix+rec.Name), []byte(id))
+}
+
+// isValidID returns true if the id is a UUID in its canonical form, which guarantees it's a safe filename
+func isValidID(id string) bool {
+	parsed, err := uuid.Parse(id)
+	return err == nil && parsed.String() == id
+}
+
+// metaFromRecord builds a metadata object from a record. The size is always taken from the file on disk
+func metaFromRecord(id string, rec *record, sizeBytes int64) *FileMetadata {
 	return &FileMetadata{
-		id:          stats.Name(),
-		name:        stats.Name(),
-		sizeBytes:   stats.Size(),
-		notes:       "N/A",
-		patientID:   "N/A",
-		contentID:   stats.Name(),
-		lastUpdated: stats.ModTime().UnixNano(),
-		deleted:     false,
-		ftype:       "N/A",
-	}, nil
+		id:          id,
+		name:        rec.Name,
+		sizeBytes:   sizeBytes,
+		notes:       rec.Notes,
+		patientID:   rec.PatientID,
+		contentID:   id,
+		lastUpdated: rec.LastUpdated,
+		deleted:     rec.Deleted,
+		ftype:       rec.Type,
+	}
 }
 
 func getFileType(fn string) (string, error) {
@@ -224,3 +1054,5 @@ func getFileType(fn string) (string, error) {
 
 var _ apiv1.FileMetadata = (*FileMetadata)(nil)
 var _ apiv1.FilesMetadata = (*FilesMetadata)(nil)
+var _ apiv1.FilesMetadata = (*txFilesMetadata)(nil)
+var _ apiv1.Transactional = (*FilesMetadata)(nil)
@@ -1,59 +1,380 @@
 package fsbasic
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"testing"
 	"time"
 
-	//"github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1"
+	"github.com/dgraph-io/badger/v3"
 	"github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestFsBasicFilesMeta(t *testing.T) {
 
-	_, err := NewFilesMetadata("/test/frula/not/exists")
-	assert.NotNil(t, err)
-
 	dir, err := ioutil.TempDir(os.TempDir(), "mifs_test")
 	assert.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	f, err := NewFilesMetadata(dir)
+	_, err = NewFilesMetadata("/test/frula/not/exists", path.Join(dir, ".meta"), nil)
+	assert.NotNil(t, err)
+
+	f, err := NewFilesMetadata(dir, path.Join(dir, ".meta"), nil)
 	assert.Nil(t, err)
+	defer f.Close()
 
-	fm, err := f.Create("f1", "someNotes", "somePatient", "someType", time.Now().Unix())
+	fm, err := f.Create("f1", "someNotes", "somePatient", "someType", 123)
 	assert.Nil(t, err)
-	assert.Equal(t, "f1", fm.ID())
-	assert.Equal(t, "f1", fm.ContentID())
+	assert.True(t, isValidID(fm.ID()))
+	assert.Equal(t, fm.ID(), fm.ContentID())
 	assert.Equal(t, "f1", fm.Name())
-	assert.Equal(t, "N/A", fm.Notes())
-	assert.Equal(t, "N/A", fm.PatientID())
-	assert.Equal(t, "N/A", fm.Type())
+	assert.Equal(t, "someNotes", fm.Notes())
+	assert.Equal(t, "somePatient", fm.PatientID())
+	assert.Equal(t, "someType", fm.Type())
+	assert.Equal(t, int64(123), fm.LastUpdated())
 	assert.Equal(t, int64(0), fm.SizeBytes())
 
-	fmCopy, err := f.Get("f1")
+	fmCopy, err := f.Get(fm.ID())
 	assert.Nil(t, err)
 	assert.Equal(t, fm, fmCopy)
 
-	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "f1"), []byte("hola"), 0644))
-	f1WithData, err := f.Get("f1")
+	files, err := NewFiles(dir, f)
+	assert.Nil(t, err)
+	assert.Nil(t, files.Write(fm.ID(), []byte("hola"), true))
+	f1WithData, err := f.Get(fm.ID())
 	assert.Nil(t, err)
 	assert.Equal(t, f1WithData.SizeBytes(), int64(4))
 
+	_, err = f.Create("f1", "someNotes", "somePatient", "someType", time.Now().Unix())
+	assert.ErrorIs(t, err, apiv1.ErrFileExists)
+
+	// names are not used as paths
+	fm2, err := f.Create("../../etc/passwd", "someNotes", "somePatient", "someType", time.Now().Unix())
+	assert.Nil(t, err)
+	assert.Equal(t, "../../etc/passwd", fm2.Name())
+	_, err = os.Stat(path.Join(dir, fm2.ID()))
+	assert.Nil(t, err)
+
+	fm3, err := f.Create("studies/2023/ct scan: <final>", "someNotes", "somePatient", "someType", time.Now().Unix())
+	assert.Nil(t, err)
+
+	fms, err := f.GetMany(&apiv1.Filter{IDs: []string{fm.ID(), fm2.ID(), fm3.ID()}})
+	assert.Nil(t, err)
+	assert.Equal(t, f1WithData, fms[fm.ID()])
+	assert.Equal(t, fm2, fms[fm2.ID()])
+	assert.Equal(t, fm3, fms[fm3.ID()])
+
+	all, err := f.GetMany(&apiv1.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(all))
+
+	updated, err := f.Update(fm.ID(), &FileMetadata{name: "f1-renamed", notes: "otherNotes", patientID: "otherPatient", ftype: "otherType"}, 456)
+	assert.Nil(t, err)
+	assert.Equal(t, "f1-renamed", updated.Name())
+	assert.Equal(t, "otherNotes", updated.Notes())
+	assert.Equal(t, "otherPatient", updated.PatientID())
+	assert.Equal(t, "otherType", updated.Type())
+	assert.Equal(t, int64(456), updated.LastUpdated())
+	assert.Equal(t, int64(4), updated.SizeBytes())
 
-	fm2, err := f.Create("f2", "someNotes", "somePatient", "someType", time.Now().Unix())
+	// empty fields keep their current value
+	updated, err = f.Update(fm.ID(), &FileMetadata{notes: "moreNotes"}, 457)
 	assert.Nil(t, err)
+	assert.Equal(t, "f1-renamed", updated.Name())
+	assert.Equal(t, "moreNotes", updated.Notes())
+	assert.Equal(t, "otherPatient", updated.PatientID())
+	assert.Equal(t, "otherType", updated.Type())
+	assert.Equal(t, int64(457), updated.LastUpdated())
+
+	_, err = f.Update(fm.ID(), &FileMetadata{name: fm3.Name()}, 789)
+	assert.ErrorIs(t, err, apiv1.ErrFileExists)
+	_, err = f.Create("f1", "someNotes", "somePatient", "someType", time.Now().Unix())
+	assert.Nil(t, err) // old name was released
 
-	fm3, err := f.Create("f3", "someNotes", "somePatient", "someType", time.Now().Unix())
+	// content changes bump the last-updated timestamp
+	assert.Nil(t, files.Write(fm.ID(), []byte("chau!"), true))
+	touched, err := f.Get(fm.ID())
 	assert.Nil(t, err)
+	assert.Equal(t, int64(5), touched.SizeBytes())
+	assert.Greater(t, touched.LastUpdated(), int64(456))
+	assert.ErrorIs(t, files.Write("0b8f5c6e-6c8b-4c36-9b5e-2f0f3f6a1d52", []byte("orphan"), true), apiv1.ErrFileDoesNotExist)
 
-	fms, err := f.GetMany(&apiv1.Filter{IDs: []string{"f1", "f2", "f3"}})
+	_, err = f.Get("../f1")
+	assert.ErrorIs(t, err, apiv1.ErrFileDoesNotExist)
+
+	assert.Nil(t, f.Remove(fm2.ID(), time.Now().UnixNano()))
+	_, err = f.Get(fm2.ID())
+	assert.ErrorIs(t, err, apiv1.ErrFileDoesNotExist)
+	_, err = f.Create("../../etc/passwd", "someNotes", "somePatient", "someType", time.Now().Unix())
 	assert.Nil(t, err)
+}
 
-	assert.Equal(t, f1WithData, fms["f1"])
-	assert.Equal(t, fm2, fms["f2"])
-	assert.Equal(t, fm3, fms["f3"])
+func TestFsBasicFilesMetaMigration(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "mifs_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	authz, err := NewAuthz(path.Join(dir, ".authdb"))
+	assert.Nil(t, err)
+	defer authz.db.Close()
+
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "legacy.txt"), []byte("hola"), 0644))
+	assert.Nil(t, authz.Grant("martin", apiv1.OperationRead, "legacy.txt"))
+
+	f, err := NewFilesMetadata(dir, path.Join(dir, ".meta"), authz)
+	assert.Nil(t, err)
+
+	all, err := f.GetMany(&apiv1.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(all))
+
+	var migrated apiv1.FileMetadata
+	for _, m := range all {
+		migrated = m
+	}
+	assert.True(t, isValidID(migrated.ID()))
+	assert.Equal(t, "legacy.txt", migrated.Name())
+	assert.Equal(t, int64(4), migrated.SizeBytes())
+	assert.NotEqual(t, int64(0), migrated.LastUpdated())
+
+	// legacy records are upgraded on first read
+	rec, err := f.getRecord(migrated.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, recordVersion, rec.Version)
+	assert.Equal(t, migrated.LastUpdated(), rec.LastUpdated)
+
+	_, err = os.Stat(path.Join(dir, "legacy.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	can, err := authz.Can("martin", apiv1.OperationRead, migrated.ID())
+	assert.Nil(t, err)
+	assert.True(t, can)
+
+	// migration is idempotent
+	assert.Nil(t, f.Close())
+	f, err = NewFilesMetadata(dir, path.Join(dir, ".meta"), authz)
+	assert.Nil(t, err)
+	defer f.Close()
+	again, err := f.Get(migrated.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, migrated, again)
+}
+
+func TestFsBasicFilesMetaMigrationInterrupted(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "mifs_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	authz, err := NewAuthz(path.Join(dir, ".authdb"))
+	assert.Nil(t, err)
+	defer authz.db.Close()
+
+	f, err := NewFilesMetadata(dir, path.Join(dir, ".meta"), authz)
+	assert.Nil(t, err)
+
+	// the file can't be renamed: permissions stay on the old name
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, "legacy.txt"), []byte("hola"), 0644))
+	assert.Nil(t, authz.Grant("martin", apiv1.OperationRead, "legacy.txt"))
+	id := "0b8f5c6e-6c8b-4c36-9b5e-2f0f3f6a1d52"
+	assert.Nil(t, f.db.Update(func(txn *badger.Txn) error { return putRecord(txn, id, &record{Name: "legacy.txt"}) }))
+	assert.Nil(t, os.MkdirAll(path.Join(dir, id, "blocker"), 0770))
+
+	_, err = f.adopt("legacy.txt")
+	assert.NotNil(t, err)
+	can, err := authz.Can("martin", apiv1.OperationRead, "legacy.txt")
+	assert.Nil(t, err)
+	assert.True(t, can)
+	can, err = authz.Can("martin", apiv1.OperationRead, id)
+	assert.Nil(t, err)
+	assert.False(t, can)
+
+	// the process died after moving permissions but before renaming the file
+	assert.Nil(t, os.RemoveAll(path.Join(dir, id)))
+	assert.Nil(t, authz.RenameObject("legacy.txt", id))
+	assert.Nil(t, f.Close())
+
+	f, err = NewFilesMetadata(dir, path.Join(dir, ".meta"), authz)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	migrated, err := f.Get(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy.txt", migrated.Name())
+	can, err = authz.Can("martin", apiv1.OperationRead, id)
+	assert.Nil(t, err)
+	assert.True(t, can)
+}
+
+func TestFsBasicFilesMetaTombstones(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "mifs_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	authz, err := NewAuthz(path.Join(dir, ".authz"))
+	assert.Nil(t, err)
+	defer authz.db.Close()
+
+	f, err := NewFilesMetadata(dir, path.Join(dir, ".meta"), authz)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	files, err := NewFiles(dir, f)
+	assert.Nil(t, err)
+
+	fm, err := f.Create("f1", "someNotes", "somePatient", "someType", 100)
+	assert.Nil(t, err)
+	assert.Nil(t, files.Write(fm.ID(), []byte("hola"), true))
+	assert.Nil(t, authz.Grant("martin", apiv1.OperationRead|apiv1.OperationWrite, fm.ID()))
+	kept, err := f.Create("f2", "someNotes", "somePatient", "someType", 100)
+	assert.Nil(t, err)
+
+	// files with contents can be removed, and both contents & metadata end up in `.deleted`
+	assert.Nil(t, f.Remove(fm.ID(), 200))
+	_, err = os.Stat(path.Join(dir, fm.ID()))
+	assert.True(t, os.IsNotExist(err))
+	contents, err := ioutil.ReadFile(path.Join(dir, deletedFolder, fm.ID()))
+	assert.Nil(t, err)
+	assert.Equal(t, "hola", string(contents))
+
+	// permissions are narrowed down to read-only, and saved along with the metadata
+	allowed, err := authz.Can("martin", apiv1.OperationRead, fm.ID())
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+	allowed, err = authz.Can("martin", apiv1.OperationWrite, fm.ID())
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+	raw, err := ioutil.ReadFile(path.Join(dir, deletedFolder, fm.ID()+".json"))
+	assert.Nil(t, err)
+	trashed := trashRecord{record: &record{}}
+	assert.Nil(t, json.Unmarshal(raw, &trashed))
+	assert.Equal(t, fm.ID(), trashed.ID)
+	assert.Equal(t, int64(200), trashed.DeletedAt)
+	assert.Equal(t, "f1", trashed.Name)
+	assert.Equal(t, map[string]uint32{"martin": uint32(apiv1.OperationRead | apiv1.OperationWrite)}, trashed.Permissions)
+
+	_, err = f.Get(fm.ID())
+	assert.ErrorIs(t, err, apiv1.ErrFileDoesNotExist)
+	assert.ErrorIs(t, f.Remove(fm.ID(), 300), apiv1.ErrFileDoesNotExist)
+	assert.ErrorIs(t, files.Write(fm.ID(), []byte("again"), true), apiv1.ErrFileDoesNotExist)
+
+	// tombstones are reported, and filtered by deletion time
+	all, err := f.GetMany(&apiv1.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(all))
+	assert.True(t, all[fm.ID()].Deleted())
+	assert.Equal(t, int64(200), all[fm.ID()].LastUpdated())
+	assert.False(t, all[kept.ID()].Deleted())
+
+	after := int64(150)
+	changed, err := f.GetMany(&apiv1.Filter{UpdatedAfter: &after})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changed))
+	assert.True(t, changed[fm.ID()].Deleted())
+
+	byID, err := f.GetMany(&apiv1.Filter{IDs: []string{fm.ID()}})
+	assert.Nil(t, err)
+	assert.True(t, byID[fm.ID()].Deleted())
+
+	after = 250
+	changed, err = f.GetMany(&apiv1.Filter{UpdatedAfter: &after})
+	assert.Nil(t, err)
+	assert.Empty(t, changed)
+
+	// the name is released, and reusing it doesn't affect the tombstone
+	reused, err := f.Create("f1", "someNotes", "somePatient", "someType", 300)
+	assert.Nil(t, err)
+	assert.NotEqual(t, fm.ID(), reused.ID())
+
+	// purging only drops tombstones older than the supplied timestamp
+	assert.Nil(t, f.PurgeTombstones(200))
+	all, err = f.GetMany(&apiv1.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(all))
+
+	assert.Nil(t, f.PurgeTombstones(201))
+	all, err = f.GetMany(&apiv1.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(all))
+	_, ok := all[fm.ID()]
+	assert.False(t, ok)
+	_, err = os.Stat(path.Join(dir, deletedFolder, fm.ID()))
+	assert.True(t, os.IsNotExist(err))
+	allowed, err = authz.Can("martin", apiv1.OperationRead, fm.ID())
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+
+	_, err = f.Create("f1", "someNotes", "somePatient", "someType", 400)
+	assert.ErrorIs(t, err, apiv1.ErrFileExists) // still owned by the new file
+}
+
+func TestFsBasicFilesMetaAtomically(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "mifs_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	f, err := NewFilesMetadata(dir, path.Join(dir, ".meta"), nil)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	existing, err := f.Create("f1", "someNotes", "somePatient", "someType", 123)
+	assert.Nil(t, err)
+
+	// a failing operation discards every change performed before it
+	var discarded string
+	err = f.Atomically(func(tx apiv1.FilesMetadata) error {
+		created, err := tx.Create("f2", "", "", "", 124)
+		assert.Nil(t, err)
+		discarded = created.ID()
+		assert.Nil(t, tx.Remove(existing.ID(), 124))
+		_, err = tx.Update(existing.ID(), &FileMetadata{name: "f3"}, 124)
+		return err
+	})
+	assert.ErrorIs(t, err, apiv1.ErrFileDoesNotExist)
+	_, err = f.Get(discarded)
+	assert.ErrorIs(t, err, apiv1.ErrFileDoesNotExist)
+	_, err = os.Stat(path.Join(dir, discarded))
+	assert.True(t, os.IsNotExist(err))
+	current, err := f.Get(existing.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, existing, current)
+
+	var created apiv1.FileMetadata
+	err = f.Atomically(func(tx apiv1.FilesMetadata) error {
+		if created, err = tx.Create("f2", "", "", "", 125); err != nil {
+			return err
+		}
+
+		// changes are visible within the transaction
+		if _, err := tx.Create("f2", "", "", "", 125); !errors.Is(err, apiv1.ErrFileExists) {
+			return fmt.Errorf("expected a name conflict, got: %v", err)
+		}
+		if _, err := tx.Update(created.ID(), &FileMetadata{name: "f2 v2"}, 126); err != nil {
+			return err
+		}
+		return tx.Remove(existing.ID(), 126)
+	})
+	assert.Nil(t, err)
+
+	current, err = f.Get(created.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, "f2 v2", current.Name())
+	assert.Equal(t, int64(126), current.LastUpdated())
+	_, err = f.Get(existing.ID())
+	assert.ErrorIs(t, err, apiv1.ErrFileDoesNotExist)
+	_, err = os.Stat(path.Join(dir, deletedFolder, existing.ID()))
+	assert.Nil(t, err)
+
+	all, err := f.GetMany(&apiv1.Filter{})
+	assert.Nil(t, err)
+	assert.Len(t, all, 2)
+	assert.False(t, all[created.ID()].Deleted())
+	assert.True(t, all[existing.ID()].Deleted())
 }
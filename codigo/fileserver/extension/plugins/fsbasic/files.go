@@ -6,31 +6,53 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"time"
 
 	"github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1"
 )
 
 type Files struct {
 	rootPath string
+	metas    *FilesMetadata
 }
 
-func NewFiles(path string) (*Files, error) {
+// NewFiles constructs a content store for files in `path`. If a metadata store is supplied, contents can only
+// be written for files with a metadata record, and the record is updated on every change
+func NewFiles(path string, metas *FilesMetadata) (*Files, error) {
 	if stats, err := os.Stat(path); err != nil || !stats.IsDir() {
 		return nil, fmt.Errorf("cannot use '%s' as path: %w", path, err)
 	}
 
-	return &Files{path}, nil
+	return &Files{rootPath: path, metas: metas}, nil
 }
 
 // Del implements apiv1.Files
 func (f *Files) Del(id string) error {
+	fp, err := f.buildPath(id)
+	if err != nil {
+		return err
+	}
+
+	if f.metas != nil {
+		defer f.metas.writing(id)()
+	}
+
 	// truncate only, to keep "metadata" alive
-	return os.Truncate(f.buildPath(id), 0)
+	if err := os.Truncate(fp, 0); err != nil {
+		return err
+	}
+
+	return f.touch(id)
 }
 
 // Read implements apiv1.Files
 func (f *Files) Read(id string) ([]byte, error) {
-	res, err := ioutil.ReadFile(f.buildPath(id))
+	fp, err := f.buildPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ioutil.ReadFile(fp)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return nil, apiv1.ErrFileDoesNotExist
@@ -42,7 +64,10 @@ func (f *Files) Read(id string) ([]byte, error) {
 
 // Write implements apiv1.Files
 func (f *Files) Write(id string, data []byte, force bool) error {
-	fp := f.buildPath(id)
+	fp, err := f.buildPath(id)
+	if err != nil {
+		return err
+	}
 
 	exists := true
 	if _, err := os.Stat(fp); errors.Is(err, os.ErrNotExist) {
@@ -53,11 +78,43 @@ func (f *Files) Write(id string, data []byte, force bool) error {
 		return apiv1.ErrFileExists
 	}
 
-	return os.WriteFile(fp, data, 0660)
+	if f.metas != nil {
+		rec, err := f.metas.getRecord(id)
+		if err != nil {
+			return err
+		}
+
+		if rec.Deleted {
+			return apiv1.ErrFileDoesNotExist
+		}
+
+		defer f.metas.writing(id)()
+	}
+
+	if err := os.WriteFile(fp, data, 0660); err != nil {
+		return err
+	}
+
+	return f.touch(id)
 }
 
-func (f *Files) buildPath(id string) string {
-	return path.Join(f.rootPath, id)
+func (f *Files) touch(id string) error {
+	if f.metas == nil {
+		return nil
+	}
+
+	if err := f.metas.touch(id, time.Now().UnixNano()); err != nil {
+		return fmt.Errorf("contents updated, but failed to update metadata: %w", err)
+	}
+	return nil
+}
+
+// buildPath returns the on-disk location of a file, rejecting ids that could escape the root path
+func (f *Files) buildPath(id string) (string, error) {
+	if !isValidID(id) {
+		return "", ErrInvalidID
+	}
+	return path.Join(f.rootPath, id), nil
 }
 
 var _ apiv1.Files = (*Files)(nil)
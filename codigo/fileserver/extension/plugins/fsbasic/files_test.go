@@ -11,17 +11,21 @@ import (
 
 func TestFsBasicFiles(t *testing.T) {
 
-	_, err := NewFiles("/test/frula/not/exists")
+	_, err := NewFiles("/test/frula/not/exists", nil)
 	assert.NotNil(t, err)
 
 	dir, err := ioutil.TempDir(os.TempDir(), "mifs_test")
 	assert.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	f, err := NewFiles(dir)
+	f, err := NewFiles(dir, nil)
 	assert.Nil(t, err)
 
-	fileId := "someId"
+	_, err = f.Read("../../etc/passwd")
+	assert.ErrorIs(t, err, ErrInvalidID)
+	assert.ErrorIs(t, f.Write("../escaped", []byte("some_data"), true), ErrInvalidID)
+
+	fileId := "0b8f5c6e-6c8b-4c36-9b5e-2f0f3f6a1d52"
 	_, err = f.Read(fileId)
 	assert.ErrorIs(t, err, apiv1.ErrFileDoesNotExist)
 
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/mredolatti/tf/codigo/fileserver/extension/contracts"
 	"github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1"
@@ -40,12 +41,17 @@ func Create(args map[string]interface{}) (apiv1.Plugin, error) {
 	if p.auth, err = fsbasic.NewAuthz(cfg.AuthDBPath); err != nil {
 		return nil, fmt.Errorf("error setting up authorization db: %w", err)
 	}
-	if p.files, err = fsbasic.NewFiles(cfg.FilePath); err != nil {
-		return nil, fmt.Errorf("error setting up file repository: %w", err)
+	if p.filesmeta, err = fsbasic.NewFilesMetadata(cfg.FilePath, cfg.MetaDBPath, p.auth); err != nil {
+		return nil, fmt.Errorf("error setting up file meta repository: %w", err)
 	}
 
-	if p.filesmeta, err = fsbasic.NewFilesMetadata(cfg.FilePath); err != nil {
-		return nil, fmt.Errorf("error setting up file meta repository: %w", err)
+	if err = p.filesmeta.StartWatching(); err != nil {
+		return nil, fmt.Errorf("error watching storage path for changes: %w", err)
+	}
+	p.filesmeta.StartPurging(cfg.TombstoneRetention, time.Hour)
+
+	if p.files, err = fsbasic.NewFiles(cfg.FilePath, p.filesmeta); err != nil {
+		return nil, fmt.Errorf("error setting up file repository: %w", err)
 	}
 
 	return &p, nil
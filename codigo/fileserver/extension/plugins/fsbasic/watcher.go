@@ -0,0 +1,177 @@
+package fsbasic
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1"
+)
+
+// StartWatching monitors the storage path for files added, modified or removed without going through
+// the api, and keeps the in-memory index up to date. Changes are reported to the listener set with Watch
+func (f *FilesMetadata) StartWatching() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating fs watcher: %w", err)
+	}
+
+	if err := watcher.Add(f.path); err != nil {
+		watcher.Close()
+		return fmt.Errorf("error watching '%s': %w", f.path, err)
+	}
+
+	f.watcher = watcher
+	go f.watch(watcher)
+	return nil
+}
+
+// Watch implements apiv1.Watcher
+func (f *FilesMetadata) Watch(listener func(apiv1.Change)) {
+	f.listenerMtx.Lock()
+	f.listener = listener
+	f.listenerMtx.Unlock()
+}
+
+// defaultSettleDelay is how long a file must go without events before the watcher picks it up, so that
+// files still being copied into the storage path aren't adopted half-written
+const defaultSettleDelay = time.Second
+
+func (f *FilesMetadata) watch(watcher *fsnotify.Watcher) {
+	pending := make(map[string]*time.Timer)
+	settled := make(chan string)
+	done := make(chan struct{})
+	defer func() {
+		for _, timer := range pending {
+			timer.Stop()
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if strings.HasPrefix(filepath.Base(event.Name), ".") {
+				continue
+			}
+
+			if timer, ok := pending[event.Name]; ok {
+				timer.Reset(f.settleDelay)
+				continue
+			}
+
+			path := event.Name
+			pending[path] = time.AfterFunc(f.settleDelay, func() {
+				select {
+				case settled <- path:
+				case <-done:
+				}
+			})
+		case path := <-settled:
+			delete(pending, path)
+			f.handle(path)
+		case _, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// nothing to report errors to. the index will catch up on the next event for the file
+		}
+	}
+}
+
+func (f *FilesMetadata) handle(path string) {
+	name := filepath.Base(path)
+	if f.isWriting(name) {
+		return // changed through the api, which keeps the index up to date & reports nothing
+	}
+
+	stats, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) && isValidID(name) { // removed or moved out of the storage path
+			if rec, err := f.getRecord(name); err != nil || rec.Deleted {
+				return // unknown file, or removed through the api
+			}
+
+			if f.Remove(name, time.Now().UnixNano()) == nil {
+				f.emit(apiv1.Change{Type: apiv1.ChangeRemoved, FileID: name})
+			}
+		}
+		return
+	}
+
+	if stats.IsDir() {
+		return
+	}
+
+	if !isValidID(name) {
+		f.adopt(name) // the file is renamed to its new id, which triggers a new event
+		return
+	}
+
+	rec, err := f.getRecord(name)
+	switch {
+	case errors.Is(err, apiv1.ErrFileDoesNotExist):
+		if _, err := f.adopt(name); err != nil {
+			return
+		}
+	case err != nil, rec.Deleted:
+		return
+	}
+
+	entry, previous, err := f.refresh(name)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case previous == nil:
+		f.emit(apiv1.Change{Type: apiv1.ChangeAdded, FileID: name})
+	case previous.modTime != entry.modTime || previous.meta.sizeBytes != entry.meta.sizeBytes:
+		if entry.meta.lastUpdated < entry.modTime { // contents changed without going through the api
+			if f.touch(name, entry.modTime) != nil {
+				return
+			}
+		}
+		f.emit(apiv1.Change{Type: apiv1.ChangeUpdated, FileID: name})
+	}
+}
+
+// writing marks a file as being changed through the api until the returned function is called, so that
+// the watcher doesn't report those changes a second time
+func (f *FilesMetadata) writing(id string) func() {
+	f.ownMtx.Lock()
+	f.ownWrites[id]++
+	f.ownMtx.Unlock()
+	return func() {
+		f.ownMtx.Lock()
+		if f.ownWrites[id]--; f.ownWrites[id] <= 0 {
+			delete(f.ownWrites, id)
+		}
+		f.ownMtx.Unlock()
+	}
+}
+
+func (f *FilesMetadata) isWriting(id string) bool {
+	f.ownMtx.Lock()
+	defer f.ownMtx.Unlock()
+	return f.ownWrites[id] > 0
+}
+
+func (f *FilesMetadata) emit(change apiv1.Change) {
+	f.listenerMtx.RLock()
+	listener := f.listener
+	f.listenerMtx.RUnlock()
+	if listener != nil {
+		listener(change)
+	}
+}
+
+var _ apiv1.Watcher = (*FilesMetadata)(nil)
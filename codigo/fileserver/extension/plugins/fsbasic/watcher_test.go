@@ -0,0 +1,87 @@
+package fsbasic
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsBasicWatcher(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "mifs_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	f, err := NewFilesMetadata(dir, path.Join(dir, ".meta"), nil)
+	assert.Nil(t, err)
+	defer f.Close()
+	f.settleDelay = 50 * time.Millisecond
+
+	changes := make(chan apiv1.Change, 100)
+	f.Watch(func(c apiv1.Change) { changes <- c })
+	assert.Nil(t, f.StartWatching())
+
+	next := func() apiv1.Change {
+		select {
+		case c := <-changes:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for change")
+		}
+		return apiv1.Change{}
+	}
+
+	// a file dropped into the directory is adopted & reported once it's fully written
+	fd, err := os.Create(path.Join(dir, "scan.dcm"))
+	assert.Nil(t, err)
+	_, err = fd.Write([]byte("some_"))
+	assert.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = fd.Write([]byte("data"))
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	added := next()
+	assert.Equal(t, apiv1.ChangeAdded, added.Type)
+	assert.True(t, isValidID(added.FileID))
+
+	all, err := f.GetMany(&apiv1.Filter{})
+	assert.Nil(t, err)
+	assert.Len(t, all, 1)
+	assert.Equal(t, "scan.dcm", all[added.FileID].Name())
+	assert.Equal(t, int64(9), all[added.FileID].SizeBytes())
+
+	// out-of-band updates bump the last-updated timestamp
+	previous := all[added.FileID].LastUpdated()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, ioutil.WriteFile(path.Join(dir, added.FileID), []byte("some_longer_data"), 0644))
+	for c := next(); c.Type != apiv1.ChangeUpdated; c = next() {
+	}
+	updated, err := f.Get(added.FileID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(16), updated.SizeBytes())
+	assert.Greater(t, updated.LastUpdated(), previous)
+
+	// as do out-of-band deletions
+	assert.Nil(t, os.Remove(path.Join(dir, added.FileID)))
+	for c := next(); c.Type != apiv1.ChangeRemoved; c = next() {
+	}
+	_, err = f.Get(added.FileID)
+	assert.ErrorIs(t, err, apiv1.ErrFileDoesNotExist)
+
+	// changes made through the api are not reported by the watcher
+	files, err := NewFiles(dir, f)
+	assert.Nil(t, err)
+	created, err := f.Create("f1", "", "", "", time.Now().UnixNano())
+	assert.Nil(t, err)
+	assert.Nil(t, files.Write(created.ID(), []byte("api_data"), true))
+	time.Sleep(200 * time.Millisecond)
+	assert.Nil(t, f.Remove(created.ID(), time.Now().UnixNano()))
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, changes)
+}
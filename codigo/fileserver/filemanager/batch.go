@@ -0,0 +1,291 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/fileserver/audit"
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
+	"github.com/mredolatti/tf/codigo/fileserver/models"
+	"github.com/mredolatti/tf/codigo/fileserver/storage"
+)
+
+// Batch operation types
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+	BatchGrant  = "grant"
+)
+
+// Batch errors
+var (
+	ErrAtomicUnsupported     = errors.New("the storage backend cannot apply batches atomically")
+	ErrInvalidBatchOperation = errors.New("invalid batch operation")
+	ErrBatchAborted          = errors.New("not applied because another operation in the batch failed")
+)
+
+// BatchOperation is a single item in a batch
+type BatchOperation struct {
+	Type      string
+	FileID    string              // update, delete & grant
+	Data      models.FileMetadata // create & update
+	Subject   string              // grant
+	Operation authz.Operation     // grant
+}
+
+// BatchResult is the outcome of a single item in a batch
+type BatchResult struct {
+	Meta models.FileMetadata // created or updated record
+	Err  error
+}
+
+// batchEffects holds what needs to be done once an operation's metadata changes have been stored
+type batchEffects struct {
+	grants  []grant
+	changes []Change
+}
+
+type grant struct {
+	subject   string
+	operation authz.Operation
+	fileID    string
+}
+
+// BatchFileMetadata applies a list of metadata operations, reporting a result for each of them.
+// If `atomic` is set, either every operation is applied or none is, which requires a storage implementing
+// storage.Transactional. Listeners are notified once the whole batch is processed, with a single change
+// per file & user reflecting its final state. Listeners registered with AddChangesListener get all of them at once
+func (i *Impl) BatchFileMetadata(ctx context.Context, user string, ops []BatchOperation, atomic bool) ([]BatchResult, error) {
+	if atomic {
+		return i.batchAtomic(ctx, user, ops)
+	}
+
+	results := make([]BatchResult, len(ops))
+	removed := i.lookupRemovals(ops)
+	changes := newChangeSet()
+	for idx := range ops {
+		op := &ops[idx]
+		err := i.authorizeBatchOp(user, op)
+		if err == nil {
+			var effects *batchEffects
+			results[idx].Meta, effects, err = execute(i.metadatas, user, op, time.Now().UnixNano())
+			if err == nil {
+				i.applyEffects(effects, changes)
+			}
+		}
+		results[idx].Err = err
+		i.recordBatchOp(ctx, user, op, results[idx].Meta, removed[idx], err)
+	}
+
+	changes.notify(i)
+	return results, nil
+}
+
+func (i *Impl) batchAtomic(ctx context.Context, user string, ops []BatchOperation) ([]BatchResult, error) {
+	tx, ok := i.metadatas.(storage.Transactional)
+	if !ok {
+		return nil, ErrAtomicUnsupported
+	}
+
+	// every permission is checked before touching the storage, since authorization changes can't be rolled back
+	results := make([]BatchResult, len(ops))
+	failed := false
+	for idx := range ops {
+		if err := i.authorizeBatchOp(user, &ops[idx]); err != nil {
+			results[idx].Err = err
+			failed = true
+		}
+	}
+
+	removed := i.lookupRemovals(ops)
+	effects := make([]*batchEffects, len(ops))
+	if !failed {
+		now := time.Now().UnixNano()
+		err := tx.Atomically(func(store storage.FilesMetadata) error {
+			for idx := range ops {
+				meta, eff, err := execute(store, user, &ops[idx], now)
+				if err != nil {
+					results[idx].Err = err
+					return err
+				}
+				results[idx].Meta, effects[idx] = meta, eff
+			}
+			return nil
+		})
+		if errors.Is(err, storage.ErrPartiallyCommitted) { // persisted anyway, so grants & notifications must follow
+			if i.logger != nil {
+				i.logger.Error("filemanager.batch: %s", err)
+			}
+			err = nil
+		}
+		failed = err != nil
+	}
+
+	if failed {
+		for idx := range results {
+			results[idx].Meta = nil
+			if results[idx].Err == nil {
+				results[idx].Err = ErrBatchAborted
+			}
+			i.recordBatchOp(ctx, user, &ops[idx], nil, removed[idx], results[idx].Err)
+		}
+		return results, nil
+	}
+
+	changes := newChangeSet()
+	for idx := range ops {
+		i.applyEffects(effects[idx], changes)
+		i.recordBatchOp(ctx, user, &ops[idx], results[idx].Meta, removed[idx], nil)
+	}
+	changes.notify(i)
+	return results, nil
+}
+
+// authorizeBatchOp validates an operation & checks that the user is allowed to perform it
+func (i *Impl) authorizeBatchOp(user string, op *BatchOperation) error {
+	var required authz.Operation
+	var object string
+	switch op.Type {
+	case BatchCreate:
+		if op.Data == nil {
+			return fmt.Errorf("%w: create requires file metadata", ErrInvalidBatchOperation)
+		}
+		required, object = authz.OperationCreate, authz.AnyObject
+	case BatchUpdate:
+		if op.FileID == "" || op.Data == nil {
+			return fmt.Errorf("%w: update requires a file id & metadata", ErrInvalidBatchOperation)
+		}
+		required, object = authz.OperationWrite, op.FileID
+	case BatchDelete:
+		if op.FileID == "" {
+			return fmt.Errorf("%w: delete requires a file id", ErrInvalidBatchOperation)
+		}
+		required, object = authz.OperationWrite, op.FileID
+	case BatchGrant:
+		if op.FileID == "" || op.Subject == "" || !authz.IsValidOperation(op.Operation) {
+			return fmt.Errorf("%w: grant requires a file id, a subject & a valid operation", ErrInvalidBatchOperation)
+		}
+		required, object = authz.OperationAdmin, op.FileID
+	default:
+		return fmt.Errorf("%w: unknown type '%s'", ErrInvalidBatchOperation, op.Type)
+	}
+
+	allowed, err := can(i.authorization, user, required, object)
+	if err != nil {
+		return fmt.Errorf("error reading permissions: %w", err)
+	}
+
+	if !allowed {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// execute performs the storage side of an already authorized operation
+func execute(store storage.FilesMetadata, user string, op *BatchOperation, whenNs int64) (models.FileMetadata, *batchEffects, error) {
+	switch op.Type {
+	case BatchCreate:
+		meta, err := store.Create(op.Data.Name(), op.Data.Notes(), op.Data.PatientID(), op.Data.Type(), whenNs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error storing new file-meta: %w", err)
+		}
+		return meta, &batchEffects{
+			grants: []grant{
+				{subject: user, operation: authz.OperationRead, fileID: meta.ID()},
+				{subject: user, operation: authz.OperationWrite, fileID: meta.ID()},
+				{subject: user, operation: authz.OperationAdmin, fileID: meta.ID()},
+			},
+			changes: []Change{{EventType: EventFileAvailable, FileRef: meta.ID(), User: user}},
+		}, nil
+	case BatchUpdate:
+		meta, err := store.Update(op.FileID, op.Data, whenNs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error updating file-meta: %w", err)
+		}
+		return meta, &batchEffects{changes: []Change{{EventType: EventFileAvailable, FileRef: meta.ID(), User: user}}}, nil
+	case BatchDelete:
+		if err := store.Remove(op.FileID, whenNs); err != nil {
+			return nil, nil, fmt.Errorf("error removing file-meta: %w", err)
+		}
+		return nil, &batchEffects{changes: []Change{{EventType: EventFileNotAvailable, FileRef: op.FileID, User: authz.EveryOne}}}, nil
+	case BatchGrant:
+		return nil, &batchEffects{
+			grants:  []grant{{subject: op.Subject, operation: op.Operation, fileID: op.FileID}},
+			changes: []Change{{EventType: EventFileAvailable, FileRef: op.FileID, User: op.Subject}},
+		}, nil
+	}
+	return nil, nil, fmt.Errorf("%w: unknown type '%s'", ErrInvalidBatchOperation, op.Type)
+}
+
+func (i *Impl) applyEffects(effects *batchEffects, changes *changeSet) {
+	for _, g := range effects.grants {
+		if err := i.authorization.Grant(g.subject, g.operation, g.fileID); err != nil && i.logger != nil {
+			i.logger.Error("filemanager.batch: error granting operation %d on file %s to %s: %s", g.operation, g.fileID, g.subject, err)
+		}
+	}
+
+	for _, c := range effects.changes {
+		changes.add(c)
+	}
+}
+
+// lookupRemovals fetches the metadata of the files about to be deleted, since it won't be available after the
+// batch is applied & is needed to audit the deletions
+func (i *Impl) lookupRemovals(ops []BatchOperation) []models.FileMetadata {
+	removed := make([]models.FileMetadata, len(ops))
+	if i.auditor == nil {
+		return removed
+	}
+
+	for idx := range ops {
+		if ops[idx].Type == BatchDelete && ops[idx].FileID != "" {
+			removed[idx] = i.lookup(ops[idx].FileID)
+		}
+	}
+	return removed
+}
+
+func (i *Impl) recordBatchOp(ctx context.Context, user string, op *BatchOperation, meta models.FileMetadata, removed models.FileMetadata, err error) {
+	id := op.FileID
+	if meta != nil {
+		id = meta.ID()
+	}
+
+	switch op.Type {
+	case BatchCreate:
+		i.record(ctx, audit.OperationCreate, user, id, op.Data, "batch", err)
+	case BatchUpdate:
+		i.record(ctx, audit.OperationUpdate, user, id, meta, "batch", err)
+	case BatchDelete:
+		i.record(ctx, audit.OperationDelete, user, id, removed, "batch", err)
+	case BatchGrant:
+		i.record(ctx, audit.OperationGrant, user, id, nil, fmt.Sprintf("batch subject=%s operation=%d", op.Subject, op.Operation), err)
+	}
+}
+
+// changeSet coalesces changes so that a single one is sent per file & user, carrying the last event type
+type changeSet struct {
+	changes []Change
+	index   map[string]int
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{index: make(map[string]int)}
+}
+
+func (s *changeSet) add(c Change) {
+	key := c.FileRef + "\x00" + c.User
+	if idx, ok := s.index[key]; ok {
+		s.changes[idx] = c
+		return
+	}
+	s.index[key] = len(s.changes)
+	s.changes = append(s.changes, c)
+}
+
+func (s *changeSet) notify(i *Impl) {
+	i.notifyAll(s.changes)
+}
@@ -0,0 +1,188 @@
+package filemanager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/mredolatti/tf/codigo/common/dtos"
+	"github.com/mredolatti/tf/codigo/fileserver/audit"
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
+	authzBasic "github.com/mredolatti/tf/codigo/fileserver/authz/basic"
+	"github.com/mredolatti/tf/codigo/fileserver/storage"
+	"github.com/mredolatti/tf/codigo/fileserver/storage/basic"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupBatchTest() (*Impl, *authzBasic.InMemoryAuthz, *[]Change) {
+	authorization := authzBasic.NewInMemoryAuthz()
+	authorization.Grant("martin", authz.OperationCreate, authz.AnyObject)
+	fm := New(basic.NewInMemoryFileStore(), basic.NewInMemoryFileMetadataStore(), authorization)
+	var changes []Change
+	fm.AddListener(func(c Change) { changes = append(changes, c) })
+	return fm, authorization, &changes
+}
+
+func TestBatchNonAtomic(t *testing.T) {
+	ctx := context.Background()
+	fm, authorization, changes := setupBatchTest()
+	authorization.Grant("martin", authz.OperationWrite, "99")
+
+	results, err := fm.BatchFileMetadata(ctx, "martin", []BatchOperation{
+		{Type: BatchCreate, Data: &dtos.FileMetadata{PName: "f1"}},
+		{Type: BatchUpdate, FileID: "1", Data: &dtos.FileMetadata{PName: "f1 v2"}},
+		{Type: BatchGrant, FileID: "1", Subject: "pedro", Operation: authz.OperationRead},
+		{Type: BatchUpdate, FileID: "99", Data: &dtos.FileMetadata{PName: "nope"}},
+		{Type: BatchDelete, FileID: "2"},
+		{Type: "rename", FileID: "1"},
+	}, false)
+	assert.Nil(t, err)
+	assert.Len(t, results, 6)
+	assert.Nil(t, results[0].Err)
+	assert.Equal(t, "1", results[0].Meta.ID())
+	assert.Nil(t, results[1].Err)
+	assert.Equal(t, "f1 v2", results[1].Meta.Name())
+	assert.Nil(t, results[2].Err)
+	assert.ErrorIs(t, results[3].Err, storage.ErrNoSuchFile)
+	assert.ErrorIs(t, results[4].Err, ErrUnauthorized)
+	assert.ErrorIs(t, results[5].Err, ErrInvalidBatchOperation)
+
+	allowed, _ := authorization.Can("pedro", authz.OperationRead, "1")
+	assert.True(t, allowed)
+
+	// creation & update of the same file are coalesced into a single change
+	assert.Equal(t, []Change{
+		{EventType: EventFileAvailable, FileRef: "1", User: "martin"},
+		{EventType: EventFileAvailable, FileRef: "1", User: "pedro"},
+	}, *changes)
+}
+
+func TestBatchNotifiesChangesTogether(t *testing.T) {
+	fm, _, changes := setupBatchTest()
+	var notifications [][]Change
+	fm.AddChangesListener(func(c []Change) { notifications = append(notifications, c) })
+
+	ops := make([]BatchOperation, 0, 50)
+	for idx := 0; idx < 50; idx++ {
+		ops = append(ops, BatchOperation{Type: BatchCreate, Data: &dtos.FileMetadata{PName: fmt.Sprintf("f%d", idx)}})
+	}
+	_, err := fm.BatchFileMetadata(context.Background(), "martin", ops, false)
+	assert.Nil(t, err)
+
+	// per-change listeners get every change, while per-operation ones get a single notification
+	assert.Len(t, *changes, 50)
+	assert.Len(t, notifications, 1)
+	assert.Len(t, notifications[0], 50)
+}
+
+func TestBatchAtomic(t *testing.T) {
+	ctx := context.Background()
+	fm, authorization, changes := setupBatchTest()
+	authorization.Grant("martin", authz.OperationWrite, "99")
+
+	results, err := fm.BatchFileMetadata(ctx, "martin", []BatchOperation{
+		{Type: BatchCreate, Data: &dtos.FileMetadata{PName: "f1"}},
+		{Type: BatchUpdate, FileID: "99", Data: &dtos.FileMetadata{PName: "nope"}},
+	}, true)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, results[0].Err, ErrBatchAborted)
+	assert.Nil(t, results[0].Meta)
+	assert.ErrorIs(t, results[1].Err, storage.ErrNoSuchFile)
+	assert.Empty(t, *changes)
+	_, err = fm.metadatas.Get("1")
+	assert.ErrorIs(t, err, storage.ErrNoSuchFile)
+
+	// unauthorized operations abort the batch before touching the storage
+	results, err = fm.BatchFileMetadata(ctx, "martin", []BatchOperation{
+		{Type: BatchCreate, Data: &dtos.FileMetadata{PName: "f1"}},
+		{Type: BatchDelete, FileID: "5"},
+	}, true)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, results[0].Err, ErrBatchAborted)
+	assert.ErrorIs(t, results[1].Err, ErrUnauthorized)
+	assert.Empty(t, *changes)
+
+	results, err = fm.BatchFileMetadata(ctx, "martin", []BatchOperation{
+		{Type: BatchCreate, Data: &dtos.FileMetadata{PName: "f1"}},
+		{Type: BatchCreate, Data: &dtos.FileMetadata{PName: "f2"}},
+	}, true)
+	assert.Nil(t, err)
+	assert.Nil(t, results[0].Err)
+	assert.Nil(t, results[1].Err)
+	assert.Len(t, *changes, 2)
+	allowed, _ := authorization.Can("martin", authz.OperationAdmin, results[1].Meta.ID())
+	assert.True(t, allowed)
+}
+
+type nonTransactionalStore struct {
+	storage.FilesMetadata
+}
+
+func TestBatchAtomicUnsupported(t *testing.T) {
+	fm := New(basic.NewInMemoryFileStore(), &nonTransactionalStore{basic.NewInMemoryFileMetadataStore()}, authzBasic.NewInMemoryAuthz())
+	_, err := fm.BatchFileMetadata(context.Background(), "martin", []BatchOperation{{Type: BatchDelete, FileID: "1"}}, true)
+	assert.ErrorIs(t, err, ErrAtomicUnsupported)
+}
+
+type partiallyCommittingStore struct {
+	*basic.InMemoryFileMetadataStore
+}
+
+func (s *partiallyCommittingStore) Atomically(fn func(tx storage.FilesMetadata) error) error {
+	if err := s.InMemoryFileMetadataStore.Atomically(fn); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: failed to update the index", storage.ErrPartiallyCommitted)
+}
+
+func TestBatchAtomicPartiallyCommitted(t *testing.T) {
+	authorization := authzBasic.NewInMemoryAuthz()
+	authorization.Grant("martin", authz.OperationCreate, authz.AnyObject)
+	fm := New(basic.NewInMemoryFileStore(), &partiallyCommittingStore{basic.NewInMemoryFileMetadataStore()}, authorization)
+	var changes []Change
+	fm.AddListener(func(c Change) { changes = append(changes, c) })
+
+	// changes were persisted, so the batch is reported as applied & its effects follow
+	results, err := fm.BatchFileMetadata(context.Background(), "martin", []BatchOperation{
+		{Type: BatchCreate, Data: &dtos.FileMetadata{PName: "f1"}},
+	}, true)
+	assert.Nil(t, err)
+	assert.Nil(t, results[0].Err)
+	assert.NotNil(t, results[0].Meta)
+	allowed, _ := authorization.Can("martin", authz.OperationAdmin, results[0].Meta.ID())
+	assert.True(t, allowed)
+	assert.Len(t, changes, 1)
+}
+
+type recordingAuditor struct {
+	records []audit.Record
+}
+
+func (r *recordingAuditor) Record(record *audit.Record) error {
+	r.records = append(r.records, *record)
+	return nil
+}
+
+func (r *recordingAuditor) Query(query *audit.Query) ([]audit.Entry, error) { return nil, nil }
+func (r *recordingAuditor) Export(w io.Writer) error                        { return nil }
+
+func TestBatchAuditsDeletedMetadata(t *testing.T) {
+	ctx := context.Background()
+	for _, atomic := range []bool{false, true} {
+		fm, authorization, _ := setupBatchTest()
+		auditor := &recordingAuditor{}
+		fm.auditor = auditor
+		meta, err := fm.metadatas.Create("f1", "", "patient-1", "", 0)
+		assert.Nil(t, err)
+		authorization.Grant("martin", authz.OperationWrite, meta.ID())
+
+		results, err := fm.BatchFileMetadata(ctx, "martin", []BatchOperation{{Type: BatchDelete, FileID: meta.ID()}}, atomic)
+		assert.Nil(t, err)
+		assert.Nil(t, results[0].Err)
+		assert.Len(t, auditor.records, 1)
+		assert.Equal(t, audit.OperationDelete, auditor.records[0].Operation)
+		assert.Equal(t, meta.ID(), auditor.records[0].FileID)
+		assert.Equal(t, "patient-1", auditor.records[0].PatientID)
+	}
+}
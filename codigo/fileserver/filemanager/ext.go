@@ -10,7 +10,7 @@ import (
 	v1adapters "github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1/adapters"
 )
 
-func fromPlugin(fn string, params map[string]interface{}) (Interface, error) {
+func fromPlugin(fn string, params map[string]interface{}) (*Impl, error) {
 
 	pl, err := plugin.Open(fn)
 	if err != nil {
@@ -46,7 +46,7 @@ func getVersion(p *plugin.Plugin) (contracts.Version, error) {
 	return vfunc(), nil
 }
 
-func buildFromV1Plugin(pl *plugin.Plugin, params map[string]interface{}) (Interface, error) {
+func buildFromV1Plugin(pl *plugin.Plugin, params map[string]interface{}) (*Impl, error) {
 
 	symbol, err := pl.Lookup(apiv1.CreateFuncName)
 	if err != nil {
@@ -63,14 +63,24 @@ func buildFromV1Plugin(pl *plugin.Plugin, params map[string]interface{}) (Interf
 		return nil, fmt.Errorf("error invoking plugin creation method: %w", err)
 	}
 
-	metaStore := v1adapters.NewFilesMetaWrapper(plug.GetFileMetadataStorage())
+	metaStore := v1adapters.WrapFilesMetadata(plug.GetFileMetadataStorage())
 	fileStore := v1adapters.NewFilesWrapper(plug.GetFileStorage())
 	authorization := v1adapters.NewAuthWrapper(plug.GetAuthorization())
 
-	authorization.Grant("martin.redolatti", authz.OperationRead, authz.AnyObject)
-	authorization.Grant("martin.redolatti", authz.OperationWrite, authz.AnyObject)
-	authorization.Grant("martin.redolatti", authz.OperationCreate, authz.AnyObject)
-	// end stuff to remove
+	fm := New(fileStore, metaStore, authorization)
+	if watcher, ok := plug.GetFileMetadataStorage().(apiv1.Watcher); ok {
+		watcher.Watch(func(c apiv1.Change) { fm.notify(mapV1Change(c)) })
+	}
+
+	return fm, nil
+}
 
-	return New(fileStore, metaStore, authorization), nil
+// mapV1Change converts a change detected by a plugin into one that can be forwarded to listeners.
+// Files added out-of-band have no owner, so changes are addressed to everyone
+func mapV1Change(c apiv1.Change) Change {
+	eventType := EventFileAvailable
+	if c.Type == apiv1.ChangeRemoved {
+		eventType = EventFileNotAvailable
+	}
+	return Change{EventType: eventType, FileRef: c.FileID, User: authz.EveryOne}
 }
@@ -20,3 +20,7 @@ type Change struct {
 // ChangeListener defines the interface to be implemented by those who want to be notified
 // whenever there's been a change in a file
 type ChangeListener = func(Change)
+
+// ChangesListener is notified once with every change resulting from a single operation (ie: a batch), so that
+// listeners with a cost per notification (like storing a record) can handle them together
+type ChangesListener = func([]Change)
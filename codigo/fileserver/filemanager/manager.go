@@ -1,19 +1,28 @@
 package filemanager
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/audit"
 	"github.com/mredolatti/tf/codigo/fileserver/authz"
+	"github.com/mredolatti/tf/codigo/fileserver/breakglass"
 	"github.com/mredolatti/tf/codigo/fileserver/models"
+	"github.com/mredolatti/tf/codigo/fileserver/sharelinks"
 	"github.com/mredolatti/tf/codigo/fileserver/storage"
 )
 
 // Public errors
 var (
-	ErrUnauthorized = errors.New("unauthorized")
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrBreakGlassDisabled = errors.New("emergency access is not enabled in this server")
+	ErrAuditDisabled      = errors.New("audit log is not enabled in this server")
+	ErrShareLinksDisabled = errors.New("share links are not enabled in this server")
 )
 
 // ListQuery specifies paramateres that can be used to firther FileMetadatas
@@ -24,31 +33,55 @@ type ListQuery struct {
 // Interface defines the set of methods that can be used to interact with the virtual FS
 type Interface interface {
 	// Metadata
-	ListFileMetadata(user string, query *ListQuery) ([]models.FileMetadata, error)
-	GetFileMetadata(user string, id string) (models.FileMetadata, error)
-	CreateFileMetadata(user string, data models.FileMetadata) (models.FileMetadata, error)
-	UpdateFileMetadata(user string, id string, data models.FileMetadata) (models.FileMetadata, error)
-	DeleteFileMetadata(user string, id string) error
+	ListFileMetadata(ctx context.Context, user string, query *ListQuery) ([]models.FileMetadata, error)
+	GetFileMetadata(ctx context.Context, user string, id string) (models.FileMetadata, error)
+	CreateFileMetadata(ctx context.Context, user string, data models.FileMetadata) (models.FileMetadata, error)
+	UpdateFileMetadata(ctx context.Context, user string, id string, data models.FileMetadata) (models.FileMetadata, error)
+	DeleteFileMetadata(ctx context.Context, user string, id string) error
+	BatchFileMetadata(ctx context.Context, user string, ops []BatchOperation, atomic bool) ([]BatchResult, error)
 
 	// Contents
-	GetFileContents(user string, id string) ([]byte, error)
-	UpdateFileContents(user string, id string, data []byte) error
-	DeleteFileContents(user string, id string) error
+	GetFileContents(ctx context.Context, user string, id string) ([]byte, error)
+	UpdateFileContents(ctx context.Context, user string, id string, data []byte) error
+	DeleteFileContents(ctx context.Context, user string, id string) error
 
 	// Permission
-	Grant(user string, id string, operation authz.Operation) error
-	Revoke(user string, id string, permission authz.Operation) error
+	Grant(ctx context.Context, user string, id string, operation authz.Operation) error
+	Revoke(ctx context.Context, user string, id string, permission authz.Operation) error
+	ListPermissions(ctx context.Context, user string, id string) (map[string]authz.Permission, error)
+
+	// Emergency access
+	RequestEmergencyAccess(ctx context.Context, user string, id string, justification string) (*breakglass.Grant, error)
+	ListEmergencyAccesses(ctx context.Context, user string) ([]breakglass.Event, error)
+
+	// Share links
+	CreateShareLink(ctx context.Context, user string, id string, ttl time.Duration, maxDownloads int) (*sharelinks.SignedLink, error)
+	RevokeShareLink(ctx context.Context, user string, linkID string) error
+	GetSharedFileContents(ctx context.Context, id string, linkID string, expires int64, signature string) ([]byte, error)
+
+	// Audit
+	QueryAuditLog(ctx context.Context, user string, query *audit.Query) ([]audit.Entry, error)
+	ExportAuditLog(ctx context.Context, user string, w io.Writer) error
+
+	// Administration
+	IsAdmin(ctx context.Context, user string) (bool, error)
 
 	// Listeners
 	AddListener(l ChangeListener)
+	AddChangesListener(l ChangesListener)
 }
 
 // Impl implements the FileManager interface
 type Impl struct {
+	logger         log.Interface
 	metadatas      storage.FilesMetadata
 	files          storage.Files
 	authorization  authz.Authorization
+	emergency      breakglass.Interface
+	auditor        audit.Interface
+	shares         sharelinks.Interface
 	listeners      []ChangeListener
+	batchListeners []ChangesListener
 	listenersMutex sync.RWMutex
 }
 
@@ -62,10 +95,22 @@ func New(files storage.Files, metadatas storage.FilesMetadata, authorization aut
 }
 
 // ListFileMetadata lists all known file (metas) that a user has access to
-func (i *Impl) ListFileMetadata(user string, query *ListQuery) ([]models.FileMetadata, error) {
+func (i *Impl) ListFileMetadata(ctx context.Context, user string, query *ListQuery) (result []models.FileMetadata, err error) {
+	defer func() {
+		if err != nil || len(result) == 0 {
+			i.record(ctx, audit.OperationList, user, "", nil, "0 files", err)
+			return
+		}
+
+		// one record per file, so that every disclosure shows up when auditing a specific file or patient
+		for _, meta := range result {
+			i.record(ctx, audit.OperationList, user, meta.ID(), meta, fmt.Sprintf("listed along with %d files", len(result)-1), nil)
+		}
+	}()
 
 	filter := &storage.Filter{}
 	canReadAll, err := i.authorization.Can(user, authz.OperationRead, authz.AnyObject)
+	observeDecision(authz.OperationRead, canReadAll, err)
 	if err != nil {
 		return nil, fmt.Errorf("error reading permissions for user '%s': %w", user, err)
 	}
@@ -92,7 +137,7 @@ func (i *Impl) ListFileMetadata(user string, query *ListQuery) ([]models.FileMet
 		return nil, err
 	}
 
-	result := make([]models.FileMetadata, 0, len(metas))
+	result = make([]models.FileMetadata, 0, len(metas))
 	for _, meta := range metas {
 		result = append(result, meta)
 	}
@@ -101,17 +146,19 @@ func (i *Impl) ListFileMetadata(user string, query *ListQuery) ([]models.FileMet
 }
 
 // GetFileMetadata fetches a single file-metadata record
-func (i *Impl) GetFileMetadata(user string, id string) (models.FileMetadata, error) {
+func (i *Impl) GetFileMetadata(ctx context.Context, user string, id string) (meta models.FileMetadata, err error) {
+	defer func() { i.record(ctx, audit.OperationGet, user, id, meta, "", err) }()
+
 	allowed, err := can(i.authorization, user, authz.OperationRead, id)
 	if err != nil {
 		return nil, fmt.Errorf("error reading permissions: %w", err)
 	}
 
-	if !allowed {
+	if !allowed && !i.emergencyAccess(user, id, audit.OperationGet) {
 		return nil, ErrUnauthorized
 	}
 
-	meta, err := i.metadatas.Get(id)
+	meta, err = i.metadatas.Get(id)
 	if err != nil {
 		return nil, fmt.Errorf("error reading file metadata: %w", err)
 	}
@@ -120,8 +167,17 @@ func (i *Impl) GetFileMetadata(user string, id string) (models.FileMetadata, err
 }
 
 // CreateFileMetadata creates a file-metadata record
-func (i *Impl) CreateFileMetadata(user string, data models.FileMetadata) (models.FileMetadata, error) {
+func (i *Impl) CreateFileMetadata(ctx context.Context, user string, data models.FileMetadata) (meta models.FileMetadata, err error) {
+	defer func() {
+		var id string
+		if meta != nil {
+			id = meta.ID()
+		}
+		i.record(ctx, audit.OperationCreate, user, id, data, "", err)
+	}()
+
 	allowed, err := i.authorization.Can(user, authz.OperationCreate, authz.AnyObject)
+	observeDecision(authz.OperationCreate, allowed, err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get permission: %w", err)
 	}
@@ -130,7 +186,7 @@ func (i *Impl) CreateFileMetadata(user string, data models.FileMetadata) (models
 		return nil, ErrUnauthorized
 	}
 
-	meta, err := i.metadatas.Create(data.Name(), data.Notes(), data.PatientID(), data.Type(), time.Now().UnixNano())
+	meta, err = i.metadatas.Create(data.Name(), data.Notes(), data.PatientID(), data.Type(), time.Now().UnixNano())
 	if err != nil {
 		return nil, fmt.Errorf("error storing new file-meta: %w", err)
 	}
@@ -145,7 +201,9 @@ func (i *Impl) CreateFileMetadata(user string, data models.FileMetadata) (models
 }
 
 // UpdateFileMetadata updates an already existing file-metadata record
-func (i *Impl) UpdateFileMetadata(user string, id string, data models.FileMetadata) (models.FileMetadata, error) {
+func (i *Impl) UpdateFileMetadata(ctx context.Context, user string, id string, data models.FileMetadata) (meta models.FileMetadata, err error) {
+	defer func() { i.record(ctx, audit.OperationUpdate, user, id, meta, "", err) }()
+
 	allowed, err := can(i.authorization, user, authz.OperationWrite, id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get permission: %w", err)
@@ -155,7 +213,7 @@ func (i *Impl) UpdateFileMetadata(user string, id string, data models.FileMetada
 		return nil, ErrUnauthorized
 	}
 
-	meta, err := i.metadatas.Update(id, data, time.Now().UnixNano())
+	meta, err = i.metadatas.Update(id, data, time.Now().UnixNano())
 	if err != nil {
 		return nil, fmt.Errorf("error updating file-meta: %w", err)
 	}
@@ -166,7 +224,10 @@ func (i *Impl) UpdateFileMetadata(user string, id string, data models.FileMetada
 }
 
 // DeleteFileMetadata removes a file-metadata record
-func (i *Impl) DeleteFileMetadata(user string, id string) error {
+func (i *Impl) DeleteFileMetadata(ctx context.Context, user string, id string) (err error) {
+	meta := i.lookup(id) // fetched beforehand, since it won't be available after deletion
+	defer func() { i.record(ctx, audit.OperationDelete, user, id, meta, "", err) }()
+
 	allowed, err := can(i.authorization, user, authz.OperationWrite, id)
 	if err != nil {
 		return fmt.Errorf("error reading permissions: %w", err)
@@ -186,21 +247,29 @@ func (i *Impl) DeleteFileMetadata(user string, id string) error {
 }
 
 // GetFileContents returns the contents of a file
-func (i *Impl) GetFileContents(user string, id string) ([]byte, error) {
+func (i *Impl) GetFileContents(ctx context.Context, user string, id string) (contents []byte, err error) {
+	defer func() { i.record(ctx, audit.OperationReadContents, user, id, nil, "", err) }()
+
 	allowed, err := can(i.authorization, user, authz.OperationRead, id)
 	if err != nil {
 		return nil, fmt.Errorf("error reading permissions: %s", err)
 	}
 
-	if !allowed {
+	if !allowed && !i.emergencyAccess(user, id, audit.OperationReadContents) {
 		return nil, ErrUnauthorized
 	}
 
-	return i.files.Read(id)
+	contents, err = i.files.Read(id)
+	bytesRead.Add(float64(len(contents)))
+	return contents, err
 }
 
 // UpdateFileContents updates the contents of a file
-func (i *Impl) UpdateFileContents(user string, id string, data []byte) error {
+func (i *Impl) UpdateFileContents(ctx context.Context, user string, id string, data []byte) (err error) {
+	defer func() {
+		i.record(ctx, audit.OperationWriteContents, user, id, nil, fmt.Sprintf("%d bytes", len(data)), err)
+	}()
+
 	allowed, err := can(i.authorization, user, authz.OperationCreate, authz.AnyObject)
 	if err != nil {
 		return fmt.Errorf("error reading permissions: %s", err)
@@ -214,6 +283,7 @@ func (i *Impl) UpdateFileContents(user string, id string, data []byte) error {
 	if err != nil {
 		return err
 	}
+	bytesWritten.Add(float64(len(data)))
 
 	i.notify(Change{EventType: EventFileAvailable, FileRef: id, User: authz.EveryOne})
 	return nil
@@ -221,7 +291,9 @@ func (i *Impl) UpdateFileContents(user string, id string, data []byte) error {
 }
 
 // DeleteFileContents deletest he contents of a file
-func (i *Impl) DeleteFileContents(user string, id string) error {
+func (i *Impl) DeleteFileContents(ctx context.Context, user string, id string) (err error) {
+	defer func() { i.record(ctx, audit.OperationDeleteContents, user, id, nil, "", err) }()
+
 	allowed, err := can(i.authorization, user, authz.OperationWrite, id)
 	if err != nil {
 		return fmt.Errorf("error reading permissions: %s", err)
@@ -247,20 +319,340 @@ func (i *Impl) AddListener(l ChangeListener) {
 	i.listenersMutex.Unlock()
 }
 
+// AddChangesListener registers a new listener that will be notified once per operation, with all of its changes
+func (i *Impl) AddChangesListener(l ChangesListener) {
+	i.listenersMutex.Lock()
+	i.batchListeners = append(i.batchListeners, l)
+	i.listenersMutex.Unlock()
+}
+
 // Grant enables user to execute `permission` on id
-func (i *Impl) Grant(user string, id string, operation authz.Operation) error {
+func (i *Impl) Grant(ctx context.Context, user string, id string, operation authz.Operation) (err error) {
+	defer func() {
+		i.record(ctx, audit.OperationGrant, user, id, nil, fmt.Sprintf("operation=%d", operation), err)
+	}()
 	return i.authorization.Grant(user, operation, id)
 }
 
 // Revoke prevents user from executing `permission` on id
-func (i *Impl) Revoke(user string, id string, operation authz.Operation) error {
+func (i *Impl) Revoke(ctx context.Context, user string, id string, operation authz.Operation) (err error) {
+	defer func() {
+		i.record(ctx, audit.OperationRevoke, user, id, nil, fmt.Sprintf("operation=%d", operation), err)
+	}()
 	return i.authorization.Revoke(user, operation, id)
 }
 
+// ListPermissions returns every subject with access to a file. Only file admins can review them
+func (i *Impl) ListPermissions(ctx context.Context, user string, id string) (map[string]authz.Permission, error) {
+	allowed, err := can(i.authorization, user, authz.OperationAdmin, id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading permissions: %w", err)
+	}
+
+	if !allowed {
+		return nil, ErrUnauthorized
+	}
+
+	perms, err := i.authorization.AllForObject(id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading permissions for object '%s': %w", id, err)
+	}
+
+	return perms, nil
+}
+
+// RequestEmergencyAccess grants a user temporary read access to a file it's not authorized to see.
+// The access is recorded in a tamper-evident trail and reported to the designated admins
+func (i *Impl) RequestEmergencyAccess(ctx context.Context, user string, id string, justification string) (grant *breakglass.Grant, err error) {
+	defer func() { i.record(ctx, audit.OperationEmergencyAccess, user, id, nil, justification, err) }()
+
+	if i.emergency == nil {
+		return nil, ErrBreakGlassDisabled
+	}
+
+	if _, err := i.metadatas.Get(id); err != nil {
+		return nil, fmt.Errorf("error reading file metadata: %w", err)
+	}
+
+	grant, err = i.emergency.Open(user, id, justification)
+	if err != nil {
+		return nil, fmt.Errorf("error issuing emergency access: %w", err)
+	}
+
+	return grant, nil
+}
+
+// ListEmergencyAccesses returns the emergency access trail. Only designated admins can review it
+func (i *Impl) ListEmergencyAccesses(ctx context.Context, user string) ([]breakglass.Event, error) {
+	if i.emergency == nil {
+		return nil, ErrBreakGlassDisabled
+	}
+
+	if !i.emergency.IsAdmin(user) {
+		return nil, ErrUnauthorized
+	}
+
+	events, err := i.emergency.Events()
+	if err != nil {
+		return nil, fmt.Errorf("error reading emergency access trail: %w", err)
+	}
+
+	return events, nil
+}
+
+// CreateShareLink mints a signed link that allows downloading a file without authentication.
+// The user must be able to read the file
+func (i *Impl) CreateShareLink(ctx context.Context, user string, id string, ttl time.Duration, maxDownloads int) (signed *sharelinks.SignedLink, err error) {
+	defer func() {
+		var detail string
+		if signed != nil {
+			detail = "link " + signed.Link.ID()
+		}
+		i.record(ctx, audit.OperationCreateShareLink, user, id, nil, detail, err)
+	}()
+
+	if i.shares == nil {
+		return nil, ErrShareLinksDisabled
+	}
+
+	allowed, err := can(i.authorization, user, authz.OperationRead, id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading permissions: %w", err)
+	}
+
+	if !allowed {
+		return nil, ErrUnauthorized
+	}
+
+	if _, err := i.metadatas.Get(id); err != nil {
+		return nil, fmt.Errorf("error reading file metadata: %w", err)
+	}
+
+	signed, err = i.shares.Create(ctx, user, id, ttl, maxDownloads)
+	if err != nil {
+		return nil, fmt.Errorf("error creating share link: %w", err)
+	}
+
+	return signed, nil
+}
+
+// RevokeShareLink invalidates a share link. Only the link's creator or a file admin can revoke it
+func (i *Impl) RevokeShareLink(ctx context.Context, user string, linkID string) (err error) {
+	var fileID string
+	defer func() { i.record(ctx, audit.OperationRevokeShareLink, user, fileID, nil, "link "+linkID, err) }()
+
+	if i.shares == nil {
+		return ErrShareLinksDisabled
+	}
+
+	link, err := i.shares.Get(ctx, linkID)
+	if err != nil {
+		return fmt.Errorf("error fetching share link: %w", err)
+	}
+	fileID = link.FileID()
+
+	if link.CreatedBy() != user {
+		allowed, err := can(i.authorization, user, authz.OperationAdmin, fileID)
+		if err != nil {
+			return fmt.Errorf("error reading permissions: %w", err)
+		}
+
+		if !allowed {
+			return ErrUnauthorized
+		}
+	}
+
+	if err := i.shares.Revoke(ctx, linkID); err != nil {
+		return fmt.Errorf("error revoking share link: %w", err)
+	}
+
+	return nil
+}
+
+// GetSharedFileContents returns the contents of a file after validating & consuming a signed share link
+func (i *Impl) GetSharedFileContents(ctx context.Context, id string, linkID string, expires int64, signature string) (contents []byte, err error) {
+	var creator string
+	defer func() {
+		i.record(ctx, audit.OperationReadContents, "share-link:"+linkID, id, nil, "created by "+creator, err)
+	}()
+
+	if i.shares == nil {
+		return nil, ErrShareLinksDisabled
+	}
+
+	// the download is registered beforehand, so that concurrent requests can't exceed the link's limit,
+	// and given back if the file can't be served
+	link, err := i.shares.Redeem(ctx, id, linkID, expires, signature)
+	if err != nil {
+		return nil, err
+	}
+	creator = link.CreatedBy()
+
+	if link.FileID() != id {
+		i.releaseShareLink(ctx, linkID)
+		return nil, ErrUnauthorized
+	}
+
+	// links only grant what their creator is still allowed to do
+	allowed, err := can(i.authorization, creator, authz.OperationRead, id)
+	if err != nil {
+		i.releaseShareLink(ctx, linkID)
+		return nil, fmt.Errorf("error reading permissions: %w", err)
+	}
+
+	if !allowed {
+		i.releaseShareLink(ctx, linkID)
+		return nil, ErrUnauthorized
+	}
+
+	contents, err = i.files.Read(id)
+	if err != nil {
+		i.releaseShareLink(ctx, linkID)
+		return nil, err
+	}
+
+	bytesRead.Add(float64(len(contents)))
+	return contents, nil
+}
+
+func (i *Impl) releaseShareLink(ctx context.Context, linkID string) {
+	if err := i.shares.Release(ctx, linkID); err != nil && i.logger != nil {
+		i.logger.Error("filemanager.GetSharedFileContents: error giving back download on link %s: %s", linkID, err)
+	}
+}
+
+// QueryAuditLog returns the audit records matching the query. Requires admin permissions on every object
+func (i *Impl) QueryAuditLog(ctx context.Context, user string, query *audit.Query) ([]audit.Entry, error) {
+	if err := i.ensureAuditor(ctx, user); err != nil {
+		return nil, err
+	}
+
+	entries, err := i.auditor.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying audit log: %w", err)
+	}
+
+	return entries, nil
+}
+
+// ExportAuditLog writes the raw hash-chained audit log. Requires admin permissions on every object
+func (i *Impl) ExportAuditLog(ctx context.Context, user string, w io.Writer) error {
+	if err := i.ensureAuditor(ctx, user); err != nil {
+		return err
+	}
+
+	if err := i.auditor.Export(w); err != nil {
+		return fmt.Errorf("error exporting audit log: %w", err)
+	}
+
+	return nil
+}
+
+// IsAdmin returns true if the user holds admin permissions on every object
+func (i *Impl) IsAdmin(ctx context.Context, user string) (bool, error) {
+	allowed, err := i.authorization.Can(user, authz.OperationAdmin, authz.AnyObject)
+	observeDecision(authz.OperationAdmin, allowed, err)
+	if err != nil {
+		return false, fmt.Errorf("error reading permissions: %w", err)
+	}
+	return allowed, nil
+}
+
+func (i *Impl) ensureAuditor(ctx context.Context, user string) error {
+	if i.auditor == nil {
+		return ErrAuditDisabled
+	}
+
+	allowed, err := i.IsAdmin(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return ErrUnauthorized
+	}
+
+	return nil
+}
+
+// emergencyAccess returns true if the user holds a valid emergency grant on the file. Every access
+// performed under a grant is recorded, and denied if it cannot be recorded
+func (i *Impl) emergencyAccess(user string, id string, operation string) bool {
+	if i.emergency == nil {
+		return false
+	}
+
+	grant, ok := i.emergency.Active(user, id)
+	if !ok {
+		return false
+	}
+
+	return i.emergency.RecordAccess(grant, operation) == nil
+}
+
+// record adds an entry to the audit log. `meta` is used to fill in the patient id, and is looked up
+// if not provided
+func (i *Impl) record(ctx context.Context, operation string, user string, id string, meta models.FileMetadata, detail string, err error) {
+	if i.auditor == nil {
+		return
+	}
+
+	if meta == nil && id != "" {
+		meta = i.lookup(id)
+	}
+
+	r := &audit.Record{
+		Timestamp: time.Now().UnixNano(),
+		Operation: operation,
+		User:      user,
+		FileID:    id,
+		ClientCN:  audit.ClientCNFromContext(ctx),
+		Outcome:   audit.OutcomeSuccess,
+		Detail:    detail,
+	}
+
+	if meta != nil {
+		r.PatientID = meta.PatientID()
+	}
+
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		r.Outcome = audit.OutcomeDenied
+	case err != nil:
+		r.Outcome = audit.OutcomeError
+	}
+
+	if err := i.auditor.Record(r); err != nil && i.logger != nil {
+		i.logger.Error("failed to record audit entry for %s on '%s' by '%s': %s", operation, id, user, err)
+	}
+}
+
+// lookup fetches file metadata bypassing permission checks. it's only meant to be used for auditing
+func (i *Impl) lookup(id string) models.FileMetadata {
+	meta, err := i.metadatas.Get(id)
+	if err != nil {
+		return nil
+	}
+	return meta
+}
+
 func (i *Impl) notify(c Change) {
+	i.notifyAll([]Change{c})
+}
+
+func (i *Impl) notifyAll(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+
 	i.listenersMutex.RLock()
 	for _, listener := range i.listeners {
-		listener(c)
+		for _, c := range changes {
+			listener(c)
+		}
+	}
+	for _, listener := range i.batchListeners {
+		listener(changes)
 	}
 	i.listenersMutex.RUnlock()
 }
@@ -273,6 +665,12 @@ func mapQuery2Filter(query *ListQuery, filter *storage.Filter) *storage.Filter {
 }
 
 func can(auth authz.Authorization, user string, action authz.Operation, resource string) (bool, error) {
+	allowed, err := checkPermission(auth, user, action, resource)
+	observeDecision(action, allowed, err)
+	return allowed, err
+}
+
+func checkPermission(auth authz.Authorization, user string, action authz.Operation, resource string) (bool, error) {
 
 	// Exact permission
 	ok, err := auth.Can(user, action, resource)
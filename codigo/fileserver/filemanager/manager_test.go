@@ -0,0 +1,156 @@
+package filemanager
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/dtos"
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/audit"
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
+	authzBasic "github.com/mredolatti/tf/codigo/fileserver/authz/basic"
+	"github.com/mredolatti/tf/codigo/fileserver/breakglass"
+	"github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1"
+	v1adapters "github.com/mredolatti/tf/codigo/fileserver/extension/contracts/apiv1/adapters"
+	"github.com/mredolatti/tf/codigo/fileserver/extension/plugins/fsbasic"
+	"github.com/mredolatti/tf/codigo/fileserver/hashchain"
+	"github.com/mredolatti/tf/codigo/fileserver/storage/basic"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemovalsAreListedForReaders(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "filemanager_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	authorization, err := fsbasic.NewAuthz(path.Join(dir, ".authz"))
+	assert.Nil(t, err)
+	metas, err := fsbasic.NewFilesMetadata(dir, path.Join(dir, ".meta"), authorization)
+	assert.Nil(t, err)
+	defer metas.Close()
+	files, err := fsbasic.NewFiles(dir, metas)
+	assert.Nil(t, err)
+
+	fm := New(v1adapters.NewFilesWrapper(files), v1adapters.WrapFilesMetadata(metas), v1adapters.NewAuthWrapper(authorization))
+	assert.Nil(t, authorization.Grant("admin", apiv1.OperationCreate, apiv1.AnyObject))
+
+	ctx := context.Background()
+	created, err := fm.CreateFileMetadata(ctx, "admin", &dtos.FileMetadata{PName: "f1", PPatientID: "p1"})
+	assert.Nil(t, err)
+	assert.Nil(t, authorization.Grant("martin", apiv1.OperationRead|apiv1.OperationWrite, created.ID()))
+
+	before := time.Now().UnixNano()
+	assert.Nil(t, fm.DeleteFileMetadata(ctx, "martin", created.ID()))
+
+	// users that don't have global read access still learn about the removal
+	listed, err := fm.ListFileMetadata(ctx, "martin", &ListQuery{UpdatedAfter: &before})
+	assert.Nil(t, err)
+	assert.Len(t, listed, 1)
+	assert.Equal(t, created.ID(), listed[0].ID())
+	assert.True(t, listed[0].Deleted())
+
+	// but they can no longer act on the file
+	allowed, err := authorization.Can("martin", apiv1.OperationWrite, created.ID())
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+
+	// once the tombstone is purged, the remaining permissions go away as well
+	assert.Nil(t, metas.PurgeTombstones(time.Now().UnixNano()))
+	listed, err = fm.ListFileMetadata(ctx, "martin", &ListQuery{})
+	assert.Nil(t, err)
+	assert.Empty(t, listed)
+}
+
+func TestListingIsAuditedPerFile(t *testing.T) {
+	authorization := authzBasic.NewInMemoryAuthz()
+	fm := New(basic.NewInMemoryFileStore(), basic.NewInMemoryFileMetadataStore(), authorization)
+	auditor := &recordingAuditor{}
+	fm.auditor = auditor
+
+	ctx := context.Background()
+	listed, err := fm.ListFileMetadata(ctx, "martin", &ListQuery{})
+	assert.Nil(t, err)
+	assert.Empty(t, listed)
+	assert.Len(t, auditor.records, 1)
+	assert.Equal(t, "", auditor.records[0].FileID)
+
+	f1, err := fm.metadatas.Create("f1", "", "patient-1", "", 0)
+	assert.Nil(t, err)
+	f2, err := fm.metadatas.Create("f2", "", "patient-2", "", 0)
+	assert.Nil(t, err)
+	_, err = fm.metadatas.Create("f3", "", "patient-3", "", 0)
+	assert.Nil(t, err)
+	authorization.Grant("martin", authz.OperationRead, f1.ID())
+	authorization.Grant("martin", authz.OperationRead, f2.ID())
+
+	auditor.records = nil
+	listed, err = fm.ListFileMetadata(ctx, "martin", &ListQuery{})
+	assert.Nil(t, err)
+	assert.Len(t, listed, 2)
+	assert.Len(t, auditor.records, 2)
+	patients := map[string]string{}
+	for _, record := range auditor.records {
+		assert.Equal(t, audit.OperationList, record.Operation)
+		assert.Equal(t, "martin", record.User)
+		patients[record.FileID] = record.PatientID
+	}
+	assert.Equal(t, map[string]string{f1.ID(): "patient-1", f2.ID(): "patient-2"}, patients)
+}
+
+func TestEmergencyAccess(t *testing.T) {
+	authorization := authzBasic.NewInMemoryAuthz()
+	fm := New(basic.NewInMemoryFileStore(), basic.NewInMemoryFileMetadataStore(), authorization)
+	meta, err := fm.metadatas.Create("f1", "", "patient-1", "", 0)
+	assert.Nil(t, err)
+	assert.Nil(t, fm.files.Write(meta.ID(), []byte("contents"), false))
+
+	ctx := context.Background()
+	_, err = fm.RequestEmergencyAccess(ctx, "martin", meta.ID(), "patient arrived unconscious")
+	assert.ErrorIs(t, err, ErrBreakGlassDisabled)
+
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+	trail, err := hashchain.Open(path.Join(t.TempDir(), "trail"))
+	assert.Nil(t, err)
+	defer trail.Close()
+	fm.emergency, err = breakglass.New(&breakglass.Config{Logger: logger, Trail: trail, Admins: []string{"admin"}})
+	assert.Nil(t, err)
+
+	_, err = fm.GetFileMetadata(ctx, "martin", meta.ID())
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	_, err = fm.RequestEmergencyAccess(ctx, "martin", meta.ID(), "")
+	assert.ErrorIs(t, err, breakglass.ErrJustificationRequired)
+	_, err = fm.RequestEmergencyAccess(ctx, "martin", "nope", "patient arrived unconscious")
+	assert.NotNil(t, err)
+
+	grant, err := fm.RequestEmergencyAccess(ctx, "martin", meta.ID(), "patient arrived unconscious")
+	assert.Nil(t, err)
+	fetched, err := fm.GetFileMetadata(ctx, "martin", meta.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, "patient-1", fetched.PatientID())
+	contents, err := fm.GetFileContents(ctx, "martin", meta.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("contents"), contents)
+
+	// the grant only covers reading that file
+	assert.ErrorIs(t, fm.UpdateFileContents(ctx, "martin", meta.ID(), []byte("new")), ErrUnauthorized)
+
+	// only admins can review the trail, which has every access made under the grant
+	_, err = fm.ListEmergencyAccesses(ctx, "martin")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	events, err := fm.ListEmergencyAccesses(ctx, "admin")
+	assert.Nil(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, breakglass.EventGranted, events[0].Type)
+	for idx, operation := range []string{audit.OperationGet, audit.OperationReadContents} {
+		assert.Equal(t, breakglass.EventAccessed, events[idx+1].Type)
+		assert.Equal(t, grant.ID, events[idx+1].Grant.ID)
+		assert.Equal(t, operation, events[idx+1].Operation)
+	}
+}
@@ -0,0 +1,54 @@
+package filemanager
+
+import (
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	bytesRead = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "fileserver",
+		Name:      "bytes_read_total",
+		Help:      "Number of bytes of file contents served",
+	})
+
+	bytesWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "fileserver",
+		Name:      "bytes_written_total",
+		Help:      "Number of bytes of file contents stored",
+	})
+
+	authorizationDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fileserver",
+		Name:      "authorization_decisions_total",
+		Help:      "Number of permission checks, by operation & outcome",
+	}, []string{"operation", "decision"})
+)
+
+// observeDecision records the outcome of a permission check
+func observeDecision(operation authz.Operation, allowed bool, err error) {
+	decision := "denied"
+	switch {
+	case err != nil:
+		decision = "error"
+	case allowed:
+		decision = "allowed"
+	}
+	authorizationDecisions.WithLabelValues(operationName(operation), decision).Inc()
+}
+
+func operationName(operation authz.Operation) string {
+	switch operation {
+	case authz.OperationRead:
+		return "read"
+	case authz.OperationWrite:
+		return "write"
+	case authz.OperationCreate:
+		return "create"
+	case authz.OperationAdmin:
+		return "admin"
+	}
+	return "unknown"
+}
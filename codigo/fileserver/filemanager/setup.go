@@ -1,27 +1,58 @@
 package filemanager
 
 import (
-	"encoding/json"
 	"fmt"
 
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/audit"
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
 	authzBasic "github.com/mredolatti/tf/codigo/fileserver/authz/basic"
+	"github.com/mredolatti/tf/codigo/fileserver/breakglass"
+	"github.com/mredolatti/tf/codigo/fileserver/sharelinks"
 	"github.com/mredolatti/tf/codigo/fileserver/storage/basic"
 )
 
-func Setup(pluginPath string, pluginConf string) (Interface, error) {
-	if pluginPath == "" {
-		return fallback()
+// Config contains parameters used to build a file manager
+type Config struct {
+	Logger       log.Interface
+	PluginPath   string
+	PluginParams map[string]interface{}
+	Admins       []string             // bootstrap admins, granted every operation on every file
+	BreakGlass   breakglass.Interface // optional. emergency access is disabled if nil
+	Audit        audit.Interface      // optional. operations are not audited if nil
+	ShareLinks   sharelinks.Interface // optional. share links are disabled if nil
+}
+
+func Setup(cfg *Config) (Interface, error) {
+	fm, err := build(cfg.PluginPath, cfg.PluginParams)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, admin := range cfg.Admins {
+		for _, operation := range []authz.Operation{authz.OperationRead, authz.OperationWrite, authz.OperationCreate} {
+			if err := fm.authorization.Grant(admin, operation, authz.AnyObject); err != nil {
+				return nil, fmt.Errorf("error granting admin permissions to '%s': %w", admin, err)
+			}
+		}
 	}
 
-	var pluginParams map[string]interface{}
-	if err := json.Unmarshal([]byte(pluginConf), &pluginParams); err != nil {
-		return nil, fmt.Errorf("error parsing plugin config JSON: %w", err)
+	fm.logger = cfg.Logger
+	fm.emergency = cfg.BreakGlass
+	fm.auditor = cfg.Audit
+	fm.shares = cfg.ShareLinks
+	return fm, nil
+}
+
+func build(pluginPath string, pluginParams map[string]interface{}) (*Impl, error) {
+	if pluginPath == "" {
+		return fallback()
 	}
 
 	return fromPlugin(pluginPath, pluginParams)
 }
 
-func fallback() (Interface, error) {
+func fallback() (*Impl, error) {
 	return New(
 		basic.NewInMemoryFileStore(),
 		basic.NewInMemoryFileMetadataStore(),
@@ -0,0 +1,79 @@
+package filemanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
+	"github.com/mredolatti/tf/codigo/fileserver/models"
+	"github.com/mredolatti/tf/codigo/fileserver/sharelinks"
+	"github.com/mredolatti/tf/codigo/fileserver/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type shareLinkMock struct {
+	fileID    string
+	downloads int
+}
+
+func (l *shareLinkMock) ID() string           { return "l1" }
+func (l *shareLinkMock) FileID() string       { return l.fileID }
+func (l *shareLinkMock) CreatedBy() string    { return "martin" }
+func (l *shareLinkMock) CreatedAt() time.Time { return time.Time{} }
+func (l *shareLinkMock) ExpiresAt() time.Time { return time.Time{} }
+func (l *shareLinkMock) MaxDownloads() int    { return 0 }
+func (l *shareLinkMock) Downloads() int       { return l.downloads }
+func (l *shareLinkMock) Revoked() bool        { return false }
+
+type shareLinksMock struct {
+	link *shareLinkMock
+}
+
+func (s *shareLinksMock) Create(ctx context.Context, user string, fileID string, ttl time.Duration, maxDownloads int) (*sharelinks.SignedLink, error) {
+	return nil, nil
+}
+
+func (s *shareLinksMock) Redeem(ctx context.Context, fileID string, linkID string, expires int64, signature string) (models.ShareLink, error) {
+	s.link.downloads++
+	return s.link, nil
+}
+
+func (s *shareLinksMock) Release(ctx context.Context, linkID string) error {
+	s.link.downloads--
+	return nil
+}
+
+func (s *shareLinksMock) Get(ctx context.Context, linkID string) (models.ShareLink, error) {
+	return s.link, nil
+}
+func (s *shareLinksMock) Revoke(ctx context.Context, linkID string) error { return nil }
+
+func TestGetSharedFileContents(t *testing.T) {
+	ctx := context.Background()
+	fm, authorization, _ := setupBatchTest()
+	shares := &shareLinksMock{link: &shareLinkMock{fileID: "f1"}}
+	fm.shares = shares
+	authorization.Grant("martin", authz.OperationRead, "f1")
+
+	// downloads are given back if the file can't be read
+	_, err := fm.GetSharedFileContents(ctx, "f1", "l1", 0, "")
+	assert.ErrorIs(t, err, storage.ErrNoSuchFile)
+	assert.Equal(t, 0, shares.link.downloads)
+
+	_, err = fm.GetSharedFileContents(ctx, "f2", "l1", 0, "")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.Equal(t, 0, shares.link.downloads)
+
+	assert.Nil(t, fm.files.Write("f1", []byte("hola"), true))
+	contents, err := fm.GetSharedFileContents(ctx, "f1", "l1", 0, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "hola", string(contents))
+	assert.Equal(t, 1, shares.link.downloads)
+
+	// links stop working once their creator loses access to the file
+	authorization.Revoke("martin", authz.OperationRead, "f1")
+	_, err = fm.GetSharedFileContents(ctx, "f1", "l1", 0, "")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.Equal(t, 1, shares.link.downloads)
+}
@@ -0,0 +1,187 @@
+package hashchain
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Public errors
+var (
+	ErrBrokenChain = errors.New("hash chain is broken")
+)
+
+// Entry is a single record in the chain. Each entry's hash covers its own contents plus the hash of the
+// previous one, so altering, removing or reordering any past record invalidates every record after it
+type Entry struct {
+	Seq       uint64          `json:"seq"`
+	Timestamp int64           `json:"ts"`
+	Payload   json.RawMessage `json:"payload"`
+	PrevHash  string          `json:"prevHash"`
+	Hash      string          `json:"hash"`
+}
+
+// Decode unmarshals the payload of the entry into `target`
+func (e *Entry) Decode(target interface{}) error {
+	return json.Unmarshal(e.Payload, target)
+}
+
+// Log is an append-only, hash-chained log backed by a file with one JSON-encoded entry per line
+type Log struct {
+	fn       string
+	file     *os.File
+	lastHash string
+	lastSeq  uint64
+	mtx      sync.Mutex
+}
+
+// Open opens (or creates) a log file, verifying the existing chain before accepting new entries
+func Open(fn string) (*Log, error) {
+	file, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("error opening log file: %w", err)
+	}
+
+	l := &Log{fn: fn, file: file}
+	if err := l.forEach(func(e *Entry) error {
+		l.lastSeq = e.Seq
+		l.lastHash = e.Hash
+		return nil
+	}); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error verifying existing log: %w", err)
+	}
+
+	return l, nil
+}
+
+// Append serializes `payload` and adds it as a new entry at the end of the chain
+func (l *Log) Append(payload interface{}) (*Entry, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing payload: %w", err)
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	entry := &Entry{
+		Seq:       l.lastSeq + 1,
+		Timestamp: time.Now().UnixNano(),
+		Payload:   raw,
+		PrevHash:  l.lastHash,
+	}
+	entry.Hash = computeHash(entry)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing entry: %w", err)
+	}
+
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("error writing entry: %w", err)
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return nil, fmt.Errorf("error flushing entry to disk: %w", err)
+	}
+
+	l.lastSeq = entry.Seq
+	l.lastHash = entry.Hash
+	return entry, nil
+}
+
+// ForEach verifies the chain while iterating it, calling `fn` for every entry in order
+func (l *Log) ForEach(fn func(*Entry) error) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.forEach(fn)
+}
+
+// Export writes a verbatim copy of the log to `w`, so that it can be verified independently
+func (l *Log) Export(w io.Writer) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	file, err := os.Open(l.fn)
+	if err != nil {
+		return fmt.Errorf("error opening log file for export: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(w, file); err != nil {
+		return fmt.Errorf("error exporting log: %w", err)
+	}
+	return nil
+}
+
+// Close releases the underlying file
+func (l *Log) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.file.Close()
+}
+
+func (l *Log) forEach(fn func(*Entry) error) error {
+	file, err := os.Open(l.fn)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+	defer file.Close()
+	return Verify(file, fn)
+}
+
+// Verify reads a log from `r` and checks that every entry is correctly chained to the previous one.
+// If `fn` is not nil, it's called for each verified entry
+func Verify(r io.Reader, fn func(*Entry) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var prevHash string
+	var prevSeq uint64
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("%w: unparseable entry after seq %d: %s", ErrBrokenChain, prevSeq, err)
+		}
+
+		if entry.Seq != prevSeq+1 || entry.PrevHash != prevHash || entry.Hash != computeHash(&entry) {
+			return fmt.Errorf("%w: at seq %d", ErrBrokenChain, entry.Seq)
+		}
+
+		if fn != nil {
+			if err := fn(&entry); err != nil {
+				return err
+			}
+		}
+
+		prevHash = entry.Hash
+		prevSeq = entry.Seq
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading log: %w", err)
+	}
+	return nil
+}
+
+func computeHash(e *Entry) string {
+	h := sha256.New()
+	h.Write([]byte(e.PrevHash))
+	h.Write([]byte(strconv.FormatUint(e.Seq, 10)))
+	h.Write([]byte(strconv.FormatInt(e.Timestamp, 10)))
+	h.Write(e.Payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,76 @@
+package hashchain
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testPayload struct {
+	User string `json:"user"`
+	File string `json:"file"`
+}
+
+func TestHashChain(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "hashchain_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := path.Join(dir, "trail.log")
+	l, err := Open(fn)
+	assert.Nil(t, err)
+
+	e1, err := l.Append(&testPayload{User: "martin", File: "f1"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), e1.Seq)
+	assert.Equal(t, "", e1.PrevHash)
+
+	e2, err := l.Append(&testPayload{User: "pedro", File: "f2"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), e2.Seq)
+	assert.Equal(t, e1.Hash, e2.PrevHash)
+	assert.Nil(t, l.Close())
+
+	// reopening continues the chain
+	l, err = Open(fn)
+	assert.Nil(t, err)
+	e3, err := l.Append(&testPayload{User: "juan", File: "f3"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), e3.Seq)
+	assert.Equal(t, e2.Hash, e3.PrevHash)
+
+	var users []string
+	err = l.ForEach(func(e *Entry) error {
+		var p testPayload
+		assert.Nil(t, e.Decode(&p))
+		users = append(users, p.User)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"martin", "pedro", "juan"}, users)
+
+	var exported bytes.Buffer
+	assert.Nil(t, l.Export(&exported))
+	assert.Nil(t, Verify(bytes.NewReader(exported.Bytes()), nil))
+	assert.Nil(t, l.Close())
+
+	// tampering with a past record breaks the chain
+	raw, err := ioutil.ReadFile(fn)
+	assert.Nil(t, err)
+	tampered := bytes.Replace(raw, []byte("pedro"), []byte("pablo"), 1)
+	assert.ErrorIs(t, Verify(bytes.NewReader(tampered), nil), ErrBrokenChain)
+	assert.Nil(t, ioutil.WriteFile(fn, tampered, 0640))
+
+	_, err = Open(fn)
+	assert.ErrorIs(t, err, ErrBrokenChain)
+
+	// so does removing one
+	lines := bytes.Split(raw, []byte("\n"))
+	removed := bytes.Join(append(lines[:1:1], lines[2:]...), []byte("\n"))
+	assert.ErrorIs(t, Verify(bytes.NewReader(removed), nil), ErrBrokenChain)
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/go-oauth2/oauth2/v4"
 )
 
@@ -23,6 +25,48 @@ type FileMetadata interface {
 	Deleted() bool
 }
 
+// ShareLink methods
+type ShareLink interface {
+	ID() string
+	FileID() string
+	CreatedBy() string
+	CreatedAt() time.Time
+	ExpiresAt() time.Time
+	MaxDownloads() int
+	Downloads() int
+	Revoked() bool
+}
+
+// Webhook methods
+type Webhook interface {
+	ID() string
+	URL() string
+	Secret() string
+	CreatedBy() string
+	CreatedAt() time.Time
+}
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed" // no attempts left
+)
+
+// WebhookDelivery methods
+type WebhookDelivery interface {
+	ID() string
+	WebhookID() string
+	EventID() string
+	Payload() []byte
+	Status() string
+	Attempts() int
+	LastError() string
+	ResponseCode() int
+	CreatedAt() time.Time
+	NextAttemptAt() time.Time
+}
+
 // TokenInfo type alias
 type TokenInfo = oauth2.TokenInfo
 
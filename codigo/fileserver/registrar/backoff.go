@@ -0,0 +1,51 @@
+package registrar
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = 1 * time.Second
+	defaultMaxBackoff     = 5 * time.Minute
+)
+
+// backoff computes exponentially increasing wait times between retries, capped at `max`.
+// Half of each wait is randomized so that many file servers restarting at once don't retry in lockstep
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+	jitter  func(n int64) int64
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+	return &backoff{
+		initial: initial,
+		max:     max,
+		current: initial,
+		jitter:  rand.Int63n,
+	}
+}
+
+// next returns how long to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	wait := b.current
+	if b.current < b.max {
+		b.current *= 2
+		if b.current > b.max {
+			b.current = b.max
+		}
+	}
+
+	half := int64(wait / 2)
+	if half <= 0 {
+		return wait
+	}
+	return time.Duration(half + b.jitter(half+1))
+}
+
+// reset starts over from the initial wait time, after a successful attempt
+func (b *backoff) reset() {
+	b.current = b.initial
+}
@@ -0,0 +1,33 @@
+package registrar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(1*time.Second, 10*time.Second)
+	b.jitter = func(n int64) int64 { return n - 1 } // always pick the longest wait
+
+	assert.Equal(t, 1*time.Second, b.next())
+	assert.Equal(t, 2*time.Second, b.next())
+	assert.Equal(t, 4*time.Second, b.next())
+	assert.Equal(t, 8*time.Second, b.next())
+	assert.Equal(t, 10*time.Second, b.next())
+	assert.Equal(t, 10*time.Second, b.next())
+
+	b.reset()
+	assert.Equal(t, 1*time.Second, b.next())
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := newBackoff(4*time.Second, time.Minute)
+	for i := 0; i < 100; i++ {
+		b.reset()
+		wait := b.next()
+		assert.GreaterOrEqual(t, wait, 2*time.Second)
+		assert.LessOrEqual(t, wait, 4*time.Second)
+	}
+}
@@ -4,34 +4,37 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	"github.com/mredolatti/tf/codigo/common/dtos"
 	"github.com/mredolatti/tf/codigo/common/log"
 )
 
 const (
-	registerPath string = "register"
+	registerPath     string = "register"
+	statusPath       string = "status"
+	serverPath       string = "server"
+	serverPausePath  string = "server/pause"
+	serverResumePath string = "server/resume"
 )
 
 type indexServerClient interface {
 	RegisterServer(ctx context.Context, serverInfo *dtos.ServerInfoDTO) (*dtos.RegistrationResultDTO, error)
-	CheckServerStatusRequest() (*dtos.ServerStatusDTO, error)
-	PauseServer() (*dtos.ServerStatusDTO, error)
-	ResumeServer() (*dtos.ServerStatusDTO, error)
+	SendHeartbeat(ctx context.Context, heartbeat *dtos.HeartbeatDTO) error
+	CheckServerStatusRequest(ctx context.Context, orgName string) (*dtos.ServerStatusDTO, error)
+	PauseServer(ctx context.Context, orgName string) (*dtos.ServerStatusDTO, error)
+	ResumeServer(ctx context.Context, orgName string) (*dtos.ServerStatusDTO, error)
 }
 
 type indexServerClientConfig struct {
-	Logger   log.Interface
-	BaseURL  string
-	RootCAFN string
-	CertFN   string
-	KeyFN    string
+	Logger       log.Interface
+	BaseURL      string
+	Certificates certmanager.Interface
 }
 
 type indexServerClientImpl struct {
@@ -41,18 +44,12 @@ type indexServerClientImpl struct {
 }
 
 func newIndexServerClient(cfg *indexServerClientConfig) (*indexServerClientImpl, error) {
-
-	tlsConfig, err := setupTLSConfig(cfg)
-	if err != nil {
-		return nil, fmt.Errorf("error setting up tls: %w", err)
-	}
-
 	return &indexServerClientImpl{
 		baseURL: cfg.BaseURL,
 		logger:  cfg.Logger,
 		client: http.Client{
 			Transport: &http.Transport{
-				TLSClientConfig: tlsConfig,
+				TLSClientConfig: cfg.Certificates.ClientConfig(&tls.Config{}),
 			},
 		},
 	}, nil
@@ -98,39 +95,110 @@ func (c *indexServerClientImpl) RegisterServer(ctx context.Context, serverInfo *
 	return &result, nil
 }
 
+// SendHeartbeat implements IndexServerClient
+func (c *indexServerClientImpl) SendHeartbeat(ctx context.Context, heartbeat *dtos.HeartbeatDTO) error {
+	body, err := json.Marshal(heartbeat)
+	if err != nil {
+		return fmt.Errorf("error serializing heartbeat: %w", err)
+	}
+
+	dstURL, err := url.JoinPath(c.baseURL, statusPath)
+	if err != nil {
+		return fmt.Errorf("error building destintaion url: %w", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", dstURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error building request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error performing request: %w", err)
+	}
+	defer response.Body.Close()
+
+	switch c := response.StatusCode; {
+	case c == 404:
+		return ErrNotRegistered
+	case c < 200 || c >= 300:
+		return fmt.Errorf("non-2xx (%d) status code returned", c)
+	}
+
+	return nil
+}
+
 // CheckServerStatusRequest implements IndexServerClient
-func (*indexServerClientImpl) CheckServerStatusRequest() (*dtos.ServerStatusDTO, error) {
-	panic("unimplemented")
+func (c *indexServerClientImpl) CheckServerStatusRequest(ctx context.Context, orgName string) (*dtos.ServerStatusDTO, error) {
+	dstURL, err := url.JoinPath(c.baseURL, serverPath)
+	if err != nil {
+		return nil, fmt.Errorf("error building destintaion url: %w", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", dstURL+"?"+url.Values{"orgName": {orgName}}.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %w", err)
+	}
+
+	return c.doStatusRequest(request)
 }
 
 // PauseServer implements IndexServerClient
-func (*indexServerClientImpl) PauseServer() (*dtos.ServerStatusDTO, error) {
-	panic("unimplemented")
+func (c *indexServerClientImpl) PauseServer(ctx context.Context, orgName string) (*dtos.ServerStatusDTO, error) {
+	return c.postStatusChange(ctx, serverPausePath, orgName)
 }
 
 // ResumeServer implements IndexServerClient
-func (*indexServerClientImpl) ResumeServer() (*dtos.ServerStatusDTO, error) {
-	panic("unimplemented")
+func (c *indexServerClientImpl) ResumeServer(ctx context.Context, orgName string) (*dtos.ServerStatusDTO, error) {
+	return c.postStatusChange(ctx, serverResumePath, orgName)
 }
 
-func setupTLSConfig(config *indexServerClientConfig) (*tls.Config, error) {
-	certBytes, err := ioutil.ReadFile(config.RootCAFN)
+func (c *indexServerClientImpl) postStatusChange(ctx context.Context, path string, orgName string) (*dtos.ServerStatusDTO, error) {
+	body, err := json.Marshal(&dtos.ServerStatusRequestDTO{OrgName: orgName})
 	if err != nil {
-		return nil, fmt.Errorf("error reading root cert file: %w", err)
+		return nil, fmt.Errorf("error serializing status request: %w", err)
 	}
-	caPool := x509.NewCertPool()
-	caPool.AppendCertsFromPEM(certBytes)
 
-	certs, err := tls.LoadX509KeyPair(config.CertFN, config.KeyFN)
+	dstURL, err := url.JoinPath(c.baseURL, path)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read server certficate chain / private key files: %w", err)
+		return nil, fmt.Errorf("error building destintaion url: %w", err)
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{certs},
-		RootCAs:      caPool,
-		ClientCAs:    caPool,
-	}, nil
+	request, err := http.NewRequestWithContext(ctx, "POST", dstURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	return c.doStatusRequest(request)
+}
+
+func (c *indexServerClientImpl) doStatusRequest(request *http.Request) (*dtos.ServerStatusDTO, error) {
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error performing request: %w", err)
+	}
+	defer response.Body.Close()
+
+	switch c := response.StatusCode; {
+	case c == 404:
+		return nil, ErrNotRegistered
+	case c < 200 || c >= 300:
+		return nil, fmt.Errorf("non-2xx (%d) status code returned", c)
+	}
+
+	respBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	var result dtos.ServerStatusDTO
+	if err = json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("error deserializing body: %w", err)
+	}
+
+	return &result, nil
 }
 
 var _ indexServerClient = (*indexServerClientImpl)(nil)
@@ -2,9 +2,13 @@ package registrar
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
+	"runtime"
+	"time"
 
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	"github.com/mredolatti/tf/codigo/common/dtos"
 	"github.com/mredolatti/tf/codigo/common/log"
 )
@@ -15,8 +19,21 @@ const (
 	fetchPath = "files"
 )
 
+// Public errors
+var (
+	ErrNotRegistered = errors.New("this server is not registered in the index server")
+)
+
+// HealthCheck reports whether the server can currently serve requests
+type HealthCheck func(ctx context.Context) error
+
 type Interface interface {
 	EnsureThisServerIsRegistered(ctx context.Context) error
+	Status(ctx context.Context) (dtos.ServerInfoStatus, error)
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
+	Start(check HealthCheck)
+	Close()
 }
 
 type Config struct {
@@ -26,23 +43,27 @@ type Config struct {
 	ClientPort         int
 	ControlPort        int
 	IndexServerBaseURL string
-	RootCAFn           string
-	CertChainFn        string
-	PrivateKeyFn       string
+	Certificates       certmanager.Interface
+	Version            string
+	HeartbeatInterval  time.Duration
 }
 
 type Impl struct {
-	isClient   indexServerClient
-	serverInfo dtos.ServerInfoDTO
+	logger            log.Interface
+	isClient          indexServerClient
+	serverInfo        dtos.ServerInfoDTO
+	version           string
+	heartbeatInterval time.Duration
+	started           time.Time
+	backoff           *backoff
+	stop              chan struct{}
 }
 
 func New(cfg *Config, logger log.Interface) (*Impl, error) {
 	isc, err := newIndexServerClient(&indexServerClientConfig{
-		Logger:   logger,
-		BaseURL:  cfg.IndexServerBaseURL,
-		RootCAFN: cfg.RootCAFn,
-		KeyFN:    cfg.PrivateKeyFn,
-		CertFN:   cfg.CertChainFn,
+		Logger:       logger,
+		BaseURL:      cfg.IndexServerBaseURL,
+		Certificates: cfg.Certificates,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("error constructing index-server api client: %w", err)
@@ -54,7 +75,12 @@ func New(cfg *Config, logger log.Interface) (*Impl, error) {
 	}
 
 	return &Impl{
-		isClient: isc,
+		logger:            logger,
+		isClient:          isc,
+		version:           cfg.Version,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		started:           time.Now(),
+		backoff:           newBackoff(defaultInitialBackoff, defaultMaxBackoff),
 		serverInfo: dtos.ServerInfoDTO{
 			OrgName:         cfg.OrgName,
 			Name:            cfg.ServerName,
@@ -76,6 +102,8 @@ func (r *Impl) EnsureThisServerIsRegistered(ctx context.Context) error {
 
 	switch response.Result {
 	case dtos.ResultOK, dtos.ResultAlreadyRegistered:
+	case dtos.ResultUpdated:
+		r.logger.Info("registrar: endpoints updated in index server")
 	default:
 		return fmt.Errorf("registration failed with result: %d", response.Result)
 	}
@@ -83,6 +111,121 @@ func (r *Impl) EnsureThisServerIsRegistered(ctx context.Context) error {
 	return nil
 }
 
+// Status returns the status of this server as seen by the index server
+func (r *Impl) Status(ctx context.Context) (dtos.ServerInfoStatus, error) {
+	response, err := r.isClient.CheckServerStatusRequest(ctx, r.serverInfo.OrgName)
+	if err != nil {
+		return dtos.StatusServerNotRegistered, fmt.Errorf("error checking server status: %w", err)
+	}
+	return dtos.ServerInfoStatus(response.Status), nil
+}
+
+// Pause asks the index server to stop syncing users against this server, ie: during maintenance
+func (r *Impl) Pause(ctx context.Context) error {
+	if _, err := r.isClient.PauseServer(ctx, r.serverInfo.OrgName); err != nil {
+		return fmt.Errorf("error pausing server: %w", err)
+	}
+	return nil
+}
+
+// Resume asks the index server to sync users against this server again
+func (r *Impl) Resume(ctx context.Context) error {
+	if _, err := r.isClient.ResumeServer(ctx, r.serverInfo.OrgName); err != nil {
+		return fmt.Errorf("error resuming server: %w", err)
+	}
+	return nil
+}
+
+// Start registers this server in the index server & periodically reports its health & load, until Close is called.
+// Registration is retried with exponential backoff, and repeated if the index server stops recognizing this server.
+// `check` is optional
+func (r *Impl) Start(check HealthCheck) {
+	r.stop = make(chan struct{})
+	go r.run(check, r.stop)
+}
+
+// Close stops the registration & heartbeat loop, if it was started
+func (r *Impl) Close() {
+	if r.stop != nil {
+		close(r.stop)
+	}
+}
+
+func (r *Impl) run(check HealthCheck, stop chan struct{}) {
+	registered := false
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-stop:
+			return
+		}
+
+		if !registered {
+			if err := r.register(); err != nil {
+				wait := r.backoff.next()
+				r.logger.Error("registrar: error registering server, retrying in %s: %s", wait, err)
+				timer.Reset(wait)
+				continue
+			}
+			r.logger.Info("registrar: server registered in index server")
+			registered = true
+			r.backoff.reset()
+		}
+
+		if err := r.sendHeartbeat(check); err != nil {
+			if errors.Is(err, ErrNotRegistered) {
+				r.logger.Info("registrar: index server no longer knows this server, registering again")
+				registered = false
+				timer.Reset(0)
+				continue
+			}
+			r.logger.Error("registrar.heartbeat: error sending heartbeat to index server: %s", err) // retried on the next tick
+		}
+		timer.Reset(r.heartbeatInterval)
+	}
+}
+
+func (r *Impl) register() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.heartbeatInterval)
+	defer cancel()
+	return r.EnsureThisServerIsRegistered(ctx)
+}
+
+func (r *Impl) sendHeartbeat(check HealthCheck) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.heartbeatInterval)
+	defer cancel()
+
+	return r.isClient.SendHeartbeat(ctx, r.buildHeartbeat(ctx, check))
+}
+
+func (r *Impl) buildHeartbeat(ctx context.Context, check HealthCheck) *dtos.HeartbeatDTO {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	heartbeat := &dtos.HeartbeatDTO{
+		OrgName:         r.serverInfo.OrgName,
+		Version:         r.version,
+		UptimeSeconds:   int64(time.Since(r.started).Seconds()),
+		IntervalSeconds: int64(r.heartbeatInterval.Seconds()),
+		Healthy:         true,
+		Load: dtos.ServerLoadDTO{
+			Goroutines: runtime.NumGoroutine(),
+			HeapBytes:  memStats.HeapAlloc,
+		},
+	}
+
+	if check != nil {
+		if err := check(ctx); err != nil {
+			heartbeat.Healthy = false
+			heartbeat.Message = err.Error()
+		}
+	}
+
+	return heartbeat
+}
+
 func buildURLs(cfg *Config) (auth, token, fetch, control string, err error) {
 	clientBaseURL := fmt.Sprintf("https://%s:%d/", cfg.ThisHost, cfg.ClientPort)
 	if auth, err = url.JoinPath(clientBaseURL, authPath); err != nil {
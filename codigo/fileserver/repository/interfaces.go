@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/go-oauth2/oauth2/v4"
 	"github.com/mredolatti/tf/codigo/fileserver/models"
@@ -21,4 +22,50 @@ type OAuth2ClientRepository interface {
 }
 
 // OAuth2TokenRepository defines the set of methods to create, retreive and remove aauth2 tokens
-type OAuth2TokenRepository = oauth2.TokenStore
+type OAuth2TokenRepository interface {
+	oauth2.TokenStore
+
+	// Rotate removes the tokens a refresh token belongs to & keeps track of it as rotated, so that reuse can be
+	// detected. Both happen in a single step, and only for tokens issued to `clientID`. The removed token is returned,
+	// or nil if there was none (ie: a concurrent request already rotated it)
+	Rotate(ctx context.Context, refresh string, clientID string, when time.Time) (models.TokenInfo, error)
+
+	// GetRotated returns the client & user a rotated refresh token was issued to, or ErrNotFound
+	GetRotated(ctx context.Context, refresh string) (clientID string, userID string, err error)
+
+	// RemoveByClientAndUser revokes every token issued to a client on behalf of a user
+	RemoveByClientAndUser(ctx context.Context, clientID string, userID string) error
+}
+
+// WebhookRepository defines the set of methods to register, list and remove webhook endpoints
+type WebhookRepository interface {
+	Add(ctx context.Context, id string, url string, secret string, createdBy string) (models.Webhook, error)
+	Get(ctx context.Context, id string) (models.Webhook, error)
+	List(ctx context.Context) ([]models.Webhook, error)
+	Remove(ctx context.Context, id string) error
+}
+
+// WebhookDeliveryRepository defines the set of methods to queue webhook deliveries and keep track of their attempts
+type WebhookDeliveryRepository interface {
+	Add(ctx context.Context, id string, webhookID string, eventID string, payload []byte, nextAttemptAt time.Time) (models.WebhookDelivery, error)
+	Get(ctx context.Context, id string) (models.WebhookDelivery, error)
+
+	// List returns the most recent deliveries for a webhook, newest first
+	List(ctx context.Context, webhookID string, limit int) ([]models.WebhookDelivery, error)
+
+	// Due returns pending deliveries whose next attempt is scheduled at or before `now`, oldest first. At most
+	// `perWebhook` deliveries are returned for each webhook, so that a backlog in one of them doesn't starve the rest
+	Due(ctx context.Context, now time.Time, perWebhook int, limit int) ([]models.WebhookDelivery, error)
+
+	// RecordAttempt stores the outcome of a delivery attempt
+	RecordAttempt(ctx context.Context, id string, status string, lastError string, responseCode int, nextAttemptAt time.Time) error
+}
+
+// ShareLinkRepository defines the set of methods to create, redeem and revoke file share links
+type ShareLinkRepository interface {
+	Add(ctx context.Context, id string, fileID string, createdBy string, expiresAt time.Time, maxDownloads int) (models.ShareLink, error)
+	Get(ctx context.Context, id string) (models.ShareLink, error)
+	Consume(ctx context.Context, id string, now time.Time) (models.ShareLink, error)
+	Release(ctx context.Context, id string) error
+	Revoke(ctx context.Context, id string) error
+}
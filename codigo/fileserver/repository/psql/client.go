@@ -24,6 +24,7 @@ type Client struct {
 	SecretField string `db:"secret"`
 	DomainField string `db:"domain"`
 	UserIDField string `db:"user_id"`
+	PKCEField   bool   `db:"require_pkce"`
 }
 
 func (c *Client) GetID() string {
@@ -42,6 +43,11 @@ func (c *Client) GetUserID() string {
 	return c.UserIDField
 }
 
+// RequiresPKCE returns true if authorization codes can only be requested along with a S256 code challenge
+func (c *Client) RequiresPKCE() bool {
+	return c.PKCEField
+}
+
 // ClientRepository is a mapping to a table in postgres that allows enables operations
 // on file server
 type ClientRepository struct {
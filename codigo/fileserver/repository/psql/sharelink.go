@@ -0,0 +1,145 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/fileserver/models"
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	shareLinkAdd     = "INSERT INTO share_links(id, file_id, created_by, created_at, expires_at, max_downloads) VALUES ($1, $2, $3, $4, $5, $6) RETURNING *"
+	shareLinkGetByID = "SELECT * FROM share_links WHERE id = $1"
+	shareLinkConsume = "UPDATE share_links SET downloads = downloads + 1 WHERE id = $1 AND NOT revoked AND expires_at > $2 AND (max_downloads = 0 OR downloads < max_downloads) RETURNING *"
+	shareLinkRelease = "UPDATE share_links SET downloads = downloads - 1 WHERE id = $1 AND downloads > 0"
+	shareLinkRevoke  = "UPDATE share_links SET revoked = TRUE WHERE id = $1"
+)
+
+// ShareLink is a postgres-compatible struct implementing models.ShareLink interface
+type ShareLink struct {
+	IDField           string    `db:"id"`
+	FileIDField       string    `db:"file_id"`
+	CreatedByField    string    `db:"created_by"`
+	CreatedAtField    time.Time `db:"created_at"`
+	ExpiresAtField    time.Time `db:"expires_at"`
+	MaxDownloadsField int       `db:"max_downloads"`
+	DownloadsField    int       `db:"downloads"`
+	RevokedField      bool      `db:"revoked"`
+}
+
+func (l *ShareLink) ID() string {
+	return l.IDField
+}
+
+func (l *ShareLink) FileID() string {
+	return l.FileIDField
+}
+
+func (l *ShareLink) CreatedBy() string {
+	return l.CreatedByField
+}
+
+func (l *ShareLink) CreatedAt() time.Time {
+	return l.CreatedAtField
+}
+
+func (l *ShareLink) ExpiresAt() time.Time {
+	return l.ExpiresAtField
+}
+
+func (l *ShareLink) MaxDownloads() int {
+	return l.MaxDownloadsField
+}
+
+func (l *ShareLink) Downloads() int {
+	return l.DownloadsField
+}
+
+func (l *ShareLink) Revoked() bool {
+	return l.RevokedField
+}
+
+// ShareLinkRepository is a mapping to a table in postgres that enables operations on share links
+type ShareLinkRepository struct {
+	db *sqlx.DB
+}
+
+// NewShareLinkRepository constructs a new postgresql-based share link repository
+func NewShareLinkRepository(db *sqlx.DB) (*ShareLinkRepository, error) {
+	if db == nil {
+		return nil, ErrNilDB
+	}
+	return &ShareLinkRepository{db: db}, nil
+}
+
+// Add a new share link
+func (r *ShareLinkRepository) Add(ctx context.Context, id string, fileID string, createdBy string, expiresAt time.Time, maxDownloads int) (models.ShareLink, error) {
+	var link ShareLink
+	err := r.db.QueryRowxContext(ctx, shareLinkAdd, id, fileID, createdBy, time.Now(), expiresAt, maxDownloads).StructScan(&link)
+	if err != nil {
+		return nil, fmt.Errorf("error executing share_link::add in postgres: %w", err)
+	}
+	return &link, nil
+}
+
+// Get returns the share link that matches the supplied id
+func (r *ShareLinkRepository) Get(ctx context.Context, id string) (models.ShareLink, error) {
+	var link ShareLink
+	err := r.db.QueryRowxContext(ctx, shareLinkGetByID, id).StructScan(&link)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repository.ErrNotFound
+		}
+		return nil, fmt.Errorf("error executing share_link::get_by_id in postgres: %w", err)
+	}
+	return &link, nil
+}
+
+// Consume atomically registers a download on a link. ErrNotFound is returned if the link doesn't exist,
+// has been revoked, has expired or has no downloads left
+func (r *ShareLinkRepository) Consume(ctx context.Context, id string, now time.Time) (models.ShareLink, error) {
+	var link ShareLink
+	err := r.db.QueryRowxContext(ctx, shareLinkConsume, id, now).StructScan(&link)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repository.ErrNotFound
+		}
+		return nil, fmt.Errorf("error executing share_link::consume in postgres: %w", err)
+	}
+	return &link, nil
+}
+
+// Release gives back a download registered with Consume, for downloads that couldn't be completed
+func (r *ShareLinkRepository) Release(ctx context.Context, id string) error {
+	res, err := r.db.ExecContext(ctx, shareLinkRelease, id)
+	if err != nil {
+		return fmt.Errorf("error executing share_link::release in postgres: %w", err)
+	}
+
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+// Revoke a share link
+func (r *ShareLinkRepository) Revoke(ctx context.Context, id string) error {
+	res, err := r.db.ExecContext(ctx, shareLinkRevoke, id)
+	if err != nil {
+		return fmt.Errorf("error executing share_link::revoke in postgres: %w", err)
+	}
+
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+var _ models.ShareLink = (*ShareLink)(nil)
+var _ repository.ShareLinkRepository = (*ShareLinkRepository)(nil)
@@ -2,6 +2,8 @@ package psql
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
@@ -20,6 +22,12 @@ const (
 	tokenRemoveByCode    = "DELETE FROM tokens WHERE code = $1"
 	tokenRemoveByAccess  = "DELETE FROM tokens WHERE access = $1"
 	tokenRemoveByRefresh = "DELETE FROM tokens WHERE refresh = $1"
+	tokenRemoveByFamily  = "DELETE FROM tokens WHERE client_id = $1 AND user_id = $2"
+	tokenGetRotated      = "SELECT client_id, user_id FROM rotated_refresh_tokens WHERE refresh = $1"
+	tokenRotate          = "WITH rotated AS (DELETE FROM tokens WHERE refresh = $1 AND client_id = $2 RETURNING *), " +
+		"marked AS (INSERT INTO rotated_refresh_tokens(refresh, client_id, user_id, rotated_at) " +
+		"SELECT refresh, client_id, user_id, $3 FROM rotated ON CONFLICT (refresh) DO NOTHING) " +
+		"SELECT * FROM rotated"
 )
 
 // TokenInfo is a postgres-compatible struct implementing models.TokenInfo interface
@@ -211,6 +219,9 @@ func (r *TokenInfoRepository) Create(ctx context.Context, info models.TokenInfo)
 func (r *TokenInfoRepository) GetByCode(ctx context.Context, code string) (models.TokenInfo, error) {
 	var token TokenInfo
 	if err := r.db.QueryRowxContext(ctx, tokenGetByCode, code).StructScan(&token); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // the oauth2 manager expects a nil token for unknown ones
+			return nil, nil
+		}
 		return nil, fmt.Errorf("error executing token_repository::get_by_code in postgres: %w", err)
 	}
 
@@ -219,7 +230,10 @@ func (r *TokenInfoRepository) GetByCode(ctx context.Context, code string) (model
 
 func (r *TokenInfoRepository) GetByAccess(ctx context.Context, access string) (models.TokenInfo, error) {
 	var token TokenInfo
-	if err := r.db.QueryRowxContext(ctx, tokenGetByCode, access).StructScan(&token); err != nil {
+	if err := r.db.QueryRowxContext(ctx, tokenGetByAccess, access).StructScan(&token); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // the oauth2 manager expects a nil token for unknown ones
+			return nil, nil
+		}
 		return nil, fmt.Errorf("error executing token_repository::get_by_access in postgres: %w", err)
 	}
 
@@ -229,6 +243,9 @@ func (r *TokenInfoRepository) GetByAccess(ctx context.Context, access string) (m
 func (r *TokenInfoRepository) GetByRefresh(ctx context.Context, refresh string) (models.TokenInfo, error) {
 	var token TokenInfo
 	if err := r.db.QueryRowxContext(ctx, tokenGetByRefresh, refresh).StructScan(&token); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // the oauth2 manager expects a nil token for unknown ones
+			return nil, nil
+		}
 		return nil, fmt.Errorf("error executing token_repository::get_by_refresh in postgres: %w", err)
 	}
 
@@ -256,5 +273,35 @@ func (r *TokenInfoRepository) RemoveByRefresh(ctx context.Context, refresh strin
 	return nil
 }
 
+func (r *TokenInfoRepository) RemoveByClientAndUser(ctx context.Context, clientID string, userID string) error {
+	if _, err := r.db.ExecContext(ctx, tokenRemoveByFamily, clientID, userID); err != nil {
+		return fmt.Errorf("error executing token_repository::delete_by_client_and_user in postgres: %w", err)
+	}
+	return nil
+}
+
+func (r *TokenInfoRepository) Rotate(ctx context.Context, refresh string, clientID string, when time.Time) (models.TokenInfo, error) {
+	var token TokenInfo
+	if err := r.db.QueryRowxContext(ctx, tokenRotate, refresh, clientID, when).StructScan(&token); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error executing token_repository::rotate in postgres: %w", err)
+	}
+
+	return &token, nil
+}
+
+func (r *TokenInfoRepository) GetRotated(ctx context.Context, refresh string) (string, string, error) {
+	var clientID, userID string
+	if err := r.db.QueryRowxContext(ctx, tokenGetRotated, refresh).Scan(&clientID, &userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", repository.ErrNotFound
+		}
+		return "", "", fmt.Errorf("error executing token_repository::get_rotated in postgres: %w", err)
+	}
+	return clientID, userID, nil
+}
+
 var _ models.TokenInfo = (*TokenInfo)(nil)
 var _ repository.OAuth2TokenRepository = (*TokenInfoRepository)(nil)
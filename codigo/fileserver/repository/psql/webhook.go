@@ -0,0 +1,258 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/fileserver/models"
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	webhookAdd     = "INSERT INTO webhooks(id, url, secret, created_by, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING *"
+	webhookGetByID = "SELECT * FROM webhooks WHERE id = $1"
+	webhookList    = "SELECT * FROM webhooks ORDER BY created_at"
+	webhookRemove  = "DELETE FROM webhooks WHERE id = $1"
+
+	deliveryAdd = "INSERT INTO webhook_deliveries(id, webhook_id, event_id, payload, status, created_at, next_attempt_at) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING *"
+	deliveryGetByID = "SELECT * FROM webhook_deliveries WHERE id = $1"
+	deliveryList    = "SELECT * FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY created_at DESC LIMIT $2"
+	deliveryDue     = "SELECT id, webhook_id, event_id, payload, status, attempts, last_error, response_code, created_at, next_attempt_at " +
+		"FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY webhook_id ORDER BY next_attempt_at) AS position " +
+		"FROM webhook_deliveries WHERE status = $1 AND next_attempt_at <= $2) due " +
+		"WHERE position <= $3 ORDER BY next_attempt_at LIMIT $4"
+	deliveryAttempt = "UPDATE webhook_deliveries SET status = $2, attempts = attempts + 1, last_error = $3, response_code = $4, " +
+		"next_attempt_at = $5 WHERE id = $1"
+)
+
+// Webhook is a postgres-compatible struct implementing models.Webhook interface
+type Webhook struct {
+	IDField        string    `db:"id"`
+	URLField       string    `db:"url"`
+	SecretField    string    `db:"secret"`
+	CreatedByField string    `db:"created_by"`
+	CreatedAtField time.Time `db:"created_at"`
+}
+
+func (w *Webhook) ID() string {
+	return w.IDField
+}
+
+func (w *Webhook) URL() string {
+	return w.URLField
+}
+
+func (w *Webhook) Secret() string {
+	return w.SecretField
+}
+
+func (w *Webhook) CreatedBy() string {
+	return w.CreatedByField
+}
+
+func (w *Webhook) CreatedAt() time.Time {
+	return w.CreatedAtField
+}
+
+// WebhookDelivery is a postgres-compatible struct implementing models.WebhookDelivery interface
+type WebhookDelivery struct {
+	IDField            string    `db:"id"`
+	WebhookIDField     string    `db:"webhook_id"`
+	EventIDField       string    `db:"event_id"`
+	PayloadField       []byte    `db:"payload"`
+	StatusField        string    `db:"status"`
+	AttemptsField      int       `db:"attempts"`
+	LastErrorField     string    `db:"last_error"`
+	ResponseCodeField  int       `db:"response_code"`
+	CreatedAtField     time.Time `db:"created_at"`
+	NextAttemptAtField time.Time `db:"next_attempt_at"`
+}
+
+func (d *WebhookDelivery) ID() string {
+	return d.IDField
+}
+
+func (d *WebhookDelivery) WebhookID() string {
+	return d.WebhookIDField
+}
+
+func (d *WebhookDelivery) EventID() string {
+	return d.EventIDField
+}
+
+func (d *WebhookDelivery) Payload() []byte {
+	return d.PayloadField
+}
+
+func (d *WebhookDelivery) Status() string {
+	return d.StatusField
+}
+
+func (d *WebhookDelivery) Attempts() int {
+	return d.AttemptsField
+}
+
+func (d *WebhookDelivery) LastError() string {
+	return d.LastErrorField
+}
+
+func (d *WebhookDelivery) ResponseCode() int {
+	return d.ResponseCodeField
+}
+
+func (d *WebhookDelivery) CreatedAt() time.Time {
+	return d.CreatedAtField
+}
+
+func (d *WebhookDelivery) NextAttemptAt() time.Time {
+	return d.NextAttemptAtField
+}
+
+// WebhookRepository is a mapping to a table in postgres that enables operations on webhook endpoints
+type WebhookRepository struct {
+	db *sqlx.DB
+}
+
+// NewWebhookRepository constructs a new postgresql-based webhook repository
+func NewWebhookRepository(db *sqlx.DB) (*WebhookRepository, error) {
+	if db == nil {
+		return nil, ErrNilDB
+	}
+	return &WebhookRepository{db: db}, nil
+}
+
+// Add a new webhook
+func (r *WebhookRepository) Add(ctx context.Context, id string, url string, secret string, createdBy string) (models.Webhook, error) {
+	var hook Webhook
+	err := r.db.QueryRowxContext(ctx, webhookAdd, id, url, secret, createdBy, time.Now()).StructScan(&hook)
+	if err != nil {
+		return nil, fmt.Errorf("error executing webhook::add in postgres: %w", err)
+	}
+	return &hook, nil
+}
+
+// Get returns the webhook that matches the supplied id
+func (r *WebhookRepository) Get(ctx context.Context, id string) (models.Webhook, error) {
+	var hook Webhook
+	err := r.db.QueryRowxContext(ctx, webhookGetByID, id).StructScan(&hook)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repository.ErrNotFound
+		}
+		return nil, fmt.Errorf("error executing webhook::get_by_id in postgres: %w", err)
+	}
+	return &hook, nil
+}
+
+// List returns every registered webhook
+func (r *WebhookRepository) List(ctx context.Context) ([]models.Webhook, error) {
+	var hooks []Webhook
+	if err := r.db.SelectContext(ctx, &hooks, webhookList); err != nil {
+		return nil, fmt.Errorf("error executing webhook::list in postgres: %w", err)
+	}
+
+	result := make([]models.Webhook, 0, len(hooks))
+	for idx := range hooks {
+		result = append(result, &hooks[idx])
+	}
+	return result, nil
+}
+
+// Remove a webhook along with its deliveries
+func (r *WebhookRepository) Remove(ctx context.Context, id string) error {
+	res, err := r.db.ExecContext(ctx, webhookRemove, id)
+	if err != nil {
+		return fmt.Errorf("error executing webhook::remove in postgres: %w", err)
+	}
+
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+// WebhookDeliveryRepository is a mapping to a table in postgres that keeps track of webhook deliveries
+type WebhookDeliveryRepository struct {
+	db *sqlx.DB
+}
+
+// NewWebhookDeliveryRepository constructs a new postgresql-based webhook delivery repository
+func NewWebhookDeliveryRepository(db *sqlx.DB) (*WebhookDeliveryRepository, error) {
+	if db == nil {
+		return nil, ErrNilDB
+	}
+	return &WebhookDeliveryRepository{db: db}, nil
+}
+
+// Add queues a new delivery
+func (r *WebhookDeliveryRepository) Add(ctx context.Context, id string, webhookID string, eventID string, payload []byte, nextAttemptAt time.Time) (models.WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := r.db.QueryRowxContext(ctx, deliveryAdd, id, webhookID, eventID, payload, models.DeliveryPending, time.Now(), nextAttemptAt).StructScan(&delivery)
+	if err != nil {
+		return nil, fmt.Errorf("error executing webhook_delivery::add in postgres: %w", err)
+	}
+	return &delivery, nil
+}
+
+// Get returns the delivery that matches the supplied id
+func (r *WebhookDeliveryRepository) Get(ctx context.Context, id string) (models.WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := r.db.QueryRowxContext(ctx, deliveryGetByID, id).StructScan(&delivery)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repository.ErrNotFound
+		}
+		return nil, fmt.Errorf("error executing webhook_delivery::get_by_id in postgres: %w", err)
+	}
+	return &delivery, nil
+}
+
+// List returns the most recent deliveries for a webhook
+func (r *WebhookDeliveryRepository) List(ctx context.Context, webhookID string, limit int) ([]models.WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	if err := r.db.SelectContext(ctx, &deliveries, deliveryList, webhookID, limit); err != nil {
+		return nil, fmt.Errorf("error executing webhook_delivery::list in postgres: %w", err)
+	}
+	return toDeliveryModels(deliveries), nil
+}
+
+// Due returns pending deliveries whose next attempt is scheduled at or before `now`, at most `perWebhook` for each webhook
+func (r *WebhookDeliveryRepository) Due(ctx context.Context, now time.Time, perWebhook int, limit int) ([]models.WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	if err := r.db.SelectContext(ctx, &deliveries, deliveryDue, models.DeliveryPending, now, perWebhook, limit); err != nil {
+		return nil, fmt.Errorf("error executing webhook_delivery::due in postgres: %w", err)
+	}
+	return toDeliveryModels(deliveries), nil
+}
+
+// RecordAttempt stores the outcome of a delivery attempt
+func (r *WebhookDeliveryRepository) RecordAttempt(ctx context.Context, id string, status string, lastError string, responseCode int, nextAttemptAt time.Time) error {
+	res, err := r.db.ExecContext(ctx, deliveryAttempt, id, status, lastError, responseCode, nextAttemptAt)
+	if err != nil {
+		return fmt.Errorf("error executing webhook_delivery::record_attempt in postgres: %w", err)
+	}
+
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+func toDeliveryModels(deliveries []WebhookDelivery) []models.WebhookDelivery {
+	result := make([]models.WebhookDelivery, 0, len(deliveries))
+	for idx := range deliveries {
+		result = append(result, &deliveries[idx])
+	}
+	return result
+}
+
+var _ models.Webhook = (*Webhook)(nil)
+var _ models.WebhookDelivery = (*WebhookDelivery)(nil)
+var _ repository.WebhookRepository = (*WebhookRepository)(nil)
+var _ repository.WebhookDeliveryRepository = (*WebhookDeliveryRepository)(nil)
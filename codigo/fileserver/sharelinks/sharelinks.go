@@ -0,0 +1,187 @@
+package sharelinks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/fileserver/models"
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+)
+
+const (
+	defaultTTL = 24 * time.Hour
+	defaultMax = 7 * 24 * time.Hour
+)
+
+// Query parameters used to carry a signed link
+const (
+	ParamLink      = "link"
+	ParamExpires   = "expires"
+	ParamSignature = "signature"
+)
+
+// Public errors
+var (
+	ErrNoSecret         = errors.New("a signing secret is required for share links")
+	ErrNoRepository     = errors.New("a repository is required for share links")
+	ErrInvalidTTL       = errors.New("invalid link duration")
+	ErrInvalidSignature = errors.New("invalid link signature")
+	ErrExpired          = errors.New("link has expired")
+	ErrUnavailable      = errors.New("link has been revoked or has no downloads left")
+)
+
+// SignedLink is a share link along with the values that need to be sent in the url to redeem it
+type SignedLink struct {
+	Link      models.ShareLink
+	Expires   int64
+	Signature string
+}
+
+// Query returns the query-string parameters that authenticate a download
+func (s *SignedLink) Query() url.Values {
+	return url.Values{
+		ParamLink:      []string{s.Link.ID()},
+		ParamExpires:   []string{strconv.FormatInt(s.Expires, 10)},
+		ParamSignature: []string{s.Signature},
+	}
+}
+
+// Interface defines the set of methods to mint, redeem & revoke share links
+type Interface interface {
+	Create(ctx context.Context, user string, fileID string, ttl time.Duration, maxDownloads int) (*SignedLink, error)
+	Redeem(ctx context.Context, fileID string, linkID string, expires int64, signature string) (models.ShareLink, error)
+	Release(ctx context.Context, linkID string) error
+	Get(ctx context.Context, linkID string) (models.ShareLink, error)
+	Revoke(ctx context.Context, linkID string) error
+}
+
+// Config contains parameters to set up the share-links component
+type Config struct {
+	Secret     []byte
+	Repository repository.ShareLinkRepository
+	MaxTTL     time.Duration
+}
+
+// Impl is an implementation of share-links signed with HMAC-SHA256
+type Impl struct {
+	secret []byte
+	repo   repository.ShareLinkRepository
+	maxTTL time.Duration
+}
+
+// New constructs a new share-links component
+func New(cfg *Config) (*Impl, error) {
+	if len(cfg.Secret) == 0 {
+		return nil, ErrNoSecret
+	}
+
+	if cfg.Repository == nil {
+		return nil, ErrNoRepository
+	}
+
+	maxTTL := cfg.MaxTTL
+	if maxTTL <= 0 {
+		maxTTL = defaultMax
+	}
+
+	return &Impl{secret: cfg.Secret, repo: cfg.Repository, maxTTL: maxTTL}, nil
+}
+
+// Create mints a new link for a file. A ttl of 0 uses the default duration, and a maxDownloads of 0 means unlimited
+func (i *Impl) Create(ctx context.Context, user string, fileID string, ttl time.Duration, maxDownloads int) (*SignedLink, error) {
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+
+	if ttl < 0 || ttl > i.maxTTL || maxDownloads < 0 {
+		return nil, ErrInvalidTTL
+	}
+
+	id, err := newLinkID()
+	if err != nil {
+		return nil, fmt.Errorf("error generating link id: %w", err)
+	}
+
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	link, err := i.repo.Add(ctx, id, fileID, user, expiresAt, maxDownloads)
+	if err != nil {
+		return nil, fmt.Errorf("error storing share link: %w", err)
+	}
+
+	return &SignedLink{
+		Link:      link,
+		Expires:   expiresAt.Unix(),
+		Signature: i.sign(id, fileID, expiresAt.Unix()),
+	}, nil
+}
+
+// Redeem validates a signed link and registers a download on it
+func (i *Impl) Redeem(ctx context.Context, fileID string, linkID string, expires int64, signature string) (models.ShareLink, error) {
+	given, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	expected, _ := base64.RawURLEncoding.DecodeString(i.sign(linkID, fileID, expires))
+	if !hmac.Equal(given, expected) {
+		return nil, ErrInvalidSignature
+	}
+
+	now := time.Now()
+	if now.Unix() >= expires {
+		return nil, ErrExpired
+	}
+
+	link, err := i.repo.Consume(ctx, linkID, now)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrUnavailable
+		}
+		return nil, fmt.Errorf("error registering download on share link: %w", err)
+	}
+
+	return link, nil
+}
+
+// Release gives back the download registered by Redeem, when the file couldn't be served
+func (i *Impl) Release(ctx context.Context, linkID string) error {
+	if err := i.repo.Release(ctx, linkID); err != nil {
+		return fmt.Errorf("error releasing download on share link: %w", err)
+	}
+	return nil
+}
+
+// Get returns a link by id
+func (i *Impl) Get(ctx context.Context, linkID string) (models.ShareLink, error) {
+	return i.repo.Get(ctx, linkID)
+}
+
+// Revoke invalidates a link
+func (i *Impl) Revoke(ctx context.Context, linkID string) error {
+	return i.repo.Revoke(ctx, linkID)
+}
+
+func (i *Impl) sign(linkID string, fileID string, expires int64) string {
+	mac := hmac.New(sha256.New, i.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", linkID, fileID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newLinkID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+var _ Interface = (*Impl)(nil)
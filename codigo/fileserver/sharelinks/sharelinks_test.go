@@ -0,0 +1,117 @@
+package sharelinks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/fileserver/models"
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+type linkMock struct {
+	id, fileID, createdBy string
+	expiresAt             time.Time
+	max, downloads        int
+	revoked               bool
+}
+
+func (l *linkMock) ID() string           { return l.id }
+func (l *linkMock) FileID() string       { return l.fileID }
+func (l *linkMock) CreatedBy() string    { return l.createdBy }
+func (l *linkMock) CreatedAt() time.Time { return time.Time{} }
+func (l *linkMock) ExpiresAt() time.Time { return l.expiresAt }
+func (l *linkMock) MaxDownloads() int    { return l.max }
+func (l *linkMock) Downloads() int       { return l.downloads }
+func (l *linkMock) Revoked() bool        { return l.revoked }
+
+type repoMock struct {
+	links map[string]*linkMock
+}
+
+func (r *repoMock) Add(ctx context.Context, id string, fileID string, createdBy string, expiresAt time.Time, maxDownloads int) (models.ShareLink, error) {
+	r.links[id] = &linkMock{id: id, fileID: fileID, createdBy: createdBy, expiresAt: expiresAt, max: maxDownloads}
+	return r.links[id], nil
+}
+
+func (r *repoMock) Get(ctx context.Context, id string) (models.ShareLink, error) {
+	if l, ok := r.links[id]; ok {
+		return l, nil
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (r *repoMock) Consume(ctx context.Context, id string, now time.Time) (models.ShareLink, error) {
+	l, ok := r.links[id]
+	if !ok || l.revoked || !now.Before(l.expiresAt) || (l.max > 0 && l.downloads >= l.max) {
+		return nil, repository.ErrNotFound
+	}
+	l.downloads++
+	return l, nil
+}
+
+func (r *repoMock) Release(ctx context.Context, id string) error {
+	if l, ok := r.links[id]; ok && l.downloads > 0 {
+		l.downloads--
+		return nil
+	}
+	return repository.ErrNotFound
+}
+
+func (r *repoMock) Revoke(ctx context.Context, id string) error {
+	if l, ok := r.links[id]; ok {
+		l.revoked = true
+		return nil
+	}
+	return repository.ErrNotFound
+}
+
+func TestShareLinks(t *testing.T) {
+	ctx := context.Background()
+	links, err := New(&Config{Secret: []byte("some_secret"), Repository: &repoMock{links: map[string]*linkMock{}}})
+	assert.Nil(t, err)
+
+	_, err = links.Create(ctx, "martin", "f1", 30*24*time.Hour, 0)
+	assert.ErrorIs(t, err, ErrInvalidTTL)
+
+	signed, err := links.Create(ctx, "martin", "f1", time.Hour, 2)
+	assert.Nil(t, err)
+	id := signed.Link.ID()
+
+	// signature is bound to link, file & expiration
+	_, err = links.Redeem(ctx, "f2", id, signed.Expires, signed.Signature)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+	_, err = links.Redeem(ctx, "f1", id, signed.Expires+3600, signed.Signature)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+	_, err = links.Redeem(ctx, "f1", id, signed.Expires, "garbage!")
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	// download limit is enforced
+	_, err = links.Redeem(ctx, "f1", id, signed.Expires, signed.Signature)
+	assert.Nil(t, err)
+	link, err := links.Redeem(ctx, "f1", id, signed.Expires, signed.Signature)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, link.Downloads())
+	_, err = links.Redeem(ctx, "f1", id, signed.Expires, signed.Signature)
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	// downloads that couldn't be served are given back
+	assert.Nil(t, links.Release(ctx, id))
+	link, err = links.Redeem(ctx, "f1", id, signed.Expires, signed.Signature)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, link.Downloads())
+
+	// revoked links cannot be used
+	signed, err = links.Create(ctx, "martin", "f1", 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, links.Revoke(ctx, signed.Link.ID()))
+	_, err = links.Redeem(ctx, "f1", signed.Link.ID(), signed.Expires, signed.Signature)
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	// expired links cannot be used
+	expired := &SignedLink{Link: signed.Link, Expires: time.Now().Add(-time.Minute).Unix()}
+	expired.Signature = links.sign(signed.Link.ID(), "f1", expired.Expires)
+	_, err = links.Redeem(ctx, "f1", signed.Link.ID(), expired.Expires, expired.Signature)
+	assert.ErrorIs(t, err, ErrExpired)
+}
@@ -0,0 +1,359 @@
+package signingkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// Supported signing algorithms
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+const (
+	keyFileExtension  = ".pem"
+	activatedAtHeader = "Activated-At"
+	rsaKeyBits        = 2048
+
+	defaultOverlap = 48 * time.Hour
+)
+
+// Public errors
+var (
+	ErrNoDirectory          = errors.New("a directory to store signing keys is required")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrUnknownKey           = errors.New("unknown or retired signing key")
+)
+
+// Key is a private key used to sign tokens, identified by the `kid` header of the tokens it signs
+type Key struct {
+	ID          string
+	Algorithm   string
+	ActivatedAt time.Time
+	private     crypto.Signer
+}
+
+// Method returns the jwt signing method to be used with this key
+func (k *Key) Method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// PrivateKey returns the key used to sign tokens
+func (k *Key) PrivateKey() crypto.PrivateKey {
+	return k.private
+}
+
+// PublicKey returns the key used to verify tokens
+func (k *Key) PublicKey() crypto.PublicKey {
+	return k.private.Public()
+}
+
+// Interface defines the set of methods to sign & verify tokens with a rotating set of keys
+type Interface interface {
+	Active() *Key
+	Lookup(kid string) (*Key, error)
+	JWKS() *JWKSet
+	Rotate() error
+}
+
+// Config contains parameters to set up the signing keys
+type Config struct {
+	Directory      string
+	Algorithm      string
+	RotationPeriod time.Duration // zero disables automatic rotation
+	Overlap        time.Duration // how long a replaced key remains valid. must exceed the lifetime of issued tokens
+}
+
+// Impl is a set of signing keys stored as PKCS8 pem files in a directory. The newest key is used to sign,
+// and the rest are kept for verification until a newer key has been active for longer than the overlap window.
+// Activation times are stored in a header of each pem file, so that copying or restoring the directory
+// doesn't alter the rotation schedule. Files without it (written by older versions) fall back to their mtime
+type Impl struct {
+	dir            string
+	algorithm      string
+	rotationPeriod time.Duration
+	overlap        time.Duration
+	keys           []*Key // sorted by activation time
+	mtx            sync.RWMutex
+	stop           chan struct{}
+}
+
+// New constructs a new key set, generating a first key if the directory has none
+func New(cfg *Config) (*Impl, error) {
+	if cfg.Directory == "" {
+		return nil, ErrNoDirectory
+	}
+
+	if cfg.Algorithm != AlgorithmRS256 && cfg.Algorithm != AlgorithmEdDSA {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnsupportedAlgorithm, cfg.Algorithm)
+	}
+
+	if err := os.MkdirAll(cfg.Directory, 0700); err != nil {
+		return nil, fmt.Errorf("error creating signing keys directory: %w", err)
+	}
+
+	overlap := cfg.Overlap
+	if overlap <= 0 {
+		overlap = defaultOverlap
+	}
+
+	set := &Impl{
+		dir:            cfg.Directory,
+		algorithm:      cfg.Algorithm,
+		rotationPeriod: cfg.RotationPeriod,
+		overlap:        overlap,
+	}
+
+	if err := set.load(); err != nil {
+		return nil, err
+	}
+
+	if set.Active() == nil {
+		if err := set.Rotate(); err != nil {
+			return nil, fmt.Errorf("error generating initial signing key: %w", err)
+		}
+	}
+
+	return set, nil
+}
+
+// Active returns the key to be used for signing new tokens
+func (s *Impl) Active() *Key {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if len(s.keys) == 0 {
+		return nil
+	}
+	return s.keys[len(s.keys)-1]
+}
+
+// Lookup returns a key that can be used to verify tokens, by id
+func (s *Impl) Lookup(kid string) (*Key, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	now := time.Now()
+	for idx, key := range s.keys {
+		if key.ID == kid && !s.retired(idx, now) {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// JWKS returns the public part of every key that can still be used to verify tokens
+func (s *Impl) JWKS() *JWKSet {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	now := time.Now()
+	set := &JWKSet{Keys: make([]JWK, 0, len(s.keys))}
+	for idx, key := range s.keys {
+		if !s.retired(idx, now) {
+			set.Keys = append(set.Keys, toJWK(key))
+		}
+	}
+	return set
+}
+
+// Rotate generates a new key, which immediately becomes the active one
+func (s *Impl) Rotate() error {
+	private, err := generate(s.algorithm)
+	if err != nil {
+		return fmt.Errorf("error generating key: %w", err)
+	}
+
+	if err := writeKey(filepath.Join(s.dir, uuid.New().String()+keyFileExtension), private, time.Now()); err != nil {
+		return err
+	}
+
+	return s.load()
+}
+
+// Prune removes the files of keys that can no longer be used to verify tokens
+func (s *Impl) Prune() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := time.Now()
+	kept := make([]*Key, 0, len(s.keys))
+	for idx, key := range s.keys {
+		if !s.retired(idx, now) {
+			kept = append(kept, key)
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.dir, key.ID+keyFileExtension)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing retired key '%s': %w", key.ID, err)
+		}
+	}
+	s.keys = kept
+	return nil
+}
+
+// StartRotating periodically rotates the active key once it's older than the rotation period, and prunes
+// retired ones. It runs until Close is called
+func (s *Impl) StartRotating(every time.Duration) {
+	s.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.maintain() // errors are retried on the next tick
+			case <-stop:
+				return
+			}
+		}
+	}(s.stop)
+}
+
+// Close stops the rotation goroutine, if any
+func (s *Impl) Close() {
+	if s.stop != nil {
+		close(s.stop)
+	}
+}
+
+func (s *Impl) maintain() error {
+	if active := s.Active(); s.rotationPeriod > 0 && time.Since(active.ActivatedAt) > s.rotationPeriod {
+		if err := s.Rotate(); err != nil {
+			return err
+		}
+	}
+	return s.Prune()
+}
+
+// retired returns true if the key in position `idx` was replaced more than `overlap` ago. must be called with the lock held
+func (s *Impl) retired(idx int, now time.Time) bool {
+	return idx < len(s.keys)-1 && now.Sub(s.keys[idx+1].ActivatedAt) > s.overlap
+}
+
+func (s *Impl) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("error listing signing keys: %w", err)
+	}
+
+	keys := make([]*Key, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), keyFileExtension) {
+			continue
+		}
+
+		key, err := readKey(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("error reading signing key '%s': %w", entry.Name(), err)
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ActivatedAt.Before(keys[j].ActivatedAt) })
+
+	s.mtx.Lock()
+	s.keys = keys
+	s.mtx.Unlock()
+	return nil
+}
+
+func readKey(fn string) (*Key, error) {
+	raw, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block found")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing PKCS8 key: %w", err)
+	}
+
+	activatedAt, err := activationTime(fn, block)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: strings.TrimSuffix(filepath.Base(fn), keyFileExtension), ActivatedAt: activatedAt}
+	switch typed := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm, key.private = AlgorithmRS256, typed
+	case ed25519.PrivateKey:
+		key.Algorithm, key.private = AlgorithmEdDSA, typed
+	default:
+		return nil, fmt.Errorf("%w: key of type %T", ErrUnsupportedAlgorithm, parsed)
+	}
+
+	return key, nil
+}
+
+// activationTime reads the activation time of a key from its pem headers, or from the file's mtime if it has none
+func activationTime(fn string, block *pem.Block) (time.Time, error) {
+	if raw, ok := block.Headers[activatedAtHeader]; ok {
+		activatedAt, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error parsing %s header: %w", activatedAtHeader, err)
+		}
+		return activatedAt, nil
+	}
+
+	stats, err := os.Stat(fn)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stats.ModTime(), nil
+}
+
+// writeKey atomically stores a key in PKCS8 pem format, along with its activation time
+func writeKey(fn string, private crypto.Signer, activatedAt time.Time) error {
+	serialized, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return fmt.Errorf("error serializing key: %w", err)
+	}
+
+	block := &pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{activatedAtHeader: activatedAt.UTC().Format(time.RFC3339Nano)},
+		Bytes:   serialized,
+	}
+
+	tmp := fn + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(block), 0600); err != nil {
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+
+	if err := os.Rename(tmp, fn); err != nil {
+		return fmt.Errorf("error moving key file into place: %w", err)
+	}
+	return nil
+}
+
+func generate(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case AlgorithmRS256:
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgorithmEdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+var _ Interface = (*Impl)(nil)
@@ -0,0 +1,131 @@
+package signingkeys
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := New(&Config{Directory: dir, Algorithm: "HS512"})
+	assert.ErrorIs(t, err, ErrUnsupportedAlgorithm)
+
+	keys, err := New(&Config{Directory: dir, Algorithm: AlgorithmEdDSA, Overlap: time.Hour})
+	assert.Nil(t, err)
+	first := keys.Active()
+	assert.NotNil(t, first)
+	assert.Equal(t, AlgorithmEdDSA, first.Algorithm)
+	assert.Equal(t, 1, len(keys.JWKS().Keys))
+
+	// keys are persisted
+	reloaded, err := New(&Config{Directory: dir, Algorithm: AlgorithmEdDSA, Overlap: time.Hour})
+	assert.Nil(t, err)
+	assert.Equal(t, first.ID, reloaded.Active().ID)
+
+	signed := sign(t, first)
+
+	// make the first key look older, so that the new one is unambiguously newer
+	past := time.Now().Add(-10 * time.Minute)
+	backdate(t, dir, first, past)
+	assert.Nil(t, keys.Rotate())
+	second := keys.Active()
+	assert.NotEqual(t, first.ID, second.ID)
+
+	// the replaced key is still valid during the overlap window
+	assert.Equal(t, 2, len(keys.JWKS().Keys))
+	assert.Nil(t, verify(keys, signed))
+	assert.Nil(t, verify(keys, sign(t, second)))
+
+	// once a newer key has been active for longer than the overlap, the old one is retired
+	older := time.Now().Add(-3 * time.Hour)
+	backdate(t, dir, first, older)
+	backdate(t, dir, second, past)
+	assert.Nil(t, keys.load())
+	assert.Nil(t, verify(keys, signed))
+
+	older = time.Now().Add(-2 * time.Hour)
+	backdate(t, dir, second, older)
+	assert.Nil(t, keys.load())
+	assert.ErrorIs(t, verify(keys, signed), ErrUnknownKey)
+	assert.Equal(t, 1, len(keys.JWKS().Keys))
+	assert.Equal(t, second.ID, keys.JWKS().Keys[0].KeyID)
+
+	assert.Nil(t, keys.Prune())
+	_, err = os.Stat(filepath.Join(dir, first.ID+keyFileExtension))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestKeyActivationTime(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := New(&Config{Directory: dir, Algorithm: AlgorithmEdDSA})
+	assert.Nil(t, err)
+	key := keys.Active()
+	fn := filepath.Join(dir, key.ID+keyFileExtension)
+
+	// touching or restoring the file doesn't change when the key was activated
+	future := time.Now().Add(24 * time.Hour)
+	assert.Nil(t, os.Chtimes(fn, future, future))
+	assert.Nil(t, keys.load())
+	assert.True(t, keys.Active().ActivatedAt.Equal(key.ActivatedAt))
+
+	// keys written without the header fall back to the file's mtime
+	serialized, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey())
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: serialized}), 0600))
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.Nil(t, os.Chtimes(fn, past, past))
+	assert.Nil(t, keys.load())
+	assert.True(t, keys.Active().ActivatedAt.Equal(past))
+}
+
+func TestRSAKeys(t *testing.T) {
+	keys, err := New(&Config{Directory: t.TempDir(), Algorithm: AlgorithmRS256})
+	assert.Nil(t, err)
+
+	key := keys.Active()
+	assert.Equal(t, AlgorithmRS256, key.Algorithm)
+	assert.Nil(t, verify(keys, sign(t, key)))
+
+	jwk := keys.JWKS().Keys[0]
+	assert.Equal(t, "RSA", jwk.KeyType)
+	assert.Equal(t, "AQAB", jwk.E)
+	assert.NotEmpty(t, jwk.N)
+}
+
+func backdate(t *testing.T, dir string, key *Key, activatedAt time.Time) {
+	t.Helper()
+	assert.Nil(t, writeKey(filepath.Join(dir, key.ID+keyFileExtension), key.private, activatedAt))
+}
+
+func sign(t *testing.T, key *Key) string {
+	t.Helper()
+	token := jwt.NewWithClaims(key.Method(), jwt.StandardClaims{Subject: "someUser"})
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.PrivateKey())
+	assert.Nil(t, err)
+	return signed
+}
+
+func verify(keys *Impl, signed string) error {
+	_, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := keys.Lookup(kid)
+		if err != nil {
+			return nil, err
+		}
+		return key.PublicKey(), nil
+	})
+
+	if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Inner != nil {
+		return validationErr.Inner
+	}
+	return err
+}
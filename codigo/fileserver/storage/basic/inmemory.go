@@ -142,7 +142,7 @@ func (i *InMemoryFileMetadataStore) Create(name string, notes string, patient st
 	return &m, nil
 }
 
-// Update modifies an existing metadata record
+// Update modifies an existing metadata record. Empty fields keep their current value
 func (i *InMemoryFileMetadataStore) Update(id string, updated models.FileMetadata, whenNs int64) (models.FileMetadata, error) {
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
@@ -152,10 +152,10 @@ func (i *InMemoryFileMetadataStore) Update(id string, updated models.FileMetadat
 		return nil, storage.ErrNoSuchFile
 	}
 
-	m.name = updated.Name()
-	m.notes = updated.Notes()
-	m.patientID = updated.PatientID()
-	m.typ = updated.Type()
+	m.name = valueOr(updated.Name(), m.name)
+	m.notes = valueOr(updated.Notes(), m.notes)
+	m.patientID = valueOr(updated.PatientID(), m.patientID)
+	m.typ = valueOr(updated.Type(), m.typ)
 	m.lastUpdated = whenNs
 	i.metas[id] = m
 
@@ -178,6 +178,26 @@ func (i *InMemoryFileMetadataStore) Remove(id string, whenNs int64) error {
 	return nil
 }
 
+// Atomically runs fn against a copy of the store, which replaces the original if fn succeeds.
+// Other operations on the store are blocked in the meantime
+func (i *InMemoryFileMetadataStore) Atomically(fn func(tx storage.FilesMetadata) error) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	tx := &InMemoryFileMetadataStore{metas: make(map[string]InMemoryMetadata, len(i.metas)), lastID: i.lastID}
+	for id, m := range i.metas {
+		tx.metas[id] = m
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	i.metas = tx.metas
+	i.lastID = tx.lastID
+	return nil
+}
+
 func (i *InMemoryFileMetadataStore) getByFilter(filter *storage.Filter) map[string]models.FileMetadata {
 	if length := len(filter.IDs); length > 0 { // If ID list is specified
 		result := make(map[string]models.FileMetadata, length)
@@ -265,7 +285,16 @@ func (i *InMemoryMetadata) Deleted() bool {
 	return i.deleted
 }
 
+// valueOr returns `value`, or `fallback` if it's empty
+func valueOr(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
 var _ models.File = (*InMemoryFile)(nil)
 var _ models.FileMetadata = (*InMemoryMetadata)(nil)
 var _ storage.FilesMetadata = (*InMemoryFileMetadataStore)(nil)
 var _ storage.Files = (*InMemoryFileStore)(nil)
+var _ storage.Transactional = (*InMemoryFileMetadataStore)(nil)
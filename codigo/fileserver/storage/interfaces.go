@@ -10,6 +10,10 @@ import (
 var (
 	ErrNoSuchFile = errors.New("file not found")
 	ErrFileExists = errors.New("file exists")
+
+	// ErrPartiallyCommitted is returned by Atomically when the changes were persisted, but some of the work
+	// that follows the commit (ie: updating caches or moving contents around) failed
+	ErrPartiallyCommitted = errors.New("changes committed with errors")
 )
 
 // Filter for retrieving files
@@ -23,10 +27,18 @@ type FilesMetadata interface {
 	Get(id string) (models.FileMetadata, error)
 	GetMany(filter *Filter) (map[string]models.FileMetadata, error)
 	Create(name string, notes string, patient string, typ string, whenNs int64) (models.FileMetadata, error)
+	// Update changes the name, notes, patient id & type of a file. Fields left empty in `updated` keep their current value
 	Update(id string, updated models.FileMetadata, whenNs int64) (models.FileMetadata, error)
 	Remove(id string, whenNs int64) error
 }
 
+// Transactional is optionally implemented by FilesMetadata storages that can apply several changes atomically
+type Transactional interface {
+	// Atomically invokes fn with a store whose changes are only persisted if fn returns nil.
+	// Errors wrapping ErrPartiallyCommitted mean that the changes were persisted nonetheless
+	Atomically(fn func(tx FilesMetadata) error) error
+}
+
 // Files defines the set of operations that can be performed on file contents
 type Files interface {
 	Read(id string) ([]byte, error)
@@ -0,0 +1,26 @@
+package webhooks
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "fileserver",
+		Name:      "webhook_queue_depth",
+		Help:      "Number of file changes whose webhook deliveries failed to be stored and are being retried",
+	})
+
+	droppedChanges = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "fileserver",
+		Name:      "webhook_changes_dropped_total",
+		Help:      "Number of file changes dropped because their deliveries couldn't be stored and the retry queue was full",
+	})
+
+	deliveryAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fileserver",
+		Name:      "webhook_delivery_attempts_total",
+		Help:      "Number of webhook delivery attempts, by resulting delivery status",
+	}, []string{"status"})
+)
@@ -0,0 +1,642 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
+	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+	"github.com/mredolatti/tf/codigo/fileserver/models"
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Headers sent along with every delivery
+const (
+	HeaderSignature = "X-Webhook-Signature" // hex-encoded HMAC-SHA256 of "<timestamp>.<body>", keyed with the webhook secret
+	HeaderTimestamp = "X-Webhook-Timestamp" // unix seconds at which the attempt was made
+	HeaderDelivery  = "X-Webhook-Delivery"  // unique per delivery. replays get a new one
+	HeaderEvent     = "X-Webhook-Event"     // unique per event. receivers should use it to discard duplicates
+)
+
+// Event types
+const (
+	EventFileAvailable    = "file.available"
+	EventFileNotAvailable = "file.not_available"
+)
+
+const (
+	defaultMaxAttempts    = 10
+	defaultTimeout        = 10 * time.Second
+	defaultPollInterval   = 5 * time.Second
+	defaultQueueSize      = 1000
+	storeTimeout          = 2 * time.Second
+	hooksCacheTTL         = 5 * time.Second
+	initialRetryDelay     = 30 * time.Second
+	maxRetryDelay         = 6 * time.Hour
+	dueBatchSize          = 100
+	duePerWebhook         = 20
+	maxConcurrentWebhooks = 8
+	maxResponseErrorSize  = 256
+)
+
+// Public errors
+var (
+	ErrNoRepository = errors.New("webhook & delivery repositories are required")
+	ErrInvalidURL   = errors.New("webhook url must be an absolute http(s) url")
+	ErrNotFound     = errors.New("not found")
+)
+
+// Event is the json payload posted to webhooks
+type Event struct {
+	ID        string   `json:"id"`
+	Type      string   `json:"type"`
+	Server    string   `json:"server"`
+	FileID    string   `json:"fileId,omitempty"`
+	FileIDs   []string `json:"fileIds,omitempty"` // set instead of FileID when several files changed in the same operation
+	User      string   `json:"user,omitempty"`    // empty if the change affects every user with access to the file
+	Timestamp int64    `json:"timestamp"`
+}
+
+// Interface defines the set of methods to manage webhooks & deliver file change events to them
+type Interface interface {
+	Register(ctx context.Context, createdBy string, endpoint string) (models.Webhook, error)
+	List(ctx context.Context) ([]models.Webhook, error)
+	Remove(ctx context.Context, id string) error
+	Deliveries(ctx context.Context, webhookID string, limit int) ([]models.WebhookDelivery, error)
+	Replay(ctx context.Context, webhookID string, deliveryID string) (models.WebhookDelivery, error)
+
+	// Notify stores a delivery of a change for every registered webhook. It can be used as a filemanager.ChangeListener
+	Notify(change filemanager.Change)
+
+	// NotifyAll is like Notify, but changes of the same type affecting the same user are bundled into a single
+	// event. It can be used as a filemanager.ChangesListener
+	NotifyAll(changes []filemanager.Change)
+
+	Start()
+	Stop()
+}
+
+// Config contains parameters to set up the webhooks component
+type Config struct {
+	Hooks        repository.WebhookRepository
+	Deliveries   repository.WebhookDeliveryRepository
+	Logger       log.Interface
+	Server       string // included in payloads so that receivers can tell servers apart
+	MaxAttempts  int
+	Timeout      time.Duration
+	PollInterval time.Duration
+}
+
+// Impl persists an outgoing delivery per webhook for every change before attempting it, and retries failed
+// attempts with exponential backoff, so that events are delivered at least once
+type Impl struct {
+	hooks        repository.WebhookRepository
+	deliveries   repository.WebhookDeliveryRepository
+	logger       log.Interface
+	server       string
+	maxAttempts  int
+	pollInterval time.Duration
+	client       http.Client
+	failed       chan *pendingEvent
+	wake         chan struct{}
+	stop         chan struct{}
+	wg           sync.WaitGroup
+	workers      chan struct{}
+	inFlight     sync.WaitGroup
+	busy         map[string]struct{}
+	busyMutex    sync.Mutex
+	cachedHooks  []models.Webhook
+	cachedAt     time.Time
+	cacheValid   bool
+	cacheMutex   sync.Mutex
+	now          func() time.Time
+}
+
+// New constructs a new webhooks component
+func New(cfg *Config) (*Impl, error) {
+	if cfg.Hooks == nil || cfg.Deliveries == nil {
+		return nil, ErrNoRepository
+	}
+
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	pollInterval := cfg.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+
+	return &Impl{
+		hooks:        cfg.Hooks,
+		deliveries:   cfg.Deliveries,
+		logger:       cfg.Logger,
+		server:       cfg.Server,
+		maxAttempts:  maxAttempts,
+		pollInterval: pollInterval,
+		client:       http.Client{Timeout: timeout, Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		failed:       make(chan *pendingEvent, defaultQueueSize),
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		workers:      make(chan struct{}, maxConcurrentWebhooks),
+		busy:         make(map[string]struct{}),
+		now:          time.Now,
+	}, nil
+}
+
+// Register adds a new webhook. The returned model carries the secret payloads will be signed with
+func (i *Impl) Register(ctx context.Context, createdBy string, endpoint string) (models.Webhook, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, ErrInvalidURL
+	}
+
+	id, err := newID(16)
+	if err != nil {
+		return nil, fmt.Errorf("error generating webhook id: %w", err)
+	}
+
+	secret, err := newID(32)
+	if err != nil {
+		return nil, fmt.Errorf("error generating webhook secret: %w", err)
+	}
+
+	hook, err := i.hooks.Add(ctx, id, endpoint, secret, createdBy)
+	if err != nil {
+		return nil, fmt.Errorf("error storing webhook: %w", err)
+	}
+
+	i.invalidateHooks()
+	return hook, nil
+}
+
+// List returns every registered webhook
+func (i *Impl) List(ctx context.Context) ([]models.Webhook, error) {
+	return i.hooks.List(ctx)
+}
+
+// Remove deletes a webhook along with its delivery log
+func (i *Impl) Remove(ctx context.Context, id string) error {
+	if err := i.hooks.Remove(ctx, id); err != nil {
+		return mapNotFound(err)
+	}
+
+	i.invalidateHooks()
+	return nil
+}
+
+// Deliveries returns the most recent deliveries for a webhook
+func (i *Impl) Deliveries(ctx context.Context, webhookID string, limit int) ([]models.WebhookDelivery, error) {
+	if _, err := i.hooks.Get(ctx, webhookID); err != nil {
+		return nil, mapNotFound(err)
+	}
+	return i.deliveries.List(ctx, webhookID, limit)
+}
+
+// Replay queues a new delivery carrying the same event as a previous one, regardless of its outcome
+func (i *Impl) Replay(ctx context.Context, webhookID string, deliveryID string) (models.WebhookDelivery, error) {
+	original, err := i.deliveries.Get(ctx, deliveryID)
+	if err != nil {
+		return nil, mapNotFound(err)
+	}
+
+	if original.WebhookID() != webhookID {
+		return nil, ErrNotFound
+	}
+
+	id, err := newID(16)
+	if err != nil {
+		return nil, fmt.Errorf("error generating delivery id: %w", err)
+	}
+
+	delivery, err := i.deliveries.Add(ctx, id, webhookID, original.EventID(), original.Payload(), i.now())
+	if err != nil {
+		return nil, fmt.Errorf("error queueing replay: %w", err)
+	}
+
+	i.signal()
+	return delivery, nil
+}
+
+// Notify implements Interface. Deliveries are stored before returning, so that they survive a restart. If that
+// fails, the change is handed to a background loop that keeps retrying, so that callers are never blocked for
+// longer than the store timeout
+func (i *Impl) Notify(change filemanager.Change) {
+	i.NotifyAll([]filemanager.Change{change})
+}
+
+// NotifyAll implements Interface. Deliveries are stored like in Notify, one event at a time
+func (i *Impl) NotifyAll(changes []filemanager.Change) {
+	stored := false
+	for _, group := range groupChanges(changes) {
+		event, err := i.newPendingEvent(group)
+		if err != nil {
+			i.logger.Error("webhooks.Notify: error building event for change in %s: %s", group.describe(), err)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		err = i.enqueue(ctx, event)
+		cancel()
+		if err != nil {
+			i.logger.Warning("webhooks.Notify: error storing deliveries for change in %s, will retry: %s", group.describe(), err)
+			select {
+			case i.failed <- event:
+			default:
+				droppedChanges.Inc()
+				i.logger.Error("webhooks.Notify: retry queue full, dropping change in %s", group.describe())
+			}
+			continue
+		}
+		stored = true
+	}
+
+	if stored {
+		i.signal()
+	}
+}
+
+// Start launches the goroutines retrying failed stores & performing deliveries
+func (i *Impl) Start() {
+	i.wg.Add(2)
+	go i.requeue()
+	go i.dispatch()
+}
+
+// Stop waits for background goroutines & in-flight deliveries to finish. Changes whose deliveries couldn't be
+// stored by then are lost
+func (i *Impl) Stop() {
+	close(i.stop)
+	i.wg.Wait()
+	i.inFlight.Wait()
+}
+
+// requeue retries storing deliveries for events that failed to be stored when notified
+func (i *Impl) requeue() {
+	defer i.wg.Done()
+	ticker := time.NewTicker(i.pollInterval)
+	defer ticker.Stop()
+
+	var backlog []*pendingEvent
+	for {
+		select {
+		case <-i.stop:
+			if len(backlog) > 0 {
+				i.logger.Error("webhooks.requeue: shutting down with %d changes whose deliveries couldn't be stored", len(backlog))
+			}
+			return
+		case event := <-i.failed:
+			backlog = append(backlog, event)
+		case <-ticker.C:
+			backlog = i.retryStore(backlog)
+		}
+		queueDepth.Set(float64(len(backlog)))
+	}
+}
+
+// retryStore attempts to store pending events again, returning those that still failed
+func (i *Impl) retryStore(backlog []*pendingEvent) []*pendingEvent {
+	remaining := backlog[:0]
+	for _, event := range backlog {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		err := i.enqueue(ctx, event)
+		cancel()
+		if err != nil {
+			i.logger.Error("webhooks.requeue: error storing deliveries for change in %s: %s", event.group.describe(), err)
+			remaining = append(remaining, event)
+			continue
+		}
+		i.signal()
+	}
+	return remaining
+}
+
+func (i *Impl) dispatch() {
+	defer i.wg.Done()
+	ticker := time.NewTicker(i.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.stop:
+			return
+		case <-ticker.C:
+		case <-i.wake:
+		}
+		i.deliverDue(context.Background())
+	}
+}
+
+// signal wakes up the dispatcher without blocking if it's already been woken up
+func (i *Impl) signal() {
+	select {
+	case i.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pendingEvent is an event whose deliveries are being stored. It keeps track of the webhooks it's already been
+// stored for, so that a partial failure can be resumed without duplicating or losing deliveries
+type pendingEvent struct {
+	group   *changeGroup
+	id      string
+	payload []byte
+	stored  map[string]struct{}
+}
+
+func (i *Impl) newPendingEvent(group *changeGroup) (*pendingEvent, error) {
+	eventID, err := newID(16)
+	if err != nil {
+		return nil, fmt.Errorf("error generating event id: %w", err)
+	}
+
+	payload, err := json.Marshal(i.toEvent(eventID, group))
+	if err != nil {
+		return nil, fmt.Errorf("error serializing event: %w", err)
+	}
+	return &pendingEvent{group: group, id: eventID, payload: payload, stored: make(map[string]struct{})}, nil
+}
+
+// enqueue stores a delivery of `event` for every registered webhook it hasn't been stored for yet
+func (i *Impl) enqueue(ctx context.Context, event *pendingEvent) error {
+	hooks, err := i.listHooks(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing webhooks: %w", err)
+	}
+
+	now := i.now()
+	for _, hook := range hooks {
+		if _, ok := event.stored[hook.ID()]; ok {
+			continue
+		}
+
+		id, err := newID(16)
+		if err != nil {
+			return fmt.Errorf("error generating delivery id: %w", err)
+		}
+
+		if _, err := i.deliveries.Add(ctx, id, hook.ID(), event.id, event.payload, now); err != nil {
+			return fmt.Errorf("error storing delivery for webhook %s: %w", hook.ID(), err)
+		}
+		event.stored[hook.ID()] = struct{}{}
+	}
+	return nil
+}
+
+// deliverDue hands every delivery whose time has come to a per-webhook worker. Webhooks are attempted
+// concurrently, up to maxConcurrentWebhooks at a time, so that a slow or dead endpoint only delays its own
+// deliveries. Webhooks that still have a worker running from a previous round are skipped
+func (i *Impl) deliverDue(ctx context.Context) {
+	due, err := i.deliveries.Due(ctx, i.now(), duePerWebhook, dueBatchSize)
+	if err != nil {
+		i.logger.Error("webhooks.deliverDue: error fetching pending deliveries: %s", err)
+		return
+	}
+
+	byHook := make(map[string][]models.WebhookDelivery)
+	var order []string
+	for _, delivery := range due {
+		if _, ok := byHook[delivery.WebhookID()]; !ok {
+			order = append(order, delivery.WebhookID())
+		}
+		byHook[delivery.WebhookID()] = append(byHook[delivery.WebhookID()], delivery)
+	}
+
+	for _, hookID := range order {
+		if !i.claim(hookID) {
+			continue
+		}
+
+		hook, err := i.hooks.Get(ctx, hookID)
+		if err != nil {
+			i.logger.Error("webhooks.deliverDue: error fetching webhook %s: %s", hookID, err)
+			i.release(hookID)
+			continue
+		}
+
+		i.inFlight.Add(1)
+		go func(hook models.Webhook, deliveries []models.WebhookDelivery) {
+			defer i.inFlight.Done()
+			defer i.release(hook.ID())
+			i.workers <- struct{}{}
+			defer func() { <-i.workers }()
+			i.deliverAll(ctx, hook, deliveries)
+		}(hook, byHook[hookID])
+	}
+}
+
+// deliverAll attempts deliveries for a single webhook in order, stopping at the first failure. The rest remain due
+// and are attempted in following rounds, so that an unreachable endpoint costs at most one timeout per round
+func (i *Impl) deliverAll(ctx context.Context, hook models.Webhook, deliveries []models.WebhookDelivery) {
+	for _, delivery := range deliveries {
+		if !i.attempt(ctx, hook, delivery) {
+			return
+		}
+	}
+}
+
+func (i *Impl) claim(hookID string) bool {
+	i.busyMutex.Lock()
+	defer i.busyMutex.Unlock()
+	if _, ok := i.busy[hookID]; ok {
+		return false
+	}
+	i.busy[hookID] = struct{}{}
+	return true
+}
+
+func (i *Impl) release(hookID string) {
+	i.busyMutex.Lock()
+	delete(i.busy, hookID)
+	i.busyMutex.Unlock()
+}
+
+// attempt posts a delivery & records the outcome, scheduling a retry if it failed and attempts are left.
+// It returns whether the delivery succeeded
+func (i *Impl) attempt(ctx context.Context, hook models.Webhook, delivery models.WebhookDelivery) bool {
+	code, err := i.post(ctx, hook, delivery)
+
+	status, lastError, next := models.DeliveryDelivered, "", time.Time{}
+	if err != nil {
+		lastError = err.Error()
+		attempts := delivery.Attempts() + 1
+		if attempts >= i.maxAttempts {
+			status = models.DeliveryFailed
+			i.logger.Warning("webhooks.attempt: giving up on delivery %s to %s after %d attempts: %s", delivery.ID(), hook.URL(), attempts, err)
+		} else {
+			status = models.DeliveryPending
+			next = i.now().Add(retryDelay(attempts))
+		}
+	}
+	deliveryAttempts.WithLabelValues(status).Inc()
+
+	if err := i.deliveries.RecordAttempt(ctx, delivery.ID(), status, lastError, code, next); err != nil {
+		// the delivery remains pending & will be attempted again
+		i.logger.Error("webhooks.attempt: error recording outcome of delivery %s: %s", delivery.ID(), err)
+	}
+	return status == models.DeliveryDelivered
+}
+
+func (i *Impl) post(ctx context.Context, hook models.Webhook, delivery models.WebhookDelivery) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, "POST", hook.URL(), bytes.NewReader(delivery.Payload()))
+	if err != nil {
+		return 0, fmt.Errorf("error building request: %w", err)
+	}
+
+	timestamp := i.now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HeaderSignature, Sign(hook.Secret(), timestamp, delivery.Payload()))
+	request.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(HeaderDelivery, delivery.ID())
+	request.Header.Set(HeaderEvent, delivery.EventID())
+
+	response, err := i.client.Do(request)
+	if err != nil {
+		return 0, fmt.Errorf("error posting event: %w", err)
+	}
+	defer response.Body.Close()
+
+	if c := response.StatusCode; c < 200 || c >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, maxResponseErrorSize))
+		return c, fmt.Errorf("non-2xx (%d) status code returned: %s", c, body)
+	}
+	return response.StatusCode, nil
+}
+
+func (i *Impl) toEvent(id string, group *changeGroup) *Event {
+	event := &Event{
+		ID:        id,
+		Type:      EventFileAvailable,
+		Server:    i.server,
+		User:      group.user,
+		Timestamp: i.now().Unix(),
+	}
+
+	if len(group.files) == 1 {
+		event.FileID = group.files[0]
+	} else {
+		event.FileIDs = group.files
+	}
+
+	if group.eventType == filemanager.EventFileNotAvailable {
+		event.Type = EventFileNotAvailable
+	}
+
+	if group.user == authz.EveryOne {
+		event.User = ""
+	}
+	return event
+}
+
+// listHooks returns every registered webhook. The list is needed for every change, so it's cached for a few
+// seconds, and dropped as soon as a webhook is registered or removed through this component
+func (i *Impl) listHooks(ctx context.Context) ([]models.Webhook, error) {
+	i.cacheMutex.Lock()
+	defer i.cacheMutex.Unlock()
+	if i.cacheValid && i.now().Sub(i.cachedAt) < hooksCacheTTL {
+		return i.cachedHooks, nil
+	}
+
+	hooks, err := i.hooks.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	i.cachedHooks, i.cachedAt, i.cacheValid = hooks, i.now(), true
+	return hooks, nil
+}
+
+func (i *Impl) invalidateHooks() {
+	i.cacheMutex.Lock()
+	i.cacheValid = false
+	i.cacheMutex.Unlock()
+}
+
+// changeGroup bundles changes of the same type, affecting the same user, into a single event
+type changeGroup struct {
+	eventType int
+	user      string
+	files     []string
+}
+
+func (g *changeGroup) describe() string {
+	if len(g.files) == 1 {
+		return "file " + g.files[0]
+	}
+	return fmt.Sprintf("%d files", len(g.files))
+}
+
+func groupChanges(changes []filemanager.Change) []*changeGroup {
+	var groups []*changeGroup
+	byKey := make(map[string]*changeGroup)
+	for _, change := range changes {
+		key := strconv.Itoa(change.EventType) + "\x00" + change.User
+		group, ok := byKey[key]
+		if !ok {
+			group = &changeGroup{eventType: change.EventType, user: change.User}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.files = append(group.files, change.FileRef)
+	}
+	return groups
+}
+
+// Sign computes the signature sent in HeaderSignature. Receivers should recompute it with the raw request body
+// and the value of HeaderTimestamp, and reject stale timestamps to prevent replay attacks
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay doubles the wait after every failed attempt, up to maxRetryDelay
+func retryDelay(attempts int) time.Duration {
+	delay := initialRetryDelay
+	for n := 1; n < attempts && delay < maxRetryDelay; n++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+func mapNotFound(err error) error {
+	if errors.Is(err, repository.ErrNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func newID(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+var _ Interface = (*Impl)(nil)
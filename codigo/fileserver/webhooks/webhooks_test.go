@@ -0,0 +1,413 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/fileserver/authz"
+	"github.com/mredolatti/tf/codigo/fileserver/filemanager"
+	"github.com/mredolatti/tf/codigo/fileserver/models"
+	"github.com/mredolatti/tf/codigo/fileserver/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+type hookMock struct {
+	id, url, secret, createdBy string
+}
+
+func (h *hookMock) ID() string           { return h.id }
+func (h *hookMock) URL() string          { return h.url }
+func (h *hookMock) Secret() string       { return h.secret }
+func (h *hookMock) CreatedBy() string    { return h.createdBy }
+func (h *hookMock) CreatedAt() time.Time { return time.Time{} }
+
+type deliveryMock struct {
+	id, webhookID, eventID string
+	payload                []byte
+	status                 string
+	attempts               int
+	lastError              string
+	responseCode           int
+	createdAt, next        time.Time
+}
+
+func (d *deliveryMock) ID() string               { return d.id }
+func (d *deliveryMock) WebhookID() string        { return d.webhookID }
+func (d *deliveryMock) EventID() string          { return d.eventID }
+func (d *deliveryMock) Payload() []byte          { return d.payload }
+func (d *deliveryMock) Status() string           { return d.status }
+func (d *deliveryMock) Attempts() int            { return d.attempts }
+func (d *deliveryMock) LastError() string        { return d.lastError }
+func (d *deliveryMock) ResponseCode() int        { return d.responseCode }
+func (d *deliveryMock) CreatedAt() time.Time     { return d.createdAt }
+func (d *deliveryMock) NextAttemptAt() time.Time { return d.next }
+
+type hookRepoMock struct {
+	hooks map[string]*hookMock
+	lists int
+}
+
+func (r *hookRepoMock) Add(ctx context.Context, id string, url string, secret string, createdBy string) (models.Webhook, error) {
+	r.hooks[id] = &hookMock{id: id, url: url, secret: secret, createdBy: createdBy}
+	return r.hooks[id], nil
+}
+
+func (r *hookRepoMock) Get(ctx context.Context, id string) (models.Webhook, error) {
+	if h, ok := r.hooks[id]; ok {
+		return h, nil
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (r *hookRepoMock) List(ctx context.Context) ([]models.Webhook, error) {
+	r.lists++
+	var result []models.Webhook
+	for _, h := range r.hooks {
+		result = append(result, h)
+	}
+	return result, nil
+}
+
+func (r *hookRepoMock) Remove(ctx context.Context, id string) error {
+	if _, ok := r.hooks[id]; !ok {
+		return repository.ErrNotFound
+	}
+	delete(r.hooks, id)
+	return nil
+}
+
+type deliveryRepoMock struct {
+	deliveries map[string]*deliveryMock
+	created    int
+	allowAdds  int // number of upcoming Add calls that will succeed before failAdds kicks in
+	failAdds   int // number of Add calls that will fail
+	mutex      sync.Mutex
+}
+
+func (r *deliveryRepoMock) Add(ctx context.Context, id string, webhookID string, eventID string, payload []byte, nextAttemptAt time.Time) (models.WebhookDelivery, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.allowAdds > 0 {
+		r.allowAdds--
+	} else if r.failAdds > 0 {
+		r.failAdds--
+		return nil, errors.New("database unavailable")
+	}
+	r.created++
+	r.deliveries[id] = &deliveryMock{id: id, webhookID: webhookID, eventID: eventID, payload: payload, status: models.DeliveryPending,
+		createdAt: time.Unix(int64(r.created), 0), next: nextAttemptAt}
+	return r.deliveries[id], nil
+}
+
+func (r *deliveryRepoMock) Get(ctx context.Context, id string) (models.WebhookDelivery, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if d, ok := r.deliveries[id]; ok {
+		return d, nil
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (r *deliveryRepoMock) List(ctx context.Context, webhookID string, limit int) ([]models.WebhookDelivery, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var result []models.WebhookDelivery
+	for _, d := range r.sorted() {
+		if d.webhookID == webhookID && len(result) < limit {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+func (r *deliveryRepoMock) Due(ctx context.Context, now time.Time, perWebhook int, limit int) ([]models.WebhookDelivery, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var result []models.WebhookDelivery
+	count := make(map[string]int)
+	sorted := r.sorted()
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].createdAt.Before(sorted[j].createdAt) })
+	for _, d := range sorted {
+		if d.status == models.DeliveryPending && !d.next.After(now) && len(result) < limit && count[d.webhookID] < perWebhook {
+			count[d.webhookID]++
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+func (r *deliveryRepoMock) RecordAttempt(ctx context.Context, id string, status string, lastError string, responseCode int, nextAttemptAt time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	d, ok := r.deliveries[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	d.status, d.lastError, d.responseCode, d.next = status, lastError, responseCode, nextAttemptAt
+	d.attempts++
+	return nil
+}
+
+func (r *deliveryRepoMock) sorted() []*deliveryMock {
+	var result []*deliveryMock
+	for _, d := range r.deliveries {
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].createdAt.After(result[j].createdAt) })
+	return result
+}
+
+func TestWebhooks(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := log.New(io.Discard, log.Error)
+
+	var received []*http.Request
+	var bodies [][]byte
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if failing {
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer server.Close()
+
+	deliveries := &deliveryRepoMock{deliveries: map[string]*deliveryMock{}}
+	hooks, err := New(&Config{
+		Hooks:       &hookRepoMock{hooks: map[string]*hookMock{}},
+		Deliveries:  deliveries,
+		Logger:      logger,
+		Server:      "unicen/filesrv1",
+		MaxAttempts: 2,
+	})
+	assert.Nil(t, err)
+	now := time.Now()
+	hooks.now = func() time.Time { return now }
+
+	_, err = hooks.Register(ctx, "admin", "ftp://somewhere")
+	assert.ErrorIs(t, err, ErrInvalidURL)
+
+	hook, err := hooks.Register(ctx, "admin", server.URL)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, hook.Secret())
+
+	// a failed attempt is retried later
+	hooks.Notify(filemanager.Change{EventType: filemanager.EventFileAvailable, FileRef: "f1", User: "martin"})
+	hooks.deliverDue(ctx)
+	hooks.inFlight.Wait()
+	assert.Len(t, received, 1)
+	history, err := hooks.Deliveries(ctx, hook.ID(), 10)
+	assert.Nil(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, models.DeliveryPending, history[0].Status())
+	assert.Equal(t, 503, history[0].ResponseCode())
+	assert.Equal(t, now.Add(initialRetryDelay), history[0].NextAttemptAt())
+
+	hooks.deliverDue(ctx) // not due yet
+	hooks.inFlight.Wait()
+	assert.Len(t, received, 1)
+
+	// payload is signed with the webhook's secret
+	req := received[0]
+	timestamp, _ := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+	assert.Equal(t, Sign(hook.Secret(), timestamp, bodies[0]), req.Header.Get(HeaderSignature))
+	var event Event
+	assert.Nil(t, json.Unmarshal(bodies[0], &event))
+	assert.Equal(t, Event{ID: req.Header.Get(HeaderEvent), Type: EventFileAvailable, Server: "unicen/filesrv1", FileID: "f1", User: "martin", Timestamp: now.Unix()}, event)
+
+	// attempts are exhausted
+	now = now.Add(initialRetryDelay)
+	hooks.deliverDue(ctx)
+	hooks.inFlight.Wait()
+	assert.Len(t, received, 2)
+	assert.Equal(t, models.DeliveryFailed, deliveries.deliveries[history[0].ID()].status)
+
+	// replaying creates a new delivery of the same event
+	failing = false
+	replayed, err := hooks.Replay(ctx, hook.ID(), history[0].ID())
+	assert.Nil(t, err)
+	assert.NotEqual(t, history[0].ID(), replayed.ID())
+	assert.Equal(t, history[0].EventID(), replayed.EventID())
+	hooks.deliverDue(ctx)
+	hooks.inFlight.Wait()
+	assert.Len(t, received, 3)
+	assert.Equal(t, models.DeliveryDelivered, deliveries.deliveries[replayed.ID()].status)
+	assert.Equal(t, history[0].EventID(), received[2].Header.Get(HeaderEvent))
+
+	_, err = hooks.Replay(ctx, "other", history[0].ID())
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// changes affecting every user are sent without one
+	hooks.Notify(filemanager.Change{EventType: filemanager.EventFileNotAvailable, FileRef: "f2", User: authz.EveryOne})
+	hooks.deliverDue(ctx)
+	hooks.inFlight.Wait()
+	assert.Len(t, received, 4)
+	var broadcast Event
+	assert.Nil(t, json.Unmarshal(bodies[3], &broadcast))
+	assert.Equal(t, EventFileNotAvailable, broadcast.Type)
+	assert.Equal(t, "", broadcast.User)
+
+	assert.Nil(t, hooks.Remove(ctx, hook.ID()))
+	assert.ErrorIs(t, hooks.Remove(ctx, hook.ID()), ErrNotFound)
+	_, err = hooks.Deliveries(ctx, hook.ID(), 10)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestWebhooksStoreFailures(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := log.New(io.Discard, log.Error)
+
+	deliveries := &deliveryRepoMock{deliveries: map[string]*deliveryMock{}}
+	hooks, err := New(&Config{Hooks: &hookRepoMock{hooks: map[string]*hookMock{}}, Deliveries: deliveries, Logger: logger})
+	assert.Nil(t, err)
+
+	first, _ := hooks.Register(ctx, "admin", "http://localhost/first")
+	second, _ := hooks.Register(ctx, "admin", "http://localhost/second")
+
+	// the second store fails, so the change is handed over for retrying
+	deliveries.allowAdds, deliveries.failAdds = 1, 1
+	hooks.Notify(filemanager.Change{EventType: filemanager.EventFileAvailable, FileRef: "f1", User: "martin"})
+	assert.Len(t, deliveries.deliveries, 1)
+	assert.Len(t, hooks.failed, 1)
+
+	// retrying stores the missing delivery only, with the same event
+	backlog := hooks.retryStore([]*pendingEvent{<-hooks.failed})
+	assert.Empty(t, backlog)
+	assert.Len(t, deliveries.deliveries, 2)
+	forFirst, _ := deliveries.List(ctx, first.ID(), 10)
+	forSecond, _ := deliveries.List(ctx, second.ID(), 10)
+	assert.Len(t, forFirst, 1)
+	assert.Len(t, forSecond, 1)
+	assert.Equal(t, forFirst[0].EventID(), forSecond[0].EventID())
+
+	// events still failing are kept
+	deliveries.failAdds = 10
+	hooks.Notify(filemanager.Change{EventType: filemanager.EventFileAvailable, FileRef: "f2", User: "martin"})
+	backlog = hooks.retryStore([]*pendingEvent{<-hooks.failed})
+	assert.Len(t, backlog, 1)
+}
+
+func TestWebhooksNotifyAll(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := log.New(io.Discard, log.Error)
+
+	repo := &hookRepoMock{hooks: map[string]*hookMock{}}
+	deliveries := &deliveryRepoMock{deliveries: map[string]*deliveryMock{}}
+	hooks, err := New(&Config{Hooks: repo, Deliveries: deliveries, Logger: logger})
+	assert.Nil(t, err)
+	now := time.Now()
+	hooks.now = func() time.Time { return now }
+	hook, err := hooks.Register(ctx, "admin", "http://localhost/hook")
+	assert.Nil(t, err)
+
+	// changes of the same type & user are bundled into a single event
+	var changes []filemanager.Change
+	for idx := 0; idx < 100; idx++ {
+		changes = append(changes, filemanager.Change{EventType: filemanager.EventFileAvailable, FileRef: "f" + strconv.Itoa(idx), User: "martin"})
+	}
+	changes = append(changes, filemanager.Change{EventType: filemanager.EventFileNotAvailable, FileRef: "f100", User: authz.EveryOne})
+	hooks.NotifyAll(changes)
+
+	stored, _ := deliveries.List(ctx, hook.ID(), 10)
+	assert.Len(t, stored, 2)
+	var bundled, single Event
+	for _, d := range stored {
+		var event Event
+		assert.Nil(t, json.Unmarshal(d.Payload(), &event))
+		if event.Type == EventFileAvailable {
+			bundled = event
+		} else {
+			single = event
+		}
+	}
+	assert.Len(t, bundled.FileIDs, 100)
+	assert.Equal(t, "", bundled.FileID)
+	assert.Equal(t, "martin", bundled.User)
+	assert.Equal(t, "f100", single.FileID)
+	assert.Nil(t, single.FileIDs)
+
+	// the webhook list is cached in between changes, until it expires or webhooks change
+	lists := repo.lists
+	hooks.Notify(filemanager.Change{EventType: filemanager.EventFileAvailable, FileRef: "f1", User: "martin"})
+	assert.Equal(t, lists, repo.lists)
+
+	now = now.Add(hooksCacheTTL)
+	hooks.Notify(filemanager.Change{EventType: filemanager.EventFileAvailable, FileRef: "f1", User: "martin"})
+	assert.Equal(t, lists+1, repo.lists)
+
+	second, err := hooks.Register(ctx, "admin", "http://localhost/second")
+	assert.Nil(t, err)
+	hooks.Notify(filemanager.Change{EventType: filemanager.EventFileAvailable, FileRef: "f1", User: "martin"})
+	forSecond, _ := deliveries.List(ctx, second.ID(), 10)
+	assert.Len(t, forSecond, 1)
+}
+
+func TestWebhooksDeadEndpoint(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := log.New(io.Discard, log.Error)
+
+	release := make(chan struct{})
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(503)
+	}))
+	defer dead.Close()
+
+	var healthyCount int32
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&healthyCount, 1)
+		w.WriteHeader(204)
+	}))
+	defer healthy.Close()
+
+	deliveries := &deliveryRepoMock{deliveries: map[string]*deliveryMock{}}
+	hooks, err := New(&Config{Hooks: &hookRepoMock{hooks: map[string]*hookMock{}}, Deliveries: deliveries, Logger: logger})
+	assert.Nil(t, err)
+
+	deadHook, _ := hooks.Register(ctx, "admin", dead.URL)
+	_, _ = hooks.Register(ctx, "admin", healthy.URL)
+	for n := 0; n < 5; n++ {
+		hooks.Notify(filemanager.Change{EventType: filemanager.EventFileAvailable, FileRef: "f" + strconv.Itoa(n), User: "martin"})
+	}
+
+	// the healthy webhook gets every delivery while the dead one is still stuck on its first attempt
+	hooks.deliverDue(ctx)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&healthyCount) == 5 }, time.Second, 10*time.Millisecond)
+
+	// a webhook with a running worker is skipped
+	assert.False(t, hooks.claim(deadHook.ID()))
+	hooks.deliverDue(ctx)
+
+	// once the attempt fails, the rest of its deliveries are left for later rounds
+	close(release)
+	hooks.inFlight.Wait()
+	history, _ := hooks.Deliveries(ctx, deadHook.ID(), 10)
+	attempted := 0
+	for _, delivery := range history {
+		attempted += delivery.Attempts()
+	}
+	assert.Equal(t, 1, attempted)
+	assert.True(t, hooks.claim(deadHook.ID()))
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, initialRetryDelay, retryDelay(1))
+	assert.Equal(t, 2*initialRetryDelay, retryDelay(2))
+	assert.Equal(t, 8*initialRetryDelay, retryDelay(4))
+	assert.Equal(t, maxRetryDelay, retryDelay(50))
+}
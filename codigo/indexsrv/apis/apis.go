@@ -2,20 +2,26 @@ package apis
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	"github.com/mredolatti/tf/codigo/common/config"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/common/log/loghttp"
+	"github.com/mredolatti/tf/codigo/common/metrics"
+	"github.com/mredolatti/tf/codigo/common/ratelimit"
+	"github.com/mredolatti/tf/codigo/common/revocation"
 	"github.com/mredolatti/tf/codigo/indexsrv/access/authentication"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/fileservers"
+	"github.com/mredolatti/tf/codigo/indexsrv/apis/fileservers/middleware"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/users"
+	"github.com/mredolatti/tf/codigo/indexsrv/fslinks"
 	"github.com/mredolatti/tf/codigo/indexsrv/mapper"
 	"github.com/mredolatti/tf/codigo/indexsrv/registrar"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 type Config struct {
@@ -23,6 +29,12 @@ type Config struct {
 	UserManager     authentication.UserManager
 	Mapper          mapper.Interface
 	ServerRegistrar registrar.Interface
+	ServerLinks     fslinks.Interface
+	Certificates    certmanager.Interface
+	Revocation      revocation.Interface // optional
+	LoginLimiter    ratelimit.Interface
+	UserLimiter     ratelimit.Interface
+	Operators       []string // client certificate CNs allowed to use operator endpoints
 	Logger          log.Interface
 }
 
@@ -37,51 +49,55 @@ func (b *Bundle) ListenAndServe() error {
 func Setup(config *Config) (*Bundle, error) {
 
 	router := gin.New()
+
+	// gin trusts every proxy by default, which would let clients pick the address they're rate limited by
+	if err := router.SetTrustedProxies(config.Server.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("error setting trusted proxies: %w", err)
+	}
+
 	router.Use(gin.Recovery())
-    router.Use(gin.Logger())
+	router.Use(loghttp.RequestLogger(config.Logger))
+	router.Use(otelgin.Middleware(config.Server.Host))
+	router.Use(metrics.HTTPMiddleware)
+
+	// scrapers authenticate with a client certificate issued by our CA, same as file servers
+	scraperAuth := middleware.NewTLSClientValidator(config.Logger, config.Certificates, config.Revocation)
+	router.GET(metrics.Path, scraperAuth.Handle, gin.WrapH(metrics.Handler()))
+
+	// operator endpoints additionally require the certificate to belong to an allowlisted operator, since
+	// file servers hold certificates issued by the same CA
+	levels := loghttp.NewLevelController(config.Logger)
+	levels.Register(router.Group("/admin"), scraperAuth.Handle, middleware.RequireCommonName(config.Logger, config.Operators))
+
 	clientAPI := router.Group("/api/clients/v1")
 	users.Mount(clientAPI, &users.Config{
 		UserManager:     config.UserManager,
 		Mapper:          config.Mapper,
 		ServerRegistrar: config.ServerRegistrar,
+		ServerLinks:     config.ServerLinks,
+		LoginLimiter:    config.LoginLimiter,
+		UserLimiter:     config.UserLimiter,
 		Logger:          config.Logger,
 	})
 
-	tlsConfig := setupTLSConfig(&config.Server)
 	fileServerAPI := router.Group("/api/fileservers/v1")
 	fileservers.Mount(fileServerAPI, &fileservers.Config{
 		ServerRegistrar: config.ServerRegistrar,
+		ServerLinks:     config.ServerLinks,
 		Logger:          config.Logger,
-		TLSConfig:       tlsConfig,
+		Certificates:    config.Certificates,
+		Revocation:      config.Revocation,
 	})
 
 	return &Bundle{
 		server: http.Server{
 			Addr:      fmt.Sprintf("%s:%d", config.Server.Host, config.Server.Port),
 			Handler:   router,
-			TLSConfig: tlsConfig,
+			TLSConfig: config.Certificates.ServerConfig(&tls.Config{
+				ServerName: config.Server.Host,
+				NextProtos: []string{"h2", "http/1.1"},
+				ClientAuth: tls.RequestClientCert, // verified by the file-server api middleware
+			}),
 		},
 	}, nil
 }
-
-func setupTLSConfig(config *config.Server) *tls.Config {
-	certBytes, err := ioutil.ReadFile(config.RootCAFn)
-	if err != nil {
-		panic("cannot read root certificate file: " + err.Error())
-	}
-	caPool := x509.NewCertPool()
-	caPool.AppendCertsFromPEM(certBytes)
-
-	certs, err := tls.LoadX509KeyPair(config.CertChainFn, config.PrivateKeyFn)
-	if err != nil {
-		panic("cannot read server certficate chain / private key files: " + err.Error())
-	}
-
-	return &tls.Config{
-		ServerName:   config.Host,
-		Certificates: []tls.Certificate{certs},
-		RootCAs:      caPool,
-		ClientAuth:   tls.RequestClientCert,
-		ClientCAs:    caPool,
-	}
-}
@@ -1,11 +1,15 @@
 package fileservers
 
 import (
-	"crypto/tls"
+	"expvar"
 
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/common/revocation"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/fileservers/controllers/registration"
+	"github.com/mredolatti/tf/codigo/indexsrv/apis/fileservers/controllers/status"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/fileservers/middleware"
+	"github.com/mredolatti/tf/codigo/indexsrv/fslinks"
 	"github.com/mredolatti/tf/codigo/indexsrv/registrar"
 
 	"github.com/gin-gonic/gin"
@@ -14,13 +18,18 @@ import (
 // Config contins user-api configuration parameters
 type Config struct {
 	Logger          log.Interface
-	TLSConfig       *tls.Config
+	Certificates    certmanager.Interface
 	ServerRegistrar registrar.Interface
+	ServerLinks     fslinks.Interface
+	Revocation      revocation.Interface // optional
 }
 
 func Mount(router gin.IRouter, config *Config) {
-	tlsMW := middleware.NewTLSClientValidator(config.Logger, config.TLSConfig)
+	tlsMW := middleware.NewTLSClientValidator(config.Logger, config.Certificates, config.Revocation)
 	router.Use(tlsMW.Handle)
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
 	servregController := registration.New(config.Logger, config.ServerRegistrar)
 	servregController.Register(router)
+	statusController := status.New(config.Logger, config.ServerLinks)
+	statusController.Register(router)
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/mredolatti/tf/codigo/common/dtos"
 	"github.com/mredolatti/tf/codigo/common/log"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/fileservers/middleware"
+	"github.com/mredolatti/tf/codigo/indexsrv/models"
 	"github.com/mredolatti/tf/codigo/indexsrv/registrar"
 )
 
@@ -29,6 +30,9 @@ func New(logger log.Interface, registry registrar.Interface) *Controller {
 func (c *Controller) Register(router gin.IRouter) {
 	router.GET("/test", func(*gin.Context) {})
 	router.POST("/register", c.registerServer)
+	router.GET("/server", c.getServerStatus)
+	router.POST("/server/pause", c.pauseServer)
+	router.POST("/server/resume", c.resumeServer)
 }
 
 func (c *Controller) registerServer(ctx *gin.Context) {
@@ -46,15 +50,101 @@ func (c *Controller) registerServer(ctx *gin.Context) {
 		return
 	}
 
-	err = c.registry.RegisterServer(ctx.Request.Context(), dto.OrgName, cn, dto.AuthURL, dto.TokenURL, dto.FetchURL, dto.ControlEndpoint)
-	switch err {
-	case nil:
-		ctx.JSON(200, dtos.RegistrationResultDTO{Result: dtos.ResultOK})
-	case registrar.ErrServerAlreadyRegistered:
+	outcome, err := c.registry.RegisterServer(ctx.Request.Context(), dto.OrgName, cn, dto.AuthURL, dto.TokenURL, dto.FetchURL, dto.ControlEndpoint)
+	if err != nil {
+		c.logger.Error("error registering server: %s", err.Error())
+		ctx.Status(500) // TODO(mredolatti): add more info in response
+		return
+	}
+
+	switch outcome {
+	case registrar.OutcomeUnchanged:
 		c.logger.Info("received registration request for already registered server: [%s::%s]", dto.OrgName, cn)
 		ctx.JSON(200, dtos.RegistrationResultDTO{Result: dtos.ResultAlreadyRegistered})
+	case registrar.OutcomeUpdated:
+		c.logger.Info("server [%s::%s] re-registered with new endpoints", dto.OrgName, cn)
+		ctx.JSON(200, dtos.RegistrationResultDTO{Result: dtos.ResultUpdated})
 	default:
-		c.logger.Error("error registering server: %s", err.Error())
-		ctx.Status(500) // TODO(mredolatti): add more info in response
+		ctx.JSON(200, dtos.RegistrationResultDTO{Result: dtos.ResultOK})
+	}
+}
+
+func (c *Controller) getServerStatus(ctx *gin.Context) {
+	cn, err := middleware.ServerCommonNameFromContext(ctx)
+	if err != nil {
+		c.logger.Error("failed to get common-name from TLS params: %s", err.Error())
+		ctx.AbortWithStatus(500)
+		return
+	}
+
+	orgName := ctx.Query("orgName")
+	server, err := c.registry.GetServer(ctx.Request.Context(), orgName, cn)
+	switch {
+	case err == nil:
+		ctx.JSON(200, toServerStatusDTO(server))
+	case errors.Is(err, registrar.ErrOrgNotFound):
+		ctx.JSON(200, dtos.ServerStatusDTO{Name: cn, Status: int(dtos.StatusServerNotRegistered)})
+	default:
+		c.logger.Error("error fetching server [%s::%s]: %s", orgName, cn, err.Error())
+		ctx.AbortWithStatus(500)
+	}
+}
+
+func (c *Controller) pauseServer(ctx *gin.Context) {
+	c.setServerStatus(ctx, models.FileServerStatusPaused)
+}
+
+func (c *Controller) resumeServer(ctx *gin.Context) {
+	c.setServerStatus(ctx, models.FileServerStatusReady)
+}
+
+func (c *Controller) setServerStatus(ctx *gin.Context, status models.FileServerStatus) {
+	var dto dtos.ServerStatusRequestDTO
+	if err := ctx.ShouldBindJSON(&dto); err != nil {
+		c.logger.Error("error reading body from server status request: %s", err.Error())
+		ctx.AbortWithStatus(400)
+		return
+	}
+
+	cn, err := middleware.ServerCommonNameFromContext(ctx)
+	if err != nil {
+		c.logger.Error("failed to get common-name from TLS params: %s", err.Error())
+		ctx.AbortWithStatus(500)
+		return
+	}
+
+	err = c.registry.SetServerStatus(ctx.Request.Context(), dto.OrgName, cn, status)
+	switch {
+	case err == nil:
+	case errors.Is(err, registrar.ErrServerNotFound):
+		ctx.AbortWithStatusJSON(404, dtos.ServerStatusDTO{Name: cn, Status: int(dtos.StatusServerNotRegistered)})
+		return
+	default:
+		c.logger.Error("error updating status for server [%s::%s]: %s", dto.OrgName, cn, err.Error())
+		ctx.AbortWithStatus(500)
+		return
+	}
+
+	c.logger.Info("server [%s::%s] status set to %d", dto.OrgName, cn, status)
+	server, err := c.registry.GetServer(ctx.Request.Context(), dto.OrgName, cn)
+	if err != nil {
+		c.logger.Error("error fetching server [%s::%s]: %s", dto.OrgName, cn, err.Error())
+		ctx.AbortWithStatus(500)
+		return
+	}
+
+	ctx.JSON(200, toServerStatusDTO(server))
+}
+
+func toServerStatusDTO(server models.FileServer) dtos.ServerStatusDTO {
+	status := dtos.StatusServerReady
+	if server.Status() == models.FileServerStatusPaused {
+		status = dtos.StatusServerDisabled
+	}
+
+	return dtos.ServerStatusDTO{
+		ID:     server.ID(),
+		Name:   server.Name(),
+		Status: int(status),
 	}
 }
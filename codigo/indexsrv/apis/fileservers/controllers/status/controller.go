@@ -1,9 +1,16 @@
-package controllers
+package status
 
 import (
+	"errors"
+	"time"
+
 	"github.com/gin-gonic/gin"
+	"github.com/mredolatti/tf/codigo/common/dtos"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/indexsrv/apis/fileservers/middleware"
 	"github.com/mredolatti/tf/codigo/indexsrv/fslinks"
+	"github.com/mredolatti/tf/codigo/indexsrv/models"
+	"github.com/mredolatti/tf/codigo/indexsrv/repository"
 )
 
 // Controller bundling endpoints for file-server check-in
@@ -12,24 +19,52 @@ type Controller struct {
 	servers fslinks.Interface
 }
 
+// New constructs a new status controller
+func New(logger log.Interface, servers fslinks.Interface) *Controller {
+	return &Controller{
+		logger:  logger,
+		servers: servers,
+	}
+}
+
 // Register mounts controller endpoints in supplied gin router
 func (c *Controller) Register(router gin.IRouter) {
 	router.POST("/status", c.updateStatus)
 }
 
 func (c *Controller) updateStatus(ctx *gin.Context) {
-	var status StatusDTO
-	err := ctx.BindJSON(&status)
-	if err != nil {
-		ctx.JSON(400, "unable to parse JSON in request body")
-		c.logger.Error("error parsing request body: ", err)
+	var heartbeat dtos.HeartbeatDTO
+	if err := ctx.ShouldBindJSON(&heartbeat); err != nil {
+		c.logger.Ctx(ctx.Request.Context()).Log(log.Error, "error reading heartbeat body", "err", err)
+		ctx.AbortWithStatus(400)
 		return
 	}
 
-	// TODO(mredolatti): figure out what to do with healthyness & uptime params
-	err = c.servers.NotifyServerUp(ctx.Request.Context(), status.ServerID, true, 123)
+	cn, err := middleware.ServerCommonNameFromContext(ctx)
 	if err != nil {
-		ctx.JSON(500, "error updating server status")
-		c.logger.Error("error updating server status: ", err)
+		c.logger.Ctx(ctx.Request.Context()).Log(log.Error, "failed to get common-name from TLS params", "err", err)
+		ctx.AbortWithStatus(500)
+		return
+	}
+
+	logger := c.logger.Ctx(log.WithFields(ctx.Request.Context(), log.KeyOrg, heartbeat.OrgName, log.KeyServer, cn))
+	err = c.servers.NotifyServerUp(ctx.Request.Context(), heartbeat.OrgName, cn, &models.Heartbeat{
+		Version:    heartbeat.Version,
+		Uptime:     time.Duration(heartbeat.UptimeSeconds) * time.Second,
+		Interval:   time.Duration(heartbeat.IntervalSeconds) * time.Second,
+		Healthy:    heartbeat.Healthy,
+		Message:    heartbeat.Message,
+		Goroutines: heartbeat.Load.Goroutines,
+		HeapBytes:  heartbeat.Load.HeapBytes,
+	})
+	switch {
+	case err == nil:
+		ctx.Status(204)
+	case errors.Is(err, repository.ErrNotFound):
+		logger.Log(log.Info, "received heartbeat from unregistered server")
+		ctx.AbortWithStatus(404)
+	default:
+		logger.Log(log.Error, "error updating server status", "err", err)
+		ctx.AbortWithStatus(500)
 	}
 }
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"github.com/mredolatti/tf/codigo/common/log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireCommonName returns a handler that only lets through requests whose client certificate, already verified
+// by TLSClientCertValidator, carries one of the `allowed` common names. Every request is rejected if none are supplied
+func RequireCommonName(logger log.Interface, allowed []string) gin.HandlerFunc {
+	names := make(map[string]struct{}, len(allowed))
+	for _, name := range allowed {
+		names[name] = struct{}{}
+	}
+
+	return func(ctx *gin.Context) {
+		cn, err := ServerCommonNameFromContext(ctx)
+		if err != nil {
+			logger.Ctx(ctx.Request.Context()).Log(log.Error, "no verified client certificate in operator request", "err", err)
+			ctx.AbortWithStatus(401)
+			return
+		}
+
+		if _, ok := names[cn]; !ok {
+			logger.Ctx(ctx.Request.Context()).Log(log.Warning, "rejecting operator request from a non-allowlisted certificate", "cn", cn)
+			ctx.AbortWithStatus(403)
+			return
+		}
+
+		ctx.Next()
+	}
+}
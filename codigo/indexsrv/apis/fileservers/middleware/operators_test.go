@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireCommonName(t *testing.T) {
+	logger, _ := log.New(io.Discard, log.None)
+	serve := func(allowed []string, cn string) int {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.PUT("/admin/log/level", func(ctx *gin.Context) {
+			if cn != "" {
+				ctx.Set(ServerCNKey, cn)
+			}
+		}, RequireCommonName(logger, allowed), func(ctx *gin.Context) { ctx.Status(204) })
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/admin/log/level", nil))
+		return recorder.Code
+	}
+
+	assert.Equal(t, 204, serve([]string{"ops.example.com"}, "ops.example.com"))
+	assert.Equal(t, 403, serve([]string{"ops.example.com"}, "fs1.example.com"))
+	assert.Equal(t, 401, serve([]string{"ops.example.com"}, ""))
+	assert.Equal(t, 403, serve(nil, "ops.example.com")) // no operators configured
+}
@@ -4,12 +4,13 @@ import (
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rsa"
-	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"time"
 
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/common/revocation"
 
 	"github.com/gin-gonic/gin"
 )
@@ -27,14 +28,16 @@ var (
 
 
 type TLSClientCertValidator struct {
-	logger    log.Interface
-	tlsConfig *tls.Config
+	logger       log.Interface
+	certificates certmanager.Interface
+	revocation   revocation.Interface
 }
 
-func NewTLSClientValidator(logger log.Interface, tlsConfig *tls.Config) *TLSClientCertValidator {
+func NewTLSClientValidator(logger log.Interface, certificates certmanager.Interface, checker revocation.Interface) *TLSClientCertValidator {
 	return &TLSClientCertValidator{
-		logger:    logger,
-		tlsConfig: tlsConfig,
+		logger:       logger,
+		certificates: certificates,
+		revocation:   checker,
 	}
 }
 
@@ -48,7 +51,7 @@ func (v *TLSClientCertValidator) Handle(ctx *gin.Context) {
 	}
 
 	opts := x509.VerifyOptions{
-		Roots:         v.tlsConfig.ClientCAs,
+		Roots:         v.certificates.RootCAs(),
 		CurrentTime:   time.Now(),
 		Intermediates: x509.NewCertPool(),
 		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
@@ -65,6 +68,14 @@ func (v *TLSClientCertValidator) Handle(ctx *gin.Context) {
 		return
 	}
 
+	if v.revocation != nil {
+		if err := v.revocation.Check(certs[0]); err != nil {
+			v.logger.Error("rejecting client certificate for %s: %s", certs[0].Subject.CommonName, err)
+			ctx.AbortWithStatusJSON(401, gin.H{"error": "client certificate has been revoked"})
+			return
+		}
+	}
+
 	switch certs[0].PublicKey.(type) {
 	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
 	default:
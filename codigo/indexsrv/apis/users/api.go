@@ -2,6 +2,7 @@ package users
 
 import (
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/common/ratelimit"
 	"github.com/mredolatti/tf/codigo/indexsrv/access/authentication"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/users/controllers/admin"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/users/controllers/fslinks"
@@ -9,6 +10,7 @@ import (
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/users/controllers/mappings"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/users/controllers/organizations"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/users/middleware"
+	serverlinks "github.com/mredolatti/tf/codigo/indexsrv/fslinks"
 	"github.com/mredolatti/tf/codigo/indexsrv/mapper"
 	"github.com/mredolatti/tf/codigo/indexsrv/registrar"
 
@@ -20,6 +22,9 @@ type Config struct {
 	UserManager         authentication.UserManager
 	Mapper              mapper.Interface
 	ServerRegistrar     registrar.Interface
+	ServerLinks         serverlinks.Interface
+	LoginLimiter        ratelimit.Interface // by ip address
+	UserLimiter         ratelimit.Interface // by session user
 	Logger              log.Interface
 }
 
@@ -31,14 +36,14 @@ func Mount(router gin.IRouter, config *Config) {
 
 	// Setup login controller
 	loginController := login.New(config.UserManager, samw, config.Logger)
-	loginController.Register(router)
+	loginController.Register(router.Group("/", ratelimit.Middleware(config.LoginLimiter, ratelimit.ByClientIP)))
 
 	// Setup session-protected api group
 	protected := router.Group("/")
-	protected.Use(samw.Handle, tfamw.Handle)
+	protected.Use(samw.Handle, tfamw.Handle, ratelimit.Middleware(config.UserLimiter, middleware.SessionUser))
 	mappingController := mappings.New(config.Logger, config.Mapper)
 	mappingController.Register(protected)
-	organizationController := organizations.New(config.ServerRegistrar, config.Logger)
+	organizationController := organizations.New(config.ServerRegistrar, config.ServerLinks, config.Logger)
 	organizationController.Register(protected)
 	fsLinksController := fslinks.New(config.Logger, config.ServerRegistrar)
 	fsLinksController.Register(protected)
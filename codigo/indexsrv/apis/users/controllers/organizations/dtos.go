@@ -6,11 +6,23 @@ type OrganizationViewDTO struct {
 }
 
 type FileServerViewDTO struct {
-	ID                string `json:"id"`
-	OrganizationName  string `json:"organizationName"`
-	Name              string `json:"name"`
-	AuthenticationURL string `json:"authenticationUrl"`
-	TokenURL          string `json:"tokenUrl"`
-	FileFetchURL      string `json:"fileFetchUrl"`
-	ControlEndpoint   string `json:"controlEndpoint"`
+	ID                string        `json:"id"`
+	OrganizationName  string        `json:"organizationName"`
+	Name              string        `json:"name"`
+	AuthenticationURL string        `json:"authenticationUrl"`
+	TokenURL          string        `json:"tokenUrl"`
+	FileFetchURL      string        `json:"fileFetchUrl"`
+	ControlEndpoint   string        `json:"controlEndpoint"`
+	Status            string        `json:"status"`
+	Health            HealthViewDTO `json:"health"`
+}
+
+type HealthViewDTO struct {
+	Status        string `json:"status"`
+	LastSeen      int64  `json:"lastSeen,omitempty"`
+	Version       string `json:"version,omitempty"`
+	UptimeSeconds int64  `json:"uptimeSeconds,omitempty"`
+	Message       string `json:"message,omitempty"`
+	Goroutines    int    `json:"goroutines,omitempty"`
+	HeapBytes     uint64 `json:"heapBytes,omitempty"`
 }
@@ -7,20 +7,28 @@ import (
 	"github.com/mredolatti/tf/codigo/common/dtos/jsend"
 	"github.com/mredolatti/tf/codigo/common/log"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis/users/middleware"
+	"github.com/mredolatti/tf/codigo/indexsrv/fslinks"
 	"github.com/mredolatti/tf/codigo/indexsrv/models"
 	"github.com/mredolatti/tf/codigo/indexsrv/registrar"
 	"github.com/mredolatti/tf/codigo/indexsrv/repository"
 )
 
+const (
+	serverStatusReady       = "ready"
+	serverStatusMaintenance = "maintenance"
+)
+
 type Controller struct {
 	logger    log.Interface
 	registrar registrar.Interface
+	links     fslinks.Interface
 }
 
-func New(registrar registrar.Interface, logger log.Interface) *Controller {
+func New(registrar registrar.Interface, links fslinks.Interface, logger log.Interface) *Controller {
 	return &Controller{
 		logger:    logger,
 		registrar: registrar,
+		links:     links,
 	}
 }
 
@@ -30,6 +38,7 @@ func (c *Controller) Register(router gin.IRouter) {
 	router.GET("/organizations/:name/servers", c.listServersForOrg)
 	router.GET("/organizations/:name/servers/:serverName", c.listServersForOrg)
 	router.GET("/organizations/:name/servers/:serverName/link", c.initiateLinkProcess)
+	router.DELETE("/organizations/:name/servers/:serverName/link", c.unlink)
 	router.GET("/servers", c.listServers)
 	router.GET("/servers/:serverId", c.getServer)
 }
@@ -91,7 +100,7 @@ func (c *Controller) listServersForOrg(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(200, jsend.NewSuccessResponse("servers", toFileServersView(fss), ""))
+	ctx.JSON(200, jsend.NewSuccessResponse("servers", c.toFileServersView(fss), ""))
 }
 
 func (c *Controller) listServers(ctx *gin.Context) {
@@ -109,7 +118,7 @@ func (c *Controller) listServers(ctx *gin.Context) {
 		return
 	}
 
-	ctx.JSON(200, jsend.NewSuccessResponse("servers", toFileServersView(fss), ""))
+	ctx.JSON(200, jsend.NewSuccessResponse("servers", c.toFileServersView(fss), ""))
 }
 
 func (c *Controller) getServer(ctx *gin.Context) {
@@ -131,7 +140,7 @@ func (c *Controller) getServer(ctx *gin.Context) {
 		ctx.AbortWithStatusJSON(500, responseErrorFetchingServers)
 		return
 	}
-	ctx.JSON(200, jsend.NewSuccessResponse("server", toFileServerView(server), ""))
+	ctx.JSON(200, jsend.NewSuccessResponse("server", c.toFileServerView(server), ""))
 }
 
 func (c *Controller) initiateLinkProcess(ctx *gin.Context) {
@@ -149,6 +158,10 @@ func (c *Controller) initiateLinkProcess(ctx *gin.Context) {
 
 	url, err := c.registrar.InitiateLinkProcess(ctx.Request.Context(), session.User(), orgName, serverName, force)
 	if err != nil {
+		if errors.Is(err, registrar.ErrServerPaused) {
+			ctx.AbortWithStatusJSON(503, responseServerInMaintenance)
+			return
+		}
 		if errors.Is(err, registrar.ErrAccountExists) {
 			c.logger.Error("requested initial link with an already existing account (%s/%s/%s)", session.User(), orgName, serverName)
 			ctx.JSON(400, "account already exists")
@@ -162,6 +175,36 @@ func (c *Controller) initiateLinkProcess(ctx *gin.Context) {
 	ctx.Redirect(301, url)
 }
 
+func (c *Controller) unlink(ctx *gin.Context) {
+	session, err := middleware.SessionFromContext(ctx)
+	if err != nil {
+		c.logger.Error("error getting session information: %s", err.Error())
+		ctx.AbortWithStatusJSON(500, jsend.ResponseErrorInSession)
+		return
+	}
+
+	orgName := ctx.Param("name")
+	serverName := ctx.Param("serverName")
+
+	err = c.registrar.UnlinkAccount(ctx.Request.Context(), session.User(), orgName, serverName)
+	switch {
+	case err == nil:
+	case errors.Is(err, registrar.ErrAccountNotFound):
+		ctx.AbortWithStatusJSON(404, responseNoAccount)
+		return
+	case errors.Is(err, registrar.ErrRevocationFailed):
+		c.logger.Error("file server refused to revoke tokens for account (%s/%s/%s): %s", session.User(), orgName, serverName, err)
+		ctx.AbortWithStatusJSON(502, responseErrorRevokingTokens)
+		return
+	default:
+		c.logger.Error("error unlinking account (%s/%s/%s): %s", session.User(), orgName, serverName, err)
+		ctx.AbortWithStatusJSON(500, responseErrorUnlinking)
+		return
+	}
+
+	ctx.JSON(200, jsend.ResponseEmptySuccess)
+}
+
 func toOrgView(org models.Organization) OrganizationViewDTO {
 	return OrganizationViewDTO{
 		ID:   org.ID(),
@@ -177,7 +220,7 @@ func toOrgsView(orgs []models.Organization) []OrganizationViewDTO {
 	return res
 }
 
-func toFileServerView(fs models.FileServer) FileServerViewDTO {
+func (c *Controller) toFileServerView(fs models.FileServer) FileServerViewDTO {
 	return FileServerViewDTO{
 		ID:                fs.ID(),
 		OrganizationName:  fs.OrganizationName(),
@@ -186,20 +229,48 @@ func toFileServerView(fs models.FileServer) FileServerViewDTO {
 		TokenURL:          fs.TokenURL(),
 		FileFetchURL:      fs.FetchURL(),
 		ControlEndpoint:   fs.ControlEndpoint(),
+		Status:            toStatusView(fs.Status()),
+		Health:            toHealthView(c.links.Health(fs)),
 	}
 }
 
-func toFileServersView(servers []models.FileServer) []FileServerViewDTO {
+func (c *Controller) toFileServersView(servers []models.FileServer) []FileServerViewDTO {
 	res := make([]FileServerViewDTO, len(servers))
 	for i := range servers {
-		res[i] = toFileServerView(servers[i])
+		res[i] = c.toFileServerView(servers[i])
 	}
 	return res
 }
 
+func toStatusView(status models.FileServerStatus) string {
+	if status == models.FileServerStatusPaused {
+		return serverStatusMaintenance
+	}
+	return serverStatusReady
+}
+
+func toHealthView(health fslinks.Health) HealthViewDTO {
+	view := HealthViewDTO{Status: string(health.Status)}
+	if health.LastSeen.IsZero() {
+		return view
+	}
+
+	view.LastSeen = health.LastSeen.Unix()
+	view.Version = health.LastHeartbeat.Version
+	view.UptimeSeconds = int64(health.LastHeartbeat.Uptime.Seconds())
+	view.Message = health.LastHeartbeat.Message
+	view.Goroutines = health.LastHeartbeat.Goroutines
+	view.HeapBytes = health.LastHeartbeat.HeapBytes
+	return view
+}
+
 var (
 	responseNoOrgForName         = jsend.NewCustomFailResponse("", "name", "no organization found with the provided name")
 	responseNoServerForName      = jsend.NewCustomFailResponse("", "name/serverName", "no server found with the provided names")
 	responseErrorFetchingOrgs    = jsend.NewErrorResponse("internal error collecting organizations")
 	responseErrorFetchingServers = jsend.NewErrorResponse("internal error collecting servers")
+	responseNoAccount            = jsend.NewCustomFailResponse("", "name/serverName", "no account linked with the provided server")
+	responseErrorRevokingTokens  = jsend.NewErrorResponse("file server could not revoke the account's tokens")
+	responseErrorUnlinking       = jsend.NewErrorResponse("internal error unlinking account")
+	responseServerInMaintenance  = jsend.NewCustomFailResponse("", "name/serverName", "server in maintenance")
 )
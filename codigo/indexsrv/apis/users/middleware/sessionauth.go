@@ -56,6 +56,7 @@ func (m *SessionAuth) Handle(ctx *gin.Context) {
 
 	ctx.Set(sessionCtxKey, session)
 	ctx.Set(sessionTokenCtxKey, sessionID)
+	ctx.Request = ctx.Request.WithContext(log.WithFields(ctx.Request.Context(), log.KeyUser, session.User()))
 }
 
 func SessionFromContext(ctx *gin.Context) (models.Session, error) {
@@ -85,3 +86,12 @@ func SessionTokenFromContext(ctx *gin.Context) (string ,error) {
 
 	return asString, nil
 }
+
+// SessionUser accounts requests to the user owning the session. Must run after SessionAuth
+func SessionUser(ctx *gin.Context) string {
+	session, err := SessionFromContext(ctx)
+	if err != nil {
+		return ""
+	}
+	return session.User()
+}
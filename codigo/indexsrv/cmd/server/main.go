@@ -9,9 +9,13 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	conf "github.com/mredolatti/tf/codigo/common/config"
 	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/common/ratelimit"
+	"github.com/mredolatti/tf/codigo/common/revocation"
 	"github.com/mredolatti/tf/codigo/common/runtime"
+	"github.com/mredolatti/tf/codigo/common/tracing"
 
 	"github.com/mredolatti/tf/codigo/indexsrv/access/authentication"
 	"github.com/mredolatti/tf/codigo/indexsrv/apis"
@@ -23,6 +27,7 @@ import (
 	"github.com/mredolatti/tf/codigo/indexsrv/repository/mongodb"
 	"github.com/mredolatti/tf/codigo/indexsrv/repository/psql"
 	"github.com/mredolatti/tf/codigo/indexsrv/repository/redis"
+	"github.com/mredolatti/tf/codigo/indexsrv/repository/traced"
 
 	goredis "github.com/redis/go-redis/v9"
 )
@@ -35,7 +40,7 @@ func main() {
 	if cfg.Debug {
 		logLevel = log.Debug
 	}
-	logger, err := log.New(os.Stdout, logLevel)
+	logger, err := log.NewWithFormat(os.Stdout, logLevel, log.Format(cfg.LogFormat))
 	if err != nil {
 		fmt.Println("Error inicializando logger: ", err)
 		os.Exit(1)
@@ -47,35 +52,64 @@ func main() {
 		os.Exit(1)
 	}
 
+	shutdownTracing, err := setupTracing(cfg, logger)
+	if err != nil {
+		logger.Error("error setting up tracing: %s", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing()
+
 	repo, err := setupRepositories(cfg)
 	if err != nil {
 		logger.Error("Error setting up repositories: %s", err)
 		os.Exit(1)
 	}
 
+	certificates, err := setupCertificates(cfg, logger)
+	if err != nil {
+		logger.Error("error setting up certificates: %s", err)
+		os.Exit(1)
+	}
+
 	serverRegistrar := registrar.New(&registrar.Config{
-		FileServers:        repo.FileServers(),
-		UserAccounts:       repo.Accounts(),
-		Organizations:      repo.Organizations(),
-		Pauth2Flows:        repo.PendingOAuth(),
-		RootCAFN:           cfg.Server.RootCAFn,
-		ServerCertFN:       cfg.Server.CertChainFn,
-		ServerPrivateKeyFN: cfg.Server.PrivateKeyFn,
-		BaseURL:            fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
+		FileServers:   repo.FileServers(),
+		UserAccounts:  repo.Accounts(),
+		Organizations: repo.Organizations(),
+		Pauth2Flows:   repo.PendingOAuth(),
+		Certificates:  certificates,
+		BaseURL:       fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
 	})
 
-	fsLinks, err := fslinks.New(logger, repo.Users(), repo.Organizations(), repo.FileServers(), serverRegistrar, cfg.Server.RootCAFn)
+	fsLinks, err := fslinks.New(logger, repo.Users(), repo.Organizations(), repo.FileServers(), serverRegistrar, certificates)
 	if err != nil {
 		logger.Error("error setting up file-server links: %s", err)
 		os.Exit(1)
 	}
 
+	revocationChecker, err := setupRevocation(cfg, logger)
+	if err != nil {
+		logger.Error("error setting up certificate revocation checks: %s", err)
+		os.Exit(1)
+	}
+
 	sessionCache, err := setupSessionCache(repo.Users(), &cfg.Redis)
 	if err != nil {
 		logger.Error("error setting up session cache: %s", err)
 		os.Exit(1)
 	}
 
+	loginLimiter, err := ratelimit.New(ratelimit.Config(cfg.RateLimits.Login))
+	if err != nil {
+		logger.Error("error setting up login rate limiter: %s", err)
+		os.Exit(1)
+	}
+
+	userLimiter, err := ratelimit.New(ratelimit.Config(cfg.RateLimits.Users))
+	if err != nil {
+		logger.Error("error setting up user rate limiter: %s", err)
+		os.Exit(1)
+	}
+
 	apiBundle, err := apis.Setup(&apis.Config{
 		Logger:      logger,
 		UserManager: authentication.NewUserManager(repo.Users(), sessionCache, logger),
@@ -84,10 +118,17 @@ func main() {
 			Repo:                repo.Mappings(),
 			Users:               repo.Users(),
 			Accounts:            repo.Accounts(),
+			Servers:             repo.FileServers(),
 			ServerLinks:         fsLinks,
 		}),
 		Server:          cfg.Server,
 		ServerRegistrar: serverRegistrar,
+		ServerLinks:     fsLinks,
+		Certificates:    certificates,
+		Revocation:      revocationChecker,
+		LoginLimiter:    loginLimiter,
+		UserLimiter:     userLimiter,
+		Operators:       cfg.Operators,
 	})
 
 	if err != nil {
@@ -109,14 +150,84 @@ func main() {
 }
 
 func setupRepositories(cfg *config.Main) (repository.Factory, error) {
+	var factory repository.Factory
+	var err error
 	switch strings.ToLower(cfg.DBEngine) {
 	case "mongo":
-		return mongodb.NewFactory(&cfg.Mongo)
+		factory, err = mongodb.NewFactory(&cfg.Mongo)
 	case "postgres":
-		return psql.NewFactory(&cfg.Postgres)
+		factory, err = psql.NewFactory(&cfg.Postgres)
 	default:
 		return nil, fmt.Errorf("unknown db-engine: %s", cfg.DBEngine)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	return traced.NewFactory(factory), nil
+}
+
+func setupTracing(cfg *config.Main, logger log.Interface) (func(), error) {
+	shutdown, err := tracing.Setup(context.Background(), &tracing.Config{
+		ServiceName:  "index-server",
+		OTLPEndpoint: cfg.Tracing.OTLPEndpoint,
+		Insecure:     cfg.Tracing.Insecure,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Tracing.OTLPEndpoint == "" {
+		logger.Info("no OTLP collector configured. spans will be written to stdout")
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			logger.Error("error flushing pending spans: %s", err)
+		}
+	}, nil
+}
+
+func setupCertificates(cfg *config.Main, logger log.Interface) (certmanager.Interface, error) {
+	certificates, err := certmanager.New(&certmanager.Config{
+		Logger:       logger,
+		CertChainFN:  cfg.Server.CertChainFn,
+		PrivateKeyFN: cfg.Server.PrivateKeyFn,
+		RootCAFN:     cfg.Server.RootCAFn,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificates: %w", err)
+	}
+
+	if err := certificates.Watch(); err != nil {
+		return nil, fmt.Errorf("error watching certificates for changes: %w", err)
+	}
+
+	return certificates, nil
+}
+
+func setupRevocation(cfg *config.Main, logger log.Interface) (revocation.Interface, error) {
+	if len(cfg.Revocation.CRLSources) == 0 && !cfg.Revocation.OCSPEnabled {
+		logger.Info("no CRLs or OCSP configured. file server certificates will not be checked for revocation")
+		return nil, nil
+	}
+
+	checker, err := revocation.New(&revocation.Config{
+		Logger:        logger,
+		IssuerFNs:     []string{cfg.Server.RootCAFn, cfg.Server.CertChainFn}, // the chain includes the intermediate CA
+		CRLSources:    cfg.Revocation.CRLSources,
+		RefreshPeriod: time.Duration(cfg.Revocation.RefreshMinutes) * time.Minute,
+		OCSPEnabled:   cfg.Revocation.OCSPEnabled,
+		OCSPResponder: cfg.Revocation.OCSPResponder,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	checker.Start()
+	return checker, nil
 }
 
 func setupSessionCache(usersRepo repository.UserRepository, redisCfg *conf.Redis) (repository.SessionRepository, error) {
@@ -145,14 +256,16 @@ func setupShutdown(rtm runtime.Interface) {
 func parseEnvVars() *config.Main {
 	return &config.Main{
 		Debug:               os.Getenv("IS_LOG_DEBUG") == "true",
+		LogFormat:           conf.StringOr(os.Getenv("IS_LOG_FORMAT"), string(log.FormatText)),
 		DBEngine:            os.Getenv("IS_DB_ENGINE"),
 		GoogleCredentialsFn: os.Getenv("IS_GOOGLE_CREDS_FN"),
 		Server: conf.Server{
-			Host:         os.Getenv("IS_HOST"),
-			Port:         conf.IntOr(os.Getenv("IS_PORT"), 9876),
-			RootCAFn:     os.Getenv("IS_ROOT_CA"),
-			CertChainFn:  os.Getenv("IS_SERVER_CERT_CHAIN"),
-			PrivateKeyFn: os.Getenv("IS_SERVER_PRIVATE_KEY"),
+			Host:           os.Getenv("IS_HOST"),
+			Port:           conf.IntOr(os.Getenv("IS_PORT"), 9876),
+			RootCAFn:       os.Getenv("IS_ROOT_CA"),
+			CertChainFn:    os.Getenv("IS_SERVER_CERT_CHAIN"),
+			PrivateKeyFn:   os.Getenv("IS_SERVER_PRIVATE_KEY"),
+			TrustedProxies: conf.StringListOr(os.Getenv("IS_TRUSTED_PROXIES"), nil),
 		},
 		Mongo: conf.Mongo{
 			Hosts:    conf.StringListOr(os.Getenv("IS_MONGO_HOSTS"), nil),
@@ -172,5 +285,26 @@ func parseEnvVars() *config.Main {
 			Port: conf.IntOr(os.Getenv("IS_REDIS_PORT"), 6379),
 			DB:   conf.IntOr(os.Getenv("IS_REDIS_DB"), 0),
 		},
+		Revocation: conf.Revocation{
+			CRLSources:     conf.StringListOr(os.Getenv("IS_CRL_SOURCES"), nil),
+			RefreshMinutes: conf.IntOr(os.Getenv("IS_CRL_REFRESH_MINUTES"), 60),
+			OCSPEnabled:    os.Getenv("IS_OCSP_ENABLED") == "true",
+			OCSPResponder:  os.Getenv("IS_OCSP_RESPONDER"),
+		},
+		Tracing: conf.Tracing{
+			OTLPEndpoint: os.Getenv("IS_OTLP_ENDPOINT"),
+			Insecure:     os.Getenv("IS_OTLP_INSECURE") == "true",
+		},
+		RateLimits: config.RateLimits{
+			Login: conf.RateLimit{
+				RequestsPerSecond: conf.FloatOr(os.Getenv("IS_RATELIMIT_LOGIN_RPS"), 0.2),
+				Burst:             conf.IntOr(os.Getenv("IS_RATELIMIT_LOGIN_BURST"), 5),
+			},
+			Users: conf.RateLimit{
+				RequestsPerSecond: conf.FloatOr(os.Getenv("IS_RATELIMIT_USERS_RPS"), 5),
+				Burst:             conf.IntOr(os.Getenv("IS_RATELIMIT_USERS_BURST"), 20),
+			},
+		},
+		Operators: conf.StringListOr(os.Getenv("IS_OPERATORS"), nil),
 	}
 }
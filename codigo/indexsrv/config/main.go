@@ -6,10 +6,21 @@ import (
 
 type Main struct {
 	Debug               bool
+	LogFormat           string
 	DBEngine            string
 	GoogleCredentialsFn string
 	Server              conf.Server
 	Mongo               conf.Mongo
 	Postgres            conf.Postgres
 	Redis               conf.Redis
+	Revocation          conf.Revocation
+	Tracing             conf.Tracing
+	RateLimits          RateLimits
+	Operators           []string // client certificate CNs allowed to use operator endpoints (ie: changing the log level)
+}
+
+// RateLimits holds the limits applied to each group of client-api endpoints
+type RateLimits struct {
+	Login conf.RateLimit // login & signup, by ip address
+	Users conf.RateLimit // session-protected endpoints, by user
 }
@@ -2,22 +2,25 @@ package fslinks
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"sync"
+	"time"
 
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	"github.com/mredolatti/tf/codigo/common/is2fs"
 	"github.com/mredolatti/tf/codigo/indexsrv/models"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
 )
 
+const recycleGracePeriod = 30 * time.Second
+
 type fsClient struct {
-	client is2fs.FileRefSyncClient
-	conn   *grpc.ClientConn
+	client   is2fs.FileRefSyncClient
+	conn     *grpc.ClientConn
+	endpoint string
 }
 
 type fsClientMap map[string]*fsClient
@@ -29,18 +32,30 @@ type connTracker struct {
 	auth    *authInterceptor
 }
 
-func newConnTracker(rootCA string, auth *authInterceptor) (*connTracker, error) {
-
-	creds, err := parseCredentials(rootCA)
-	if err != nil {
-		return nil, fmt.Errorf("error setting up gRPC client TLS credentials: %w", err)
-	}
-
-	return &connTracker{
+func newConnTracker(certificates certmanager.Interface, auth *authInterceptor) *connTracker {
+	// file servers bind access tokens to the certificate used to obtain them, so the same one must be presented here
+	tracker := &connTracker{
 		servers: make(fsClientMap),
 		auth:    auth,
-		creds:   creds,
-	}, nil
+		creds:   credentials.NewTLS(certificates.ClientConfig(&tls.Config{})),
+	}
+	certificates.AddListener(tracker.recycleAll)
+	return tracker
+}
+
+// recycleAll drops every connection, so that new ones present the current certificate. Connections are closed
+// after a grace period to let in-flight calls finish
+func (t *connTracker) recycleAll() {
+	t.mutex.Lock()
+	previous := t.servers
+	t.servers = make(fsClientMap)
+	t.mutex.Unlock()
+
+	for _, packed := range previous {
+		time.AfterFunc(recycleGracePeriod, func(conn *grpc.ClientConn) func() {
+			return func() { conn.Close() }
+		}(packed.conn))
+	}
 }
 
 func (t *connTracker) get(server models.FileServer) (*fsClient, error) {
@@ -49,8 +64,9 @@ func (t *connTracker) get(server models.FileServer) (*fsClient, error) {
 	defer t.mutex.Unlock()
 	packed, exists := t.servers[server.ID()]
 
-	if exists && !shouldRecycle(packed.conn) {
-		exists = false // recreate the connection
+	if exists && (shouldRecycle(packed.conn) || packed.endpoint != server.ControlEndpoint()) {
+		packed.conn.Close() // the server re-registered with a new endpoint, or the connection is no longer usable
+		exists = false      // recreate the connection
 	}
 
 	if !exists {
@@ -58,16 +74,17 @@ func (t *connTracker) get(server models.FileServer) (*fsClient, error) {
 		conn, err := grpc.Dial(
 			server.ControlEndpoint(),
 			grpc.WithTransportCredentials(t.creds),
-			grpc.WithUnaryInterceptor(t.auth.Unary()),
-			grpc.WithStreamInterceptor(t.auth.Stream()),
+			grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(), t.auth.Unary()),
+			grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor(), t.auth.Stream()),
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to connect to server: %w", err)
 		}
 
 		packed = &fsClient{
-			client: is2fs.NewFileRefSyncClient(conn),
-			conn:   conn,
+			client:   is2fs.NewFileRefSyncClient(conn),
+			conn:     conn,
+			endpoint: server.ControlEndpoint(),
 		}
 
 		t.servers[server.ID()] = packed
@@ -86,19 +103,3 @@ func shouldRecycle(conn *grpc.ClientConn) bool {
 		return true
 	}
 }
-
-func parseCredentials(rootCA string) (credentials.TransportCredentials, error) {
-	certData, err := ioutil.ReadFile(rootCA)
-	if err != nil {
-		return nil, err
-	}
-
-	certPool := x509.NewCertPool()
-	if !certPool.AppendCertsFromPEM(certData) {
-		return nil, errors.New("error adding certificate to pool")
-	}
-
-	return credentials.NewTLS(&tls.Config{
-		RootCAs: certPool,
-	}), nil
-}
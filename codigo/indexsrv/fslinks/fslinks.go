@@ -2,9 +2,12 @@ package fslinks
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
+	"github.com/mredolatti/tf/codigo/common/certmanager"
 	"github.com/mredolatti/tf/codigo/common/is2fs"
 	"github.com/mredolatti/tf/codigo/common/log"
 	"github.com/mredolatti/tf/codigo/indexsrv/models"
@@ -12,13 +15,19 @@ import (
 	"github.com/mredolatti/tf/codigo/indexsrv/repository"
 )
 
+// Public errors
+var (
+	ErrServerUnavailable = errors.New("file server has stopped sending heartbeats")
+)
+
 type ctxKeyUserID struct{}
 type ctxKeyOrgName struct{}
 type ctxKeyServerName struct{}
 
 // Interface defines the methods for a file-server links monitor
 type Interface interface {
-	NotifyServerUp(ctx context.Context, serverID string, healthy bool, uptime int64) error
+	NotifyServerUp(ctx context.Context, orgName string, serverName string, heartbeat *models.Heartbeat) error
+	Health(server models.FileServer) Health
 	FetchUpdates(ctx context.Context, orgName string, serverName string, user models.User, checkpoint int64) ([]models.Update, error)
 }
 
@@ -29,6 +38,7 @@ type Impl struct {
 	orgs    repository.OrganizationRepository
 	servers repository.FileServerRepository
 	conns   *connTracker
+	now     func() time.Time
 }
 
 // New constructs a new file-server link monitor
@@ -38,13 +48,10 @@ func New(
 	orgRepo repository.OrganizationRepository,
 	servers repository.FileServerRepository,
 	reg registrar.Interface,
-	rootCA string,
+	certificates certmanager.Interface,
 ) (*Impl, error) {
 
-	connTracker, err := newConnTracker(rootCA, newAuthInterceptor(reg))
-	if err != nil {
-		return nil, fmt.Errorf("error setting up gRPC connection tracker: %w", err)
-	}
+	connTracker := newConnTracker(certificates, newAuthInterceptor(reg))
 
 	return &Impl{
 		logger:  logger,
@@ -52,35 +59,52 @@ func New(
 		users:   userRepo,
 		orgs:    orgRepo,
 		servers: servers,
+		now:     time.Now,
 	}, nil
 }
 
-// NotifyServerUp is meant to be called whenever a server announces itself
-func (i *Impl) NotifyServerUp(ctx context.Context, serverID string, healthy bool, uptime int64) error {
+// NotifyServerUp records a heartbeat sent by a registered file server
+func (i *Impl) NotifyServerUp(ctx context.Context, orgName string, serverName string, heartbeat *models.Heartbeat) error {
+	ctx = log.WithFields(ctx, log.KeyOrg, orgName, log.KeyServer, serverName)
+	fs, err := i.servers.Get(ctx, orgName, serverName)
+	if err != nil {
+		return fmt.Errorf("error fetching server '%s/%s': %w", orgName, serverName, err)
+	}
 
-	// TODO(mredolatti)
-	/*
-		fs, err := i.servers.Get(ctx, serverID)
-		if err != nil {
-			return fmt.Errorf("error fetching server '%s': %w", serverID, err)
-		}
+	now := i.now()
+	previous := healthOf(fs, now).Status
+	heartbeat.Interval = clampInterval(heartbeat.Interval)
+	if err := i.servers.UpdateHeartbeat(ctx, orgName, serverName, now, heartbeat); err != nil {
+		return fmt.Errorf("error storing heartbeat for server '%s/%s': %w", orgName, serverName, err)
+	}
 
-		_, err = i.conns.get(fs)
-		if err != nil {
-			return fmt.Errorf("error connecting to server '%s': %w", serverID, err)
-		}
-	*/
+	switch {
+	case previous == HealthUnavailable:
+		i.logger.Ctx(ctx).Log(log.Info, "file server is back online")
+	case previous != HealthDegraded && !heartbeat.Healthy:
+		i.logger.Ctx(ctx).Log(log.Warning, "file server reports being unhealthy", "message", heartbeat.Message)
+	}
 
 	return nil
 }
 
+// Health returns the last known state of a file server
+func (i *Impl) Health(server models.FileServer) Health {
+	return healthOf(server, i.now())
+}
+
 // FetchUpdates asks the server for the latest changes in file for a specific user
 func (i *Impl) FetchUpdates(ctx context.Context, orgName string, serverName string, user models.User, checkpoint int64) ([]models.Update, error) {
+	ctx = log.WithFields(ctx, log.KeyOrg, orgName, log.KeyServer, serverName)
 	fs, err := i.servers.Get(ctx, orgName, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching server '%s/%s': %w", orgName, serverName, err)
 	}
 
+	if i.Health(fs).Status == HealthUnavailable {
+		return nil, fmt.Errorf("error syncing with server '%s/%s': %w", orgName, serverName, ErrServerUnavailable)
+	}
+
 	pack, err := i.conns.get(fs)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to server '%s/%s': %w", orgName, serverName, err)
@@ -118,6 +142,7 @@ func (i *Impl) FetchUpdates(ctx context.Context, orgName string, serverName stri
 
 	}
 
+	i.logger.Ctx(ctx).Log(log.Debug, "fetched updates from file server", "checkpoint", checkpoint, "updates", len(updates))
 	return updates, nil
 }
 
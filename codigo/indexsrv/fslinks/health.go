@@ -0,0 +1,69 @@
+package fslinks
+
+import (
+	"time"
+
+	"github.com/mredolatti/tf/codigo/indexsrv/models"
+)
+
+const (
+	// a server is considered unavailable after this many heartbeats are missed in a row
+	missedHeartbeatsThreshold = 3
+
+	// used when a server doesn't report how often it sends heartbeats
+	defaultHeartbeatInterval = 30 * time.Second
+
+	// bounds for the interval reported by servers, so that a misconfigured one can neither be considered
+	// alive for hours after going down, nor be flagged as unavailable on every slow heartbeat
+	minHeartbeatInterval = 5 * time.Second
+	maxHeartbeatInterval = 5 * time.Minute
+)
+
+// HealthStatus summarizes the state of a file server based on its heartbeats
+type HealthStatus string
+
+// Possible health statuses
+const (
+	HealthUnknown     HealthStatus = "unknown" // the server has never sent a heartbeat
+	HealthHealthy     HealthStatus = "healthy"
+	HealthDegraded    HealthStatus = "degraded" // the server is alive but reported itself as unhealthy
+	HealthUnavailable HealthStatus = "unavailable"
+)
+
+// Health is the last known state of a file server
+type Health struct {
+	Status        HealthStatus
+	LastSeen      time.Time
+	LastHeartbeat models.Heartbeat
+}
+
+// healthOf computes the state of a server at a point in time, based on the last heartbeat stored for it
+func healthOf(server models.FileServer, now time.Time) Health {
+	heartbeat := server.LastHeartbeat()
+	if heartbeat == nil {
+		return Health{Status: HealthUnknown}
+	}
+
+	health := Health{LastSeen: server.LastSeen(), LastHeartbeat: *heartbeat}
+	switch {
+	case now.Sub(health.LastSeen) > missedHeartbeatsThreshold*clampInterval(heartbeat.Interval):
+		health.Status = HealthUnavailable
+	case !heartbeat.Healthy:
+		health.Status = HealthDegraded
+	default:
+		health.Status = HealthHealthy
+	}
+	return health
+}
+
+func clampInterval(interval time.Duration) time.Duration {
+	switch {
+	case interval <= 0:
+		return defaultHeartbeatInterval
+	case interval < minHeartbeatInterval:
+		return minHeartbeatInterval
+	case interval > maxHeartbeatInterval:
+		return maxHeartbeatInterval
+	}
+	return interval
+}
@@ -0,0 +1,99 @@
+package fslinks
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/log"
+	"github.com/mredolatti/tf/codigo/indexsrv/models"
+	"github.com/mredolatti/tf/codigo/indexsrv/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+type serverMock struct {
+	models.FileServer
+	lastSeen  time.Time
+	heartbeat *models.Heartbeat
+}
+
+func (s *serverMock) LastSeen() time.Time              { return s.lastSeen }
+func (s *serverMock) LastHeartbeat() *models.Heartbeat { return s.heartbeat }
+
+type serverRepoMock struct {
+	repository.FileServerRepository
+	servers map[string]*serverMock
+}
+
+func (r *serverRepoMock) Get(ctx context.Context, orgName string, name string) (models.FileServer, error) {
+	server, ok := r.servers[orgName+"/"+name]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return server, nil
+}
+
+func (r *serverRepoMock) UpdateHeartbeat(ctx context.Context, orgName string, name string, seen time.Time, heartbeat *models.Heartbeat) error {
+	server, ok := r.servers[orgName+"/"+name]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	server.lastSeen, server.heartbeat = seen, heartbeat
+	return nil
+}
+
+func TestHealth(t *testing.T) {
+	now := time.Now()
+	server := &serverMock{}
+	assert.Equal(t, HealthUnknown, healthOf(server, now).Status)
+
+	server.lastSeen, server.heartbeat = now, &models.Heartbeat{Version: "v1", Interval: 10 * time.Second, Healthy: true}
+	health := healthOf(server, now)
+	assert.Equal(t, HealthHealthy, health.Status)
+	assert.Equal(t, now, health.LastSeen)
+	assert.Equal(t, "v1", health.LastHeartbeat.Version)
+
+	// a couple of missed heartbeats are tolerated
+	assert.Equal(t, HealthHealthy, healthOf(server, now.Add(25*time.Second)).Status)
+	assert.Equal(t, HealthUnavailable, healthOf(server, now.Add(35*time.Second)).Status)
+
+	server.heartbeat = &models.Heartbeat{Interval: 10 * time.Second, Healthy: false, Message: "db down"}
+	health = healthOf(server, now)
+	assert.Equal(t, HealthDegraded, health.Status)
+	assert.Equal(t, "db down", health.LastHeartbeat.Message)
+
+	// servers that don't report an interval get the default one
+	server.heartbeat = &models.Heartbeat{Healthy: true}
+	assert.Equal(t, HealthHealthy, healthOf(server, now.Add(missedHeartbeatsThreshold*defaultHeartbeatInterval-time.Second)).Status)
+
+	// & intervals out of bounds are clamped
+	server.heartbeat = &models.Heartbeat{Interval: 24 * time.Hour, Healthy: true}
+	assert.Equal(t, HealthUnavailable, healthOf(server, now.Add(missedHeartbeatsThreshold*maxHeartbeatInterval+time.Second)).Status)
+	server.heartbeat = &models.Heartbeat{Interval: time.Millisecond, Healthy: true}
+	assert.Equal(t, HealthHealthy, healthOf(server, now.Add(time.Second)).Status)
+}
+
+func TestNotifyServerUp(t *testing.T) {
+	logger, err := log.New(io.Discard, log.None)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	servers := &serverRepoMock{servers: map[string]*serverMock{"org1/server1": {}}}
+	links := &Impl{logger: logger, servers: servers, now: func() time.Time { return now }}
+
+	assert.Nil(t, links.NotifyServerUp(context.Background(), "org1", "server1", &models.Heartbeat{Interval: 24 * time.Hour, Healthy: true}))
+	stored := servers.servers["org1/server1"]
+	assert.Equal(t, now, stored.lastSeen)
+	assert.Equal(t, maxHeartbeatInterval, stored.heartbeat.Interval)
+	assert.Equal(t, HealthHealthy, links.Health(stored).Status)
+
+	// health survives the index server restarting, since it's read back from the repository
+	restarted := &Impl{logger: logger, servers: servers, now: func() time.Time { return now.Add(time.Minute) }}
+	server, err := servers.Get(context.Background(), "org1", "server1")
+	assert.Nil(t, err)
+	assert.Equal(t, HealthHealthy, restarted.Health(server).Status)
+
+	err = links.NotifyServerUp(context.Background(), "org1", "nope", &models.Heartbeat{Healthy: true})
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+}
@@ -6,21 +6,30 @@ import (
 	"sync"
 	"time"
 
+	"github.com/mredolatti/tf/codigo/common/tracing"
 	"github.com/mredolatti/tf/codigo/indexsrv/fslinks"
 	"github.com/mredolatti/tf/codigo/indexsrv/models"
 	"github.com/mredolatti/tf/codigo/indexsrv/repository"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	defaultUpdateTolerance = 1 * time.Hour
 )
 
+var tracer = otel.Tracer("github.com/mredolatti/tf/codigo/indexsrv/mapper")
+
 // Config parameters to configure the mapper
 type Config struct {
 	LastUpdateTolerance time.Duration
 	Users               repository.UserRepository
 	Repo                repository.MappingRepository
 	Accounts            repository.UserAccountRepository
+	Servers             repository.FileServerRepository
 	ServerLinks         fslinks.Interface
 }
 
@@ -37,6 +46,7 @@ type Impl struct {
 	mappings    repository.MappingRepository
 	accounts    repository.UserAccountRepository
 	users       repository.UserRepository
+	servers     repository.FileServerRepository
 	serverLinks fslinks.Interface
 }
 
@@ -47,17 +57,20 @@ func New(config Config) *Impl {
 		accounts:    config.Accounts,
 		serverLinks: config.ServerLinks,
 		users:       config.Users,
+		servers:     config.Servers,
 	}
 }
 
 // Get fetches mappings for a specific user based on a query
-func (i *Impl) Get(ctx context.Context, userID string, forceUpdate bool, query *models.MappingQuery) ([]models.Mapping, error) {
+func (i *Impl) Get(ctx context.Context, userID string, forceUpdate bool, query *models.MappingQuery) (mappings []models.Mapping, err error) {
+	ctx, span := tracer.Start(ctx, "mapper.Get", trace.WithAttributes(attribute.Bool("force_update", forceUpdate)))
+	defer func() { tracing.End(span, err) }()
 
 	if query == nil {
 		query = &models.MappingQuery{}
 	}
 
-	err := i.ensureUpdated(ctx, userID, forceUpdate)
+	err = i.ensureUpdated(ctx, userID, forceUpdate)
 	if err != nil {
 		return nil, err // do not wrap to preserve underlying error type
 	}
@@ -76,8 +89,9 @@ func (i *Impl) ResetPathByID(ctx context.Context, userID, id string) error {
     return i.mappings.RemovePathByID(ctx, userID, id)
 }
 
-func (i *Impl) ensureUpdated(ctx context.Context, userID string, force bool) error {
-
+func (i *Impl) ensureUpdated(ctx context.Context, userID string, force bool) (err error) {
+	ctx, span := tracer.Start(ctx, "mapper.ensureUpdated")
+	defer func() { tracing.End(span, err) }()
 
 	user, err := i.users.Get(ctx, userID)
 	if err != nil {
@@ -90,25 +104,27 @@ func (i *Impl) ensureUpdated(ctx context.Context, userID string, force bool) err
 		return fmt.Errorf("failed to fetch user accounts for userID=%s: %w", userID, err)
 	}
 
+	paused, err := i.pausedServers(ctx)
+	if err != nil {
+		return err
+	}
+
 	thresholdNS := time.Now().Add(-defaultUpdateTolerance).UnixNano()
 
 	var wg sync.WaitGroup
     multiErr := newMultiSyncErr()
 	for _, account := range forUser {
+		if _, isPaused := paused[serverKey(account.OrganizationName(), account.FileServerName())]; isPaused {
+			continue // servers under maintenance are synced once resumed
+		}
+
 		if account.Checkpoint() < thresholdNS || force {
 			wg.Add(1)
 			go func(acc models.UserAccount) {
 				defer wg.Done()
-				updates, err := i.serverLinks.FetchUpdates(ctx, acc.OrganizationName(), acc.FileServerName(), user, acc.Checkpoint())
-				if err != nil {
-                    multiErr.Add(acc.OrganizationName(), acc.FileServerName(), err)
-                    return
-				}
-
-				err = i.handleUpdates(ctx, acc, updates)
-				if err != nil {
+				if err := i.syncAccount(ctx, user, acc); err != nil {
+					syncFailures.WithLabelValues(acc.OrganizationName(), acc.FileServerName()).Inc()
                     multiErr.Add(acc.OrganizationName(), acc.FileServerName(), err)
-                    return
 				}
 			}(account)
 		}
@@ -122,6 +138,44 @@ func (i *Impl) ensureUpdated(ctx context.Context, userID string, force bool) err
 	return nil
 }
 
+// syncAccount fetches the updates available in a file server since the account's last checkpoint and applies them
+func (i *Impl) syncAccount(ctx context.Context, user models.User, acc models.UserAccount) error {
+	ctx, span := tracer.Start(ctx, "mapper.syncAccount", trace.WithAttributes(
+		attribute.String("org", acc.OrganizationName()),
+		attribute.String("server", acc.FileServerName()),
+		attribute.Int64("checkpoint", acc.Checkpoint()),
+	))
+	timer := prometheus.NewTimer(syncDuration.WithLabelValues(acc.OrganizationName(), acc.FileServerName()))
+	defer timer.ObserveDuration()
+
+	updates, err := i.serverLinks.FetchUpdates(ctx, acc.OrganizationName(), acc.FileServerName(), user, acc.Checkpoint())
+	if err != nil {
+		return tracing.End(span, err)
+	}
+	span.SetAttributes(attribute.Int("updates", len(updates)))
+
+	return tracing.End(span, i.handleUpdates(ctx, acc, updates))
+}
+
+// pausedServers returns the set of servers currently under maintenance
+func (i *Impl) pausedServers(ctx context.Context) (map[string]struct{}, error) {
+	status := models.FileServerStatusPaused
+	servers, err := i.servers.List(ctx, models.FileServersQuery{Status: &status})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch paused servers: %w", err)
+	}
+
+	paused := make(map[string]struct{}, len(servers))
+	for _, server := range servers {
+		paused[serverKey(server.OrganizationName(), server.Name())] = struct{}{}
+	}
+	return paused, nil
+}
+
+func serverKey(orgName string, serverName string) string {
+	return orgName + "::" + serverName
+}
+
 func (i *Impl) handleUpdates(ctx context.Context, account models.UserAccount, updates []models.Update) error {
 
 	if len(updates) == 0 {
@@ -0,0 +1,21 @@
+package mapper
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	syncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "indexsrv",
+		Name:      "sync_duration_seconds",
+		Help:      "Time taken to fetch & apply file updates from a file server for a user",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"org", "server"})
+
+	syncFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "indexsrv",
+		Name:      "sync_failures_total",
+		Help:      "Number of failed attempts to sync a user's files with a file server",
+	}, []string{"org", "server"})
+)
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// FileServerStatus is the enumeration type used for the administrative status of a file server
+type FileServerStatus int
+
+// FileServerStatus constants
+const (
+	FileServerStatusReady  FileServerStatus = 0
+	FileServerStatusPaused FileServerStatus = 1 // under maintenance. users are not synced against it
+)
+
+// Heartbeat contains the information reported by a file server the last time it checked in
+type Heartbeat struct {
+	Version    string        `json:"version"`
+	Uptime     time.Duration `json:"uptime"`
+	Interval   time.Duration `json:"interval"`
+	Healthy    bool          `json:"healthy"`
+	Message    string        `json:"message,omitempty"`
+	Goroutines int           `json:"goroutines"`
+	HeapBytes  uint64        `json:"heapBytes"`
+}
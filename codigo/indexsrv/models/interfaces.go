@@ -28,6 +28,9 @@ type FileServer interface {
 	FetchURL() string
 	TokenURL() string
 	ControlEndpoint() string
+	Status() FileServerStatus
+	LastSeen() time.Time
+	LastHeartbeat() *Heartbeat
 }
 
 // Patient defines the patient model
@@ -64,11 +67,13 @@ type PendingOAuth2 interface {
 	UserID() string
 	OrganizationName() string
 	ServerName() string
+	CodeVerifier() string
 }
 
 type FileServersQuery struct {
 	Names            []string
 	OrganizationName *string
+	Status           *FileServerStatus
 }
 
 // MappingQuery has optional fields that can be set to narrow the search for mapping
@@ -0,0 +1,25 @@
+package registrar
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+const codeVerifierBytes = 32 // 43 characters once encoded, the minimum allowed by RFC 7636
+
+// newCodeVerifier generates a random PKCE code verifier
+func newCodeVerifier() (string, error) {
+	raw := make([]byte, codeVerifierBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("error reading random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// codeChallenge derives the S256 challenge sent in the authorization request from a code verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
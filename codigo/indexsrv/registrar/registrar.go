@@ -3,19 +3,27 @@ package registrar
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/mredolatti/tf/codigo/common/certmanager"
+	"github.com/mredolatti/tf/codigo/common/tracing"
 	"github.com/mredolatti/tf/codigo/indexsrv/models"
 	"github.com/mredolatti/tf/codigo/indexsrv/repository"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -23,17 +31,35 @@ const (
 	clientSecret = "1234567890"
 
 	tokenValidityMaxTolerance = 5 * time.Minute
+
+	syncScope = "sync" // only allows streaming file-reference updates, not reading or modifying files
 )
 
+var tracer = otel.Tracer("github.com/mredolatti/tf/codigo/indexsrv/registrar")
+
 // Public errors
 var (
-	ErrOrgNotFound             = errors.New("organization not found")
-	ErrServerAlreadyRegistered = errors.New("server already registered")
+	ErrOrgNotFound    = errors.New("organization not found")
+	ErrServerNotFound = errors.New("server not found")
+	ErrServerPaused   = errors.New("server is paused for maintenance")
 
 	ErrAccountExists = errors.New("account already exists")
 	ErrInvalidClaims = errors.New("unknown claims in jwt")
 
 	ErrNeedReLink = errors.New("accounts needs to be re-linked")
+
+	ErrAccountNotFound  = errors.New("account not found")
+	ErrRevocationFailed = errors.New("file server rejected token revocation")
+)
+
+// RegistrationOutcome describes what happened when a server (re-)registered itself
+type RegistrationOutcome int
+
+// Possible registration outcomes
+const (
+	OutcomeRegistered RegistrationOutcome = iota // first time this server registers
+	OutcomeUnchanged                             // already registered with the same endpoints
+	OutcomeUpdated                               // already registered, endpoints have been replaced with the new ones
 )
 
 // Interface defines the set of methods for managing user <-> server links
@@ -43,10 +69,12 @@ type Interface interface {
 	GetOrganization(ctx context.Context, name string) (models.Organization, error)
 	ListServers(ctx context.Context, query models.FileServersQuery) ([]models.FileServer, error)
 	GetServer(ctx context.Context, orgName string, name string) (models.FileServer, error)
-	RegisterServer(ctx context.Context, orgId string, name string, authURL string, tokenURL string, fetchURL string, controlEndpoint string) error
+	RegisterServer(ctx context.Context, orgName string, name string, authURL string, tokenURL string, fetchURL string, controlEndpoint string) (RegistrationOutcome, error)
+	SetServerStatus(ctx context.Context, orgName string, name string, status models.FileServerStatus) error
 
 	InitiateLinkProcess(ctx context.Context, userID string, orgName string, serverName string, force bool) (string, error)
 	CompleteLinkProcess(ctx context.Context, state string, code string) error
+	UnlinkAccount(ctx context.Context, userID string, orgName string, serverName string) error
 	GetValidToken(ctx context.Context, userID string, orgName string, serverName string) (*Token, error)
 }
 
@@ -58,25 +86,29 @@ type Impl struct {
 	organizations repository.OrganizationRepository
 	userAccounts  repository.UserAccountRepository
 	oauth2Flows   repository.PendingOAuth2Repository
+	certificates  certmanager.Interface
 	httpClient    http.Client
+	refreshes     singleflight.Group // one in-flight refresh per account, refresh tokens are single-use
 }
 
 type Config struct {
-	FileServers        repository.FileServerRepository
-	UserAccounts       repository.UserAccountRepository
-	Organizations      repository.OrganizationRepository
-	Pauth2Flows        repository.PendingOAuth2Repository
-	BaseURL            string
-	RootCAFN           string
-	ServerCertFN       string
-	ServerPrivateKeyFN string
+	FileServers   repository.FileServerRepository
+	UserAccounts  repository.UserAccountRepository
+	Organizations repository.OrganizationRepository
+	Pauth2Flows   repository.PendingOAuth2Repository
+	BaseURL       string
+	Certificates  certmanager.Interface
 }
 
 // New constructs a new registrar
 func New(cfg *Config) *Impl {
 
 	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.TLSClientConfig = setupTLSConfig(cfg.RootCAFN, cfg.ServerCertFN, cfg.ServerPrivateKeyFN)
+	transport.TLSClientConfig = cfg.Certificates.ClientConfig(&tls.Config{})
+
+	// tokens are bound to the certificate presented when requesting them, so refreshes after a rotation must not
+	// reuse connections established with the previous one
+	cfg.Certificates.AddListener(transport.CloseIdleConnections)
     url, _ := url.JoinPath(cfg.BaseURL, "user_accounts/callback")
 	return &Impl{
 		randGen:       newRandGenerator(),
@@ -84,7 +116,8 @@ func New(cfg *Config) *Impl {
 		userAccounts:  cfg.UserAccounts,
 		organizations: cfg.Organizations,
 		oauth2Flows:   cfg.Pauth2Flows,
-		httpClient:    http.Client{Transport: transport},
+		certificates:  cfg.Certificates,
+		httpClient:    http.Client{Transport: otelhttp.NewTransport(transport)}, // propagates the trace context to file servers
 		redirectURL:   url,
 	}
 }
@@ -134,7 +167,8 @@ func (i *Impl) GetServer(ctx context.Context, orgName string, name string) (mode
 	return server, nil
 }
 
-// RegisterServer implements Interface
+// RegisterServer implements Interface. Registering an already known server is not an error: if any of the
+// endpoints changed, they're updated so that the server can move without manual intervention
 func (i *Impl) RegisterServer(
 	ctx context.Context,
 	orgName string,
@@ -143,28 +177,62 @@ func (i *Impl) RegisterServer(
 	tokenURL string,
 	fetchURL string,
 	controlEndpoint string,
-) error {
+) (outcome RegistrationOutcome, err error) {
+	ctx, span := tracer.Start(ctx, "registrar.RegisterServer", serverAttributes(orgName, serverName))
+	defer func() { tracing.End(span, err) }()
 
 	org, err := i.organizations.GetByName(ctx, orgName)
 	if err != nil {
 		if errors.Is(err, repository.ErrNotFound) {
-			return ErrOrgNotFound
+			return 0, ErrOrgNotFound
 		}
-		return fmt.Errorf("error fetching organization '%s': %w", orgName, err)
+		return 0, fmt.Errorf("error fetching organization '%s': %w", orgName, err)
+	}
+
+	_, err = i.fileServers.Add(ctx, serverName, org.Name(), authURL, tokenURL, fetchURL, controlEndpoint)
+	if err == nil {
+		return OutcomeRegistered, nil
+	}
+
+	if !errors.Is(err, repository.ErrAlreadyExists) {
+		return 0, fmt.Errorf("error storing server info in db: %w", err)
+	}
+
+	existing, err := i.fileServers.Get(ctx, org.Name(), serverName)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching already registered server from db: %w", err)
+	}
+
+	if existing.AuthURL() == authURL &&
+		existing.TokenURL() == tokenURL &&
+		existing.FetchURL() == fetchURL &&
+		existing.ControlEndpoint() == controlEndpoint {
+		return OutcomeUnchanged, nil
 	}
 
-	if _, err := i.fileServers.Add(ctx, serverName, org.Name(), authURL, tokenURL, fetchURL, controlEndpoint); err != nil {
-		if errors.Is(err, repository.ErrAlreadyExists) {
-			return ErrServerAlreadyRegistered
+	if err := i.fileServers.Update(ctx, org.Name(), serverName, authURL, tokenURL, fetchURL, controlEndpoint); err != nil {
+		return 0, fmt.Errorf("error updating server endpoints in db: %w", err)
+	}
+	return OutcomeUpdated, nil
+}
+
+// SetServerStatus pauses or resumes a file server
+func (i *Impl) SetServerStatus(ctx context.Context, orgName string, name string, status models.FileServerStatus) error {
+	if err := i.fileServers.UpdateStatus(ctx, orgName, name, status); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return ErrServerNotFound
 		}
-		return fmt.Errorf("error storing server info in db: %w", err)
+		return fmt.Errorf("error updating server status in db: %w", err)
 	}
 	return nil
 }
 
 // InitiateLinkProcess sets up the initial parameters to authenticate againsta a file-server,
 // and returns a URL to redirect the user to
-func (i *Impl) InitiateLinkProcess(ctx context.Context, userID string, orgName string, serverName string, force bool) (string, error) {
+func (i *Impl) InitiateLinkProcess(ctx context.Context, userID string, orgName string, serverName string, force bool) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "registrar.InitiateLinkProcess", serverAttributes(orgName, serverName))
+	defer func() { tracing.End(span, err) }()
+
 	if acc, _ := i.userAccounts.Get(ctx, userID, orgName, serverName); !force && acc != nil {
 		return "", ErrAccountExists
 	}
@@ -174,13 +242,22 @@ func (i *Impl) InitiateLinkProcess(ctx context.Context, userID string, orgName s
 		return "", fmt.Errorf("error fetching server from repository: %w", err)
 	}
 
+	if server.Status() == models.FileServerStatusPaused {
+		return "", ErrServerPaused
+	}
+
+	verifier, err := newCodeVerifier()
+	if err != nil {
+		return "", fmt.Errorf("error generating pkce code verifier: %w", err)
+	}
+
 	state := i.randGen.RandStringRunes(50)
-	redirectURL, err := buildRedirectURL(server, clientID, state)
+	redirectURL, err := buildRedirectURL(server, clientID, state, codeChallenge(verifier))
 	if err != nil {
 		return "", fmt.Errorf("error building redirect URL: %w", err)
 	}
 
-	if _, err := i.oauth2Flows.Put(ctx, userID, orgName, serverName, state); err != nil {
+	if _, err := i.oauth2Flows.Put(ctx, userID, orgName, serverName, state, verifier); err != nil {
 		return "", fmt.Errorf("error persisting oauth2 flow init parameters: %w", err)
 
 	}
@@ -188,14 +265,16 @@ func (i *Impl) InitiateLinkProcess(ctx context.Context, userID string, orgName s
 }
 
 // CompleteLinkProcess effectively sets up a user account after the reception of an auth code
-func (i *Impl) CompleteLinkProcess(ctx context.Context, state string, code string) error {
+func (i *Impl) CompleteLinkProcess(ctx context.Context, state string, code string) (err error) {
+	ctx, span := tracer.Start(ctx, "registrar.CompleteLinkProcess")
+	defer func() { tracing.End(span, err) }()
 
 	flow, err := i.oauth2Flows.Pop(ctx, state)
 	if err != nil {
 		return fmt.Errorf("error fetching pending flow from repository: %w", err)
 	}
 
-	tokenResp, err := i.exchangeCode(ctx, flow.OrganizationName(), flow.ServerName(), code)
+	tokenResp, err := i.exchangeCode(ctx, flow.OrganizationName(), flow.ServerName(), code, flow.CodeVerifier())
 	if err != nil {
 		return fmt.Errorf("error exchanging code for token: %w", err)
 	}
@@ -207,25 +286,25 @@ func (i *Impl) CompleteLinkProcess(ctx context.Context, state string, code strin
 	return nil
 }
 
-func (i *Impl) exchangeCode(ctx context.Context, orgName string, serverName string, code string) (*tokenResponse, error) {
+func (i *Impl) exchangeCode(ctx context.Context, orgName string, serverName string, code string, codeVerifier string) (*tokenResponse, error) {
 
 	server, err := i.fileServers.Get(ctx, orgName, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching server from repository: %w", err)
 	}
 
-	req, err := http.NewRequest("GET", server.TokenURL(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", server.TokenURL(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request for code exchange: %w", err)
 	}
 
-	// ?grant_type=authorization_code&client_id=${cid}&client_secret=${secret}&scope=read&code=${code//[$'\t\r\n ']}&redirect_uri=${redirect}"
+	// ?grant_type=authorization_code&client_id=${cid}&client_secret=${secret}&code=${code//[$'\t\r\n ']}&redirect_uri=${redirect}"
 	qps := req.URL.Query()
 	qps.Add("grant_type", "authorization_code")
 	qps.Add("client_id", clientID)
 	qps.Add("client_secret", clientSecret)
-	qps.Add("scope", "read")
 	qps.Add("code", code)
+	qps.Add("code_verifier", codeVerifier)
 	qps.Add("redirect_uri", "http://index-server:9876/user_accounts/callback")
 	req.URL.RawQuery = qps.Encode()
 
@@ -249,23 +328,78 @@ func (i *Impl) exchangeCode(ctx context.Context, orgName string, serverName stri
 
 }
 
+// UnlinkAccount revokes the tokens issued by the file server for this account and removes it
+func (i *Impl) UnlinkAccount(ctx context.Context, userID string, orgName string, serverName string) (err error) {
+	ctx, span := tracer.Start(ctx, "registrar.UnlinkAccount", serverAttributes(orgName, serverName))
+	defer func() { tracing.End(span, err) }()
+
+	acc, err := i.userAccounts.Get(ctx, userID, orgName, serverName)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return ErrAccountNotFound
+		}
+		return fmt.Errorf("error getting account from repository: %w", err)
+	}
+
+	server, err := i.fileServers.Get(ctx, orgName, serverName)
+	if err != nil {
+		return fmt.Errorf("error fetching server from repository: %w", err)
+	}
+
+	// revoking the refresh token also revokes the access token issued along with it
+	if err := i.revokeToken(ctx, server.TokenURL(), acc.RefreshToken(), "refresh_token"); err != nil {
+		return fmt.Errorf("error revoking tokens: %w", err)
+	}
+
+	if err := i.userAccounts.Remove(ctx, userID, orgName, serverName); err != nil {
+		return fmt.Errorf("error removing account from repository: %w", err)
+	}
+
+	return nil
+}
+
 // GetValidToken returns the current token if still valid or a refreshed one otherwise
-func (i *Impl) GetValidToken(ctx context.Context, userID string, orgName string, serverName string) (*Token, error) {
+func (i *Impl) GetValidToken(ctx context.Context, userID string, orgName string, serverName string) (_ *Token, err error) {
+	ctx, span := tracer.Start(ctx, "registrar.GetValidToken", serverAttributes(orgName, serverName))
+	defer func() { tracing.End(span, err) }()
+
 	acc, err := i.userAccounts.Get(ctx, userID, orgName, serverName)
 	if err != nil {
 		return nil, fmt.Errorf("error getting account from repository: %w", err)
 	}
 
-	if token := acc.Token(); isTokenStillValid(token) {
+	if token := acc.Token(); isTokenStillValid(token, i.certificates.Thumbprint()) {
 		return &Token{raw: token}, nil
 	}
 
-	newAccessToken, err := i.doRefreshToken(ctx, userID, orgName, serverName, acc.RefreshToken())
+	span.AddEvent("refreshing expired or unbound token")
+
+	// concurrent requests for the same account share a single refresh. Otherwise all but one of them would present
+	// an already rotated refresh token & the file server would reject them
+	key := path.Join(userID, orgName, serverName)
+	newAccessToken, err, _ := i.refreshes.Do(key, func() (interface{}, error) {
+		return i.refreshIfNeeded(ctx, userID, orgName, serverName)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error refreshing token: %w", err)
 	}
 
-	return &Token{raw: newAccessToken}, nil
+	return &Token{raw: newAccessToken.(string)}, nil
+}
+
+// refreshIfNeeded re-reads the account before refreshing, since a refresh that completed right before this one
+// started would have already stored a new token pair
+func (i *Impl) refreshIfNeeded(ctx context.Context, userID string, orgName string, serverName string) (string, error) {
+	acc, err := i.userAccounts.Get(ctx, userID, orgName, serverName)
+	if err != nil {
+		return "", fmt.Errorf("error getting account from repository: %w", err)
+	}
+
+	if token := acc.Token(); isTokenStillValid(token, i.certificates.Thumbprint()) {
+		return token, nil
+	}
+
+	return i.doRefreshToken(ctx, userID, orgName, serverName, acc.RefreshToken())
 }
 
 func (i *Impl) doRefreshToken(ctx context.Context, userID string, orgName string, serverName string, refreshToken string) (string, error) {
@@ -274,7 +408,7 @@ func (i *Impl) doRefreshToken(ctx context.Context, userID string, orgName string
 		return "", fmt.Errorf("error fetching server from repository: %w", err)
 	}
 
-	status, tokenResponse, err := i.makeTokenRefreshRequest(server.TokenURL(), refreshToken)
+	status, tokenResponse, err := i.makeTokenRefreshRequest(ctx, server.TokenURL(), refreshToken)
 	switch status {
 	case 200: // do nothing
 	case 401:
@@ -289,13 +423,13 @@ func (i *Impl) doRefreshToken(ctx context.Context, userID string, orgName string
 	return tokenResponse.AccessToken, nil
 }
 
-func (i *Impl) makeTokenRefreshRequest(tokenURL string, refreshToken string) (int, *tokenResponse, error) {
+func (i *Impl) makeTokenRefreshRequest(ctx context.Context, tokenURL string, refreshToken string) (int, *tokenResponse, error) {
 	bodyForm := url.Values{}
 	bodyForm.Add("grant_type", "refresh_token")
 	bodyForm.Add("client_id", clientID)
 	bodyForm.Add("client_secret", clientSecret)
 	bodyForm.Add("refresh_token", refreshToken)
-	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(bodyForm.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(bodyForm.Encode()))
 	if err != nil {
 		return 0, nil, fmt.Errorf("error creating request for token refresh: %w", err)
 	}
@@ -322,22 +456,74 @@ func (i *Impl) makeTokenRefreshRequest(tokenURL string, refreshToken string) (in
 	return resp.StatusCode, &tokenResponse, nil
 }
 
-func isTokenStillValid(token string) bool {
+func (i *Impl) revokeToken(ctx context.Context, tokenURL string, token string, hint string) error {
+	revocationURL, err := buildRevocationURL(tokenURL)
+	if err != nil {
+		return fmt.Errorf("error building revocation url: %w", err)
+	}
+
+	bodyForm := url.Values{}
+	bodyForm.Add("client_id", clientID)
+	bodyForm.Add("client_secret", clientSecret)
+	bodyForm.Add("token", token)
+	bodyForm.Add("token_type_hint", hint)
+	req, err := http.NewRequestWithContext(ctx, "POST", revocationURL, strings.NewReader(bodyForm.Encode()))
+	if err != nil {
+		return fmt.Errorf("error creating request for token revocation: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making token revocation request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%w: status code %d", ErrRevocationFailed, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// buildRevocationURL derives the file server's revocation endpoint, which is mounted next to the token one
+func buildRevocationURL(tokenURL string) (string, error) {
+	parsed, err := url.Parse(tokenURL)
+	if err != nil {
+		return "", fmt.Errorf("error parsing URL '%s': %w", tokenURL, err)
+	}
+
+	parsed.Path = path.Join(path.Dir(parsed.Path), "revoke")
+	parsed.RawQuery = ""
+	return parsed.String(), nil
+}
+
+func serverAttributes(orgName string, serverName string) trace.SpanStartEventOption {
+	return trace.WithAttributes(attribute.String("org", orgName), attribute.String("server", serverName))
+}
+
+// isTokenStillValid returns whether a token hasn't expired and, if bound to a certificate, whether that's still
+// the one this server presents. Tokens bound to a rotated certificate are rejected by file servers
+func isTokenStillValid(token string, thumbprint string) bool {
 	var parser jwt.Parser
-	parsed, _, err := parser.ParseUnverified(token, &jwt.StandardClaims{})
+	parsed, _, err := parser.ParseUnverified(token, &boundClaims{})
 	if err != nil {
 		return false
 	}
 
-	claims, ok := parsed.Claims.(*jwt.StandardClaims)
+	claims, ok := parsed.Claims.(*boundClaims)
 	if !ok {
 		return false
 	}
 
+	if claims.Confirmation != nil && claims.Confirmation.X5tS256 != thumbprint {
+		return false
+	}
+
 	return time.Now().Before(time.Unix(claims.ExpiresAt, 0))
 }
 
-func buildRedirectURL(server models.FileServer, clientID string, state string) (*url.URL, error) {
+func buildRedirectURL(server models.FileServer, clientID string, state string, challenge string) (*url.URL, error) {
 	redirectURL, err := url.Parse(server.AuthURL())
 	if err != nil {
 		return nil, fmt.Errorf("error parsing URL '%s': %w", server.AuthURL(), err)
@@ -347,6 +533,9 @@ func buildRedirectURL(server models.FileServer, clientID string, state string) (
 	queryString.Add("client_id", clientID)
 	queryString.Add("state", state)
 	queryString.Add("response_type", "code")
+	queryString.Add("scope", syncScope)
+	queryString.Add("code_challenge", challenge)
+	queryString.Add("code_challenge_method", "S256")
 	redirectURL.RawQuery = queryString.Encode()
 
 	return redirectURL, nil
@@ -359,24 +548,4 @@ type tokenResponse struct {
 	TokenType    string `json:"token_type"`
 }
 
-func setupTLSConfig(rootCAFN string, serverCertFN string, serverPrivateKeyFN string) *tls.Config {
-	certBytes, err := ioutil.ReadFile(rootCAFN)
-	if err != nil {
-		panic("cannot read root certificate file: " + err.Error())
-	}
-	caPool := x509.NewCertPool()
-	caPool.AppendCertsFromPEM(certBytes)
-
-	certs, err := tls.LoadX509KeyPair(serverCertFN, serverPrivateKeyFN)
-	if err != nil {
-		panic("cannot read server certficate chain / private key files: " + err.Error())
-	}
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{certs},
-		RootCAs:      caPool,
-		ClientAuth:   tls.RequestClientCert,
-	}
-}
-
 var _ Interface = (*Impl)(nil)
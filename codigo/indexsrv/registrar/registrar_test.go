@@ -0,0 +1,218 @@
+package registrar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/mredolatti/tf/codigo/common/certmanager"
+	"github.com/mredolatti/tf/codigo/indexsrv/models"
+	"github.com/mredolatti/tf/codigo/indexsrv/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+type accountMock struct {
+	models.UserAccount
+	token, refresh string
+}
+
+func (a *accountMock) Token() string        { return a.token }
+func (a *accountMock) RefreshToken() string { return a.refresh }
+
+type accountRepoMock struct {
+	repository.UserAccountRepository
+	mtx     sync.Mutex
+	account accountMock
+}
+
+func (r *accountRepoMock) Get(ctx context.Context, userID string, orgName string, serverName string) (models.UserAccount, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	acc := r.account
+	return &acc, nil
+}
+
+func (r *accountRepoMock) UpdateTokens(ctx context.Context, userID, orgName, serverName, accessToken, refreshToken string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.account.token, r.account.refresh = accessToken, refreshToken
+	return nil
+}
+
+type fileServerMock struct {
+	models.FileServer
+	orgName, authURL, tokenURL, fetchURL, controlEndpoint string
+}
+
+func (s *fileServerMock) OrganizationName() string { return s.orgName }
+func (s *fileServerMock) AuthURL() string          { return s.authURL }
+func (s *fileServerMock) TokenURL() string         { return s.tokenURL }
+func (s *fileServerMock) FetchURL() string         { return s.fetchURL }
+func (s *fileServerMock) ControlEndpoint() string  { return s.controlEndpoint }
+
+type fileServerRepoMock struct {
+	repository.FileServerRepository
+	server *fileServerMock
+}
+
+func (r *fileServerRepoMock) Get(ctx context.Context, orgName string, name string) (models.FileServer, error) {
+	return r.server, nil
+}
+
+// serverRegistryMock stores servers by organization name, like the postgres repository does
+type serverRegistryMock struct {
+	repository.FileServerRepository
+	servers map[string]*fileServerMock
+}
+
+func (r *serverRegistryMock) Get(ctx context.Context, orgName string, name string) (models.FileServer, error) {
+	server, ok := r.servers[orgName+"/"+name]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return server, nil
+}
+
+func (r *serverRegistryMock) Add(ctx context.Context, name string, orgName string, authURL string, tokenURL string, fetchURL string, controlEndpoint string) (models.FileServer, error) {
+	if _, ok := r.servers[orgName+"/"+name]; ok {
+		return nil, repository.ErrAlreadyExists
+	}
+	server := &fileServerMock{orgName: orgName, authURL: authURL, tokenURL: tokenURL, fetchURL: fetchURL, controlEndpoint: controlEndpoint}
+	r.servers[orgName+"/"+name] = server
+	return server, nil
+}
+
+func (r *serverRegistryMock) Update(ctx context.Context, orgName string, name string, authURL string, tokenURL string, fetchURL string, controlEndpoint string) error {
+	server, ok := r.servers[orgName+"/"+name]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	server.authURL, server.tokenURL, server.fetchURL, server.controlEndpoint = authURL, tokenURL, fetchURL, controlEndpoint
+	return nil
+}
+
+type orgMock struct {
+	models.Organization
+	id, name string
+}
+
+func (o *orgMock) ID() string   { return o.id }
+func (o *orgMock) Name() string { return o.name }
+
+type orgRepoMock struct {
+	repository.OrganizationRepository
+	orgs []*orgMock
+}
+
+func (r *orgRepoMock) GetByName(ctx context.Context, name string) (models.Organization, error) {
+	for _, org := range r.orgs {
+		if org.name == name {
+			return org, nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+type certificatesMock struct {
+	certmanager.Interface
+}
+
+func (c *certificatesMock) Thumbprint() string { return "current" }
+
+func TestConcurrentRefreshes(t *testing.T) {
+	sign := func(expires time.Time) string {
+		raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{ExpiresAt: expires.Unix()}).SignedString([]byte("secret"))
+		assert.Nil(t, err)
+		return raw
+	}
+
+	// the file server rotates refresh tokens, so presenting one twice is rejected
+	var mtx sync.Mutex
+	var refreshes int32
+	current := "refresh-0"
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&refreshes, 1)
+		time.Sleep(50 * time.Millisecond) // give concurrent callers a chance to pile up
+		mtx.Lock()
+		defer mtx.Unlock()
+		if r.FormValue("refresh_token") != current {
+			w.WriteHeader(401)
+			return
+		}
+		current = fmt.Sprintf("refresh-%d", atomic.LoadInt32(&refreshes))
+		json.NewEncoder(w).Encode(map[string]string{"access_token": sign(time.Now().Add(time.Hour)), "refresh_token": current})
+	}))
+	defer tokenServer.Close()
+
+	accounts := &accountRepoMock{account: accountMock{token: sign(time.Now().Add(-time.Hour)), refresh: current}}
+	registrar := &Impl{
+		userAccounts: accounts,
+		fileServers:  &fileServerRepoMock{server: &fileServerMock{tokenURL: tokenServer.URL}},
+		certificates: &certificatesMock{},
+	}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for idx := range tokens {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			token, err := registrar.GetValidToken(context.Background(), "user1", "org1", "server1")
+			assert.Nil(t, err)
+			if token != nil {
+				tokens[idx] = token.Raw()
+			}
+		}(idx)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshes))
+	for _, token := range tokens {
+		assert.Equal(t, accounts.account.token, token)
+	}
+
+	// once refreshed, the stored token is used as is
+	token, err := registrar.GetValidToken(context.Background(), "user1", "org1", "server1")
+	assert.Nil(t, err)
+	assert.Equal(t, accounts.account.token, token.Raw())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshes))
+}
+
+func TestRegisterServer(t *testing.T) {
+	servers := &serverRegistryMock{servers: map[string]*fileServerMock{}}
+	registrar := &Impl{
+		fileServers:   servers,
+		organizations: &orgRepoMock{orgs: []*orgMock{{id: "1", name: "org1"}}},
+	}
+	ctx := context.Background()
+
+	outcome, err := registrar.RegisterServer(ctx, "org1", "server1", "https://auth", "https://token", "https://fetch", "server1:9000")
+	assert.Nil(t, err)
+	assert.Equal(t, OutcomeRegistered, outcome)
+	server, err := servers.Get(ctx, "org1", "server1")
+	assert.Nil(t, err)
+	assert.Equal(t, "org1", server.OrganizationName())
+
+	outcome, err = registrar.RegisterServer(ctx, "org1", "server1", "https://auth", "https://token", "https://fetch", "server1:9000")
+	assert.Nil(t, err)
+	assert.Equal(t, OutcomeUnchanged, outcome)
+
+	// servers that move get their endpoints replaced
+	outcome, err = registrar.RegisterServer(ctx, "org1", "server1", "https://auth", "https://token", "https://fetch", "server1:9001")
+	assert.Nil(t, err)
+	assert.Equal(t, OutcomeUpdated, outcome)
+	server, err = servers.Get(ctx, "org1", "server1")
+	assert.Nil(t, err)
+	assert.Equal(t, "server1:9001", server.ControlEndpoint())
+
+	_, err = registrar.RegisterServer(ctx, "nope", "server2", "https://auth", "https://token", "https://fetch", "server2:9000")
+	assert.ErrorIs(t, err, ErrOrgNotFound)
+	assert.Len(t, servers.servers, 1)
+}
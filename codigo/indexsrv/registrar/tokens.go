@@ -31,6 +31,14 @@ func (t *Token) ParseClaims() (*TokenClaims, error) {
 	return claims, nil
 }
 
+// boundClaims adds the certificate confirmation claim (RFC 8705) file servers include in access tokens
+type boundClaims struct {
+	jwt.StandardClaims
+	Confirmation *struct {
+		X5tS256 string `json:"x5t#S256"`
+	} `json:"cnf,omitempty"`
+}
+
 // Raw returns the full token string
 func (t *Token) Raw() string {
 	return t.raw
@@ -0,0 +1,33 @@
+package registrar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTokenStillValid(t *testing.T) {
+	sign := func(claims jwt.Claims) string {
+		raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		assert.Nil(t, err)
+		return raw
+	}
+
+	valid := jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	expired := jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Hour).Unix()}
+
+	assert.True(t, isTokenStillValid(sign(valid), "current"))
+	assert.False(t, isTokenStillValid(sign(expired), "current"))
+	assert.False(t, isTokenStillValid("garbage", "current"))
+
+	bound := &boundClaims{StandardClaims: valid}
+	bound.Confirmation = &struct {
+		X5tS256 string `json:"x5t#S256"`
+	}{X5tS256: "current"}
+	assert.True(t, isTokenStillValid(sign(bound), "current"))
+
+	// tokens bound to a certificate that's since been rotated need to be refreshed
+	assert.False(t, isTokenStillValid(sign(bound), "rotated"))
+}
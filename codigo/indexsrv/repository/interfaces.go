@@ -56,6 +56,9 @@ type FileServerRepository interface {
 	GetByID(ctx context.Context, id string) (models.FileServer, error)
 	Get(ctx context.Context, orgName string, name string) (models.FileServer, error)
 	Add(ctx context.Context, name string, organizationName string, authURL string, tokenURL string, fetchURL string, controlEndpoint string) (models.FileServer, error)
+	Update(ctx context.Context, orgName string, name string, authURL string, tokenURL string, fetchURL string, controlEndpoint string) error
+	UpdateStatus(ctx context.Context, orgName string, name string, status models.FileServerStatus) error
+	UpdateHeartbeat(ctx context.Context, orgName string, name string, seen time.Time, heartbeat *models.Heartbeat) error
 	Remove(ctx context.Context, id string) error
 }
 
@@ -71,7 +74,7 @@ type UserAccountRepository interface {
 
 // PendingOAuth2Repository is used to store & retreive in-progress oauth2 flows metadata
 type PendingOAuth2Repository interface {
-	Put(ctx context.Context, userID string, orgName string, serverName, state string) (models.PendingOAuth2, error)
+	Put(ctx context.Context, userID string, orgName string, serverName, state string, codeVerifier string) (models.PendingOAuth2, error)
 	Pop(ctx context.Context, state string) (models.PendingOAuth2, error)
 }
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/mredolatti/tf/codigo/indexsrv/models"
 	"github.com/mredolatti/tf/codigo/indexsrv/repository"
@@ -21,6 +22,9 @@ type FileServer struct {
 	TokenURLField        string             `bson:"tokenUrl"`
 	FetchURLField        string             `bson:"fetchUrl"`
 	ControlEndpointField string             `bson:"controlEndpoint"`
+	StatusField          int                `bson:"status"`
+	LastSeenField        int64              `bson:"lastSeen"`
+	LastHeartbeatField   *models.Heartbeat  `bson:"lastHeartbeat,omitempty"`
 }
 
 // ID returns the id of the fileServer
@@ -58,6 +62,24 @@ func (f *FileServer) ControlEndpoint() string {
 	return f.ControlEndpointField
 }
 
+// Status returns the administrative status of the server
+func (f *FileServer) Status() models.FileServerStatus {
+	return models.FileServerStatus(f.StatusField)
+}
+
+// LastSeen returns the time at which the last heartbeat from the server was received
+func (f *FileServer) LastSeen() time.Time {
+	if f.LastSeenField == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, f.LastSeenField)
+}
+
+// LastHeartbeat returns the contents of the last heartbeat received, or nil if the server never sent one
+func (f *FileServer) LastHeartbeat() *models.Heartbeat {
+	return f.LastHeartbeatField
+}
+
 type FileServerRepository struct {
 	collection *mongo.Collection
 }
@@ -158,6 +180,76 @@ func (r *FileServerRepository) GetByID(ctx context.Context, id string) (models.F
 	return &u, nil
 }
 
+// Update implements repository.FileServerRepository
+func (r *FileServerRepository) Update(
+	ctx context.Context,
+	orgName string,
+	name string,
+	authURL string,
+	tokenURL string,
+	fetchURL string,
+	controlEndpoint string,
+) error {
+	res, err := r.collection.UpdateOne(
+		ctx,
+		bson.D{{Key: "organizationName", Value: orgName}, {Key: "name", Value: name}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "authUrl", Value: authURL},
+			{Key: "tokenUrl", Value: tokenURL},
+			{Key: "fetchUrl", Value: fetchURL},
+			{Key: "controlEndpoint", Value: controlEndpoint},
+		}}},
+	)
+	if err != nil {
+		return fmt.Errorf("error updating fileServer in mongodb: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
+// UpdateStatus implements repository.FileServerRepository
+func (r *FileServerRepository) UpdateStatus(ctx context.Context, orgName string, name string, status models.FileServerStatus) error {
+	res, err := r.collection.UpdateOne(
+		ctx,
+		bson.D{{Key: "organizationName", Value: orgName}, {Key: "name", Value: name}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: int(status)}}}},
+	)
+	if err != nil {
+		return fmt.Errorf("error updating fileServer status in mongodb: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
+// UpdateHeartbeat implements repository.FileServerRepository
+func (r *FileServerRepository) UpdateHeartbeat(ctx context.Context, orgName string, name string, seen time.Time, heartbeat *models.Heartbeat) error {
+	res, err := r.collection.UpdateOne(
+		ctx,
+		bson.D{{Key: "organizationName", Value: orgName}, {Key: "name", Value: name}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "lastSeen", Value: seen.UnixNano()},
+			{Key: "lastHeartbeat", Value: heartbeat},
+		}}},
+	)
+	if err != nil {
+		return fmt.Errorf("error updating fileServer heartbeat in mongodb: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
 // Remove implements repository.FileServerRepository
 func (r *FileServerRepository) Remove(ctx context.Context, fileServerID string) error {
 	oid, err := primitive.ObjectIDFromHex(fileServerID)
@@ -192,6 +284,10 @@ func buildListFilter(query models.FileServersQuery) (bson.D, error) {
 		filter = append(filter, bson.E{Key: "name", Value: bson.E{Key: "$in", Value: query.Names}})
 	}
 
+	if query.Status != nil {
+		filter = append(filter, bson.E{Key: "status", Value: int(*query.Status)})
+	}
+
 	return filter, nil
 }
 
@@ -3,6 +3,7 @@ package mongodb
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/mredolatti/tf/codigo/common/refutil"
 	"github.com/mredolatti/tf/codigo/indexsrv/models"
@@ -54,6 +55,38 @@ func TestFileServersIntegration(t *testing.T) {
 	assert.Contains(t, list2, inserted3)
 	assert.Contains(t, list2, inserted4)
 
+	// Pausing
+	assert.Equal(t, models.FileServerStatusReady, inserted3.Status())
+	err = repo.UpdateStatus(ctx, "org2", "fs3", models.FileServerStatusPaused)
+	assert.Nil(t, err)
+	paused, err := repo.List(ctx, models.FileServersQuery{Status: refutil.Ref(models.FileServerStatusPaused)})
+	assert.Nil(t, err)
+	assert.Len(t, paused, 1)
+	assert.Equal(t, "fs3", paused[0].Name())
+	assert.Equal(t, models.FileServerStatusPaused, paused[0].Status())
+	assert.Equal(t, repository.ErrNotFound, repo.UpdateStatus(ctx, "org2", "nonexistent", models.FileServerStatusPaused))
+
+	// Heartbeats
+	assert.Nil(t, inserted3.LastHeartbeat())
+	seen := time.Now()
+	err = repo.UpdateHeartbeat(ctx, "org2", "fs3", seen, &models.Heartbeat{Version: "v1", Interval: 30 * time.Second, Healthy: true})
+	assert.Nil(t, err)
+	beating, err := repo.Get(ctx, "org2", "fs3")
+	assert.Nil(t, err)
+	assert.Equal(t, seen.UnixNano(), beating.LastSeen().UnixNano())
+	assert.Equal(t, "v1", beating.LastHeartbeat().Version)
+	assert.Equal(t, 30*time.Second, beating.LastHeartbeat().Interval)
+	assert.Equal(t, repository.ErrNotFound, repo.UpdateHeartbeat(ctx, "org2", "nonexistent", seen, &models.Heartbeat{}))
+
+	// Updating endpoints
+	err = repo.Update(ctx, "org2", "fs3", "https://new/auth", "https://new/token", "https://new/fetch", "new:9000")
+	assert.Nil(t, err)
+	updated, err := repo.Get(ctx, "org2", "fs3")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://new/auth", updated.AuthURL())
+	assert.Equal(t, "new:9000", updated.ControlEndpoint())
+	assert.Equal(t, repository.ErrNotFound, repo.Update(ctx, "org2", "nonexistent", "a", "t", "f", "c"))
+
 	// Removing
 	err = repo.Remove(ctx, inserted1.ID())
 	assert.Nil(t, err)
@@ -18,6 +18,7 @@ type PendingOAuth2 struct {
 	OrganizationNameField string             `bson:"organizationName"`
 	ServerNameField       string             `bson:"serverName"`
 	StateField            string             `bson:"state"`
+	CodeVerifierField     string             `bson:"codeVerifier"`
 }
 
 func (p *PendingOAuth2) OrganizationName() string {
@@ -38,6 +39,11 @@ func (p *PendingOAuth2) State() string {
 	return p.StateField
 }
 
+// CodeVerifier returns the PKCE secret whose hash was sent along with the authorization request
+func (p *PendingOAuth2) CodeVerifier() string {
+	return p.CodeVerifierField
+}
+
 // PendingOAuth2Repository is a postgres-based implementation of an in-progress oauth2 flow repository
 type PendingOAuth2Repository struct {
 	collection *mongo.Collection
@@ -49,7 +55,7 @@ func NewPendingOAuth2Repository(db *mongo.Database) *PendingOAuth2Repository {
 }
 
 // Put starts tracking a new flow
-func (r *PendingOAuth2Repository) Put(ctx context.Context, userID string, orgName string, serverName string, state string) (models.PendingOAuth2, error) {
+func (r *PendingOAuth2Repository) Put(ctx context.Context, userID string, orgName string, serverName string, state string, codeVerifier string) (models.PendingOAuth2, error) {
 	uid, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		return nil, fmt.Errorf("error constructing objectID for user with id=%s: %w", userID, err)
@@ -61,6 +67,7 @@ func (r *PendingOAuth2Repository) Put(ctx context.Context, userID string, orgNam
 		ServerNameField:       serverName,
 		UserIDField:           uid,
 		StateField:            state,
+		CodeVerifierField:     codeVerifier,
 	}
 
 	_, err = r.collection.InsertOne(ctx, toInsert)
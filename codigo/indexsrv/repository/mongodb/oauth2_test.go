@@ -22,13 +22,14 @@ func TestPendingOAuthIntegration(t *testing.T) {
 
 	repo := NewPendingOAuth2Repository(db)
 
-	inserted, err := repo.Put(ctx, userID.Hex(), "org1", "fs1", "someState")
+	inserted, err := repo.Put(ctx, userID.Hex(), "org1", "fs1", "someState", "someVerifier")
 	assert.Nil(t, err)
 
 	assert.Equal(t, "org1", inserted.OrganizationName())
 	assert.Equal(t, "fs1", inserted.ServerName())
 	assert.Equal(t, inserted.UserID(), userID.Hex())
 	assert.Equal(t, inserted.State(), "someState")
+	assert.Equal(t, "someVerifier", inserted.CodeVerifier())
 
 	popped, err := repo.Pop(ctx, "someState")
 	assert.Nil(t, err)
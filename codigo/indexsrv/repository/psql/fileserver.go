@@ -3,10 +3,12 @@ package psql
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mredolatti/tf/codigo/indexsrv/models"
 	"github.com/mredolatti/tf/codigo/indexsrv/repository"
@@ -15,14 +17,25 @@ import (
 )
 
 const (
-	fsListBase = "SELECT * FROM file_servers"
-	fsListOrgFilter = "org_id = $<IDX>"
-	fsListIDFilter = "id in ($<IDX>)"
-	fsGetByIDQuery  = "SELECT * FROM file_servers WHERE id = $1"
-	fsGetQuery  = "SELECT * FROM file_servers WHERE org_name = $1 AND name = $2"
-	fsAddQuery  = "INSERT INTO file_servers(name, org_id, auth_url, token_url, fetch_url, control_endpoint) " +
-		"VALUES ($1, $2, $3, $4, $5, $6) RETURNING *"
+	fsColumns = "SELECT fs.id, fs.name, o.name AS org_name, fs.auth_url, fs.token_url, fs.fetch_url, fs.control_endpoint, fs.status, " +
+		"fs.last_seen, fs.last_heartbeat "
+	fsSelectBase = fsColumns + "FROM file_servers fs JOIN organizations o ON o.id = fs.org_id"
+	fsListBase = fsSelectBase
+	fsListOrgFilter = "o.name = $<IDX>"
+	fsListNameFilter = "fs.name = ANY($<IDX>)"
+	fsGetByIDQuery  = fsSelectBase + " WHERE fs.id = $1"
+	fsGetQuery  = fsSelectBase + " WHERE o.name = $1 AND fs.name = $2"
+	fsAddQuery  = "WITH fs AS (INSERT INTO file_servers(name, org_id, auth_url, token_url, fetch_url, control_endpoint) " +
+		"SELECT $1, id, $3, $4, $5, $6 FROM organizations WHERE name = $2 RETURNING *) " +
+		fsColumns + "FROM fs JOIN organizations o ON o.id = fs.org_id"
 	fsDelQuery = "DELETE FROM file_servers WHERE id = $1"
+	fsListStatusFilter = "fs.status = $<IDX>"
+	fsUpdateQuery = "UPDATE file_servers SET auth_url = $1, token_url = $2, fetch_url = $3, control_endpoint = $4 " +
+		"WHERE org_id = (SELECT id FROM organizations WHERE name = $5) AND name = $6"
+	fsUpdateStatusQuery = "UPDATE file_servers SET status = $1 " +
+		"WHERE org_id = (SELECT id FROM organizations WHERE name = $2) AND name = $3"
+	fsUpdateHeartbeatQuery = "UPDATE file_servers SET last_seen = $1, last_heartbeat = $2 " +
+		"WHERE org_id = (SELECT id FROM organizations WHERE name = $3) AND name = $4"
 )
 
 // FileServer is a postgres-compatible struct implementing models.FileServer interface
@@ -34,6 +47,9 @@ type FileServer struct {
 	TokenURLField        string `db:"token_url"`
 	FetchURLField        string `db:"fetch_url"`
 	ControlEndpointField string `db:"control_endpoint"`
+	StatusField          int    `db:"status"`
+	LastSeenField        int64  `db:"last_seen"`
+	LastHeartbeatField   []byte `db:"last_heartbeat"`
 }
 
 // ID returns the id of the file server
@@ -71,6 +87,32 @@ func (f *FileServer) ControlEndpoint() string {
 	return f.ControlEndpointField
 }
 
+// Status returns the administrative status of the server
+func (f *FileServer) Status() models.FileServerStatus {
+	return models.FileServerStatus(f.StatusField)
+}
+
+// LastSeen returns the time at which the last heartbeat from the server was received
+func (f *FileServer) LastSeen() time.Time {
+	if f.LastSeenField == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, f.LastSeenField)
+}
+
+// LastHeartbeat returns the contents of the last heartbeat received, or nil if the server never sent one
+func (f *FileServer) LastHeartbeat() *models.Heartbeat {
+	if len(f.LastHeartbeatField) == 0 {
+		return nil
+	}
+
+	var heartbeat models.Heartbeat
+	if err := json.Unmarshal(f.LastHeartbeatField, &heartbeat); err != nil {
+		return nil
+	}
+	return &heartbeat
+}
+
 // FileServerRepository is a mapping to a table in postgres that allows enables operations
 // on file server
 type FileServerRepository struct {
@@ -133,20 +175,81 @@ func (r *FileServerRepository) GetByID(ctx context.Context, id string) (models.F
 func (r *FileServerRepository) Add(
 	ctx context.Context,
 	name string,
-	orgID string,
+	orgName string,
 	authURL string,
 	tokenURL string,
 	fetchURL string,
 	controlEndpoint string,
 ) (models.FileServer, error) {
 	var server FileServer
-	err := r.db.QueryRowxContext(ctx, fsAddQuery, name, orgID, authURL, tokenURL, fetchURL, controlEndpoint).StructScan(&server)
+	err := r.db.QueryRowxContext(ctx, fsAddQuery, name, orgName, authURL, tokenURL, fetchURL, controlEndpoint).StructScan(&server)
 	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, repository.ErrAlreadyExists
+		}
+		if errors.Is(err, sql.ErrNoRows) { // nothing is inserted if the organization doesn't exist
+			return nil, repository.ErrNotFound
+		}
 		return nil, fmt.Errorf("error executing file_server::add in postgres: %w", err)
 	}
 	return &server, nil
 }
 
+// Update replaces the urls & control endpoint of a file server
+func (r *FileServerRepository) Update(
+	ctx context.Context,
+	orgName string,
+	name string,
+	authURL string,
+	tokenURL string,
+	fetchURL string,
+	controlEndpoint string,
+) error {
+	res, err := r.db.ExecContext(ctx, fsUpdateQuery, authURL, tokenURL, fetchURL, controlEndpoint, orgName, name)
+	if err != nil {
+		return fmt.Errorf("error executing file_server::update in postgres: %w", err)
+	}
+
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
+// UpdateStatus sets the administrative status of a file server
+func (r *FileServerRepository) UpdateStatus(ctx context.Context, orgName string, name string, status models.FileServerStatus) error {
+	res, err := r.db.ExecContext(ctx, fsUpdateStatusQuery, int(status), orgName, name)
+	if err != nil {
+		return fmt.Errorf("error executing file_server::update_status in postgres: %w", err)
+	}
+
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
+// UpdateHeartbeat stores the last heartbeat received from a file server & when it arrived
+func (r *FileServerRepository) UpdateHeartbeat(ctx context.Context, orgName string, name string, seen time.Time, heartbeat *models.Heartbeat) error {
+	serialized, err := json.Marshal(heartbeat)
+	if err != nil {
+		return fmt.Errorf("error serializing heartbeat: %w", err)
+	}
+
+	res, err := r.db.ExecContext(ctx, fsUpdateHeartbeatQuery, seen.UnixNano(), serialized, orgName, name)
+	if err != nil {
+		return fmt.Errorf("error executing file_server::update_heartbeat in postgres: %w", err)
+	}
+
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
 // Remove deletes a file server that matches the supplied id
 func (r *FileServerRepository) Remove(ctx context.Context, id string) error {
 	_, err := r.db.ExecContext(ctx, fsDelQuery, id)
@@ -161,7 +264,7 @@ func buildListQuery(query models.FileServersQuery) (preparedStmt string, values
 	paramIdx := 1
 	var queryParts []string
 	if query.Names != nil {
-		queryParts = append(queryParts, strings.ReplaceAll(fsListIDFilter, "<IDX>", strconv.Itoa(paramIdx)))
+		queryParts = append(queryParts, strings.ReplaceAll(fsListNameFilter, "<IDX>", strconv.Itoa(paramIdx)))
 		values = append(values, query.Names)
 		paramIdx++
 	}
@@ -172,11 +275,17 @@ func buildListQuery(query models.FileServersQuery) (preparedStmt string, values
 		paramIdx++
 	}
 
+	if query.Status != nil {
+		queryParts = append(queryParts, strings.ReplaceAll(fsListStatusFilter, "<IDX>", strconv.Itoa(paramIdx)))
+		values = append(values, int(*query.Status))
+		paramIdx++
+	}
+
 	if len(queryParts) == 0 {
 		return fsListBase, nil
 	}
 
-	return fmt.Sprintf("%s WHERE %s", fsListBase, strings.Join(queryParts, "AND")), values
+	return fmt.Sprintf("%s WHERE %s", fsListBase, strings.Join(queryParts, " AND ")), values
 }
 
 var _ repository.FileServerRepository = (*FileServerRepository)(nil)
@@ -0,0 +1,163 @@
+package psql
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgconn"
+	"github.com/mredolatti/tf/codigo/indexsrv/models"
+	"github.com/mredolatti/tf/codigo/indexsrv/repository"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func setupFileServerRepo(t *testing.T) (*FileServerRepository, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+	return NewFileServerRepository(sqlx.NewDb(db, "pgx")), mock
+}
+
+func TestFileServerGet(t *testing.T) {
+	repo, mock := setupFileServerRepo(t)
+
+	// file_servers only holds the organization id, so the name has to come from organizations
+	assert.Regexp(t, regexp.MustCompile(`JOIN organizations o ON o.id = fs.org_id WHERE o.name = \$1`), fsGetQuery)
+
+	mock.ExpectQuery(fsGetQuery).
+		WithArgs("org1", "server1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "org_name", "auth_url", "token_url", "fetch_url", "control_endpoint", "status"}).
+			AddRow("1", "server1", "org1", "https://auth", "https://token", "https://fetch", "server1:9000", int(models.FileServerStatusPaused)))
+
+	server, err := repo.Get(context.Background(), "org1", "server1")
+	assert.Nil(t, err)
+	assert.Equal(t, "org1", server.OrganizationName())
+	assert.Equal(t, models.FileServerStatusPaused, server.Status())
+
+	mock.ExpectQuery(fsGetQuery).WithArgs("org1", "nope").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	_, err = repo.Get(context.Background(), "org1", "nope")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFileServerList(t *testing.T) {
+	repo, mock := setupFileServerRepo(t)
+	columns := []string{"id", "name", "org_name", "auth_url", "token_url", "fetch_url", "control_endpoint", "status", "last_seen", "last_heartbeat"}
+
+	mock.ExpectQuery(fsSelectBase).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("1", "server1", "org1", "https://auth", "https://token", "https://fetch", "server1:9000", 0, 0, nil).
+			AddRow("2", "server2", "org2", "https://auth", "https://token", "https://fetch", "server2:9000", 1, 0, nil))
+	servers, err := repo.List(context.Background(), models.FileServersQuery{})
+	assert.Nil(t, err)
+	assert.Len(t, servers, 2)
+	assert.Equal(t, "org2", servers[1].OrganizationName())
+
+	status := models.FileServerStatusPaused
+	orgName := "org2"
+	mock.ExpectQuery(fsSelectBase+" WHERE o.name = $1 AND fs.status = $2").
+		WithArgs("org2", int(models.FileServerStatusPaused)).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("2", "server2", "org2", "https://auth", "https://token", "https://fetch", "server2:9000", 1, 0, nil))
+	servers, err = repo.List(context.Background(), models.FileServersQuery{OrganizationName: &orgName, Status: &status})
+	assert.Nil(t, err)
+	assert.Len(t, servers, 1)
+	assert.Equal(t, "server2", servers[0].Name())
+	assert.Equal(t, "org2", servers[0].OrganizationName())
+	assert.Equal(t, models.FileServerStatusPaused, servers[0].Status())
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFileServerUpdateStatus(t *testing.T) {
+	repo, mock := setupFileServerRepo(t)
+	assert.Contains(t, fsUpdateStatusQuery, "org_id = (SELECT id FROM organizations WHERE name = $2)")
+
+	mock.ExpectExec(fsUpdateStatusQuery).
+		WithArgs(int(models.FileServerStatusPaused), "org1", "server1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.Nil(t, repo.UpdateStatus(context.Background(), "org1", "server1", models.FileServerStatusPaused))
+
+	mock.ExpectExec(fsUpdateStatusQuery).
+		WithArgs(int(models.FileServerStatusReady), "org1", "nope").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.ErrorIs(t, repo.UpdateStatus(context.Background(), "org1", "nope", models.FileServerStatusReady), repository.ErrNotFound)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFileServerUpdateHeartbeat(t *testing.T) {
+	repo, mock := setupFileServerRepo(t)
+	seen := time.Now()
+	heartbeat := &models.Heartbeat{Version: "v1", Interval: 30 * time.Second, Healthy: true}
+	serialized, err := json.Marshal(heartbeat)
+	assert.Nil(t, err)
+
+	mock.ExpectExec(fsUpdateHeartbeatQuery).
+		WithArgs(seen.UnixNano(), serialized, "org1", "server1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.Nil(t, repo.UpdateHeartbeat(context.Background(), "org1", "server1", seen, heartbeat))
+
+	mock.ExpectExec(fsUpdateHeartbeatQuery).
+		WithArgs(seen.UnixNano(), serialized, "org1", "nope").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.ErrorIs(t, repo.UpdateHeartbeat(context.Background(), "org1", "nope", seen, heartbeat), repository.ErrNotFound)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// & it's read back when fetching the server
+	server := FileServer{LastSeenField: seen.UnixNano(), LastHeartbeatField: serialized}
+	assert.Equal(t, seen.UnixNano(), server.LastSeen().UnixNano())
+	assert.Equal(t, heartbeat, server.LastHeartbeat())
+	assert.Nil(t, (&FileServer{}).LastHeartbeat())
+}
+
+func TestFileServerAdd(t *testing.T) {
+	repo, mock := setupFileServerRepo(t)
+	columns := []string{"id", "name", "org_name", "auth_url", "token_url", "fetch_url", "control_endpoint", "status", "last_seen", "last_heartbeat"}
+
+	// servers are registered with the organization name, the id is resolved by the insert itself
+	mock.ExpectQuery(fsAddQuery).
+		WithArgs("server1", "org1", "https://auth", "https://token", "https://fetch", "server1:9000").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("1", "server1", "org1", "https://auth", "https://token", "https://fetch", "server1:9000", 0, 0, nil))
+	server, err := repo.Add(context.Background(), "server1", "org1", "https://auth", "https://token", "https://fetch", "server1:9000")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", server.ID())
+	assert.Equal(t, "org1", server.OrganizationName())
+	assert.Equal(t, "server1:9000", server.ControlEndpoint())
+
+	mock.ExpectQuery(fsAddQuery).
+		WithArgs("server1", "org1", "https://auth", "https://token", "https://fetch", "server1:9000").
+		WillReturnError(&pgconn.PgError{Code: pgUniqueViolation})
+	_, err = repo.Add(context.Background(), "server1", "org1", "https://auth", "https://token", "https://fetch", "server1:9000")
+	assert.ErrorIs(t, err, repository.ErrAlreadyExists)
+
+	// nothing gets inserted for unknown organizations
+	mock.ExpectQuery(fsAddQuery).
+		WithArgs("server2", "nope", "https://auth", "https://token", "https://fetch", "server2:9000").
+		WillReturnRows(sqlmock.NewRows(columns))
+	_, err = repo.Add(context.Background(), "server2", "nope", "https://auth", "https://token", "https://fetch", "server2:9000")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFileServerUpdate(t *testing.T) {
+	repo, mock := setupFileServerRepo(t)
+	assert.Contains(t, fsUpdateQuery, "org_id = (SELECT id FROM organizations WHERE name = $5)")
+
+	mock.ExpectExec(fsUpdateQuery).
+		WithArgs("https://auth2", "https://token2", "https://fetch2", "server1:9001", "org1", "server1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.Nil(t, repo.Update(context.Background(), "org1", "server1", "https://auth2", "https://token2", "https://fetch2", "server1:9001"))
+
+	mock.ExpectExec(fsUpdateQuery).
+		WithArgs("https://auth2", "https://token2", "https://fetch2", "server1:9001", "org2", "server1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	err := repo.Update(context.Background(), "org2", "server1", "https://auth2", "https://token2", "https://fetch2", "server1:9001")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -13,7 +13,7 @@ import (
 )
 
 const (
-	oauthPutQuery = "INSERT INTO oauth2_pending(user_id,organization_name,server_name,state) VALUES ($1, $2, $3, $4) RETURNING *"
+	oauthPutQuery = "INSERT INTO oauth2_pending(user_id,organization_name,server_name,state,code_verifier) VALUES ($1, $2, $3, $4, $5) RETURNING *"
 	oauthPopQuery = "DELETE FROM oauth2_pending WHERE state = $1 RETURNING *"
 )
 
@@ -23,6 +23,7 @@ type PendingOAuth2 struct {
 	FileServerNameField   string `db:"server_name"`
 	UserIDField           string `db:"user_id"`
 	StateField            string `db:"state"`
+	CodeVerifierField     string `db:"code_verifier"`
 }
 
 func (p *PendingOAuth2) OrganizationName() string {
@@ -30,7 +31,7 @@ func (p *PendingOAuth2) OrganizationName() string {
 }
 
 func (p *PendingOAuth2) ServerName() string {
-	return p.ServerName()
+	return p.FileServerNameField
 }
 
 // UserID returns the user we're trying to authenticate
@@ -43,6 +44,11 @@ func (p *PendingOAuth2) State() string {
 	return p.StateField
 }
 
+// CodeVerifier returns the PKCE secret whose hash was sent along with the authorization request
+func (p *PendingOAuth2) CodeVerifier() string {
+	return p.CodeVerifierField
+}
+
 // PendingOAuth2Repository is a postgres-based implementation of an in-progress oauth2 flow repository
 type PendingOAuth2Repository struct {
 	db *sqlx.DB
@@ -54,9 +60,9 @@ func NewPendingOAuth2Repository(db *sqlx.DB) *PendingOAuth2Repository {
 }
 
 // Put starts tracking a new flow
-func (r *PendingOAuth2Repository) Put(ctx context.Context, userID string, orgName string, serverName, state string) (models.PendingOAuth2, error) {
+func (r *PendingOAuth2Repository) Put(ctx context.Context, userID string, orgName string, serverName, state string, codeVerifier string) (models.PendingOAuth2, error) {
 	var flow PendingOAuth2
-	err := r.db.QueryRowxContext(ctx, oauthPutQuery, userID, orgName, serverName, state).StructScan(&flow)
+	err := r.db.QueryRowxContext(ctx, oauthPutQuery, userID, orgName, serverName, state, codeVerifier).StructScan(&flow)
 	if err != nil {
 		return nil, fmt.Errorf("error executing oauth2flow::put in postgres: %w", err)
 	}
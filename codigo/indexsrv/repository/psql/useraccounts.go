@@ -17,8 +17,8 @@ const (
 	accountGetQuery          = "SELECT * FROM user_accounts WHERE user_id = $1 and organization_name = $2 AND server_name = $3"
 	accountAddQuery          = "INSERT INTO user_accounts(user_id, organization_name, server_name, token, refresh_token) VALUES ($1, $2, $3, $4, $5) RETURNING *"
 	accountCheckpointUpdate  = "UPDATE user_accounts set checkpoint = $3 WHERE user_id = $1 AND organization_name = $2 and server_name = $3 returning *"
-	accountAccessTokenUpdate = "UPDATE user_accounts set token = $3 WHERE user_id = $1 AND organization_name = $2 AND server_name = $3 returning *"
-	accountTokensUpdate      = "UPDATE user_accounts set token = $3, refresh_token = $4 WHERE user_id = $1 AND organization_name = $2 server_name = $3 returning *"
+	accountAccessTokenUpdate = "UPDATE user_accounts set token = $4 WHERE user_id = $1 AND organization_name = $2 AND server_name = $3 returning *"
+	accountTokensUpdate      = "UPDATE user_accounts set token = $4, refresh_token = $5 WHERE user_id = $1 AND organization_name = $2 AND server_name = $3 returning *"
 	accountDelQuery          = "DELETE FROM user_accounts WHERE user_id = $1 AND organization_name = $2 and server_name = $3"
 )
 
@@ -1,6 +1,18 @@
 package psql
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/jackc/pgconn"
+)
+
+const pgUniqueViolation = "23505"
 
 // ErrNilDB is returned when constructing a postgresql-based repository with a nil connection
 var ErrNilDB = errors.New("db cannot be nil")
+
+// isUniqueViolation returns true if `err` was caused by a duplicate value in a unique column
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation
+}
@@ -0,0 +1,333 @@
+package traced
+
+import (
+	"context"
+	"time"
+
+	"github.com/mredolatti/tf/codigo/common/tracing"
+	"github.com/mredolatti/tf/codigo/indexsrv/models"
+	"github.com/mredolatti/tf/codigo/indexsrv/repository"
+
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("github.com/mredolatti/tf/codigo/indexsrv/repository")
+
+// Factory wraps the repositories built by another factory, recording a span for every call
+type Factory struct {
+	inner repository.Factory
+}
+
+// NewFactory constructs a tracing factory on top of `inner`
+func NewFactory(inner repository.Factory) *Factory {
+	return &Factory{inner: inner}
+}
+
+// Users implements repository.Factory
+func (f *Factory) Users() repository.UserRepository {
+	return &UserRepository{inner: f.inner.Users()}
+}
+
+// Organizations implements repository.Factory
+func (f *Factory) Organizations() repository.OrganizationRepository {
+	return &OrganizationRepository{inner: f.inner.Organizations()}
+}
+
+// Mappings implements repository.Factory
+func (f *Factory) Mappings() repository.MappingRepository {
+	return &MappingRepository{inner: f.inner.Mappings()}
+}
+
+// FileServers implements repository.Factory
+func (f *Factory) FileServers() repository.FileServerRepository {
+	return &FileServerRepository{inner: f.inner.FileServers()}
+}
+
+// Accounts implements repository.Factory
+func (f *Factory) Accounts() repository.UserAccountRepository {
+	return &UserAccountRepository{inner: f.inner.Accounts()}
+}
+
+// PendingOAuth implements repository.Factory
+func (f *Factory) PendingOAuth() repository.PendingOAuth2Repository {
+	return &PendingOAuth2Repository{inner: f.inner.PendingOAuth()}
+}
+
+// UserRepository records spans for calls to a wrapped user repository
+type UserRepository struct {
+	inner repository.UserRepository
+}
+
+// Get implements repository.UserRepository
+func (r *UserRepository) Get(ctx context.Context, id string) (models.User, error) {
+	ctx, span := tracer.Start(ctx, "UserRepository.Get")
+	user, err := r.inner.Get(ctx, id)
+	return user, tracing.End(span, err)
+}
+
+// GetByEmail implements repository.UserRepository
+func (r *UserRepository) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	ctx, span := tracer.Start(ctx, "UserRepository.GetByEmail")
+	user, err := r.inner.GetByEmail(ctx, email)
+	return user, tracing.End(span, err)
+}
+
+// Add implements repository.UserRepository
+func (r *UserRepository) Add(ctx context.Context, name string, email string, passwordHash string) (models.User, error) {
+	ctx, span := tracer.Start(ctx, "UserRepository.Add")
+	user, err := r.inner.Add(ctx, name, email, passwordHash)
+	return user, tracing.End(span, err)
+}
+
+// UpdatePassword implements repository.UserRepository
+func (r *UserRepository) UpdatePassword(ctx context.Context, id string, passwordHash string) (models.User, error) {
+	ctx, span := tracer.Start(ctx, "UserRepository.UpdatePassword")
+	user, err := r.inner.UpdatePassword(ctx, id, passwordHash)
+	return user, tracing.End(span, err)
+}
+
+// Update2FA implements repository.UserRepository
+func (r *UserRepository) Update2FA(ctx context.Context, userID string, totp string) error {
+	ctx, span := tracer.Start(ctx, "UserRepository.Update2FA")
+	return tracing.End(span, r.inner.Update2FA(ctx, userID, totp))
+}
+
+// Remove implements repository.UserRepository
+func (r *UserRepository) Remove(ctx context.Context, userID string) error {
+	ctx, span := tracer.Start(ctx, "UserRepository.Remove")
+	return tracing.End(span, r.inner.Remove(ctx, userID))
+}
+
+// OrganizationRepository records spans for calls to a wrapped organization repository
+type OrganizationRepository struct {
+	inner repository.OrganizationRepository
+}
+
+// Get implements repository.OrganizationRepository
+func (r *OrganizationRepository) Get(ctx context.Context, name string) (models.Organization, error) {
+	ctx, span := tracer.Start(ctx, "OrganizationRepository.Get")
+	org, err := r.inner.Get(ctx, name)
+	return org, tracing.End(span, err)
+}
+
+// GetByName implements repository.OrganizationRepository
+func (r *OrganizationRepository) GetByName(ctx context.Context, name string) (models.Organization, error) {
+	ctx, span := tracer.Start(ctx, "OrganizationRepository.GetByName")
+	org, err := r.inner.GetByName(ctx, name)
+	return org, tracing.End(span, err)
+}
+
+// List implements repository.OrganizationRepository
+func (r *OrganizationRepository) List(ctx context.Context) ([]models.Organization, error) {
+	ctx, span := tracer.Start(ctx, "OrganizationRepository.List")
+	orgs, err := r.inner.List(ctx)
+	return orgs, tracing.End(span, err)
+}
+
+// Add implements repository.OrganizationRepository
+func (r *OrganizationRepository) Add(ctx context.Context, name string) (models.Organization, error) {
+	ctx, span := tracer.Start(ctx, "OrganizationRepository.Add")
+	org, err := r.inner.Add(ctx, name)
+	return org, tracing.End(span, err)
+}
+
+// Remove implements repository.OrganizationRepository
+func (r *OrganizationRepository) Remove(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "OrganizationRepository.Remove")
+	return tracing.End(span, r.inner.Remove(ctx, id))
+}
+
+// MappingRepository records spans for calls to a wrapped mapping repository
+type MappingRepository struct {
+	inner repository.MappingRepository
+}
+
+// List implements repository.MappingRepository
+func (r *MappingRepository) List(ctx context.Context, userID string, query models.MappingQuery) ([]models.Mapping, error) {
+	ctx, span := tracer.Start(ctx, "MappingRepository.List")
+	mappings, err := r.inner.List(ctx, userID, query)
+	return mappings, tracing.End(span, err)
+}
+
+// Add implements repository.MappingRepository
+func (r *MappingRepository) Add(ctx context.Context, userID string, mapping models.Mapping) (models.Mapping, error) {
+	ctx, span := tracer.Start(ctx, "MappingRepository.Add")
+	added, err := r.inner.Add(ctx, userID, mapping)
+	return added, tracing.End(span, err)
+}
+
+// AddPath implements repository.MappingRepository
+func (r *MappingRepository) AddPath(ctx context.Context, userID string, org string, server string, ref string, newPath string) (models.Mapping, error) {
+	ctx, span := tracer.Start(ctx, "MappingRepository.AddPath")
+	mapping, err := r.inner.AddPath(ctx, userID, org, server, ref, newPath)
+	return mapping, tracing.End(span, err)
+}
+
+// UpdatePathByID implements repository.MappingRepository
+func (r *MappingRepository) UpdatePathByID(ctx context.Context, userID string, id string, newPath string) (models.Mapping, error) {
+	ctx, span := tracer.Start(ctx, "MappingRepository.UpdatePathByID")
+	mapping, err := r.inner.UpdatePathByID(ctx, userID, id, newPath)
+	return mapping, tracing.End(span, err)
+}
+
+// RemovePathByID implements repository.MappingRepository
+func (r *MappingRepository) RemovePathByID(ctx context.Context, userID string, id string) error {
+	ctx, span := tracer.Start(ctx, "MappingRepository.RemovePathByID")
+	return tracing.End(span, r.inner.RemovePathByID(ctx, userID, id))
+}
+
+// Remove implements repository.MappingRepository
+func (r *MappingRepository) Remove(ctx context.Context, userID string, mappingID string) error {
+	ctx, span := tracer.Start(ctx, "MappingRepository.Remove")
+	return tracing.End(span, r.inner.Remove(ctx, userID, mappingID))
+}
+
+// HandleServerUpdates implements repository.MappingRepository
+func (r *MappingRepository) HandleServerUpdates(ctx context.Context, userID string, orgName string, serverName string, updates []models.Update) error {
+	ctx, span := tracer.Start(ctx, "MappingRepository.HandleServerUpdates")
+	return tracing.End(span, r.inner.HandleServerUpdates(ctx, userID, orgName, serverName, updates))
+}
+
+// FileServerRepository records spans for calls to a wrapped file server repository
+type FileServerRepository struct {
+	inner repository.FileServerRepository
+}
+
+// List implements repository.FileServerRepository
+func (r *FileServerRepository) List(ctx context.Context, query models.FileServersQuery) ([]models.FileServer, error) {
+	ctx, span := tracer.Start(ctx, "FileServerRepository.List")
+	servers, err := r.inner.List(ctx, query)
+	return servers, tracing.End(span, err)
+}
+
+// GetByID implements repository.FileServerRepository
+func (r *FileServerRepository) GetByID(ctx context.Context, id string) (models.FileServer, error) {
+	ctx, span := tracer.Start(ctx, "FileServerRepository.GetByID")
+	server, err := r.inner.GetByID(ctx, id)
+	return server, tracing.End(span, err)
+}
+
+// Get implements repository.FileServerRepository
+func (r *FileServerRepository) Get(ctx context.Context, orgName string, name string) (models.FileServer, error) {
+	ctx, span := tracer.Start(ctx, "FileServerRepository.Get")
+	server, err := r.inner.Get(ctx, orgName, name)
+	return server, tracing.End(span, err)
+}
+
+// Add implements repository.FileServerRepository
+func (r *FileServerRepository) Add(
+	ctx context.Context,
+	name string,
+	organizationName string,
+	authURL string,
+	tokenURL string,
+	fetchURL string,
+	controlEndpoint string,
+) (models.FileServer, error) {
+	ctx, span := tracer.Start(ctx, "FileServerRepository.Add")
+	server, err := r.inner.Add(ctx, name, organizationName, authURL, tokenURL, fetchURL, controlEndpoint)
+	return server, tracing.End(span, err)
+}
+
+// Update implements repository.FileServerRepository
+func (r *FileServerRepository) Update(
+	ctx context.Context,
+	orgName string,
+	name string,
+	authURL string,
+	tokenURL string,
+	fetchURL string,
+	controlEndpoint string,
+) error {
+	ctx, span := tracer.Start(ctx, "FileServerRepository.Update")
+	return tracing.End(span, r.inner.Update(ctx, orgName, name, authURL, tokenURL, fetchURL, controlEndpoint))
+}
+
+// UpdateStatus implements repository.FileServerRepository
+func (r *FileServerRepository) UpdateStatus(ctx context.Context, orgName string, name string, status models.FileServerStatus) error {
+	ctx, span := tracer.Start(ctx, "FileServerRepository.UpdateStatus")
+	return tracing.End(span, r.inner.UpdateStatus(ctx, orgName, name, status))
+}
+
+// UpdateHeartbeat implements repository.FileServerRepository
+func (r *FileServerRepository) UpdateHeartbeat(ctx context.Context, orgName string, name string, seen time.Time, heartbeat *models.Heartbeat) error {
+	ctx, span := tracer.Start(ctx, "FileServerRepository.UpdateHeartbeat")
+	return tracing.End(span, r.inner.UpdateHeartbeat(ctx, orgName, name, seen, heartbeat))
+}
+
+// Remove implements repository.FileServerRepository
+func (r *FileServerRepository) Remove(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "FileServerRepository.Remove")
+	return tracing.End(span, r.inner.Remove(ctx, id))
+}
+
+// UserAccountRepository records spans for calls to a wrapped user account repository
+type UserAccountRepository struct {
+	inner repository.UserAccountRepository
+}
+
+// List implements repository.UserAccountRepository
+func (r *UserAccountRepository) List(ctx context.Context, userID string) ([]models.UserAccount, error) {
+	ctx, span := tracer.Start(ctx, "UserAccountRepository.List")
+	accounts, err := r.inner.List(ctx, userID)
+	return accounts, tracing.End(span, err)
+}
+
+// Get implements repository.UserAccountRepository
+func (r *UserAccountRepository) Get(ctx context.Context, userID string, orgName string, serverName string) (models.UserAccount, error) {
+	ctx, span := tracer.Start(ctx, "UserAccountRepository.Get")
+	account, err := r.inner.Get(ctx, userID, orgName, serverName)
+	return account, tracing.End(span, err)
+}
+
+// AddOrUpdate implements repository.UserAccountRepository
+func (r *UserAccountRepository) AddOrUpdate(ctx context.Context, userID, orgName, serverName, accessToken, refreshToken string) (models.UserAccount, error) {
+	ctx, span := tracer.Start(ctx, "UserAccountRepository.AddOrUpdate")
+	account, err := r.inner.AddOrUpdate(ctx, userID, orgName, serverName, accessToken, refreshToken)
+	return account, tracing.End(span, err)
+}
+
+// Remove implements repository.UserAccountRepository
+func (r *UserAccountRepository) Remove(ctx context.Context, userID string, orgName string, serverName string) error {
+	ctx, span := tracer.Start(ctx, "UserAccountRepository.Remove")
+	return tracing.End(span, r.inner.Remove(ctx, userID, orgName, serverName))
+}
+
+// UpdateCheckpoint implements repository.UserAccountRepository
+func (r *UserAccountRepository) UpdateCheckpoint(ctx context.Context, userID string, orgName string, serverName string, newCheckpoint int64) error {
+	ctx, span := tracer.Start(ctx, "UserAccountRepository.UpdateCheckpoint")
+	return tracing.End(span, r.inner.UpdateCheckpoint(ctx, userID, orgName, serverName, newCheckpoint))
+}
+
+// UpdateTokens implements repository.UserAccountRepository
+func (r *UserAccountRepository) UpdateTokens(ctx context.Context, userID, orgName, serverName, accessToken, refreshToken string) error {
+	ctx, span := tracer.Start(ctx, "UserAccountRepository.UpdateTokens")
+	return tracing.End(span, r.inner.UpdateTokens(ctx, userID, orgName, serverName, accessToken, refreshToken))
+}
+
+// PendingOAuth2Repository records spans for calls to a wrapped pending oauth2 flow repository
+type PendingOAuth2Repository struct {
+	inner repository.PendingOAuth2Repository
+}
+
+// Put implements repository.PendingOAuth2Repository
+func (r *PendingOAuth2Repository) Put(ctx context.Context, userID string, orgName string, serverName, state string, codeVerifier string) (models.PendingOAuth2, error) {
+	ctx, span := tracer.Start(ctx, "PendingOAuth2Repository.Put")
+	flow, err := r.inner.Put(ctx, userID, orgName, serverName, state, codeVerifier)
+	return flow, tracing.End(span, err)
+}
+
+// Pop implements repository.PendingOAuth2Repository
+func (r *PendingOAuth2Repository) Pop(ctx context.Context, state string) (models.PendingOAuth2, error) {
+	ctx, span := tracer.Start(ctx, "PendingOAuth2Repository.Pop")
+	flow, err := r.inner.Pop(ctx, state)
+	return flow, tracing.End(span, err)
+}
+
+var _ repository.Factory = (*Factory)(nil)
+var _ repository.UserRepository = (*UserRepository)(nil)
+var _ repository.OrganizationRepository = (*OrganizationRepository)(nil)
+var _ repository.MappingRepository = (*MappingRepository)(nil)
+var _ repository.FileServerRepository = (*FileServerRepository)(nil)
+var _ repository.UserAccountRepository = (*UserAccountRepository)(nil)
+var _ repository.PendingOAuth2Repository = (*PendingOAuth2Repository)(nil)
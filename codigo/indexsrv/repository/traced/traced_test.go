@@ -0,0 +1,58 @@
+package traced
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mredolatti/tf/codigo/indexsrv/models"
+	"github.com/mredolatti/tf/codigo/indexsrv/repository"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type orgRepoMock struct {
+	repository.OrganizationRepository
+	lastCtx context.Context
+}
+
+func (m *orgRepoMock) GetByName(ctx context.Context, name string) (models.Organization, error) {
+	m.lastCtx = ctx
+	return nil, repository.ErrNotFound
+}
+
+func (m *orgRepoMock) Remove(ctx context.Context, id string) error {
+	m.lastCtx = ctx
+	return nil
+}
+
+func TestTracedRepository(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	inner := &orgRepoMock{}
+	repo := &OrganizationRepository{inner: inner}
+
+	assert.Nil(t, repo.Remove(ctx, "some"))
+	_, err := repo.GetByName(ctx, "some")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+	parent.End()
+
+	ended := recorder.Ended()
+	assert.Len(t, ended, 3)
+
+	assert.Equal(t, "OrganizationRepository.Remove", ended[0].Name())
+	assert.Equal(t, codes.Unset, ended[0].Status().Code)
+	assert.Equal(t, parent.SpanContext().SpanID(), ended[0].Parent().SpanID())
+
+	assert.Equal(t, "OrganizationRepository.GetByName", ended[1].Name())
+	assert.Equal(t, codes.Error, ended[1].Status().Code)
+
+	// the wrapped repository receives a context carrying the new span
+	assert.Equal(t, ended[1].SpanContext().SpanID(), trace.SpanContextFromContext(inner.lastCtx).SpanID())
+}
@@ -24,7 +24,8 @@ function init_db() {
                 id      VARCHAR NOT NULL PRIMARY KEY,
                 secret  VARCHAR NOT NULL,
                 domain  VARCHAR NOT NULL,
-                user_id VARCHAR
+                user_id VARCHAR,
+                require_pkce BOOLEAN NOT NULL DEFAULT TRUE
             );
             CREATE TABLE IF NOT EXISTS tokens (
                 client_id                       VARCHAR NOT NULL,
@@ -43,6 +44,43 @@ function init_db() {
                 refresh_created_at              TIMESTAMPTZ,
                 refresh_expires_in_seconds      INTEGER
             );
+            CREATE TABLE IF NOT EXISTS rotated_refresh_tokens (
+                refresh     VARCHAR NOT NULL PRIMARY KEY,
+                client_id   VARCHAR NOT NULL,
+                user_id     VARCHAR NOT NULL,
+                rotated_at  TIMESTAMPTZ NOT NULL
+            );
+            CREATE TABLE IF NOT EXISTS share_links (
+                id              VARCHAR NOT NULL PRIMARY KEY,
+                file_id         VARCHAR NOT NULL,
+                created_by      VARCHAR NOT NULL,
+                created_at      TIMESTAMPTZ NOT NULL,
+                expires_at      TIMESTAMPTZ NOT NULL,
+                max_downloads   INTEGER NOT NULL DEFAULT 0,
+                downloads       INTEGER NOT NULL DEFAULT 0,
+                revoked         BOOLEAN NOT NULL DEFAULT FALSE
+            );
+            CREATE TABLE IF NOT EXISTS webhooks (
+                id              VARCHAR NOT NULL PRIMARY KEY,
+                url             VARCHAR NOT NULL,
+                secret          VARCHAR NOT NULL,
+                created_by      VARCHAR NOT NULL,
+                created_at      TIMESTAMPTZ NOT NULL
+            );
+            CREATE TABLE IF NOT EXISTS webhook_deliveries (
+                id              VARCHAR NOT NULL PRIMARY KEY,
+                webhook_id      VARCHAR NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+                event_id        VARCHAR NOT NULL,
+                payload         BYTEA NOT NULL,
+                status          VARCHAR NOT NULL,
+                attempts        INTEGER NOT NULL DEFAULT 0,
+                last_error      VARCHAR NOT NULL DEFAULT '',
+                response_code   INTEGER NOT NULL DEFAULT 0,
+                created_at      TIMESTAMPTZ NOT NULL,
+                next_attempt_at TIMESTAMPTZ NOT NULL
+            );
+            CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+            CREATE INDEX IF NOT EXISTS webhook_deliveries_by_hook ON webhook_deliveries(webhook_id, created_at);
         COMMIT;
 
         INSERT INTO clients(id, secret, domain, user_id)
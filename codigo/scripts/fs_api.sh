@@ -210,12 +210,16 @@ function fs_delete_contents() {
 
 function fs_auth_code() {
 
-    usage="usage: fs_auth_code -i <client_id>"
+    usage="usage: fs_auth_code -i <client_id> [-c <code_challenge>] [-o <scope>]"
     local verbose=""
     local OPTIND
-    while getopts "hi:" options; do
+    local challenge=""
+    local scope="files:read"
+    while getopts "hi:c:o:" options; do
         case ${options} in
             i) local cid=${OPTARG} ;;
+            o) scope=${OPTARG} ;;
+            c) challenge="&code_challenge=${OPTARG}&code_challenge_method=S256" ;;
             h) echo ${usage} && return 0 ;;
             v) verbose="-v" ;;
             *) echo ${usage} && return 1 ;;
@@ -229,15 +233,17 @@ function fs_auth_code() {
         --cacert ${FS_CACERT} \
         --cert ${FS_CERT} \
         --key ${FS_KEY} \
-        "${BASE_URL}/authorize?client_id=${cid}&response_type=code"
+        "${BASE_URL}/authorize?client_id=${cid}&response_type=code&scope=${scope// /%20}${challenge}"
 }
 
 function fs_exchange_code() {
-    usage="usage: fs_exchange_code -c <code> -i <client_id> -s <client_secret> -r <redirect_uri>"
+    usage="usage: fs_exchange_code -c <code> -i <client_id> -s <client_secret> -r <redirect_uri> [-p <code_verifier>]"
     local verbose=""
     local OPTIND
-    while getopts "hvc:i:s:r:" options; do
+    local verifier=""
+    while getopts "hvc:i:s:r:p:" options; do
         case ${options} in
+            p) verifier="&code_verifier=${OPTARG}" ;;
             c) local code=${OPTARG} ;;
             i) local cid=${OPTARG} ;;
             s) local secret=${OPTARG} ;;
@@ -261,5 +267,5 @@ function fs_exchange_code() {
         --cacert ${FS_CACERT} \
         --cert ${FS_CERT} \
         --key ${FS_KEY} \
-    "${BASE_URL}/token?grant_type=authorization_code&client_id=${cid}&client_secret=${secret}&scope=read&code=${code//[$'\t\r\n ']}&redirect_uri=${redirect}"
+    "${BASE_URL}/token?grant_type=authorization_code&client_id=${cid}&client_secret=${secret}&code=${code//[$'\t\r\n ']}&redirect_uri=${redirect}${verifier}"
 }
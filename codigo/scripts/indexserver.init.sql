@@ -24,7 +24,10 @@ CREATE TABLE IF NOT EXISTS file_servers (
     auth_url VARCHAR NOT NULL,
     token_url VARCHAR NOT NULL,
     fetch_url VARCHAR NOT NULL,
-    control_endpoint VARCHAR NOT NULL
+    control_endpoint VARCHAR NOT NULL,
+    status INT NOT NULL DEFAULT 0,
+    last_seen BIGINT NOT NULL DEFAULT 0,
+    last_heartbeat JSONB
 );
 
 CREATE TABLE IF NOT EXISTS user_accounts (
@@ -51,5 +54,6 @@ CREATE TABLE IF NOT EXISTS oauth2_pending (
     user_id INT NOT NULL REFERENCES users(id),
     server_id INT NOT NULL REFERENCES file_servers(id),
     state VARCHAR NOT NULL,
+    code_verifier VARCHAR NOT NULL,
     PRIMARY KEY(state)
 );